@@ -49,6 +49,10 @@ func New(sm subnet.Manager, extIface *backend.ExternalInterface) (backend.Backen
 	return &be, nil
 }
 
+func (be *AliVpcBackend) Capabilities() backend.Capabilities {
+	return backend.Capabilities{}
+}
+
 func (be *AliVpcBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
 	// 1. Parse our configuration
 	cfg := struct {
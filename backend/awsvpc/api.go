@@ -0,0 +1,295 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package awsvpc
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+const (
+	// consistencyAttempts is the number of times a call failing because
+	// of the EC2 API's eventual consistency is tried
+	consistencyAttempts = 5
+	// defaultConsistencyDelay is the wait before the first retry, it
+	// doubles on each attempt
+	defaultConsistencyDelay = time.Second
+)
+
+// errRouteNotFound is returned by getRoute if the table has no route for the
+// subnet
+var errRouteNotFound = errors.New("route not found")
+
+// consistencyErrorCodes are returned for resources which exist but which the
+// part of the EC2 API that served the call doesn't know about yet
+var consistencyErrorCodes = map[string]bool{
+	"InvalidRouteTableID.NotFound":       true,
+	"InvalidNetworkInterfaceID.NotFound": true,
+	"InvalidInstanceID.NotFound":         true,
+}
+
+// ec2API is the part of the EC2 API the backend uses
+type ec2API interface {
+	DescribeInstances(*ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error)
+	DescribeRouteTables(*ec2.DescribeRouteTablesInput) (*ec2.DescribeRouteTablesOutput, error)
+	CreateRoute(*ec2.CreateRouteInput) (*ec2.CreateRouteOutput, error)
+	ReplaceRoute(*ec2.ReplaceRouteInput) (*ec2.ReplaceRouteOutput, error)
+	DeleteRoute(*ec2.DeleteRouteInput) (*ec2.DeleteRouteOutput, error)
+	ModifyNetworkInterfaceAttribute(*ec2.ModifyNetworkInterfaceAttributeInput) (*ec2.ModifyNetworkInterfaceAttributeOutput, error)
+}
+
+// awsAPI manages the routes to an ENI in VPC route tables
+type awsAPI struct {
+	ec2c  ec2API
+	eniID string
+	// consistencyDelay is the wait before retrying a call which failed
+	// because of eventual consistency
+	consistencyDelay time.Duration
+}
+
+func newAPI(ec2c ec2API, eniID string) *awsAPI {
+	return &awsAPI{
+		ec2c:             ec2c,
+		eniID:            eniID,
+		consistencyDelay: defaultConsistencyDelay,
+	}
+}
+
+func errorCode(err error) string {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code()
+	}
+	return ""
+}
+
+func isNotFound(err error) bool {
+	return err == errRouteNotFound || errorCode(err) == "InvalidRoute.NotFound"
+}
+
+// withConsistencyRetries calls fn until it returns an error other than one
+// caused by eventual consistency, or runs out of attempts. It returns the
+// error of ctx if ctx is done while waiting to retry.
+func (api *awsAPI) withConsistencyRetries(ctx context.Context, operation string, fn func() error) error {
+	delay := api.consistencyDelay
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !consistencyErrorCodes[errorCode(err)] || attempt == consistencyAttempts {
+			return err
+		}
+		log.Warningf("%s failed on attempt %d of %d, retrying in %v: %v", operation, attempt, consistencyAttempts, delay, err)
+		if err := sleep(ctx, delay); err != nil {
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// getRoute returns the route for subnet in the route table
+func (api *awsAPI) getRoute(ctx context.Context, routeTableID, subnet string) (*ec2.Route, error) {
+	filter := newFilter()
+	filter.Add("route.destination-cidr-block", subnet)
+
+	input := ec2.DescribeRouteTablesInput{Filters: filter, RouteTableIds: []*string{aws.String(routeTableID)}}
+
+	var resp *ec2.DescribeRouteTablesOutput
+	err := api.withConsistencyRetries(ctx, "describing route table "+routeTableID, func() (err error) {
+		resp, err = api.ec2c.DescribeRouteTables(&input)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, routeTable := range resp.RouteTables {
+		for _, route := range routeTable.Routes {
+			if aws.StringValue(route.DestinationCidrBlock) == subnet {
+				return route, nil
+			}
+		}
+	}
+	return nil, errRouteNotFound
+}
+
+// routePointsHere returns true if route is active and goes to our ENI
+func (api *awsAPI) routePointsHere(route *ec2.Route) bool {
+	return aws.StringValue(route.State) == ec2.RouteStateActive && aws.StringValue(route.NetworkInterfaceId) == api.eniID
+}
+
+// insertRoute creates the route for subnet to our ENI. A route which already
+// exists for the subnet is replaced unless it already goes to our ENI.
+func (api *awsAPI) insertRoute(ctx context.Context, routeTableID, subnet string) error {
+	err := api.withConsistencyRetries(ctx, "creating route for "+subnet, func() error {
+		_, err := api.ec2c.CreateRoute(&ec2.CreateRouteInput{
+			RouteTableId:         aws.String(routeTableID),
+			NetworkInterfaceId:   aws.String(api.eniID),
+			DestinationCidrBlock: aws.String(subnet),
+		})
+		return err
+	})
+	if errorCode(err) == "RouteAlreadyExists" {
+		route, getErr := api.getRoute(ctx, routeTableID, subnet)
+		if getErr != nil {
+			return getErr
+		}
+		if api.routePointsHere(route) {
+			return nil
+		}
+		log.Infof("Replacing conflicting route in table %s: %s - %s", routeTableID, subnet, aws.StringValue(route.NetworkInterfaceId))
+		err = api.withConsistencyRetries(ctx, "replacing route for "+subnet, func() error {
+			_, err := api.ec2c.ReplaceRoute(&ec2.ReplaceRouteInput{
+				RouteTableId:         aws.String(routeTableID),
+				NetworkInterfaceId:   aws.String(api.eniID),
+				DestinationCidrBlock: aws.String(subnet),
+			})
+			return err
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Route added to table %s: %s - %s", routeTableID, subnet, api.eniID)
+	return nil
+}
+
+// deleteRoute deletes the route for subnet, it is not an error if there is none
+func (api *awsAPI) deleteRoute(ctx context.Context, routeTableID, subnet string) error {
+	err := api.withConsistencyRetries(ctx, "deleting route for "+subnet, func() error {
+		_, err := api.ec2c.DeleteRoute(&ec2.DeleteRouteInput{
+			RouteTableId:         aws.String(routeTableID),
+			DestinationCidrBlock: aws.String(subnet),
+		})
+		return err
+	})
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// ensureRoute inserts the route for subnet unless one to our ENI already
+// exists. The route is looked up again afterwards, because the change may
+// take a while to be visible.
+func (api *awsAPI) ensureRoute(ctx context.Context, routeTableID, subnet string) error {
+	route, err := api.getRoute(ctx, routeTableID, subnet)
+	switch {
+	case err == nil && api.routePointsHere(route):
+		log.Infof("Exact pre-existing route found in table %s: %s - %s", routeTableID, subnet, api.eniID)
+		return nil
+	case err != nil && !isNotFound(err):
+		return fmt.Errorf("error getting route: %v", err)
+	}
+
+	if err := api.insertRoute(ctx, routeTableID, subnet); err != nil {
+		return fmt.Errorf("error inserting route: %v", err)
+	}
+
+	return api.waitForRoute(ctx, routeTableID, subnet)
+}
+
+// waitForRoute waits until the route table reports the route for subnet to
+// our ENI
+func (api *awsAPI) waitForRoute(ctx context.Context, routeTableID, subnet string) error {
+	delay := api.consistencyDelay
+	for attempt := 1; ; attempt++ {
+		route, err := api.getRoute(ctx, routeTableID, subnet)
+		switch {
+		case err == nil && api.routePointsHere(route):
+			return nil
+		case err != nil && !isNotFound(err):
+			return fmt.Errorf("error getting route: %v", err)
+		case attempt == consistencyAttempts:
+			return fmt.Errorf("route for %s in table %s not visible after %d attempts", subnet, routeTableID, attempt)
+		}
+		if err := sleep(ctx, delay); err != nil {
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// sleep waits for d, or returns the error of ctx if it is done first
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// pruneRoutes deletes the routes of the route table for subnets of network
+// which are blackholes, or which go to an ENI but whose subnet is not in
+// activeSubnets. Routes to other targets, e.g. gateways, are left alone. If
+// activeSubnets is nil only blackhole routes are deleted.
+func (api *awsAPI) pruneRoutes(ctx context.Context, routeTableID string, network ip.IP4Net, activeSubnets []string) error {
+	input := ec2.DescribeRouteTablesInput{RouteTableIds: []*string{aws.String(routeTableID)}}
+	resp, err := api.ec2c.DescribeRouteTables(&input)
+	if err != nil {
+		return err
+	}
+
+	active := make(map[string]bool)
+	for _, sn := range activeSubnets {
+		active[sn] = true
+	}
+
+	for _, routeTable := range resp.RouteTables {
+		for _, route := range routeTable.Routes {
+			cidr := aws.StringValue(route.DestinationCidrBlock)
+			_, subnet, err := net.ParseCIDR(cidr)
+			if err != nil || !network.Contains(ip.FromIP(subnet.IP)) {
+				continue
+			}
+
+			switch {
+			case aws.StringValue(route.State) == ec2.RouteStateBlackhole:
+				log.Info("Removing blackhole route: ", cidr)
+			case activeSubnets != nil && route.NetworkInterfaceId != nil && !active[cidr]:
+				log.Infof("Removing stale route: %s - %s", cidr, aws.StringValue(route.NetworkInterfaceId))
+			default:
+				continue
+			}
+
+			if err := api.deleteRoute(ctx, routeTableID, cidr); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (api *awsAPI) disableSrcDestCheck() error {
+	attr := &ec2.ModifyNetworkInterfaceAttributeInput{
+		NetworkInterfaceId: aws.String(api.eniID),
+		SourceDestCheck:    &ec2.AttributeBooleanValue{Value: aws.Bool(false)},
+	}
+	_, err := api.ec2c.ModifyNetworkInterfaceAttribute(attr)
+	return err
+}
@@ -0,0 +1,196 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package awsvpc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// fakeEC2 keeps the routes of a single route table. Filters are ignored.
+type fakeEC2 struct {
+	ec2API
+	routes map[string]*ec2.Route
+	// consistencyErrors is the number of calls failing as if the route
+	// table weren't visible yet
+	consistencyErrors int
+	deleted           []string
+	replaced          []string
+}
+
+func newFakeEC2(routes ...*ec2.Route) *fakeEC2 {
+	f := &fakeEC2{routes: make(map[string]*ec2.Route)}
+	for _, r := range routes {
+		f.routes[aws.StringValue(r.DestinationCidrBlock)] = r
+	}
+	return f
+}
+
+func (f *fakeEC2) notVisible() error {
+	if f.consistencyErrors > 0 {
+		f.consistencyErrors--
+		return awserr.New("InvalidRouteTableID.NotFound", "not found", nil)
+	}
+	return nil
+}
+
+func (f *fakeEC2) DescribeRouteTables(input *ec2.DescribeRouteTablesInput) (*ec2.DescribeRouteTablesOutput, error) {
+	if err := f.notVisible(); err != nil {
+		return nil, err
+	}
+	rt := &ec2.RouteTable{RouteTableId: aws.String("rtb-1")}
+	for _, r := range f.routes {
+		rt.Routes = append(rt.Routes, r)
+	}
+	return &ec2.DescribeRouteTablesOutput{RouteTables: []*ec2.RouteTable{rt}}, nil
+}
+
+func (f *fakeEC2) CreateRoute(input *ec2.CreateRouteInput) (*ec2.CreateRouteOutput, error) {
+	if err := f.notVisible(); err != nil {
+		return nil, err
+	}
+	cidr := aws.StringValue(input.DestinationCidrBlock)
+	if _, ok := f.routes[cidr]; ok {
+		return nil, awserr.New("RouteAlreadyExists", "exists", nil)
+	}
+	f.routes[cidr] = activeRoute(cidr, aws.StringValue(input.NetworkInterfaceId))
+	return &ec2.CreateRouteOutput{}, nil
+}
+
+func (f *fakeEC2) ReplaceRoute(input *ec2.ReplaceRouteInput) (*ec2.ReplaceRouteOutput, error) {
+	cidr := aws.StringValue(input.DestinationCidrBlock)
+	f.replaced = append(f.replaced, cidr)
+	f.routes[cidr] = activeRoute(cidr, aws.StringValue(input.NetworkInterfaceId))
+	return &ec2.ReplaceRouteOutput{}, nil
+}
+
+func (f *fakeEC2) DeleteRoute(input *ec2.DeleteRouteInput) (*ec2.DeleteRouteOutput, error) {
+	cidr := aws.StringValue(input.DestinationCidrBlock)
+	if _, ok := f.routes[cidr]; !ok {
+		return nil, awserr.New("InvalidRoute.NotFound", "not found", nil)
+	}
+	f.deleted = append(f.deleted, cidr)
+	delete(f.routes, cidr)
+	return &ec2.DeleteRouteOutput{}, nil
+}
+
+func activeRoute(cidr, eniID string) *ec2.Route {
+	return &ec2.Route{
+		DestinationCidrBlock: aws.String(cidr),
+		NetworkInterfaceId:   aws.String(eniID),
+		State:                aws.String(ec2.RouteStateActive),
+	}
+}
+
+func newTestAPI(f *fakeEC2) *awsAPI {
+	api := newAPI(f, "eni-1")
+	api.consistencyDelay = 0
+	return api
+}
+
+func TestEnsureRoute(t *testing.T) {
+	f := newFakeEC2(
+		activeRoute("10.0.1.0/24", "eni-1"),
+		activeRoute("10.0.2.0/24", "eni-2"),
+	)
+	api := newTestAPI(f)
+
+	for _, subnet := range []string{"10.0.1.0/24", "10.0.2.0/24", "10.0.3.0/24"} {
+		if err := api.ensureRoute(context.Background(), "rtb-1", subnet); err != nil {
+			t.Fatalf("%v: %v", subnet, err)
+		}
+		if route := f.routes[subnet]; route == nil || !api.routePointsHere(route) {
+			t.Errorf("%v: expected a route to eni-1, got %+v", subnet, route)
+		}
+	}
+
+	if len(f.replaced) != 1 || f.replaced[0] != "10.0.2.0/24" {
+		t.Errorf("expected only the conflicting route to be replaced, got %v", f.replaced)
+	}
+	if len(f.deleted) != 0 {
+		t.Errorf("expected no routes to be deleted, got %v", f.deleted)
+	}
+}
+
+func TestEnsureRouteEventualConsistency(t *testing.T) {
+	f := newFakeEC2()
+	f.consistencyErrors = consistencyAttempts - 1
+	api := newTestAPI(f)
+
+	if err := api.ensureRoute(context.Background(), "rtb-1", "10.0.1.0/24"); err != nil {
+		t.Fatal(err)
+	}
+
+	f.consistencyErrors = consistencyAttempts
+	if err := api.ensureRoute(context.Background(), "rtb-1", "10.0.2.0/24"); err == nil {
+		t.Fatal("expected an error once the attempts run out")
+	}
+}
+
+func TestRetriesCanceled(t *testing.T) {
+	f := newFakeEC2()
+	api := newTestAPI(f)
+	api.consistencyDelay = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	f.consistencyErrors = 1
+	if _, err := api.getRoute(ctx, "rtb-1", "10.0.1.0/24"); err != context.Canceled {
+		t.Errorf("expected the retry to be canceled, got %v", err)
+	}
+
+	f.consistencyErrors = 0
+	if err := api.waitForRoute(ctx, "rtb-1", "10.0.2.0/24"); err != context.Canceled {
+		t.Errorf("expected the wait for the route to be canceled, got %v", err)
+	}
+}
+
+func TestPruneRoutes(t *testing.T) {
+	blackhole := activeRoute("10.0.4.0/24", "eni-4")
+	blackhole.State = aws.String(ec2.RouteStateBlackhole)
+	f := newFakeEC2(
+		activeRoute("10.0.1.0/24", "eni-1"),
+		activeRoute("10.0.2.0/24", "eni-2"),
+		activeRoute("10.0.3.0/24", "eni-3"),
+		blackhole,
+		// outside the network
+		activeRoute("192.168.0.0/24", "eni-5"),
+		&ec2.Route{DestinationCidrBlock: aws.String("10.0.5.0/24"), GatewayId: aws.String("igw-1"), State: aws.String(ec2.RouteStateActive)},
+	)
+	api := newTestAPI(f)
+	network := ip.IP4Net{IP: ip.MustParseIP4("10.0.0.0"), PrefixLen: 16}
+
+	if err := api.pruneRoutes(context.Background(), "rtb-1", network, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.deleted) != 1 || f.deleted[0] != "10.0.4.0/24" {
+		t.Errorf("expected only the blackhole route to be deleted, got %v", f.deleted)
+	}
+
+	if err := api.pruneRoutes(context.Background(), "rtb-1", network, []string{"10.0.1.0/24", "10.0.2.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.deleted) != 2 || f.deleted[1] != "10.0.3.0/24" {
+		t.Errorf("expected the stale route to be deleted, got %v", f.deleted)
+	}
+}
@@ -18,12 +18,10 @@ package awsvpc
 import (
 	"encoding/json"
 	"fmt"
-	"net"
 	"strings"
 	"sync"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
@@ -52,12 +50,19 @@ func New(sm subnet.Manager, extIface *backend.ExternalInterface) (backend.Backen
 	return &be, nil
 }
 
+func (be *AwsVpcBackend) Capabilities() backend.Capabilities {
+	return backend.Capabilities{}
+}
+
 type backendConfig struct {
 	RouteTableID     interface{} `json:"RouteTableID"`
 	RouteTableFilter []string    `json:"RouteTableFilter"`
+	// PruneStaleRoutes deletes the routes to ENIs for subnets which are no
+	// longer leased at startup
+	PruneStaleRoutes bool `json:"PruneStaleRoutes"`
 }
 
-func (conf *backendConfig) routeTablesByFilter(ec2c *ec2.EC2) ([]string, error) {
+func (conf *backendConfig) routeTablesByFilter(ec2c ec2API) ([]string, error) {
 	filter := newFilter()
 	for _, v := range conf.RouteTableFilter {
 		chunks := strings.SplitN(v, "=", 2)
@@ -82,11 +87,11 @@ func (conf *backendConfig) routeTablesByFilter(ec2c *ec2.EC2) ([]string, error)
 
 func (conf *backendConfig) routeTables() ([]string, error) {
 	if table, ok := conf.RouteTableID.(string); ok {
-		log.Info("RouteTableID configured as string: %s", table)
+		log.Infof("RouteTableID configured as string: %s", table)
 		return []string{table}, nil
 	}
 	if rawTables, ok := conf.RouteTableID.([]interface{}); ok {
-		log.Info("RouteTableID configured as slice: %+v", rawTables)
+		log.Infof("RouteTableID configured as slice: %+v", rawTables)
 		tables := make([]string, len(rawTables))
 		for idx, t := range rawTables {
 			table, ok := t.(string)
@@ -108,10 +113,10 @@ func (conf *backendConfig) routeTableConfigured() bool {
 
 func (be *AwsVpcBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
 	// Parse our configuration
-	var cfg backendConfig
+	cfg := backendConfig{}
 
 	if len(config.Backend) > 0 {
-		log.Info("Backend configured as: %s", string(config.Backend))
+		log.Infof("Backend configured as: %s", string(config.Backend))
 		if err := json.Unmarshal(config.Backend, &cfg); err != nil {
 			return nil, fmt.Errorf("error decoding VPC backend config: %v", err)
 		}
@@ -155,8 +160,10 @@ func (be *AwsVpcBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup
 		return nil, fmt.Errorf("unable to find ENI that matches the %s IP address. %s\n", be.extIface.IfaceAddr, err)
 	}
 
+	api := newAPI(ec2c, *eni.NetworkInterfaceId)
+
 	// Try to disable SourceDestCheck on the main network interface
-	if err := be.disableSrcDestCheck(eni.NetworkInterfaceId, ec2c); err != nil {
+	if err := api.disableSrcDestCheck(); err != nil {
 		log.Warningf("failed to disable SourceDestCheck on %s: %s.\n", *eni.NetworkInterfaceId, err)
 	}
 
@@ -167,11 +174,6 @@ func (be *AwsVpcBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup
 		log.Infof("Found route table %s.\n", cfg.RouteTableID)
 	}
 
-	networkConfig, err := be.sm.GetNetworkConfig(ctx)
-	if err != nil {
-		log.Errorf("Error fetching network config: %v", err)
-	}
-
 	var tables []string
 	if len(cfg.RouteTableFilter) > 0 {
 		tables, err = cfg.routeTablesByFilter(ec2c)
@@ -188,123 +190,98 @@ func (be *AwsVpcBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup
 	}
 
 	for _, routeTableID := range tables {
-		err = be.cleanupBlackholeRoutes(routeTableID, networkConfig.Network, ec2c)
-		if err != nil {
-			log.Errorf("Error cleaning up blackhole routes: %v", err)
+		for _, network := range config.Networks() {
+			if err := api.pruneRoutes(ctx, routeTableID, network, nil); err != nil {
+				log.Errorf("Error cleaning up blackhole routes: %v", err)
+			}
 		}
 
-		matchingRouteFound, err := be.checkMatchingRoutes(routeTableID, l.Subnet.String(), eni.NetworkInterfaceId, ec2c)
-		if err != nil {
-			log.Errorf("Error describing route tables: %v", err)
+		// Add the route for this machine's subnet
+		if err := api.ensureRoute(ctx, routeTableID, l.Subnet.String()); err != nil {
+			return nil, fmt.Errorf("unable to add route %s: %v", l.Subnet.String(), err)
 		}
+	}
 
-		if !matchingRouteFound {
-			cidrBlock := l.Subnet.String()
-			deleteRouteInput := &ec2.DeleteRouteInput{RouteTableId: &routeTableID, DestinationCidrBlock: &cidrBlock}
-			if _, err := ec2c.DeleteRoute(deleteRouteInput); err != nil {
-				if ec2err, ok := err.(awserr.Error); !ok || ec2err.Code() != "InvalidRoute.NotFound" {
-					// an error other than the route not already existing occurred
-					return nil, fmt.Errorf("error deleting existing route for %s: %v", l.Subnet.String(), err)
-				}
-			}
-
-			// Add the route for this machine's subnet
-			if err := be.createRoute(routeTableID, l.Subnet.String(), eni.NetworkInterfaceId, ec2c); err != nil {
-				return nil, fmt.Errorf("unable to add route %s: %v", l.Subnet.String(), err)
-			}
-		}
+	if cfg.PruneStaleRoutes {
+		wg.Add(1)
+		go func() {
+			be.pruneStaleRoutes(ctx, api, tables, config.Networks(), l)
+			wg.Done()
+		}()
 	}
 
-	return &backend.SimpleNetwork{
-		SubnetLease: l,
-		ExtIface:    be.extIface,
+	return &network{
+		SimpleNetwork: backend.SimpleNetwork{
+			SubnetLease: l,
+			ExtIface:    be.extIface,
+		},
+		api:    api,
+		tables: tables,
+		subnet: l.Subnet.String(),
 	}, nil
 }
 
-func (be *AwsVpcBackend) cleanupBlackholeRoutes(routeTableID string, network ip.IP4Net, ec2c *ec2.EC2) error {
-	filter := newFilter()
-	filter.Add("route.state", "blackhole")
-
-	input := ec2.DescribeRouteTablesInput{Filters: filter, RouteTableIds: []*string{&routeTableID}}
-	resp, err := ec2c.DescribeRouteTables(&input)
+// pruneStaleRoutes deletes the routes of subnets of networks which are no
+// longer leased
+func (be *AwsVpcBackend) pruneStaleRoutes(ctx context.Context, api *awsAPI, tables []string, networks []ip.IP4Net, ownLease *subnet.Lease) {
+	res, err := be.sm.WatchLeases(ctx, nil)
 	if err != nil {
-		return err
-	}
-
-	for _, routeTable := range resp.RouteTables {
-		for _, route := range routeTable.Routes {
-			if *route.State == "blackhole" && route.DestinationCidrBlock != nil {
-				_, subnet, err := net.ParseCIDR(*route.DestinationCidrBlock)
-				if err == nil && network.Contains(ip.FromIP(subnet.IP)) {
-					log.Info("Removing blackhole route: ", *route.DestinationCidrBlock)
-					deleteRouteInput := &ec2.DeleteRouteInput{RouteTableId: &routeTableID, DestinationCidrBlock: route.DestinationCidrBlock}
-					if _, err := ec2c.DeleteRoute(deleteRouteInput); err != nil {
-						if ec2err, ok := err.(awserr.Error); !ok || ec2err.Code() != "InvalidRoute.NotFound" {
-							// an error other than the route not already existing occurred
-							return err
-						}
-					}
-				}
-			}
-		}
+		log.Errorf("Error fetching subnet leases, not pruning stale routes: %v", err)
+		return
 	}
 
-	return nil
-}
-
-func (be *AwsVpcBackend) checkMatchingRoutes(routeTableID, subnet string, eniID *string, ec2c *ec2.EC2) (bool, error) {
-	matchingRouteFound := false
-
-	filter := newFilter()
-	filter.Add("route.destination-cidr-block", subnet)
-	filter.Add("route.state", "active")
+	if ctx.Err() != nil {
+		return
+	}
 
-	input := ec2.DescribeRouteTablesInput{Filters: filter, RouteTableIds: []*string{&routeTableID}}
+	// only a snapshot tells us the full set of leases
+	if len(res.Events) > 0 {
+		log.Infof("Subnet manager %v does not provide a lease snapshot, not pruning stale routes", be.sm.Name())
+		return
+	}
 
-	resp, err := ec2c.DescribeRouteTables(&input)
-	if err != nil {
-		return matchingRouteFound, err
+	activeSubnets := []string{ownLease.Subnet.String()}
+	for _, l := range res.Snapshot {
+		activeSubnets = append(activeSubnets, l.Subnet.String())
 	}
 
-	for _, routeTable := range resp.RouteTables {
-		for _, route := range routeTable.Routes {
-			if route.DestinationCidrBlock != nil && subnet == *route.DestinationCidrBlock &&
-				*route.State == "active" && route.NetworkInterfaceId == eniID {
-				matchingRouteFound = true
-				break
+	for _, routeTableID := range tables {
+		for _, network := range networks {
+			if err := api.pruneRoutes(ctx, routeTableID, network, activeSubnets); err != nil {
+				log.Errorf("Error pruning stale routes in table %s: %v", routeTableID, err)
 			}
 		}
 	}
-
-	return matchingRouteFound, nil
 }
 
-func (be *AwsVpcBackend) createRoute(routeTableID, subnet string, eniID *string, ec2c *ec2.EC2) error {
-	route := &ec2.CreateRouteInput{
-		RouteTableId:         &routeTableID,
-		NetworkInterfaceId:   eniID,
-		DestinationCidrBlock: &subnet,
-	}
+// network reports on the routes of the lease for health checks
+type network struct {
+	backend.SimpleNetwork
+	backend.ReconcileHealth
 
-	if _, err := ec2c.CreateRoute(route); err != nil {
-		return err
-	}
-	log.Infof("Route added to table %s: %s - %s.\n", routeTableID, subnet, *eniID)
-	return nil
+	api    *awsAPI
+	tables []string
+	subnet string
 }
 
-func (be *AwsVpcBackend) disableSrcDestCheck(eniID *string, ec2c *ec2.EC2) error {
-	attr := &ec2.ModifyNetworkInterfaceAttributeInput{
-		NetworkInterfaceId: eniID,
-		SourceDestCheck:    &ec2.AttributeBooleanValue{Value: aws.Bool(false)},
+// CheckRoutes returns an error unless every route table has an active route
+// for the lease to our ENI
+func (n *network) CheckRoutes(ctx context.Context) error {
+	for _, routeTableID := range n.tables {
+		route, err := n.api.getRoute(ctx, routeTableID, n.subnet)
+		if err != nil {
+			return fmt.Errorf("error getting route for subnet %v in table %v: %v", n.subnet, routeTableID, err)
+		}
+		if !n.api.routePointsHere(route) {
+			return fmt.Errorf("route for subnet %v in table %v does not go to %v", n.subnet, routeTableID, n.api.eniID)
+		}
 	}
-	_, err := ec2c.ModifyNetworkInterfaceAttribute(attr)
-	return err
+	return nil
 }
 
 // detectRouteTableID detect the routing table that is associated with the ENI,
 // subnet can be implicitly associated with the main routing table
-func (be *AwsVpcBackend) detectRouteTableID(eni *ec2.InstanceNetworkInterface, ec2c *ec2.EC2) (string, error) {
+func (be *AwsVpcBackend) detectRouteTableID(eni *ec2.InstanceNetworkInterface, ec2c ec2API) (string, error) {
 	subnetID := eni.SubnetId
 	vpcID := eni.VpcId
 
@@ -344,7 +321,7 @@ func (be *AwsVpcBackend) detectRouteTableID(eni *ec2.InstanceNetworkInterface, e
 	return *res.RouteTables[0].RouteTableId, nil
 }
 
-func (be *AwsVpcBackend) findENI(instanceID string, ec2c *ec2.EC2) (*ec2.InstanceNetworkInterface, error) {
+func (be *AwsVpcBackend) findENI(instanceID string, ec2c ec2API) (*ec2.InstanceNetworkInterface, error) {
 	instance, err := ec2c.DescribeInstances(&ec2.DescribeInstancesInput{
 		InstanceIds: []*string{aws.String(instanceID)}},
 	)
@@ -15,7 +15,10 @@
 package backend
 
 import (
+	"encoding/json"
+	"fmt"
 	"net"
+	"strings"
 	"sync"
 
 	"golang.org/x/net/context"
@@ -45,3 +48,122 @@ type Network interface {
 }
 
 type BackendCtor func(sm subnet.Manager, ei *ExternalInterface) (Backend, error)
+
+// Reasons of the events backends record about the routes they manage, see
+// subnet.EventRecorder
+const (
+	EventRouteCreated      = "RouteCreated"
+	EventRouteCreateFailed = "RouteCreateFailed"
+	EventRouteDeleted      = "RouteDeleted"
+	EventRouteDeleteFailed = "RouteDeleteFailed"
+)
+
+// PlannedRoute is a route a backend would ensure for a lease
+type PlannedRoute struct {
+	Name        string
+	Network     string
+	Destination string
+	NextHop     string
+}
+
+// RoutePlanner is implemented by backends which can report the routes they
+// would ensure for a lease without creating, changing or deleting anything
+type RoutePlanner interface {
+	PlanRoutes(ctx context.Context, config *subnet.Config, lease *subnet.Lease) ([]PlannedRoute, error)
+}
+
+// Capabilities are the features a backend supports
+type Capabilities struct {
+	// IPv6 routes the IPv6 subnets of networks with an IPv6Network
+	IPv6 bool
+	// DryRun can log the changes it would make instead of making them
+	DryRun bool
+	// Firewall can manage firewall rules allowing the flannel traffic
+	Firewall bool
+	// AliasIP can assign the subnets as alias IP ranges instead of
+	// routing them
+	AliasIP bool
+	// RouteReconcile checks and repairs the routes of the lease while
+	// running, see Reconciler
+	RouteReconcile bool
+}
+
+// CapabilityReporter is implemented by backends which report the features
+// they support, so that configs needing others fail at startup
+type CapabilityReporter interface {
+	Capabilities() Capabilities
+}
+
+// ConfigCapabilities returns the features config needs: IPv6 with an
+// IPv6Network, and those its backend config asks for with the options of the
+// backends which support them, DryRun, ManageFirewall and RoutingMode
+// alias-ip. RouteReconcile is needed by flags rather than the config.
+func ConfigCapabilities(config *subnet.Config) (Capabilities, error) {
+	needs := Capabilities{IPv6: config.EnableIPv6()}
+	if len(config.Backend) == 0 {
+		return needs, nil
+	}
+	var opts struct {
+		DryRun         bool
+		ManageFirewall bool
+		RoutingMode    string
+	}
+	if err := json.Unmarshal(config.Backend, &opts); err != nil {
+		return Capabilities{}, fmt.Errorf("error decoding backend config: %v", err)
+	}
+	needs.DryRun = opts.DryRun
+	needs.Firewall = opts.ManageFirewall
+	needs.AliasIP = opts.RoutingMode == "alias-ip"
+	return needs, nil
+}
+
+// CheckCapabilities returns an error naming the features in needs which be,
+// of type backendType, reports it doesn't support. Backends which don't
+// report their capabilities are assumed to support them all.
+func CheckCapabilities(be Backend, backendType string, needs Capabilities) error {
+	cr, ok := be.(CapabilityReporter)
+	if !ok {
+		return nil
+	}
+	caps := cr.Capabilities()
+
+	var unsupported []string
+	for _, c := range []struct {
+		needed, supported bool
+		what              string
+	}{
+		{needs.IPv6, caps.IPv6, "IPv6, needed by IPv6Network"},
+		{needs.DryRun, caps.DryRun, "dry runs, needed by DryRun"},
+		{needs.Firewall, caps.Firewall, "firewall rules, needed by ManageFirewall"},
+		{needs.AliasIP, caps.AliasIP, "alias IP ranges, needed by RoutingMode alias-ip"},
+		{needs.RouteReconcile, caps.RouteReconcile, "route reconciles, needed by the lease renew failure threshold"},
+	} {
+		if c.needed && !c.supported {
+			unsupported = append(unsupported, c.what)
+		}
+	}
+	if len(unsupported) > 0 {
+		return fmt.Errorf("the %s backend doesn't support %s", backendType, strings.Join(unsupported, "; "))
+	}
+	return nil
+}
+
+// Reconfigurer is implemented by networks which can apply some changes to the
+// backend config while running
+type Reconfigurer interface {
+	// Reconfigure applies the changes in the backend config of config
+	// which it can. If others need a restart, it returns a
+	// *RestartRequiredError naming them.
+	Reconfigure(ctx context.Context, config *subnet.Config) error
+}
+
+// RestartRequiredError is returned by Reconfigure for config changes which
+// only take effect when flannel restarts
+type RestartRequiredError struct {
+	// Keys are the changed config keys which weren't applied
+	Keys []string
+}
+
+func (e *RestartRequiredError) Error() string {
+	return fmt.Sprintf("changing %s requires restarting flannel", strings.Join(e.Keys, ", "))
+}
@@ -0,0 +1,112 @@
+// Copyright 2024 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/subnet"
+)
+
+type fakeBackend struct{}
+
+func (fakeBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup, config *subnet.Config) (Network, error) {
+	return nil, nil
+}
+
+type fakeCapableBackend struct {
+	fakeBackend
+	caps Capabilities
+}
+
+func (be fakeCapableBackend) Capabilities() Capabilities {
+	return be.caps
+}
+
+func TestConfigCapabilities(t *testing.T) {
+	for _, tc := range []struct {
+		config string
+		needs  Capabilities
+	}{
+		{`{"Network": "10.0.0.0/16"}`, Capabilities{}},
+		{`{"Network": "10.0.0.0/16", "Backend": {"Type": "vxlan", "VNI": 2}}`, Capabilities{}},
+		{`{"Network": "10.0.0.0/16", "IPv6Network": "fd00::/48", "Backend": {"Type": "gce"}}`, Capabilities{IPv6: true}},
+		{`{"Network": "10.0.0.0/16", "Backend": {"Type": "gce", "DryRun": true}}`, Capabilities{DryRun: true}},
+		{`{"Network": "10.0.0.0/16", "Backend": {"Type": "gce", "ManageFirewall": true}}`, Capabilities{Firewall: true}},
+		{`{"Network": "10.0.0.0/16", "Backend": {"Type": "gce", "RoutingMode": "alias-ip"}}`, Capabilities{AliasIP: true}},
+		{`{"Network": "10.0.0.0/16", "Backend": {"Type": "gce", "RoutingMode": "routes"}}`, Capabilities{}},
+	} {
+		config, err := subnet.ParseConfig(tc.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		needs, err := ConfigCapabilities(config)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.config, err)
+		}
+		if needs != tc.needs {
+			t.Errorf("%s: expected %+v, got %+v", tc.config, tc.needs, needs)
+		}
+	}
+
+	config, err := subnet.ParseConfig(`{"Network": "10.0.0.0/16", "Backend": {"Type": "gce", "DryRun": "yes"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ConfigCapabilities(config); err == nil {
+		t.Error("expected an error for an invalid DryRun")
+	}
+}
+
+func TestCheckCapabilities(t *testing.T) {
+	all := Capabilities{IPv6: true, DryRun: true, Firewall: true, AliasIP: true, RouteReconcile: true}
+	for _, tc := range []struct {
+		name  string
+		needs Capabilities
+		what  string
+	}{
+		{"IPv6", Capabilities{IPv6: true}, "IPv6Network"},
+		{"DryRun", Capabilities{DryRun: true}, "DryRun"},
+		{"Firewall", Capabilities{Firewall: true}, "ManageFirewall"},
+		{"AliasIP", Capabilities{AliasIP: true}, "RoutingMode alias-ip"},
+		{"RouteReconcile", Capabilities{RouteReconcile: true}, "lease renew failure threshold"},
+	} {
+		err := CheckCapabilities(fakeCapableBackend{}, "vxlan", tc.needs)
+		if err == nil || !strings.Contains(err.Error(), "vxlan") || !strings.Contains(err.Error(), tc.what) {
+			t.Errorf("%s: expected an error naming the backend and %s, got %v", tc.name, tc.what, err)
+		}
+		if err := CheckCapabilities(fakeCapableBackend{caps: tc.needs}, "vxlan", tc.needs); err != nil {
+			t.Errorf("%s: unexpected error when supported: %v", tc.name, err)
+		}
+		if err := CheckCapabilities(fakeBackend{}, "vxlan", tc.needs); err != nil {
+			t.Errorf("%s: unexpected error for a backend which doesn't report its capabilities: %v", tc.name, err)
+		}
+	}
+
+	if err := CheckCapabilities(fakeCapableBackend{}, "vxlan", Capabilities{}); err != nil {
+		t.Errorf("unexpected error for no needed capabilities: %v", err)
+	}
+	if err := CheckCapabilities(fakeCapableBackend{caps: all}, "gce", all); err != nil {
+		t.Errorf("unexpected error when all are supported: %v", err)
+	}
+	err := CheckCapabilities(fakeCapableBackend{caps: Capabilities{IPv6: true}}, "vxlan", all)
+	if err == nil || strings.Contains(err.Error(), "IPv6Network") || !strings.Contains(err.Error(), "DryRun") || !strings.Contains(err.Error(), "ManageFirewall") {
+		t.Errorf("expected an error naming all unsupported capabilities but IPv6, got %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package directrouting
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// The direct-routing backend, like host-gw, routes the subnet of each host via
+// its public IP without any encapsulation, so all hosts need to be on the same
+// L2 network. The metric and table of the routes are configurable so that they
+// can coexist with the routes of other routing daemons, and the routes are
+// deleted when their lease expires and when flannel shuts down.
+
+const (
+	backendType = "direct-routing"
+
+	// rtTableLocal is the kernel's local routing table, which must not be used
+	rtTableLocal = 255
+)
+
+func init() {
+	backend.Register(backendType, New)
+}
+
+type DirectRoutingBackend struct {
+	sm       subnet.Manager
+	extIface *backend.ExternalInterface
+}
+
+func New(sm subnet.Manager, extIface *backend.ExternalInterface) (backend.Backend, error) {
+	if !extIface.ExtAddr.Equal(extIface.IfaceAddr) {
+		return nil, fmt.Errorf("your PublicIP differs from interface IP, meaning that probably you're on a NAT, which is not supported by %s backend", backendType)
+	}
+
+	be := &DirectRoutingBackend{
+		sm:       sm,
+		extIface: extIface,
+	}
+	return be, nil
+}
+
+func (be *DirectRoutingBackend) Capabilities() backend.Capabilities {
+	return backend.Capabilities{}
+}
+
+// backendConfig is the direct-routing part of the backend config
+type backendConfig struct {
+	RouteMetric int
+	RouteTable  int
+}
+
+func parseBackendConfig(config *subnet.Config) (backendConfig, error) {
+	var cfg backendConfig
+	if len(config.Backend) > 0 {
+		if err := json.Unmarshal(config.Backend, &cfg); err != nil {
+			return cfg, fmt.Errorf("error decoding direct-routing backend config: %v", err)
+		}
+	}
+
+	if cfg.RouteMetric < 0 {
+		return cfg, fmt.Errorf("invalid RouteMetric %d: must not be negative", cfg.RouteMetric)
+	}
+	if cfg.RouteTable < 0 || cfg.RouteTable == rtTableLocal {
+		return cfg, fmt.Errorf("invalid RouteTable %d: must be a non-negative table id other than the local table (%d)", cfg.RouteTable, rtTableLocal)
+	}
+	return cfg, nil
+}
+
+func (be *DirectRoutingBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
+	cfg, err := parseBackendConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Direct routing config: RouteMetric=%d RouteTable=%d", cfg.RouteMetric, cfg.RouteTable)
+
+	mtu, err := backend.DetectMTU(config, be.extIface, backendType, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := subnet.LeaseAttrs{
+		PublicIP:    ip.FromIP(be.extIface.ExtAddr),
+		BackendType: backendType,
+	}
+
+	l, err := be.sm.AcquireLease(ctx, &attrs)
+	switch err {
+	case nil:
+
+	case context.Canceled, context.DeadlineExceeded:
+		return nil, err
+
+	default:
+		return nil, fmt.Errorf("failed to acquire lease: %v", err)
+	}
+
+	return newNetwork(be.sm, be.extIface, l, mtu, cfg.RouteMetric, cfg.RouteTable), nil
+}
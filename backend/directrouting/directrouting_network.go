@@ -0,0 +1,210 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package directrouting
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+const (
+	routeCheckInterval = 10 * time.Second
+)
+
+type network struct {
+	backend.SimpleNetwork
+	sm     subnet.Manager
+	mtu    int
+	metric int
+	table  int
+
+	mu sync.Mutex
+	// routes are those installed for the leases of other hosts
+	routes map[ip.IP4Net]netlink.Route
+}
+
+func newNetwork(sm subnet.Manager, extIface *backend.ExternalInterface, lease *subnet.Lease, mtu, metric, table int) *network {
+	return &network{
+		SimpleNetwork: backend.SimpleNetwork{
+			SubnetLease: lease,
+			ExtIface:    extIface,
+		},
+		sm:     sm,
+		mtu:    mtu,
+		metric: metric,
+		table:  table,
+		routes: make(map[ip.IP4Net]netlink.Route),
+	}
+}
+
+func (n *network) MTU() int {
+	return n.mtu
+}
+
+func (n *network) Run(ctx context.Context) {
+	wg := sync.WaitGroup{}
+
+	log.Info("Watching for new subnet leases")
+	evts := make(chan []subnet.Event)
+	wg.Add(1)
+	go func() {
+		subnet.WatchLeases(ctx, n.sm, n.SubnetLease, evts)
+		wg.Done()
+	}()
+
+	defer func() {
+		wg.Wait()
+		n.deleteRoutes()
+	}()
+
+	ticker := time.NewTicker(routeCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case evtBatch := <-evts:
+			n.handleSubnetEvents(evtBatch)
+
+		case <-ticker.C:
+			n.checkRoutes()
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (n *network) route(lease *subnet.Lease) netlink.Route {
+	return netlink.Route{
+		Dst:       lease.Subnet.ToIPNet(),
+		Gw:        lease.Attrs.PublicIP.ToIP(),
+		LinkIndex: n.ExtIface.Iface.Index,
+		Priority:  n.metric,
+		Table:     n.table,
+	}
+}
+
+func (n *network) handleSubnetEvents(batch []subnet.Event) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, evt := range batch {
+		if evt.Lease.Attrs.BackendType != backendType {
+			log.Warningf("Ignoring non-%v subnet: type=%v", backendType, evt.Lease.Attrs.BackendType)
+			continue
+		}
+
+		switch evt.Type {
+		case subnet.EventAdded:
+			log.Infof("Subnet added: %v via %v", evt.Lease.Subnet, evt.Lease.Attrs.PublicIP)
+
+			route := n.route(&evt.Lease)
+			// the kernel keeps routes of another priority alongside, so
+			// RouteReplace would only replace the old route of the same one
+			if old, ok := n.routes[evt.Lease.Subnet]; ok && (!old.Gw.Equal(route.Gw) || old.Priority != route.Priority) {
+				log.Infof("Replacing route to %v via %v metric %d with %v metric %d", evt.Lease.Subnet, old.Gw, old.Priority, route.Gw, route.Priority)
+				if err := netlink.RouteDel(&old); err != nil {
+					log.Errorf("Error deleting route to %v via %v: %v", evt.Lease.Subnet, old.Gw, err)
+				}
+			}
+
+			n.routes[evt.Lease.Subnet] = route
+			if err := netlink.RouteReplace(&route); err != nil {
+				log.Errorf("Error adding route to %v via %v: %v", evt.Lease.Subnet, evt.Lease.Attrs.PublicIP, err)
+			}
+
+		case subnet.EventRemoved:
+			// the lease was deleted or has expired
+			log.Info("Subnet removed: ", evt.Lease.Subnet)
+
+			route, ok := n.routes[evt.Lease.Subnet]
+			if !ok {
+				continue
+			}
+			delete(n.routes, evt.Lease.Subnet)
+			if err := netlink.RouteDel(&route); err != nil {
+				log.Errorf("Error deleting route to %v: %v", evt.Lease.Subnet, err)
+			}
+
+		default:
+			log.Error("Internal error: unknown event type: ", int(evt.Type))
+		}
+	}
+}
+
+// checkRoutes adds back the routes that have been deleted by someone else
+func (n *network) checkRoutes() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if len(n.routes) == 0 {
+		return
+	}
+
+	// without a filter only the main table is listed
+	var filter *netlink.Route
+	var filterMask uint64
+	if n.table != 0 {
+		filter, filterMask = &netlink.Route{Table: n.table}, netlink.RT_FILTER_TABLE
+	}
+
+	routeList, err := netlink.RouteListFiltered(netlink.FAMILY_V4, filter, filterMask)
+	if err != nil {
+		log.Errorf("Error fetching route list. Will automatically retry: %v", err)
+		return
+	}
+
+	for sn, route := range n.routes {
+		if !routeExists(routeList, route) {
+			if err := netlink.RouteReplace(&route); err != nil {
+				log.Errorf("Error recovering route to %v via %v: %v", sn, route.Gw, err)
+				continue
+			}
+			log.Infof("Route recovered %v : %v", sn, route.Gw)
+		}
+	}
+}
+
+// deleteRoutes deletes all the routes added by the backend, on shutdown
+func (n *network) deleteRoutes() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	log.Infof("Deleting %d routes", len(n.routes))
+	for sn, route := range n.routes {
+		if err := netlink.RouteDel(&route); err != nil {
+			log.Errorf("Error deleting route to %v: %v", sn, err)
+		}
+		delete(n.routes, sn)
+	}
+}
+
+func routeExists(routeList []netlink.Route, route netlink.Route) bool {
+	for _, r := range routeList {
+		if r.Dst != nil && r.Dst.String() == route.Dst.String() && r.Gw.Equal(route.Gw) && r.Priority == route.Priority {
+			return true
+		}
+	}
+	return false
+}
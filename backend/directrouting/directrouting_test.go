@@ -0,0 +1,162 @@
+// Copyright 2024 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package directrouting
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/ns"
+	"github.com/coreos/flannel/subnet"
+)
+
+func TestParseBackendConfig(t *testing.T) {
+	for _, tc := range []struct {
+		backend string
+		valid   bool
+		metric  int
+		table   int
+	}{
+		{``, true, 0, 0},
+		{`{"Type": "direct-routing"}`, true, 0, 0},
+		{`{"Type": "direct-routing", "RouteMetric": 100, "RouteTable": 100}`, true, 100, 100},
+		{`{"Type": "direct-routing", "RouteTable": 254}`, true, 0, 254},
+		{`{"Type": "direct-routing", "RouteMetric": -1}`, false, 0, 0},
+		{`{"Type": "direct-routing", "RouteTable": -1}`, false, 0, 0},
+		{`{"Type": "direct-routing", "RouteTable": 255}`, false, 0, 0},
+		{`{"Type": "direct-routing", "RouteMetric": "100"}`, false, 0, 0},
+	} {
+		cfg, err := parseBackendConfig(&subnet.Config{Backend: json.RawMessage(tc.backend)})
+		if !tc.valid {
+			if err == nil {
+				t.Errorf("%s: expected an error", tc.backend)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.backend, err)
+			continue
+		}
+		if cfg.RouteMetric != tc.metric || cfg.RouteTable != tc.table {
+			t.Errorf("%s: expected metric %d and table %d, got %+v", tc.backend, tc.metric, tc.table, cfg)
+		}
+	}
+}
+
+func TestRouteExists(t *testing.T) {
+	_, dst, _ := net.ParseCIDR("10.1.1.0/24")
+	_, other, _ := net.ParseCIDR("10.1.2.0/24")
+	gw := net.ParseIP("192.168.0.2")
+	route := netlink.Route{Dst: dst, Gw: gw, Priority: 200}
+
+	for _, tc := range []struct {
+		name   string
+		list   []netlink.Route
+		exists bool
+	}{
+		{"empty", nil, false},
+		{"same", []netlink.Route{{Dst: dst, Gw: gw, Priority: 200}}, true},
+		{"default route", []netlink.Route{{Gw: gw, Priority: 200}}, false},
+		{"other destination", []netlink.Route{{Dst: other, Gw: gw, Priority: 200}}, false},
+		{"other gateway", []netlink.Route{{Dst: dst, Gw: net.ParseIP("192.168.0.3"), Priority: 200}}, false},
+		{"old metric", []netlink.Route{{Dst: dst, Gw: gw, Priority: 100}}, false},
+		{"among others", []netlink.Route{{Dst: dst, Gw: gw, Priority: 100}, {Dst: dst, Gw: gw, Priority: 200}}, true},
+	} {
+		if exists := routeExists(tc.list, route); exists != tc.exists {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.exists, exists)
+		}
+	}
+}
+
+// newTestNetwork returns a network routing via lo in a new network namespace
+func newTestNetwork(t *testing.T, metric int) (*network, func()) {
+	teardown := ns.SetUpNetlinkTest(t)
+
+	lo, err := netlink.LinkByName("lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.AddrAdd(lo, &netlink.Addr{IPNet: &net.IPNet{IP: net.ParseIP("127.0.0.1"), Mask: net.CIDRMask(32, 32)}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.LinkSetUp(lo); err != nil {
+		t.Fatal(err)
+	}
+	extIface := &backend.ExternalInterface{Iface: &net.Interface{Index: lo.Attrs().Index}}
+	return newNetwork(nil, extIface, &subnet.Lease{}, 1500, metric, 0), teardown
+}
+
+var (
+	testSubnet = ip.IP4Net{IP: ip.FromIP(net.ParseIP("10.1.1.0")), PrefixLen: 24}
+	testLease  = subnet.Lease{
+		Subnet: testSubnet,
+		Attrs:  subnet.LeaseAttrs{PublicIP: ip.FromIP(net.ParseIP("127.0.0.1")), BackendType: backendType},
+	}
+)
+
+// subnetRoutes returns the routes to testSubnet in the main table
+func subnetRoutes(t *testing.T) []netlink.Route {
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Dst: testSubnet.ToIPNet()}, netlink.RT_FILTER_DST)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return routes
+}
+
+func TestHandleSubnetEventsMetricChange(t *testing.T) {
+	n, teardown := newTestNetwork(t, 100)
+	defer teardown()
+
+	n.handleSubnetEvents([]subnet.Event{{Type: subnet.EventAdded, Lease: testLease}})
+	if routes := subnetRoutes(t); len(routes) != 1 || routes[0].Priority != 100 {
+		t.Fatalf("expected the route with metric 100, got %v", routes)
+	}
+
+	n.metric = 200
+	n.handleSubnetEvents([]subnet.Event{{Type: subnet.EventAdded, Lease: testLease}})
+	if routes := subnetRoutes(t); len(routes) != 1 || routes[0].Priority != 200 {
+		t.Fatalf("expected only the route with metric 200, got %v", routes)
+	}
+
+	n.handleSubnetEvents([]subnet.Event{{Type: subnet.EventRemoved, Lease: testLease}})
+	if routes := subnetRoutes(t); len(routes) != 0 {
+		t.Errorf("expected the route to be deleted, got %v", routes)
+	}
+}
+
+func TestCheckRoutesOldMetric(t *testing.T) {
+	n, teardown := newTestNetwork(t, 100)
+	defer teardown()
+
+	// a route of the old metric is left over, the new one is missing
+	old := n.route(&testLease)
+	if err := netlink.RouteAdd(&old); err != nil {
+		t.Fatal(err)
+	}
+	n.metric = 200
+	n.routes[testSubnet] = n.route(&testLease)
+
+	n.checkRoutes()
+	routes := subnetRoutes(t)
+	if !routeExists(routes, n.routes[testSubnet]) {
+		t.Errorf("expected the route with metric 200 to be added back, got %v", routes)
+	}
+}
@@ -51,6 +51,10 @@ func New(sm subnet.Manager, extIface *backend.ExternalInterface) (backend.Backen
 	return be, nil
 }
 
+func (be *ExtensionBackend) Capabilities() backend.Capabilities {
+	return backend.Capabilities{}
+}
+
 func (_ *ExtensionBackend) Run(ctx context.Context) {
 	<-ctx.Done()
 }
@@ -0,0 +1,95 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package gce
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	log "github.com/golang/glog"
+	"google.golang.org/api/compute/v1"
+)
+
+// findEquivalentRoute returns a route in the network which flannel didn't
+// name, e.g. created before the cluster migrated to flannel, but which sends
+// subnet to the same next hop as the route flannel wants for it, nil if there
+// is none
+func (api *gceAPI) findEquivalentRoute(ctx context.Context, subnet string) (*compute.Route, error) {
+	planned, err := api.planRoute(subnet)
+	if err != nil {
+		return nil, err
+	}
+
+	var found *compute.Route
+	filter := fmt.Sprintf("destRange eq %s", regexp.QuoteMeta(subnet))
+	err = api.computeService.Routes.List(api.networkProject).Filter(filter).Pages(ctx, func(page *compute.RouteList) error {
+		for _, route := range page.Items {
+			if found != nil || route.Network != planned.network || route.Name == planned.name {
+				continue
+			}
+			if routeFromCompute(route).sameTarget(planned) {
+				found = route
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing routes for subnet %v: %v", subnet, err)
+	}
+	return found, nil
+}
+
+// adoptRoute looks for a route equivalent to the one flannel wants for
+// subnet, which is missing, and adopts it as configured by adoptRoutes. It
+// returns true if the route was adopted, so that flannel doesn't create its
+// own. With adoptRoutesRecreate, flannel's route is created before the
+// adopted one is deleted, so that traffic keeps flowing.
+func (api *gceAPI) adoptRoute(ctx context.Context, subnet string) (bool, error) {
+	if api.adoptRoutes == "" {
+		return false, nil
+	}
+	route, err := api.findEquivalentRoute(ctx, subnet)
+	if err != nil || route == nil {
+		return false, err
+	}
+
+	if api.adoptRoutes == adoptRoutesKeep {
+		logger.V(1).Infof("Adopting pre-existing route %s", api.logFields(route))
+		return true, nil
+	}
+
+	logger.V(1).Infof("Recreating pre-existing route under flannel's name %s", api.logFields(route))
+	operation, err := api.insertRoute(ctx, subnet)
+	if err == nil && operation != nil {
+		err = api.pollOperationStatus(ctx, operation)
+	}
+	api.recordInsert(ctx, subnet, err)
+	if err != nil {
+		return false, fmt.Errorf("error inserting route replacing %v: %v", route.Name, err)
+	}
+
+	operation, err = api.deleteNamedRoute(ctx, route.Name, subnet)
+	if err == nil && operation != nil {
+		err = api.pollOperationStatus(ctx, operation)
+	}
+	if err != nil {
+		// flannel's route is in place, deleting the duplicate can
+		// be done by hand
+		log.Errorf("Error deleting pre-existing route replaced by flannel's %s: %v", api.logFields(route), err)
+	}
+	return true, nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package gce
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/compute/v1"
+
+	"github.com/coreos/flannel/backend"
+)
+
+// newAdoptTestAPI returns an api routing via 10.128.0.2, in a network holding
+// a route for 10.0.1.0/24 via nextHop which flannel didn't create
+func newAdoptTestAPI(t *testing.T, mode, nextHop string) (*gceAPI, *fakeCompute, func()) {
+	network := "projects/test-project/global/networks/default"
+	fake := newFakeCompute(
+		&compute.Route{Name: "legacy-pods-1", DestRange: "10.0.1.0/24", Network: network, NextHopIp: nextHop, Priority: defaultRoutePriority},
+		// in another network
+		&compute.Route{Name: "legacy-pods-2", DestRange: "10.0.1.0/24", Network: "projects/test-project/global/networks/other", NextHopIp: "10.128.0.2"},
+	)
+	api, done := newTestAPI(t, fake)
+	api.useIPNextHop = true
+	api.gceInstance.NetworkInterfaces = []*compute.NetworkInterface{{NetworkIP: "10.128.0.2"}}
+	api.adoptRoutes = mode
+	return api, fake, done
+}
+
+func TestAdoptRoutes(t *testing.T) {
+	for _, tc := range []struct {
+		mode     string
+		nextHop  string
+		repaired bool
+		inserted []string
+		deleted  []string
+	}{
+		// the route of flannel is created alongside
+		{"", "10.128.0.2", true, []string{"flannel-10-0-1-0-24"}, nil},
+		{adoptRoutesKeep, "10.128.0.2", false, nil, nil},
+		{adoptRoutesRecreate, "10.128.0.2", true, []string{"flannel-10-0-1-0-24"}, []string{"legacy-pods-1"}},
+		// not equivalent, so it isn't adopted
+		{adoptRoutesKeep, "10.128.0.9", true, []string{"flannel-10-0-1-0-24"}, nil},
+		{adoptRoutesRecreate, "10.128.0.9", true, []string{"flannel-10-0-1-0-24"}, nil},
+	} {
+		api, fake, done := newAdoptTestAPI(t, tc.mode, tc.nextHop)
+		state, repaired, err := api.repairRoute(context.Background(), "10.0.1.0/24")
+		done()
+		if err != nil {
+			t.Fatalf("%q via %v: %v", tc.mode, tc.nextHop, err)
+		}
+		if state != backend.RoutePresent || repaired != tc.repaired {
+			t.Errorf("%q via %v: expected the route to be present with repaired=%v, got %v and %v", tc.mode, tc.nextHop, tc.repaired, state, repaired)
+		}
+		if strings.Join(fake.inserted, ",") != strings.Join(tc.inserted, ",") {
+			t.Errorf("%q via %v: expected %v to be inserted, got %v", tc.mode, tc.nextHop, tc.inserted, fake.inserted)
+		}
+		if strings.Join(fake.deleted, ",") != strings.Join(tc.deleted, ",") {
+			t.Errorf("%q via %v: expected %v to be deleted, got %v", tc.mode, tc.nextHop, tc.deleted, fake.deleted)
+		}
+		if fake.routes["legacy-pods-2"] == nil {
+			t.Errorf("%q via %v: expected the route in another network to be left alone", tc.mode, tc.nextHop)
+		}
+	}
+}
+
+func TestCheckRouteAdopted(t *testing.T) {
+	for _, tc := range []struct {
+		mode    string
+		nextHop string
+		state   backend.RouteState
+	}{
+		{"", "10.128.0.2", backend.RouteAbsent},
+		{adoptRoutesKeep, "10.128.0.2", backend.RoutePresent},
+		{adoptRoutesKeep, "10.128.0.9", backend.RouteAbsent},
+	} {
+		api, _, done := newAdoptTestAPI(t, tc.mode, tc.nextHop)
+		state, _ := api.checkRoute(context.Background(), "10.0.1.0/24")
+		done()
+		if state != tc.state {
+			t.Errorf("%q via %v: expected %v, got %v", tc.mode, tc.nextHop, tc.state, state)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package gce
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+
+	"github.com/coreos/flannel/backend"
+)
+
+// maxAliasUpdateAttempts bounds the updates of a network interface which
+// failed because the interface changed since it was read
+const maxAliasUpdateAttempts = 5
+
+// aliasIPRange is an alias IP range of a network interface. The vendored
+// compute client predates them, so they are read and written as JSON.
+type aliasIPRange struct {
+	IPCidrRange         string `json:"ipCidrRange"`
+	SubnetworkRangeName string `json:"subnetworkRangeName,omitempty"`
+}
+
+// aliasNIC is the network interface the alias IP ranges are assigned to. The
+// fingerprint of the interface as read must be sent with updates to it.
+type aliasNIC struct {
+	Name          string         `json:"name"`
+	Fingerprint   string         `json:"fingerprint"`
+	AliasIPRanges []aliasIPRange `json:"aliasIpRanges"`
+}
+
+// getAliasNIC fetches the network interface of the instance selected like the
+// one providing the next hop IP of routes
+func (api *gceAPI) getAliasNIC(ctx context.Context) (*aliasNIC, error) {
+	data, err := api.getInstanceJSON(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	gi := &compute.Instance{}
+	if err := json.Unmarshal(data, gi); err != nil {
+		return nil, fmt.Errorf("error decoding instance: %v", err)
+	}
+	var instance struct {
+		NetworkInterfaces []aliasNIC `json:"networkInterfaces"`
+	}
+	if err := json.Unmarshal(data, &instance); err != nil {
+		return nil, fmt.Errorf("error decoding instance: %v", err)
+	}
+
+	gn, _, _ := api.resources()
+	nic, err := api.nextHopInterface(gn, gi)
+	if err != nil {
+		return nil, err
+	}
+	for i := range gi.NetworkInterfaces {
+		if gi.NetworkInterfaces[i] == nic {
+			return &instance.NetworkInterfaces[i], nil
+		}
+	}
+	return nil, fmt.Errorf("error finding network interface %v of instance %v", nic.Name, gi.SelfLink)
+}
+
+// aliasRangeIndex returns the index of the alias IP range for subnet in
+// ranges, or -1
+func aliasRangeIndex(ranges []aliasIPRange, subnet string) int {
+	_, want, err := net.ParseCIDR(subnet)
+	for i, r := range ranges {
+		if err != nil {
+			if r.IPCidrRange == subnet {
+				return i
+			}
+			continue
+		}
+		if _, got, err := net.ParseCIDR(r.IPCidrRange); err == nil && got.String() == want.String() {
+			return i
+		}
+	}
+	return -1
+}
+
+// hasAliasRange returns true if the alias IP range for subnet is assigned to
+// the network interface of the instance
+func (api *gceAPI) hasAliasRange(ctx context.Context, subnet string) (bool, error) {
+	nic, err := api.getAliasNIC(ctx)
+	if err != nil {
+		return false, fmt.Errorf("error getting network interface: %v", err)
+	}
+	return aliasRangeIndex(nic.AliasIPRanges, subnet) >= 0, nil
+}
+
+// ensureAliasRange assigns subnet as an alias IP range to the network
+// interface of the instance, unless it already is
+func (api *gceAPI) ensureAliasRange(ctx context.Context, subnet string) error {
+	if err := validateSubnet(subnet); err != nil {
+		return err
+	}
+	return api.updateAliasRanges(ctx, "adding alias IP range "+subnet, func(ranges []aliasIPRange) ([]aliasIPRange, bool) {
+		if aliasRangeIndex(ranges, subnet) >= 0 {
+			logger.V(2).Infof("Alias IP range %v is already assigned to instance %v", subnet, api.instanceName)
+			return ranges, false
+		}
+		return append(ranges, aliasIPRange{IPCidrRange: subnet, SubnetworkRangeName: api.aliasRangeName}), true
+	})
+}
+
+// removeAliasRanges removes the alias IP ranges for subnets from the network
+// interface of the instance, ranges which aren't assigned are skipped
+func (api *gceAPI) removeAliasRanges(ctx context.Context, subnets []string) error {
+	return api.updateAliasRanges(ctx, fmt.Sprintf("removing alias IP ranges %v", subnets), func(ranges []aliasIPRange) ([]aliasIPRange, bool) {
+		kept := []aliasIPRange{}
+		for _, r := range ranges {
+			if !containsAliasRange(subnets, r) {
+				kept = append(kept, r)
+			}
+		}
+		return kept, len(kept) < len(ranges)
+	})
+}
+
+// containsAliasRange returns true if r is the alias IP range of one of subnets
+func containsAliasRange(subnets []string, r aliasIPRange) bool {
+	for _, sn := range subnets {
+		if aliasRangeIndex([]aliasIPRange{r}, sn) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// repairAliasRange assigns the alias IP range for subnet again if it was
+// removed. It returns the state of the range and whether it was assigned
+// again, like repairRoute.
+func (api *gceAPI) repairAliasRange(ctx context.Context, subnet string) (backend.RouteState, bool, error) {
+	ok, err := api.hasAliasRange(ctx, subnet)
+	if err != nil {
+		return backend.RouteUnknown, false, err
+	}
+	if ok {
+		return backend.RoutePresent, false, nil
+	}
+
+	logger.V(1).Infof("Repairing missing alias IP range %v of instance %v", subnet, api.instanceName)
+	if err := api.ensureAliasRange(ctx, subnet); err != nil {
+		return backend.RouteAbsent, false, fmt.Errorf("error adding alias IP range: %v", err)
+	}
+	return backend.RoutePresent, true, nil
+}
+
+// updateAliasRanges replaces the alias IP ranges of the network interface of
+// the instance with those update returns, if it changed them, and waits for
+// the operation to complete. The interface is read again and update called
+// again when it changed before the update was applied.
+func (api *gceAPI) updateAliasRanges(ctx context.Context, what string, update func([]aliasIPRange) ([]aliasIPRange, bool)) error {
+	for attempt := 1; ; attempt++ {
+		nic, err := api.getAliasNIC(ctx)
+		if err != nil {
+			return fmt.Errorf("error getting network interface: %v", err)
+		}
+		ranges, changed := update(nic.AliasIPRanges)
+		if !changed {
+			return nil
+		}
+
+		if api.readOnly {
+			return fmt.Errorf("not %s on network interface %v of instance %v in read-only mode", what, nic.Name, api.instanceName)
+		}
+		if api.dryRun {
+			logger.V(1).Infof("Dry run: not %s on network interface %v of instance %v", what, nic.Name, api.instanceName)
+			return nil
+		}
+		logger.V(1).Infof("Updating network interface %v of instance %v: %s", nic.Name, api.instanceName, what)
+		if err := api.waitForWrite(ctx); err != nil {
+			return err
+		}
+		probe, err := api.breaker.wait(ctx)
+		if err != nil {
+			return err
+		}
+
+		updated := &aliasNIC{Name: nic.Name, Fingerprint: nic.Fingerprint, AliasIPRanges: ranges}
+		var operation *compute.Operation
+		err = api.withRetries(ctx, what, func() error {
+			var err error
+			start := time.Now()
+			operation, err = api.updateNetworkInterfaceJSON(ctx, updated)
+			observeAPICall("updateNetworkInterface", start, err)
+			return err
+		})
+		api.breaker.done(probe, err)
+		if apiError, ok := err.(*googleapi.Error); ok && apiError.Code == http.StatusPreconditionFailed && attempt < maxAliasUpdateAttempts {
+			logger.V(2).Infof("Network interface %v of instance %v changed while %s, retrying", nic.Name, api.instanceName, what)
+			continue
+		}
+		if err != nil {
+			return wrapRateLimitError(err)
+		}
+		return api.pollOperationStatus(ctx, operation)
+	}
+}
+
+// updateNetworkInterfaceJSON updates the network interface of the instance to
+// nic. The vendored compute client predates updating network interfaces, so
+// the request is sent directly.
+func (api *gceAPI) updateNetworkInterfaceJSON(ctx context.Context, nic *aliasNIC) (*compute.Operation, error) {
+	data, err := json.Marshal(nic)
+	if err != nil {
+		return nil, err
+	}
+
+	u := api.instanceLink() + "/updateNetworkInterface?networkInterface=" + url.QueryEscape(nic.Name)
+	req, err := http.NewRequest("PATCH", u, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := api.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer googleapi.CloseBody(res)
+	if err := googleapi.CheckResponse(res); err != nil {
+		return nil, err
+	}
+
+	operation := &compute.Operation{}
+	if err := json.NewDecoder(res.Body).Decode(operation); err != nil {
+		return nil, fmt.Errorf("error decoding operation: %v", err)
+	}
+	return operation, nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+// +build !windows
+
+package gce
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"google.golang.org/api/compute/v1"
+
+	"github.com/coreos/flannel/backend"
+)
+
+// newAliasTestAPI returns an API in alias IP mode for instance node, whose
+// only network interface nic0 has the alias IP ranges
+func newAliasTestAPI(t *testing.T, ranges ...aliasIPRange) (*gceAPI, *fakeCompute, func()) {
+	fake := newFakeCompute()
+	fake.instances["node"] = &compute.Instance{
+		SelfLink:          "projects/test-project/zones/z/instances/node",
+		NetworkInterfaces: []*compute.NetworkInterface{{Name: "nic0", Network: "projects/test-project/global/networks/default"}},
+	}
+	fake.aliasRanges["node/nic0"] = ranges
+
+	api, done := newTestAPI(t, fake)
+	api.aliasIP = true
+	api.instanceProject = "test-project"
+	api.instanceZone = "z"
+	api.instanceName = "node"
+	return api, fake, done
+}
+
+func TestEnsureAliasRange(t *testing.T) {
+	other := aliasIPRange{IPCidrRange: "10.0.9.0/24", SubnetworkRangeName: "pods"}
+	api, fake, done := newAliasTestAPI(t, other)
+	defer done()
+	api.aliasRangeName = "pods"
+
+	ctx := context.Background()
+	if err := api.ensureAliasRange(ctx, "10.0.1.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	want := []aliasIPRange{other, {IPCidrRange: "10.0.1.0/24", SubnetworkRangeName: "pods"}}
+	if got := fake.aliasRanges["node/nic0"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected alias IP ranges %+v, got %+v", want, got)
+	}
+
+	// already assigned, the network interface isn't updated again
+	if err := api.ensureAliasRange(ctx, "10.0.1.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.updated) != 1 {
+		t.Errorf("expected a single update, got %v", fake.updated)
+	}
+}
+
+func TestEnsureAliasRangeFingerprintChanged(t *testing.T) {
+	api, fake, done := newAliasTestAPI(t)
+	defer done()
+	fake.staleUpdates = 2
+
+	if err := api.ensureAliasRange(context.Background(), "10.0.1.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	want := []aliasIPRange{{IPCidrRange: "10.0.1.0/24"}}
+	if got := fake.aliasRanges["node/nic0"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected alias IP ranges %+v, got %+v", want, got)
+	}
+
+	fake.staleUpdates = maxAliasUpdateAttempts
+	if err := api.ensureAliasRange(context.Background(), "10.0.2.0/24"); err == nil {
+		t.Error("expected an error once the interface kept changing")
+	}
+}
+
+func TestRemoveAliasRanges(t *testing.T) {
+	other := aliasIPRange{IPCidrRange: "10.0.9.0/24"}
+	api, fake, done := newAliasTestAPI(t, aliasIPRange{IPCidrRange: "10.0.1.0/24"}, other)
+	defer done()
+
+	ctx := context.Background()
+	if err := api.removeAliasRanges(ctx, []string{"10.0.1.0/24", "10.0.2.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.aliasRanges["node/nic0"]; !reflect.DeepEqual(got, []aliasIPRange{other}) {
+		t.Errorf("expected only %+v to be kept, got %+v", other, got)
+	}
+
+	// nothing left to remove
+	if err := api.removeAliasRanges(ctx, []string{"10.0.1.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.updated) != 1 {
+		t.Errorf("expected a single update, got %v", fake.updated)
+	}
+}
+
+func TestRepairAliasRange(t *testing.T) {
+	api, fake, done := newAliasTestAPI(t)
+	defer done()
+
+	ctx := context.Background()
+	state, repaired, err := api.repairAliasRange(ctx, "10.0.1.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != backend.RoutePresent || !repaired {
+		t.Errorf("expected the missing range to be repaired, got state %v, repaired %v", state, repaired)
+	}
+
+	state, repaired, err = api.repairAliasRange(ctx, "10.0.1.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != backend.RoutePresent || repaired {
+		t.Errorf("expected the range to be left alone, got state %v, repaired %v", state, repaired)
+	}
+	if len(fake.updated) != 1 {
+		t.Errorf("expected a single update, got %v", fake.updated)
+	}
+}
+
+func TestAliasRangeDryRun(t *testing.T) {
+	api, fake, done := newAliasTestAPI(t)
+	defer done()
+	api.dryRun = true
+
+	if err := api.ensureAliasRange(context.Background(), "10.0.1.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.updated) != 0 {
+		t.Errorf("expected no update in a dry run, got %v", fake.updated)
+	}
+}
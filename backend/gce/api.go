@@ -16,27 +16,209 @@
 package gce
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 
 	log "github.com/golang/glog"
+	"github.com/jonboulle/clockwork"
 
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
+	"golang.org/x/time/rate"
 	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/subnet"
+	"github.com/coreos/flannel/version"
 )
 
 // EnvGCENetworkProjectID is an environment variable to set the network project
 // When set, network routes will be created within a network project instead of the project running the instances
 const EnvGCENetworkProjectID = "GCE_NETWORK_PROJECT_ID"
 
+// When set, requests to the compute API are sent to this base URL instead of the default,
+// e.g. for private Google access or testing against a fake
+const EnvGCEComputeEndpoint = "GCE_COMPUTE_ENDPOINT"
+
+// When set, requests to the compute API carry this project in the X-Goog-User-Project header,
+// which bills it for them and counts them against its quota
+const EnvGCEQuotaProject = "GCE_QUOTA_PROJECT"
+
+// selfLinkBase starts the links of compute resources, whichever endpoint is used
+const selfLinkBase = "https://www.googleapis.com/compute/v1/"
+
 type gceAPI struct {
-	project        string
+	// networkProject owns the network and its routes. It differs from
+	// instanceProject when EnvGCENetworkProjectID is set.
+	networkProject string
 	useIPNextHop   bool
 	computeService *compute.Service
+	httpClient     *http.Client
+	metadata       metadataClient
 	gceNetwork     *compute.Network
 	gceInstance    *compute.Instance
+	instanceIPv6   string
+	// nicIPv6s are the IPv6 addresses of the network interfaces of
+	// gceInstance, by index, empty for those without one
+	nicIPv6s    []string
+	clock       clockwork.Clock
+	pollBackoff backoffPolicy
+	// retryBackoff and maxAttempts control the retries of route inserts
+	// and deletes which failed transiently
+	retryBackoff backoffPolicy
+	maxAttempts  int
+	// progressLogInterval is how often a pending operation is logged,
+	// zero disables it
+	progressLogInterval time.Duration
+	// waitForOperations waits for operations with the wait method, which
+	// blocks server side, instead of polling them. waitUnavailable is set
+	// once the API rejected a wait, polling is used from then on.
+	waitForOperations bool
+	waitUnavailable   int32
+	routePriority     int64
+	tags              []string
+	// priorityRanges override routePriority for the subnets they contain
+	priorityRanges []priorityRange
+	// nicIndex is the network interface providing the next hop IP,
+	// unless matchNICByNetwork is set
+	nicIndex          int
+	matchNICByNetwork bool
+	// nextHopIP selects the network interface with that IP instead
+	nextHopIP string
+	dryRun    bool
+	// readOnly checks the routes but refuses to insert or delete any, they
+	// are managed by another process
+	readOnly bool
+	// writeLimiter limits the rate of route inserts and deletes, which
+	// count against the project's write quota. nil means no limit.
+	writeLimiter *rate.Limiter
+	// writeConcurrency bounds the route inserts and deletes of a batch
+	// which are in flight at once
+	writeConcurrency int
+	// breaker pauses route inserts and deletes after sustained failures.
+	// nil means they are never paused.
+	breaker *circuitBreaker
+	// retryBudget bounds the retries and repeated operation polls of the
+	// backend. nil means they are unbounded.
+	retryBudget *retryBudget
+	// routeNamePrefix starts the names of the routes flannel manages
+	routeNamePrefix string
+	// routeNameReplacer sanitizes subnets in route names. nil means
+	// defaultRouteNameReplacer.
+	routeNameReplacer *strings.Replacer
+	// skipInstanceLookup derives the instance link from its identity
+	// rather than fetching the instance
+	skipInstanceLookup bool
+	// nextHopIlb is the forwarding rule routes go to instead of the
+	// instance, if set
+	nextHopIlb string
+	// forceNextHopInstance routes via the instance even when it is in
+	// another project than the network
+	forceNextHopInstance bool
+	// nextHopRanges route the subnets they contain via a gateway or VPN
+	// tunnel instead of the instance
+	nextHopRanges []nextHopRange
+	// instanceGroup, if set, is the managed instance group the link of the
+	// instance is resolved through. While it replaces the instance, routes
+	// go to its IP, as tracked by replacingInstance.
+	instanceGroup     *instanceGroup
+	replacingInstance bool
+	description       *template.Template
+	clusterName       string
+	// recorder records route changes as events, nil drops them
+	recorder subnet.EventRecorder
+	// aliasIP assigns the subnets as alias IP ranges from aliasRangeName
+	// to the network interface of the instance instead of creating routes
+	aliasIP        bool
+	aliasRangeName string
+	// adoptRoutes is the AdoptRoutes of the backend config
+	adoptRoutes string
+	// recreateOutdated recreates the routes created with an older schema
+	recreateOutdated bool
+	// maxPruneFraction and forcePrune are the MaxPruneFraction and
+	// ForcePrune of the backend config
+	maxPruneFraction float64
+	forcePrune       bool
+
+	// identify the network and instance when refreshing them
+	networkName     string
+	instanceProject string
+	instanceZone    string
+	instanceName    string
+
+	// mu guards gceNetwork, gceInstance, instanceIPv6 and nicIPv6s, which
+	// are refreshed in the background, and routePriority, priorityRanges,
+	// tags and description, which change when the network is reconfigured
+	mu          sync.RWMutex
+	stopRefresh chan struct{}
+	closeOnce   sync.Once
+}
+
+// backoffPolicy controls how long pollOperationStatus waits between polls
+// of an operation and how long it waits in total before giving up.
+type backoffPolicy struct {
+	initialInterval time.Duration
+	maxInterval     time.Duration
+	multiplier      float64
+	// jitter is the fraction of the interval by which each wait is randomized
+	jitter   float64
+	deadline time.Duration
+}
+
+// defaultPollBackoff polls once a second for 100 seconds
+var defaultPollBackoff = backoffPolicy{
+	initialInterval: time.Second,
+	maxInterval:     time.Second,
+	multiplier:      1,
+	jitter:          0,
+	deadline:        100 * time.Second,
+}
+
+// defaultRetryBackoff doubles the wait between retries from one second up to
+// half a minute
+var defaultRetryBackoff = backoffPolicy{
+	initialInterval: time.Second,
+	maxInterval:     30 * time.Second,
+	multiplier:      2,
+	jitter:          0.2,
+}
+
+// next returns the interval to use after the given one
+func (b backoffPolicy) next(interval time.Duration) time.Duration {
+	next := time.Duration(float64(interval) * b.multiplier)
+	if next > b.maxInterval {
+		next = b.maxInterval
+	}
+	return next
+}
+
+// jittered randomizes interval by up to +/- jitter of its length
+func (b backoffPolicy) jittered(interval time.Duration) time.Duration {
+	if b.jitter <= 0 {
+		return interval
+	}
+	delta := b.jitter * float64(interval)
+	return time.Duration(float64(interval) - delta + rand.Float64()*2*delta)
 }
 
 // limit auth scope to just the required GCP API's
@@ -45,127 +227,1814 @@ func gceScopes() []string {
 	return []string{"https://www.googleapis.com/auth/compute"}
 }
 
-func newAPI() (*gceAPI, error) {
-	client, err := google.DefaultClient(context.TODO(), gceScopes()...)
+// newTransport returns the transport of the compute API client, configured by
+// the connection settings of cfg. Unlike http.DefaultTransport it keeps
+// enough idle connections for concurrent route writes, for long enough to
+// reuse them across reconciles.
+func newTransport(cfg *backendConfig) *http.Transport {
+	return &http.Transport{
+		Proxy: proxyFunc(cfg),
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: time.Duration(cfg.KeepAlive) * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		IdleConnTimeout:       time.Duration(cfg.IdleConnTimeout) * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+// proxyFunc returns the proxy of the requests to the compute API, those of the
+// HTTPS_PROXY and NO_PROXY environment variables unless overridden by the
+// HTTPSProxy and NoProxy of cfg
+func proxyFunc(cfg *backendConfig) func(*http.Request) (*url.URL, error) {
+	if cfg.HTTPSProxy == "" && cfg.NoProxy == "" {
+		return http.ProxyFromEnvironment
+	}
+
+	proxy := httpproxy.FromEnvironment()
+	if cfg.HTTPSProxy != "" {
+		proxy.HTTPSProxy = cfg.HTTPSProxy
+	}
+	if cfg.NoProxy != "" {
+		proxy.NoProxy = cfg.NoProxy
+	}
+	f := proxy.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return f(req.URL)
+	}
+}
+
+// newClient returns an http client sending requests with transport, authorized
+// with the service account key in credentialsFile, or with the Application
+// Default Credentials if it is empty
+func newClient(ctx context.Context, credentialsFile string, transport http.RoundTripper) (*http.Client, error) {
+	// the oauth2 clients wrap the transport of the client in ctx, which
+	// also fetches the tokens
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: transport})
+	if credentialsFile == "" {
+		return google.DefaultClient(ctx, gceScopes()...)
+	}
+
+	data, err := ioutil.ReadFile(credentialsFile)
 	if err != nil {
-		return nil, fmt.Errorf("error creating client: %v", err)
+		return nil, fmt.Errorf("error reading credentials file: %v", err)
 	}
 
-	cs, err := compute.New(client)
+	conf, err := google.JWTConfigFromJSON(data, gceScopes()...)
 	if err != nil {
-		return nil, fmt.Errorf("error creating compute service: %v", err)
+		return nil, fmt.Errorf("error parsing credentials file %v: %v", credentialsFile, err)
 	}
+	return conf.Client(ctx), nil
+}
 
-	networkName, err := networkFromMetadata()
+// gceIdentity identifies the network and instance the API manages routes for
+type gceIdentity struct {
+	// networkProject owns the network and its routes
+	networkProject  string
+	networkName     string
+	instanceProject string
+	instanceZone    string
+	instanceName    string
+	// instanceIPv6 is the next hop for IPv6 routes, if any
+	instanceIPv6 string
+}
+
+// newComputeService returns a compute service authorized with the
+// credentials in credentialsFile, which sends requests to endpoint if it is
+// set with transport, and the client it uses. Building them is expensive,
+// keep them for as long as the credentials don't change.
+func newComputeService(ctx context.Context, credentialsFile, endpoint, quotaProject string, transport http.RoundTripper) (*compute.Service, *http.Client, error) {
+	client, err := newClient(ctx, credentialsFile, transport)
 	if err != nil {
-		return nil, fmt.Errorf("error getting network metadata: %v", err)
+		return nil, nil, fmt.Errorf("error creating client: %v", err)
+	}
+	if quotaProject != "" {
+		// only the API requests are attributed, token requests are not
+		log.Infof("Attributing compute API requests to quota project %v", quotaProject)
+		client = &http.Client{Transport: &quotaProjectTransport{base: client.Transport, project: quotaProject}}
 	}
 
-	prj, err := projectFromMetadata()
+	cs, err := compute.New(client)
 	if err != nil {
-		return nil, fmt.Errorf("error getting project: %v", err)
+		return nil, nil, fmt.Errorf("error creating compute service: %v", err)
+	}
+
+	if endpoint != "" {
+		// the service appends paths to the base path as is
+		if !strings.HasSuffix(endpoint, "/") {
+			endpoint += "/"
+		}
+		log.Infof("Using compute API endpoint %v", endpoint)
+		cs.BasePath = endpoint
+	}
+	return cs, client, nil
+}
+
+// computeEndpoint returns the configured compute API endpoint, which
+// defaults to the one in EnvGCEComputeEndpoint
+func computeEndpoint(cfg *backendConfig) string {
+	if cfg.ComputeEndpoint != "" {
+		return cfg.ComputeEndpoint
+	}
+	return os.Getenv(EnvGCEComputeEndpoint)
+}
+
+// quotaProject returns the configured quota project, which defaults to the one
+// in EnvGCEQuotaProject
+func quotaProject(cfg *backendConfig) string {
+	if cfg.QuotaProject != "" {
+		return cfg.QuotaProject
+	}
+	return os.Getenv(EnvGCEQuotaProject)
+}
+
+// projectNumberRegexp matches project numbers, which the compute API doesn't
+// accept in place of project IDs in route and network links
+var projectNumberRegexp = regexp.MustCompile(`^[0-9]+$`)
+
+// networkProjectFromEnv returns the project ID in EnvGCENetworkProjectID,
+// without surrounding whitespace, or an error if it isn't one. It is empty if
+// the variable isn't set.
+func networkProjectFromEnv() (string, error) {
+	prj := strings.TrimSpace(os.Getenv(EnvGCENetworkProjectID))
+	switch {
+	case prj == "":
+		return "", nil
+	case projectNumberRegexp.MatchString(prj):
+		return "", fmt.Errorf("invalid %s %q: this is a project number, set the project ID instead, "+
+			"e.g. from gcloud projects describe %s --format='value(projectId)'", EnvGCENetworkProjectID, prj, prj)
+	case !projectIDRegexp.MatchString(prj):
+		return "", fmt.Errorf("invalid %s %q: not a project ID, which has 6 to 30 lowercase letters, digits and dashes and starts with a letter", EnvGCENetworkProjectID, prj)
 	}
+	return prj, nil
+}
+
+// quotaProjectTransport sets the X-Goog-User-Project header of the requests it
+// sends with base
+type quotaProjectTransport struct {
+	base    http.RoundTripper
+	project string
+}
 
-	instanceName, err := instanceNameFromMetadata()
+func (t *quotaProjectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// round trippers must not modify the request they are given
+	req = req.Clone(req.Context())
+	req.Header.Set("X-Goog-User-Project", t.project)
+	return t.base.RoundTrip(req)
+}
+
+// newAPI builds the compute service and resolves the identity from md, then
+// returns the API using them, whose waits and timeouts follow clock
+func newAPI(ctx context.Context, cfg *backendConfig, md metadataClient, clock clockwork.Clock) (*gceAPI, error) {
+	cs, client, err := newComputeService(ctx, cfg.CredentialsFile, computeEndpoint(cfg), quotaProject(cfg), newTransport(cfg))
 	if err != nil {
-		return nil, fmt.Errorf("error getting instance name: %v", err)
+		return nil, err
 	}
 
-	instanceZone, err := instanceZoneFromMetadata()
+	id, err := identityFromMetadata(md, cfg)
 	if err != nil {
-		return nil, fmt.Errorf("error getting instance zone: %v", err)
+		return nil, err
+	}
+
+	return newAPIWithService(ctx, cs, client, md, clock, id, cfg)
+}
+
+// identityFromMetadata resolves the network and instance from md, except for
+// the parts cfg overrides, which are not looked up
+func identityFromMetadata(md metadataClient, cfg *backendConfig) (gceIdentity, error) {
+	var err error
+
+	networkName := ""
+	if len(cfg.Networks) > 0 {
+		networkName = cfg.Networks[0]
+	} else if networkName, err = md.network(); err != nil {
+		return gceIdentity{}, fmt.Errorf("error getting network metadata: %v", err)
+	}
+
+	prj := cfg.Project
+	if prj == "" {
+		if prj, err = md.project(); err != nil {
+			return gceIdentity{}, fmt.Errorf("error getting project: %v", err)
+		}
+	}
+
+	instanceName := cfg.InstanceName
+	if instanceName == "" {
+		if instanceName, err = md.instanceName(); err != nil {
+			return gceIdentity{}, fmt.Errorf("error getting instance name: %v", err)
+		}
+	}
+
+	instanceZone := cfg.Zone
+	if instanceZone == "" {
+		if instanceZone, err = md.instanceZone(); err != nil {
+			return gceIdentity{}, fmt.Errorf("error getting instance zone: %v", err)
+		}
 	}
 
 	// netPrj refers to the project which owns the network being used
 	// defaults to what is read by the metadata
 	netPrj := prj
 	// has the network project been provided?
-	if v := os.Getenv(EnvGCENetworkProjectID); v != "" {
+	if v, err := networkProjectFromEnv(); err != nil {
+		return gceIdentity{}, err
+	} else if v != "" {
 		netPrj = v
 	}
 
-	gn, err := cs.Networks.Get(netPrj, networkName).Do()
+	// the compute API does not report IPv6 addresses of an instance,
+	// so read it from the metadata server instead
+	instanceIPv6, err := md.instanceIPv6()
 	if err != nil {
-		return nil, fmt.Errorf("error getting network from compute service: %v", err)
+		log.Infof("No IPv6 address found for instance %v: %v", instanceName, err)
 	}
 
-	gi, err := cs.Instances.Get(prj, instanceZone, instanceName).Do()
+	return gceIdentity{
+		networkProject:  netPrj,
+		networkName:     networkName,
+		instanceProject: prj,
+		instanceZone:    instanceZone,
+		instanceName:    instanceName,
+		instanceIPv6:    instanceIPv6,
+	}, nil
+}
+
+// newAPIWithService returns an API which uses cs to manage the routes of the
+// network and instance identified by id. client must be the client cs uses, it
+// sends the requests cs can't express, md is used to refresh the IPv6 address
+// of the instance. Backoffs, rate limiting, refreshes and timeouts follow
+// clock.
+func newAPIWithService(ctx context.Context, cs *compute.Service, client *http.Client, md metadataClient, clock clockwork.Clock, id gceIdentity, cfg *backendConfig) (*gceAPI, error) {
+	registerMetrics()
+
+	description, err := parseRouteDescription(cfg.RouteDescription)
 	if err != nil {
-		return nil, fmt.Errorf("error getting instance from compute service: %v", err)
+		return nil, err
+	}
+	priorityRanges, err := parseRoutePriorities(cfg.RoutePriorities)
+	if err != nil {
+		return nil, err
+	}
+	nextHopRanges, err := parseRouteNextHops(cfg.RouteNextHops)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := cfg.RouteNamePrefix
+	if prefix == "" {
+		prefix = defaultRouteNamePrefix
+	}
+	// with several networks, the routes for a subnet in each of them
+	// need different names, and the next hop is the NIC in that network
+	multiNetwork := len(cfg.Networks) > 1
+	if multiNetwork {
+		prefix = qualifiedRouteNamePrefix(prefix, id.networkName)
+	}
+
+	pollBackoff := defaultPollBackoff
+	if cfg.OperationTimeout > 0 {
+		pollBackoff.deadline = time.Duration(cfg.OperationTimeout) * time.Second
 	}
 
 	// if the instance project is different from the network project
 	// we need to use the ip as the next hop when creating routes
 	// cross project referencing is not allowed for instances
-	useIPNextHop := prj != netPrj
-
-	return &gceAPI{
-		project:        netPrj,
-		useIPNextHop:   useIPNextHop,
-		computeService: cs,
-		gceNetwork:     gn,
-		gceInstance:    gi,
-	}, nil
+	useIPNextHop := id.instanceProject != id.networkProject ||
+		cfg.NextHopResolution == nextHopResolutionIP
+
+	var group *instanceGroup
+	if cfg.NextHopResolution == nextHopResolutionInstanceGroup {
+		link, err := md.instanceGroupManager()
+		if err != nil {
+			return nil, fmt.Errorf("error getting the instance group of the instance: %v", err)
+		}
+		if group, err = parseInstanceGroup(link); err != nil {
+			return nil, err
+		}
+	}
+
+	api := &gceAPI{
+		networkProject:       id.networkProject,
+		useIPNextHop:         useIPNextHop,
+		computeService:       cs,
+		httpClient:           client,
+		metadata:             md,
+		instanceIPv6:         id.instanceIPv6,
+		clock:                clock,
+		pollBackoff:          pollBackoff,
+		retryBackoff:         defaultRetryBackoff,
+		maxAttempts:          cfg.MaxAttempts,
+		progressLogInterval:  time.Duration(cfg.OperationLogInterval) * time.Second,
+		waitForOperations:    cfg.OperationPollMode == operationPollModeWait,
+		routePriority:        cfg.RoutePriority,
+		priorityRanges:       priorityRanges,
+		tags:                 cfg.Tags,
+		nicIndex:             cfg.NextHopInterface,
+		matchNICByNetwork:    cfg.MatchNextHopInterfaceNetwork || multiNetwork,
+		nextHopIP:            cfg.NextHopIP,
+		dryRun:               cfg.DryRun,
+		readOnly:             cfg.ReadOnly,
+		forceNextHopInstance: cfg.ForceNextHopInstance,
+		nextHopIlb:           cfg.NextHopIlb,
+		nextHopRanges:        nextHopRanges,
+		instanceGroup:        group,
+		aliasIP:              cfg.RoutingMode == routingModeAliasIP,
+		aliasRangeName:       cfg.AliasIPRangeName,
+		adoptRoutes:          cfg.AdoptRoutes,
+		recreateOutdated:     cfg.RecreateOutdatedRoutes,
+		maxPruneFraction:     cfg.MaxPruneFraction,
+		forcePrune:           cfg.ForcePrune,
+		routeNamePrefix:      prefix,
+		routeNameReplacer:    newRouteNameReplacer(cfg.RouteNameReplacements),
+		writeLimiter:         newWriteLimiter(cfg),
+		writeConcurrency:     writeConcurrency(cfg),
+		breaker:              newCircuitBreaker(cfg, clock),
+		retryBudget:          newRetryBudget(cfg, clock),
+		description:          description,
+		clusterName:          cfg.ClusterName,
+		networkName:          id.networkName,
+		instanceProject:      id.instanceProject,
+		instanceZone:         id.instanceZone,
+		instanceName:         id.instanceName,
+		stopRefresh:          make(chan struct{}),
+	}
+
+	// the instance is only needed for its link unless routing via its IP,
+	// which it may with an instance group
+	api.skipInstanceLookup = cfg.SkipInstanceLookup && !api.routesViaNIC() && group == nil
+
+	api.gceNetwork, api.gceInstance, api.nicIPv6s, err = api.fetchResources(ctx)
+	if err != nil {
+		return nil, err
+	}
+	api.replacingInstance, err = api.resolveManagedInstance(ctx, api.gceInstance)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.RefreshInterval > 0 {
+		go api.refreshPeriodically(ctx, time.Duration(cfg.RefreshInterval)*time.Second)
+	}
+
+	return api, nil
+}
+
+// Close stops refreshing the network and instance
+func (api *gceAPI) Close() {
+	api.closeOnce.Do(func() {
+		close(api.stopRefresh)
+	})
+}
+
+func (api *gceAPI) refreshPeriodically(ctx context.Context, interval time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-api.stopRefresh:
+			return
+		case <-api.clock.After(interval):
+			if err := api.refresh(ctx); err != nil {
+				log.Errorf("Error refreshing GCE network and instance, will retry in %v: %v", interval, err)
+			}
+		}
+	}
 }
 
-func (api *gceAPI) getRoute(subnet string) (*compute.Route, error) {
-	routeName := formatRouteName(subnet)
-	return api.computeService.Routes.Get(api.project, routeName).Do()
+// refresh fetches the current network and instance
+func (api *gceAPI) refresh(ctx context.Context) error {
+	gn, gi, nicIPv6s, err := api.fetchResources(ctx)
+	if err != nil {
+		return err
+	}
+	replacing, err := api.resolveManagedInstance(ctx, gi)
+	if err != nil {
+		return err
+	}
+
+	instanceIPv6, _ := api.metadata.instanceIPv6()
+
+	api.mu.Lock()
+	if replacing && !api.replacingInstance {
+		log.Warningf("Instance group %v is replacing instance %v, routing via its IP until it is back", api.instanceGroup, gi.Name)
+	}
+	api.gceNetwork = gn
+	api.gceInstance = gi
+	api.instanceIPv6 = instanceIPv6
+	api.nicIPv6s = nicIPv6s
+	api.replacingInstance = replacing
+	api.mu.Unlock()
+	return nil
 }
 
-func (api *gceAPI) deleteRoute(subnet string) (*compute.Operation, error) {
-	routeName := formatRouteName(subnet)
-	return api.computeService.Routes.Delete(api.project, routeName).Do()
+// fetchResources gets the network and instance, and the IPv6 addresses of
+// its network interfaces, from the compute API. If skipInstanceLookup is set,
+// the instance is only described by its link.
+func (api *gceAPI) fetchResources(ctx context.Context) (*compute.Network, *compute.Instance, []string, error) {
+	gn, err := api.computeService.Networks.Get(api.networkProject, api.networkName).Context(ctx).Do()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("error getting network from compute service: %v", err)
+	}
+
+	if api.skipInstanceLookup {
+		return gn, &compute.Instance{
+			Name: api.instanceName,
+			SelfLink: fmt.Sprintf("%sprojects/%s/zones/%s/instances/%s", selfLinkBase,
+				api.instanceProject, api.instanceZone, api.instanceName),
+		}, nil, nil
+	}
+
+	gi, nicIPv6s, err := api.getInstance(ctx)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("error getting instance from compute service: %v", err)
+	}
+	return gn, gi, nicIPv6s, nil
 }
 
-func (api *gceAPI) insertRoute(subnet string) (*compute.Operation, error) {
-	log.Infof("Inserting route for subnet: %v", subnet)
-	route := &compute.Route{
-		Name:      formatRouteName(subnet),
-		DestRange: subnet,
-		Network:   api.gceNetwork.SelfLink,
-		Priority:  1000,
-		Tags:      []string{},
+// getInstance gets the instance and the IPv6 addresses of its network
+// interfaces, by index. The vendored compute client predates IPv6 network
+// interfaces, so the instance is fetched directly.
+func (api *gceAPI) getInstance(ctx context.Context) (*compute.Instance, []string, error) {
+	data, err := api.getInstanceJSON(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	gi := &compute.Instance{}
+	if err := json.Unmarshal(data, gi); err != nil {
+		return nil, nil, fmt.Errorf("error decoding instance: %v", err)
+	}
+	var ipv6 struct {
+		NetworkInterfaces []struct {
+			Ipv6Address       string `json:"ipv6Address"`
+			Ipv6AccessConfigs []struct {
+				ExternalIpv6 string `json:"externalIpv6"`
+			} `json:"ipv6AccessConfigs"`
+		} `json:"networkInterfaces"`
+	}
+	if err := json.Unmarshal(data, &ipv6); err != nil {
+		return nil, nil, fmt.Errorf("error decoding instance: %v", err)
 	}
 
-	if api.useIPNextHop {
-		if len(api.gceInstance.NetworkInterfaces) == 0 {
-			return nil, fmt.Errorf("error expected instance=%v to have network interfaces",
-				api.gceInstance.SelfLink)
+	// prefer the internal address, interfaces with only an external one
+	// are reachable by it too
+	nicIPv6s := make([]string, len(ipv6.NetworkInterfaces))
+	for i, nic := range ipv6.NetworkInterfaces {
+		nicIPv6s[i] = nic.Ipv6Address
+		if nicIPv6s[i] == "" && len(nic.Ipv6AccessConfigs) > 0 {
+			nicIPv6s[i] = nic.Ipv6AccessConfigs[0].ExternalIpv6
 		}
+	}
+	return gi, nicIPv6s, nil
+}
 
-		route.NextHopIp = api.gceInstance.NetworkInterfaces[0].NetworkIP
-	} else {
-		route.NextHopInstance = api.gceInstance.SelfLink
+// instanceLink returns the API URL of the instance
+func (api *gceAPI) instanceLink() string {
+	return api.computeService.BasePath + url.PathEscape(api.instanceProject) + "/zones/" +
+		url.PathEscape(api.instanceZone) + "/instances/" + url.PathEscape(api.instanceName)
+}
+
+// getInstanceJSON fetches the instance as returned by the API, including the
+// fields the vendored compute client doesn't know
+func (api *gceAPI) getInstanceJSON(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequest("GET", api.instanceLink(), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := api.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer googleapi.CloseBody(res)
+	if err := googleapi.CheckResponse(res); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(res.Body)
+}
+
+// routesViaNIC returns true if IPv4 routes go to the IP of one of the
+// instance's network interfaces
+func (api *gceAPI) routesViaNIC() bool {
+	return api.useIPNextHop && !api.forceNextHopInstance && api.nextHopIlb == ""
+}
+
+// ipv6Addresses are the IPv6 addresses of the instance: those of its network
+// interfaces by index, and the one of its first interface from the metadata
+// server, which is all there is if the instance isn't looked up
+type ipv6Addresses struct {
+	nics     []string
+	metadata string
+}
+
+// nextHopViaIP returns true if routes go to the IP of the instance rather
+// than its link
+func (api *gceAPI) nextHopViaIP() bool {
+	api.mu.RLock()
+	defer api.mu.RUnlock()
+	return api.useIPNextHop || api.replacingInstance
+}
+
+// resources returns the most recently fetched network and instance
+func (api *gceAPI) resources() (*compute.Network, *compute.Instance, ipv6Addresses) {
+	api.mu.RLock()
+	defer api.mu.RUnlock()
+	return api.gceNetwork, api.gceInstance, ipv6Addresses{nics: api.nicIPv6s, metadata: api.instanceIPv6}
+}
+
+func (api *gceAPI) getRoute(ctx context.Context, subnet string) (*compute.Route, error) {
+	if err := validateSubnet(subnet); err != nil {
+		return nil, err
+	}
+	routeName := api.routeName(subnet)
+	start := time.Now()
+	route, err := api.computeService.Routes.Get(api.networkProject, routeName).Context(ctx).Do()
+	observeAPICall("getRoute", start, err)
+	return route, err
+}
+
+// deleteRoute deletes the route for subnet. In dry-run mode no operation is
+// returned.
+func (api *gceAPI) deleteRoute(ctx context.Context, subnet string) (*compute.Operation, error) {
+	if err := validateSubnet(subnet); err != nil {
+		return nil, err
+	}
+	return api.deleteNamedRoute(ctx, api.routeName(subnet), subnet)
+}
+
+// deleteNamedRoute deletes the route routeName for subnet, which needn't be
+// named by flannel, like deleteRoute
+func (api *gceAPI) deleteNamedRoute(ctx context.Context, routeName, subnet string) (*compute.Operation, error) {
+	fields := api.logFields(&compute.Route{Name: routeName, DestRange: subnet})
+	if api.readOnly {
+		return nil, fmt.Errorf("not deleting route %s in read-only mode", fields)
+	}
+	if api.dryRun {
+		logger.V(1).Infof("Dry run: not deleting route %s", fields)
+		return nil, nil
+	}
+	logger.V(1).Infof("Deleting route %s", fields)
+	if err := api.waitForWrite(ctx); err != nil {
+		return nil, err
+	}
+	probe, err := api.breaker.wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var operation *compute.Operation
+	err = api.withRetries(ctx, "deleting route "+routeName, func() error {
+		var err error
+		start := time.Now()
+		operation, err = api.computeService.Routes.Delete(api.networkProject, routeName).Context(ctx).Do()
+		observeAPICall("deleteRoute", start, err)
+		return err
+	})
+	api.breaker.done(probe, err)
+	if isNotFound(err) {
+		// deleted out of band or by an earlier attempt, which is what
+		// we want
+		logger.V(2).Infof("Route %s was already deleted", fields)
+		return nil, nil
+	}
+	return operation, err
+}
+
+// insertRoute creates the route for subnet. If an identical route already
+// exists, or in dry-run mode, no operation is returned.
+func (api *gceAPI) insertRoute(ctx context.Context, subnet string) (*compute.Operation, error) {
+	if err := validateSubnet(subnet); err != nil {
+		return nil, err
+	}
+	planned, err := api.planRoute(subnet)
+	if err != nil {
+		return nil, err
+	}
+	return api.insertPlannedRoute(ctx, planned)
+}
+
+// insertPlannedRoute creates planned. If an identical route already exists,
+// or in dry-run mode, no operation is returned.
+func (api *gceAPI) insertPlannedRoute(ctx context.Context, planned *route) (*compute.Operation, error) {
+	route := planned.toCompute()
+
+	fields := api.logFields(route)
+	if api.readOnly {
+		return nil, fmt.Errorf("not inserting route %s in read-only mode", fields)
+	}
+	if api.dryRun {
+		logger.V(1).Infof("Dry run: not inserting route %s", fields)
+		return nil, nil
+	}
+	logger.V(1).Infof("Inserting route %s", fields)
+	logger.V(2).Infof("Route %s has priority %d, tags %v and description %q", route.Name, route.Priority, route.Tags, route.Description)
+	if err := api.waitForWrite(ctx); err != nil {
+		return nil, err
+	}
+	probe, err := api.breaker.wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var operation *compute.Operation
+	err = api.withRetries(ctx, "inserting route "+route.Name, func() error {
+		var err error
+		start := time.Now()
+		if planned.nextHop.ilb != "" {
+			operation, err = api.insertRouteJSON(ctx, route, planned.nextHop.ilb)
+		} else {
+			operation, err = api.computeService.Routes.Insert(api.networkProject, route).Context(ctx).Do()
+		}
+		observeAPICall("insertRoute", start, err)
+		return err
+	})
+	api.breaker.done(probe, err)
+	if apiError, ok := err.(*googleapi.Error); ok && apiError.Code == http.StatusConflict {
+		// the route may have been created by a previous run which
+		// didn't live long enough to see the operation complete
+		existing, getErr := api.getRoute(ctx, planned.destRange)
+		if getErr != nil {
+			return nil, fmt.Errorf("error getting existing route %v: %v", route.Name, getErr)
+		}
+
+		if !routeFromCompute(existing).sameTarget(planned) {
+			return nil, fmt.Errorf("conflicting route %v already exists: dest range %v via %v%v, expected %v via %v%v",
+				route.Name, existing.DestRange, existing.NextHopIp, existing.NextHopInstance,
+				route.DestRange, route.NextHopIp, route.NextHopInstance)
+		}
+
+		logger.V(2).Infof("Route already exists %s", fields)
+		return nil, nil
+	}
+	if err != nil {
+		err = wrapRateLimitError(err)
+		if _, ok := err.(*RateLimitError); !ok && api.forceNextHopInstance && api.useIPNextHop {
+			return nil, fmt.Errorf("%v (ForceNextHopInstance routes via instance %v from project %v, "+
+				"which requires the organization to allow cross-project instance next hops; "+
+				"unset it to route via the instance IP instead)", err, route.NextHopInstance, api.networkProject)
+		}
+		return nil, err
+	}
+	return operation, nil
+}
+
+// planRoute returns the route flannel wants for subnet
+func (api *gceAPI) planRoute(subnet string) (*route, error) {
+	gn, gi, ipv6 := api.resources()
+	hop, err := api.nextHop(gn, gi, ipv6, subnet)
+	if err != nil {
+		return nil, err
+	}
+	return api.planRouteVia(gn, subnet, hop, gi.Name)
+}
+
+// planRouteVia returns the route for subnet in gn to hop, created for
+// instance
+func (api *gceAPI) planRouteVia(gn *compute.Network, subnet string, hop routeNextHop, instance string) (*route, error) {
+	priority, tags, description := api.routeSettings(subnet)
+	r := &route{
+		name:      api.routeName(subnet),
+		destRange: subnet,
+		network:   gn.SelfLink,
+		nextHop:   hop,
+		priority:  priority,
+		tags:      tags,
+		owner:     &routeOwner{Cluster: api.clusterName, Node: instance, Version: version.Version, Schema: routeSchemaVersion},
 	}
 
-	return api.computeService.Routes.Insert(api.project, route).Do()
+	if description != nil {
+		var buf bytes.Buffer
+		data := routeDescriptionData{
+			Instance: instance,
+			Cluster:  api.clusterName,
+			Subnet:   subnet,
+			Network:  gn.Name,
+		}
+		if err := description.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("error formatting description of route %v: %v", r.name, err)
+		}
+		r.description = buf.String()
+	}
+	return r, nil
 }
 
-func (api *gceAPI) pollOperationStatus(operationName string) error {
-	for i := 0; i < 100; i++ {
-		operation, err := api.computeService.GlobalOperations.Get(api.project, operationName).Do()
+// nextHop returns the next hop of the route for subnet
+func (api *gceAPI) nextHop(gn *compute.Network, gi *compute.Instance, ipv6 ipv6Addresses, subnet string) (routeNextHop, error) {
+	if hop, ok := routeNextHopOf(subnet, api.nextHopRanges); ok {
+		return hop, nil
+	}
+	switch {
+	case api.nextHopIlb != "":
+		return routeNextHop{ilb: api.nextHopIlb}, nil
+
+	case api.forceNextHopInstance:
+		// the instance must be referenced by its full link from
+		// another project
+		return routeNextHop{instance: gi.SelfLink}, nil
+
+	case api.nextHopViaIP() && isIPv6(subnet):
+		ip, err := api.nextHopIPv6(gn, gi, ipv6)
 		if err != nil {
-			return fmt.Errorf("error fetching operation status: %v", err)
+			return routeNextHop{}, fmt.Errorf("%v for subnet %v", err, subnet)
 		}
+		return routeNextHop{ip: ip}, nil
 
-		if operation.Error != nil {
-			return fmt.Errorf("error running operation: %v", operation.Error)
+	case api.nextHopViaIP():
+		nic, err := api.nextHopInterface(gn, gi)
+		if err != nil {
+			return routeNextHop{}, err
 		}
+		return routeNextHop{ip: nic.NetworkIP}, nil
+
+	default:
+		return routeNextHop{instance: gi.SelfLink}, nil
+	}
+}
 
-		if i%5 == 0 {
-			log.Infof("%v operation status: %v waiting for completion...", operation.OperationType, operation.Status)
+// nextHopIPv6 returns the IPv6 address IPv6 routes go to: that of the network
+// interface IPv4 routes go to if it has one, otherwise that of the first
+// interface in the network with one, otherwise the one from the metadata
+// server
+func (api *gceAPI) nextHopIPv6(gn *compute.Network, gi *compute.Instance, ipv6 ipv6Addresses) (string, error) {
+	nicIPv6 := func(i int) string {
+		if i < len(ipv6.nics) {
+			return ipv6.nics[i]
 		}
+		return ""
+	}
 
-		if operation.Status == "DONE" {
-			return nil
+	if selected, err := api.nextHopInterface(gn, gi); err == nil {
+		for i, nic := range gi.NetworkInterfaces {
+			if nic == selected && nicIPv6(i) != "" {
+				return nicIPv6(i), nil
+			}
+		}
+	}
+	for i, nic := range gi.NetworkInterfaces {
+		if sameLink(nic.Network, gn.SelfLink) && nicIPv6(i) != "" {
+			return nicIPv6(i), nil
+		}
+	}
+	if ipv6.metadata != "" {
+		return ipv6.metadata, nil
+	}
+	return "", fmt.Errorf("error expected instance=%v to have an IPv6 address, none of its %d network interfaces has one",
+		gi.SelfLink, len(gi.NetworkInterfaces))
+}
+
+// routePointsHere returns true if route's next hop is the one insertRoute
+// would use for it now
+func (api *gceAPI) routePointsHere(route *compute.Route) (bool, error) {
+	gn, gi, ipv6 := api.resources()
+	hop, err := api.nextHop(gn, gi, ipv6, route.DestRange)
+	if err != nil {
+		return false, err
+	}
+	return hop.matches(routeFromCompute(route).nextHop), nil
+}
+
+// routeSettings returns the priority, tags and description template of the
+// routes for subnet inserted from now on
+func (api *gceAPI) routeSettings(subnet string) (int64, []string, *template.Template) {
+	api.mu.RLock()
+	defer api.mu.RUnlock()
+
+	return routePriorityOf(subnet, api.routePriority, api.priorityRanges), api.tags, api.description
+}
+
+// setRouteSettings changes the priorities, tags and description template of
+// the routes inserted from now on
+func (api *gceAPI) setRouteSettings(priority int64, priorityRanges []priorityRange, tags []string, description *template.Template) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	api.routePriority, api.priorityRanges, api.tags, api.description = priority, priorityRanges, tags, description
+}
+
+// routeUpToDate returns true if route points here and has the priority and
+// tags insertRoute would give it now. Descriptions only apply to new routes,
+// unless recreateOutdated recreates those created with an older schema.
+func (api *gceAPI) routeUpToDate(route *compute.Route) (bool, error) {
+	ok, err := api.routePointsHere(route)
+	if err != nil || !ok {
+		return false, err
+	}
+	if api.recreateOutdated && routeOutdated(route) {
+		return false, nil
+	}
+	priority, tags, _ := api.routeSettings(route.DestRange)
+	return route.Priority == priority && sameStrings(route.Tags, tags), nil
+}
+
+// sameLink returns true if a and b refer to the same resource. GCE returns
+// full URLs, but accepts and may be given partial links or bare names.
+func sameLink(a, b string) bool {
+	a, b = partialLink(a), partialLink(b)
+	if !strings.Contains(a, "/") || !strings.Contains(b, "/") {
+		return path.Base(a) == path.Base(b)
+	}
+	return a == b
+}
+
+// partialLink strips everything before "projects/" from link
+func partialLink(link string) string {
+	if i := strings.Index(link, "projects/"); i >= 0 {
+		return link[i:]
+	}
+	return link
+}
+
+// repairRoute makes sure the route for subnet exists and points at this
+// instance, recreating it if its next hop drifted, e.g. because the instance
+// IP changed, or its priority or tags no longer match the config. It returns
+// true if the route was changed, and the state of the route: present once
+// repaired, otherwise what getRoute found. With recreateOutdated, routes
+// created with an older schema are recreated too.
+func (api *gceAPI) repairRoute(ctx context.Context, subnet string) (backend.RouteState, bool, error) {
+	route, err := api.getRoute(ctx, subnet)
+	if err != nil && !isNotFound(err) {
+		return backend.RouteUnknown, false, fmt.Errorf("error getting route: %v", err)
+	}
+
+	state := backend.RouteAbsent
+	if route != nil {
+		ok, err := api.routeUpToDate(route)
+		if err != nil {
+			return backend.RouteUnknown, false, err
+		}
+		if ok {
+			return backend.RoutePresent, false, nil
+		}
+		state = backend.RouteDrifted
+
+		if pointsHere, _ := api.routePointsHere(route); !pointsHere {
+			logger.V(1).Infof("Repairing route whose next hop drifted %s", api.logFields(route))
+		} else if api.recreateOutdated && routeOutdated(route) {
+			logger.V(1).Infof("Recreating route created by an older flannel %s", api.logFields(route))
+		} else {
+			logger.V(1).Infof("Recreating route whose priority or tags changed %s", api.logFields(route))
+		}
+		operation, err := api.deleteRoute(ctx, subnet)
+		if err == nil && operation != nil {
+			err = api.pollOperationStatus(ctx, operation)
+		}
+		api.recordDelete(ctx, subnet, err)
+		if err != nil {
+			return state, false, fmt.Errorf("error deleting drifted route: %v", err)
+		}
+	} else {
+		adopted, err := api.adoptRoute(ctx, subnet)
+		if err != nil {
+			return backend.RouteUnknown, false, fmt.Errorf("error adopting route: %v", err)
+		}
+		if adopted {
+			return backend.RoutePresent, api.adoptRoutes == adoptRoutesRecreate, nil
 		}
-		time.Sleep(time.Second)
+		logger.V(1).Infof("Repairing missing route %s", api.logFields(&compute.Route{Name: api.routeName(subnet), DestRange: subnet}))
 	}
 
-	return fmt.Errorf("timeout waiting for operation to finish")
+	operation, err := api.insertRoute(ctx, subnet)
+	if err == nil && operation != nil {
+		err = api.pollOperationStatus(ctx, operation)
+	}
+	api.recordInsert(ctx, subnet, err)
+	if err != nil {
+		// the drifted route is gone by now
+		return backend.RouteAbsent, false, fmt.Errorf("error inserting repaired route: %v", err)
+	}
+	return backend.RoutePresent, true, nil
+}
+
+// checkRoute returns the state of the route for subnet, or in alias IP mode of
+// its alias IP range, without changing it. Routes which are absent or don't
+// point at this instance are returned with an error.
+func (api *gceAPI) checkRoute(ctx context.Context, subnet string) (backend.RouteState, error) {
+	if api.aliasIP {
+		ok, err := api.hasAliasRange(ctx, subnet)
+		if err != nil {
+			return backend.RouteUnknown, err
+		}
+		if !ok {
+			return backend.RouteAbsent, fmt.Errorf("alias IP range %v is not assigned to instance %v", subnet, api.instanceName)
+		}
+		return backend.RoutePresent, nil
+	}
+
+	route, err := api.getRoute(ctx, subnet)
+	if isNotFound(err) && api.adoptRoutes != "" {
+		// an equivalent route flannel didn't create will do
+		adopted, findErr := api.findEquivalentRoute(ctx, subnet)
+		if findErr != nil {
+			return backend.RouteUnknown, findErr
+		}
+		if adopted != nil {
+			return backend.RoutePresent, nil
+		}
+	}
+	if isNotFound(err) {
+		return backend.RouteAbsent, fmt.Errorf("route %v for subnet %v does not exist", api.routeName(subnet), subnet)
+	}
+	if err != nil {
+		return backend.RouteUnknown, fmt.Errorf("error getting route: %v", err)
+	}
+	ok, err := api.routePointsHere(route)
+	if err != nil {
+		return backend.RouteUnknown, err
+	}
+	if !ok {
+		return backend.RouteDrifted, fmt.Errorf("route %v for subnet %v does not point at this instance", route.Name, subnet)
+	}
+	return backend.RoutePresent, nil
+}
+
+// insertRouteJSON inserts route with ilb as its next hop. The vendored compute
+// client predates load balancer next hops, so the request is sent directly.
+func (api *gceAPI) insertRouteJSON(ctx context.Context, route *compute.Route, ilb string) (*compute.Operation, error) {
+	data, err := json.Marshal(route)
+	if err != nil {
+		return nil, err
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return nil, err
+	}
+	body["nextHopIlb"] = ilb
+	if data, err = json.Marshal(body); err != nil {
+		return nil, err
+	}
+
+	u := api.computeService.BasePath + url.PathEscape(api.networkProject) + "/global/routes"
+	req, err := http.NewRequest("POST", u, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := api.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer googleapi.CloseBody(res)
+	if err := googleapi.CheckResponse(res); err != nil {
+		return nil, err
+	}
+
+	operation := &compute.Operation{}
+	if err := json.NewDecoder(res.Body).Decode(operation); err != nil {
+		return nil, fmt.Errorf("error decoding operation: %v", err)
+	}
+	return operation, nil
+}
+
+// listFlannelRoutes returns all the routes in the project whose name has
+// the flannel prefix
+func (api *gceAPI) listFlannelRoutes(ctx context.Context) ([]*compute.Route, error) {
+	var routes []*compute.Route
+	filter := fmt.Sprintf("name eq %s.*", api.routeNamePrefix)
+	err := api.computeService.Routes.List(api.networkProject).Filter(filter).Pages(ctx, func(page *compute.RouteList) error {
+		for _, route := range page.Items {
+			// the filter is a regular expression, don't rely on it alone
+			if strings.HasPrefix(route.Name, api.routeNamePrefix) {
+				routes = append(routes, route)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing routes: %v", err)
+	}
+	return routes, nil
+}
+
+// nextHopInterface returns the network interface of the instance whose IP
+// is used as the next hop
+func (api *gceAPI) nextHopInterface(gn *compute.Network, gi *compute.Instance) (*compute.NetworkInterface, error) {
+	nics := gi.NetworkInterfaces
+	if len(nics) == 0 {
+		return nil, fmt.Errorf("error expected instance=%v to have network interfaces",
+			gi.SelfLink)
+	}
+
+	if api.nextHopIP != "" {
+		for _, nic := range nics {
+			if nic.NetworkIP != api.nextHopIP {
+				continue
+			}
+			if !sameLink(nic.Network, gn.SelfLink) {
+				return nil, fmt.Errorf("error network interface of instance=%v with next hop IP %v is in network %v, not %v",
+					gi.SelfLink, api.nextHopIP, nic.Network, gn.SelfLink)
+			}
+			return nic, nil
+		}
+		return nil, fmt.Errorf("error next hop IP %v is not the IP of any network interface of instance=%v, which has %v",
+			api.nextHopIP, gi.SelfLink, strings.Join(nicIPs(nics), ", "))
+	}
+
+	if api.matchNICByNetwork {
+		for _, nic := range nics {
+			if sameLink(nic.Network, gn.SelfLink) {
+				return nic, nil
+			}
+		}
+		return nil, fmt.Errorf("error expected instance=%v to have a network interface in network %v",
+			gi.SelfLink, gn.SelfLink)
+	}
+
+	if api.nicIndex >= len(nics) {
+		return nil, fmt.Errorf("error network interface %d requested but instance=%v has %d network interfaces",
+			api.nicIndex, gi.SelfLink, len(nics))
+	}
+	return nics[api.nicIndex], nil
+}
+
+// cleanupRoutes deletes the routes for subnets which still point at this
+// instance, one after the other until ctx is done, and returns the subnets
+// whose routes may be left. Routes pointing elsewhere, e.g. because the
+// subnet was leased to another node since, are left alone.
+func (api *gceAPI) cleanupRoutes(ctx context.Context, subnets []string) []string {
+	var left []string
+	for i, subnet := range subnets {
+		if ctx.Err() != nil {
+			return append(left, subnets[i:]...)
+		}
+		if err := api.cleanupRoute(ctx, subnet); err != nil {
+			log.Errorf("Error deleting route %s: %v", api.logFields(&compute.Route{Name: api.routeName(subnet), DestRange: subnet}), err)
+			left = append(left, subnet)
+		}
+	}
+	return left
+}
+
+// cleanupRoute deletes the route for subnet if it points at this instance
+func (api *gceAPI) cleanupRoute(ctx context.Context, subnet string) error {
+	route, err := api.getRoute(ctx, subnet)
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error getting route: %v", err)
+	}
+	ok, err := api.routePointsHere(route)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		logger.V(1).Infof("Leaving route which no longer points at this instance %s", api.logFields(route))
+		return nil
+	}
+
+	operation, err := api.deleteRoute(ctx, subnet)
+	if err == nil && operation != nil {
+		err = api.pollOperationStatus(ctx, operation)
+	}
+	api.recordDelete(ctx, subnet, err)
+	return err
+}
+
+// checkInstanceNetwork returns an error unless the instance has a network
+// interface in gn, e.g. because a Shared VPC network was configured which the
+// instance isn't attached to, so that routes to it couldn't reach the pods.
+// Routes via a load balancer don't go to the instance, and without looking the
+// instance up its interfaces aren't known, so neither is checked.
+func (api *gceAPI) checkInstanceNetwork(gn *compute.Network, gi *compute.Instance) error {
+	if api.nextHopIlb != "" || api.skipInstanceLookup {
+		return nil
+	}
+	var networks []string
+	for _, nic := range gi.NetworkInterfaces {
+		if sameLink(nic.Network, gn.SelfLink) {
+			return nil
+		}
+		networks = append(networks, nic.Network)
+	}
+	return fmt.Errorf("instance %v has no network interface in network %v, only in %v: check the network name and project, e.g. the host project of a Shared VPC",
+		gi.SelfLink, gn.SelfLink, networks)
+}
+
+// nicIPs returns the IPs of nics
+func nicIPs(nics []*compute.NetworkInterface) []string {
+	var ips []string
+	for _, nic := range nics {
+		ips = append(ips, nic.NetworkIP)
+	}
+	return ips
+}
+
+// pruneOrphanedRoutes deletes the routes created by flannel in the network
+// whose subnets are not in activeSubnets. It deletes none if they are more
+// than maxPruneFraction of the flannel routes, unless forcePrune is set.
+func (api *gceAPI) pruneOrphanedRoutes(ctx context.Context, activeSubnets []string) error {
+	routes, err := api.listFlannelRoutes(ctx)
+	if err != nil {
+		return err
+	}
+
+	// the routes of active subnets are kept whichever node they go to,
+	// each node manages its own
+	desired := make(map[string]*route)
+	for _, sn := range activeSubnets {
+		if _, ipn, err := net.ParseCIDR(sn); err == nil {
+			sn = ipn.String()
+		}
+		desired[sn] = nil
+	}
+	d := api.diffRoutes(desired, routes, sameRouteTarget)
+	for _, route := range d.remove {
+		logger.V(2).Infof("Found orphaned route %s", api.logFields(route))
+	}
+
+	if err := api.checkPruneFraction(len(d.remove), len(d.remove)+len(d.unchanged), "lease list"); err != nil {
+		return err
+	}
+
+	if _, _, err := api.applyRouteDiff(ctx, d); err != nil {
+		return fmt.Errorf("failed to delete orphaned routes: %v", err)
+	}
+	return nil
+}
+
+// checkPruneFraction returns an error if pruning would delete more than
+// maxPruneFraction of the total flannel routes, as the list of subnets it was
+// given, of which source names the kind, is more likely incomplete than most
+// of them gone. With forcePrune, it logs a warning instead.
+func (api *gceAPI) checkPruneFraction(deletes, total int, source string) error {
+	if api.maxPruneFraction <= 0 || float64(deletes) <= api.maxPruneFraction*float64(total) {
+		return nil
+	}
+	if !api.forcePrune {
+		return fmt.Errorf("refusing to delete %d of the %d flannel routes, more than MaxPruneFraction %v of them, "+
+			"the %s may be incomplete (set ForcePrune to delete them anyway)", deletes, total, api.maxPruneFraction, source)
+	}
+	log.Warningf("Deleting %d of the %d flannel routes, more than MaxPruneFraction %v of them, as ForcePrune is set", deletes, total, api.maxPruneFraction)
+	return nil
+}
+
+// ownsRoute returns true if route was created by flannel for the cluster of
+// api, according to its description. Routes created before the owner was
+// recorded are assumed to be, as their name has the route name prefix.
+func (api *gceAPI) ownsRoute(route *compute.Route) bool {
+	owner, _ := decodeRouteDescription(route.Description)
+	if owner == nil || owner.Cluster == api.clusterName {
+		return true
+	}
+	logger.V(1).Infof("Leaving route of cluster %q alone %s", owner.Cluster, api.logFields(route))
+	return false
+}
+
+// pruneOwnStaleRoutes deletes the routes created by flannel in the network
+// which point at this instance but are not for ownSubnets, e.g. because the
+// node was given another subnet
+func (api *gceAPI) pruneOwnStaleRoutes(ctx context.Context, ownSubnets []string) error {
+	if api.nextHopIlb != "" {
+		// routes via the load balancer don't tell which instance they are for
+		return nil
+	}
+
+	own := make(map[string]bool)
+	for _, sn := range ownSubnets {
+		own[api.routeName(sn)] = true
+	}
+
+	routes, err := api.listFlannelRoutes(ctx)
+	if err != nil {
+		return err
+	}
+
+	gn, _, _ := api.resources()
+	var subnets []string
+	for _, route := range routes {
+		if route.Network != gn.SelfLink || !api.ownsRoute(route) {
+			continue
+		}
+		if route.Name != api.routeName(route.DestRange) || own[route.Name] || !api.pointsAtInstance(route) {
+			continue
+		}
+		logger.V(1).Infof("Deleting stale route of this instance %s", api.logFields(route))
+		subnets = append(subnets, route.DestRange)
+	}
+
+	if err := api.deleteRoutes(ctx, subnets); err != nil {
+		return fmt.Errorf("failed to delete stale routes of this instance: %v", err)
+	}
+	return nil
+}
+
+// pointsAtInstance returns true if route goes to this instance, by its link or
+// by the IP of one of its network interfaces, whichever next hop flannel uses
+// now
+func (api *gceAPI) pointsAtInstance(route *compute.Route) bool {
+	_, gi, ipv6 := api.resources()
+	switch {
+	case route.NextHopInstance != "":
+		return sameLink(route.NextHopInstance, gi.SelfLink)
+	case route.NextHopIp == "":
+		return false
+	case route.NextHopIp == ipv6.metadata:
+		return true
+	}
+	for i, nic := range gi.NetworkInterfaces {
+		if nic.NetworkIP == route.NextHopIp || (i < len(ipv6.nics) && ipv6.nics[i] == route.NextHopIp) {
+			return true
+		}
+	}
+	return false
+}
+
+// deleteRoutesForInstance deletes the flannel routes in the network whose
+// next hop is hop, an instance or an IP, whatever their subnet, e.g. those of
+// a node being decommissioned. It returns the subnets whose routes were
+// deleted, none unless all of them were.
+func (api *gceAPI) deleteRoutesForInstance(ctx context.Context, hop routeNextHop) ([]string, error) {
+	routes, err := api.listFlannelRoutes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	gn, _, _ := api.resources()
+	var subnets []string
+	for _, route := range routes {
+		// only touch routes whose name flannel would have generated
+		if route.Network != gn.SelfLink || route.Name != api.routeName(route.DestRange) || !api.ownsRoute(route) {
+			continue
+		}
+		if !hop.matches(routeFromCompute(route).nextHop) {
+			continue
+		}
+		logger.V(1).Infof("Deleting route of %s %s", hop, api.logFields(route))
+		subnets = append(subnets, route.DestRange)
+	}
+	sort.Strings(subnets)
+
+	if err := api.deleteRoutes(ctx, subnets); err != nil {
+		return nil, fmt.Errorf("failed to delete the routes of %s: %v", hop, err)
+	}
+	return subnets, nil
+}
+
+// deleteRoutes deletes the routes for subnets, writeConcurrency at once, and
+// waits for the operations to complete. Failures are returned together as a
+// multiError.
+func (api *gceAPI) deleteRoutes(ctx context.Context, subnets []string) error {
+	return runWorkers(ctx, len(subnets), api.writeConcurrency, func(ctx context.Context, i int) error {
+		operation, err := api.deleteRoute(ctx, subnets[i])
+		if err == nil && operation != nil {
+			err = api.pollOperationStatus(ctx, operation)
+		}
+		api.recordDelete(ctx, subnets[i], err)
+		if err != nil {
+			log.Errorf("Error deleting route %s: %v", api.logFields(&compute.Route{Name: api.routeName(subnets[i]), DestRange: subnets[i]}), err)
+			return fmt.Errorf("error deleting route for subnet %v: %v", subnets[i], err)
+		}
+		return nil
+	})
+}
+
+// pollOperationStatus waits for operation to complete. Each poll after the
+// first takes from the retry budget, it gives up once that is exhausted.
+func (api *gceAPI) pollOperationStatus(ctx context.Context, operation *compute.Operation) (err error) {
+	callStart := time.Now()
+	defer func() { observeAPICall("pollOperationStatus", callStart, err) }()
+	get := api.operationPoller(operation)
+	start := api.clock.Now()
+	lastLog := start
+	interval := api.pollBackoff.initialInterval
+	for polls := 0; ; polls++ {
+		if polls > 0 && !api.retryBudget.allow() {
+			log.Warningf("Not polling operation %s again as the retry budget is exhausted", operation.Name)
+			return errRetryBudgetExhausted
+		}
+		operation, waited, err := get(ctx)
+		if err != nil {
+			if rlErr, ok := wrapRateLimitError(err).(*RateLimitError); ok {
+				return rlErr
+			}
+			return fmt.Errorf("error fetching operation status: %v", err)
+		}
+
+		if operation.Error != nil {
+			return fmt.Errorf("error running operation: %v", operation.Error)
+		}
+
+		now := api.clock.Now()
+		if operation.Status == "DONE" {
+			logger.V(2).Infof("Operation DONE operation=%s type=%s target=%s elapsed=%v",
+				operation.Name, operation.OperationType, operation.TargetLink, now.Sub(start))
+			return nil
+		}
+
+		if api.progressLogInterval > 0 && now.Sub(lastLog) >= api.progressLogInterval {
+			logger.V(2).Infof("Waiting for operation to complete operation=%s type=%s status=%s target=%s elapsed=%v",
+				operation.Name, operation.OperationType, operation.Status, operation.TargetLink, now.Sub(start))
+			lastLog = now
+		}
+
+		timeout := func() error {
+			return &OperationTimeoutError{Operation: operation.Name, Status: operation.Status, Elapsed: now.Sub(start), Timeout: api.pollBackoff.deadline}
+		}
+		if waited {
+			// the API already waited for the operation, ask again
+			// right away
+			if now.Sub(start) >= api.pollBackoff.deadline {
+				return timeout()
+			}
+			continue
+		}
+
+		wait := api.pollBackoff.jittered(interval)
+		if api.clock.Now().Add(wait).Sub(start) >= api.pollBackoff.deadline {
+			// the next poll would be past the deadline
+			return timeout()
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-api.clock.After(wait):
+		}
+		interval = api.pollBackoff.next(interval)
+	}
+}
+
+// operationPoller returns a function fetching the state of operation, and
+// whether the API waited for it to change first. Operations are waited for if
+// waitForOperations is set and fetched right away otherwise, or if the API
+// doesn't support waiting.
+func (api *gceAPI) operationPoller(operation *compute.Operation) func(ctx context.Context) (*compute.Operation, bool, error) {
+	get := api.operationGetter(operation)
+	return func(ctx context.Context) (*compute.Operation, bool, error) {
+		if api.waitForOperations && atomic.LoadInt32(&api.waitUnavailable) == 0 {
+			start := time.Now()
+			op, err := api.waitOperation(ctx, operation)
+			observeAPICall("waitOperation", start, err)
+			if !isWaitUnavailable(err) {
+				return op, true, err
+			}
+			if atomic.CompareAndSwapInt32(&api.waitUnavailable, 0, 1) {
+				log.Warningf("Waiting for operations is not supported, polling them instead: %v", err)
+			}
+		}
+		op, err := get(ctx)
+		return op, false, err
+	}
+}
+
+// waitOperation waits on the server for operation to complete, for up to
+// about a minute, and returns its state. The vendored compute client predates
+// the wait method, so the request is sent directly.
+func (api *gceAPI) waitOperation(ctx context.Context, operation *compute.Operation) (*compute.Operation, error) {
+	project := api.networkProject
+	if p := linkSegment(operation.SelfLink, "projects"); p != "" {
+		project = p
+	}
+	scope, location := operationScope(operation)
+	u := api.computeService.BasePath + url.PathEscape(project)
+	if scope == "" {
+		u += "/global"
+	} else {
+		u += "/" + scope + "/" + url.PathEscape(location)
+	}
+	u += "/operations/" + url.PathEscape(operation.Name) + "/wait"
+
+	req, err := http.NewRequest("POST", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := api.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer googleapi.CloseBody(res)
+	if err := googleapi.CheckResponse(res); err != nil {
+		return nil, err
+	}
+
+	op := &compute.Operation{}
+	if err := json.NewDecoder(res.Body).Decode(op); err != nil {
+		return nil, fmt.Errorf("error decoding operation: %v", err)
+	}
+	return op, nil
+}
+
+// isWaitUnavailable returns true if err shows that the API has no wait
+// method for operations, e.g. because the endpoint doesn't implement it
+func isWaitUnavailable(err error) bool {
+	apiError, ok := err.(*googleapi.Error)
+	if !ok {
+		return false
+	}
+	switch apiError.Code {
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return true
+	}
+	return false
+}
+
+// operationGetter returns a function fetching the current state of operation
+// from the global, regional or zonal operations API, depending on its scope.
+// Operations without a scope are assumed to be global.
+func (api *gceAPI) operationGetter(operation *compute.Operation) func(ctx context.Context) (*compute.Operation, error) {
+	name := operation.Name
+	project := api.networkProject
+	scope, location := operationScope(operation)
+	if p := linkSegment(operation.SelfLink, "projects"); p != "" {
+		project = p
+	}
+
+	switch scope {
+	case "regions":
+		return func(ctx context.Context) (*compute.Operation, error) {
+			return api.computeService.RegionOperations.Get(project, location, name).Context(ctx).Do()
+		}
+	case "zones":
+		return func(ctx context.Context) (*compute.Operation, error) {
+			return api.computeService.ZoneOperations.Get(project, location, name).Context(ctx).Do()
+		}
+	default:
+		return func(ctx context.Context) (*compute.Operation, error) {
+			return api.computeService.GlobalOperations.Get(project, name).Context(ctx).Do()
+		}
+	}
+}
+
+// operationScope returns "regions" or "zones" and the region or zone of
+// regional and zonal operations, and empty strings for global operations
+func operationScope(operation *compute.Operation) (string, string) {
+	if region := linkSegment(operation.SelfLink, "regions"); region != "" {
+		return "regions", region
+	}
+	if zone := linkSegment(operation.SelfLink, "zones"); zone != "" {
+		return "zones", zone
+	}
+	if operation.Region != "" {
+		return "regions", path.Base(operation.Region)
+	}
+	if operation.Zone != "" {
+		return "zones", path.Base(operation.Zone)
+	}
+	return "", ""
+}
+
+// linkSegment returns the path segment following collection in a resource
+// link such as .../projects/p/regions/r/operations/o
+func linkSegment(link, collection string) string {
+	parts := strings.Split(link, "/")
+	for i := 0; i < len(parts)-1; i++ {
+		if parts[i] == collection {
+			return parts[i+1]
+		}
+	}
+	return ""
+}
+
+// recordInsert records the outcome of creating the route for sn as an
+// event. Dry runs and cancellations are not recorded.
+func (api *gceAPI) recordInsert(ctx context.Context, sn string, err error) {
+	if api.recorder == nil || api.dryRun || ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		api.recorder.Eventf(subnet.EventTypeWarning, backend.EventRouteCreateFailed, "Failed to create GCE route %v for subnet %v in network %v: %v",
+			api.routeName(sn), sn, api.networkName, err)
+		return
+	}
+	api.recorder.Eventf(subnet.EventTypeNormal, backend.EventRouteCreated, "Created GCE route %v for subnet %v in network %v",
+		api.routeName(sn), sn, api.networkName)
+}
+
+// recordDelete records the outcome of deleting the route for sn as an
+// event. Dry runs and cancellations are not recorded.
+func (api *gceAPI) recordDelete(ctx context.Context, sn string, err error) {
+	if api.recorder == nil || api.dryRun || ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		api.recorder.Eventf(subnet.EventTypeWarning, backend.EventRouteDeleteFailed, "Failed to delete GCE route %v for subnet %v in network %v: %v",
+			api.routeName(sn), sn, api.networkName, err)
+		return
+	}
+	api.recorder.Eventf(subnet.EventTypeNormal, backend.EventRouteDeleted, "Deleted GCE route %v for subnet %v in network %v",
+		api.routeName(sn), sn, api.networkName)
+}
+
+// routeName returns the name of the route for subnet
+func (api *gceAPI) routeName(subnet string) string {
+	r := api.routeNameReplacer
+	if r == nil {
+		r = defaultRouteNameReplacer
+	}
+	return formatRouteNameWith(r, api.routeNamePrefix, subnet)
+}
+
+// DefaultRouteNameReplacements returns the replacements which turn a subnet
+// into the part of a route name after the prefix: the separators of IPv4 and
+// IPv6 addresses and the prefix length all become dashes.
+func DefaultRouteNameReplacements() map[string]string {
+	return map[string]string{".": "-", "/": "-", ":": "-"}
+}
+
+var defaultRouteNameReplacer = newRouteNameReplacer(nil)
+
+// newRouteNameReplacer returns a replacer applying replacements on top of
+// DefaultRouteNameReplacements. Longer strings are replaced first, so that
+// the result doesn't depend on map order.
+func newRouteNameReplacer(replacements map[string]string) *strings.Replacer {
+	merged := DefaultRouteNameReplacements()
+	for old, repl := range replacements {
+		merged[old] = repl
+	}
+
+	olds := make([]string, 0, len(merged))
+	for old := range merged {
+		olds = append(olds, old)
+	}
+	sort.Slice(olds, func(i, j int) bool {
+		if len(olds[i]) != len(olds[j]) {
+			return len(olds[i]) > len(olds[j])
+		}
+		return olds[i] < olds[j]
+	})
+
+	var pairs []string
+	for _, old := range olds {
+		pairs = append(pairs, old, merged[old])
+	}
+	return strings.NewReplacer(pairs...)
+}
+
+// RouteName returns the name flannel gives the route for subnet, with the
+// route name prefix and replacements of the backend config. Empty prefix
+// and nil replacements mean the defaults. This lets other tools find the
+// routes flannel creates.
+func RouteName(prefix, subnet string, replacements map[string]string) string {
+	if prefix == "" {
+		prefix = defaultRouteNamePrefix
+	}
+	return formatRouteNameWith(newRouteNameReplacer(replacements), prefix, subnet)
+}
+
+// qualifiedRouteNamePrefix returns the prefix of the names of the routes in
+// network, when routes are created in several networks. Long network names
+// are replaced by a hash, so that the hash formatRouteName may add to the
+// name still follows the whole prefix.
+func qualifiedRouteNamePrefix(prefix, network string) string {
+	qualified := prefix + network + "-"
+	if len(qualified) <= maxQualifiedRouteNamePrefixLength {
+		return qualified
+	}
+	sum := sha256.Sum256([]byte(network))
+	return prefix + hex.EncodeToString(sum[:])[:networkNameHashLength] + "-"
+}
+
+// formatRouteName returns the name of the route for subnet with the default
+// replacements
+func formatRouteName(prefix, subnet string) string {
+	return formatRouteNameWith(defaultRouteNameReplacer, prefix, subnet)
+}
+
+// formatRouteNameWith returns the name of the route for subnet. Names which
+// would be too long or invalid are shortened and suffixed with a hash of the
+// subnet.
+func formatRouteNameWith(replacer *strings.Replacer, prefix, subnet string) string {
+	if _, ipn, err := net.ParseCIDR(subnet); err == nil && strings.Contains(subnet, ":") {
+		// use the canonical form so that equivalent spellings of
+		// the same range map to the same name. IPv4-mapped ranges
+		// become IPv4 ones, spelled with dots their names would be
+		// those of the IPv6 ranges ending in the same groups.
+		subnet = ipn.String()
+	}
+	name := prefix + replacer.Replace(subnet)
+	if len(name) <= maxRouteNameLength && routeNameRegexp.MatchString(name) {
+		return name
+	}
+
+	// keep a readable part of the name and make it unique with a hash of
+	// the subnet, dropping anything that isn't allowed in a name
+	sum := sha256.Sum256([]byte(subnet))
+	hash := hex.EncodeToString(sum[:])[:routeNameHashLength]
+	readable := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' {
+			return r
+		}
+		return -1
+	}, strings.ToLower(name))
+	if max := maxRouteNameLength - routeNameHashLength - 1; len(readable) > max {
+		readable = readable[:max]
+	}
+	return strings.TrimRight(readable, "-") + "-" + hash
+}
+
+// logFields formats route as key=value pairs for log messages. Use the same
+// keys everywhere so that operators can filter the logs of many nodes by
+// route, subnet, next hop or project.
+func (api *gceAPI) logFields(route *compute.Route) string {
+	nextHop := route.NextHopIp
+	if nextHop == "" {
+		nextHop = route.NextHopInstance
+	}
+	if nextHop == "" {
+		nextHop = "-"
+	}
+	return fmt.Sprintf("route=%s subnet=%s nextHop=%s project=%s", route.Name, route.DestRange, nextHop, api.networkProject)
+}
+
+// writeConcurrency returns the configured WriteConcurrency, which defaults to
+// defaultWriteConcurrency
+func writeConcurrency(cfg *backendConfig) int {
+	if cfg.WriteConcurrency > 0 {
+		return cfg.WriteConcurrency
+	}
+	return defaultWriteConcurrency
+}
+
+// newWriteLimiter returns the limiter for route writes configured by cfg
+func newWriteLimiter(cfg *backendConfig) *rate.Limiter {
+	if cfg.WriteRateLimit <= 0 {
+		return nil
+	}
+	burst := cfg.WriteBurst
+	if burst < 1 {
+		burst = 1
+	}
+	return rate.NewLimiter(rate.Limit(cfg.WriteRateLimit), burst)
+}
+
+// waitForWrite blocks until the write limiter allows another write, or ctx
+// is done. Waits are jittered so that nodes throttled together don't retry
+// together.
+func (api *gceAPI) waitForWrite(ctx context.Context) error {
+	if api.writeLimiter == nil {
+		return nil
+	}
+
+	r := api.writeLimiter.Reserve()
+	if !r.OK() {
+		return fmt.Errorf("error waiting for the write rate limiter: burst is zero")
+	}
+	delay := r.Delay()
+	if delay <= 0 {
+		return nil
+	}
+	delay += time.Duration(rand.Int63n(int64(delay)/writeJitterFraction + 1))
+
+	select {
+	case <-ctx.Done():
+		r.Cancel()
+		return ctx.Err()
+	case <-api.clock.After(delay):
+		return nil
+	}
+}
+
+// routeDescriptionData is available to the RouteDescription template
+type routeDescriptionData struct {
+	Instance string
+	Cluster  string
+	Subnet   string
+	Network  string
+}
+
+// parseRouteDescription parses the RouteDescription template. An empty
+// template leaves routes without a description.
+func parseRouteDescription(text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	tmpl, err := template.New("description").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RouteDescription: %v", err)
+	}
+	return tmpl, nil
+}
+
+// priorityRange is the priority of the routes for the subnets in cidr
+type priorityRange struct {
+	cidr     *net.IPNet
+	priority int64
+}
+
+// parseRoutePriorities parses the RoutePriorities ranges, returning them most
+// specific first
+func parseRoutePriorities(priorities map[string]int64) ([]priorityRange, error) {
+	var ranges []priorityRange
+	seen := make(map[string]string)
+	for cidr, priority := range priorities {
+		_, ipn, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RoutePriorities range %q: %v", cidr, err)
+		}
+		if priority < 0 || priority > maxRoutePriority {
+			return nil, fmt.Errorf("invalid RoutePriorities priority %d of %v: must be between 0 and %d", priority, cidr, maxRoutePriority)
+		}
+		if other, ok := seen[ipn.String()]; ok {
+			return nil, fmt.Errorf("invalid RoutePriorities range %q: same as %q", cidr, other)
+		}
+		seen[ipn.String()] = cidr
+		ranges = append(ranges, priorityRange{cidr: ipn, priority: priority})
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		oi, _ := ranges[i].cidr.Mask.Size()
+		oj, _ := ranges[j].cidr.Mask.Size()
+		if oi != oj {
+			return oi > oj
+		}
+		return ranges[i].cidr.String() < ranges[j].cidr.String()
+	})
+	return ranges, nil
+}
+
+// routePriorityOf returns the priority of the most specific of ranges which
+// contains subnet, or def if none does
+func routePriorityOf(subnet string, def int64, ranges []priorityRange) int64 {
+	_, sn, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return def
+	}
+	ones, bits := sn.Mask.Size()
+	for _, r := range ranges {
+		rOnes, rBits := r.cidr.Mask.Size()
+		if rBits == bits && rOnes <= ones && r.cidr.Contains(sn.IP) {
+			return r.priority
+		}
+	}
+	return def
+}
+
+// nextHopRange is the gateway or VPN tunnel of the routes for the subnets in
+// cidr
+type nextHopRange struct {
+	cidr *net.IPNet
+	hop  routeNextHop
+}
+
+var (
+	gatewayLinkRegexp   = regexp.MustCompile(`(^|/)projects/[^/]+/global/gateways/[^/]+$`)
+	vpnTunnelLinkRegexp = regexp.MustCompile(`(^|/)projects/[^/]+/regions/[^/]+/vpnTunnels/[^/]+$`)
+)
+
+// parseRouteNextHops parses the RouteNextHops ranges, returning them most
+// specific first
+func parseRouteNextHops(hops map[string]string) ([]nextHopRange, error) {
+	var ranges []nextHopRange
+	seen := make(map[string]string)
+	for cidr, link := range hops {
+		_, ipn, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RouteNextHops range %q: %v", cidr, err)
+		}
+		var hop routeNextHop
+		switch {
+		case gatewayLinkRegexp.MatchString(link):
+			hop.gateway = link
+		case vpnTunnelLinkRegexp.MatchString(link):
+			hop.vpnTunnel = link
+		default:
+			return nil, fmt.Errorf("invalid RouteNextHops next hop %q of %v: must be the link of a gateway or VPN tunnel", link, cidr)
+		}
+		if other, ok := seen[ipn.String()]; ok {
+			return nil, fmt.Errorf("invalid RouteNextHops range %q: same as %q", cidr, other)
+		}
+		seen[ipn.String()] = cidr
+		ranges = append(ranges, nextHopRange{cidr: ipn, hop: hop})
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		oi, _ := ranges[i].cidr.Mask.Size()
+		oj, _ := ranges[j].cidr.Mask.Size()
+		if oi != oj {
+			return oi > oj
+		}
+		return ranges[i].cidr.String() < ranges[j].cidr.String()
+	})
+	return ranges, nil
+}
+
+// routeNextHopOf returns the next hop of the most specific of ranges which
+// contains subnet, or false if none does
+func routeNextHopOf(subnet string, ranges []nextHopRange) (routeNextHop, bool) {
+	_, sn, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return routeNextHop{}, false
+	}
+	ones, bits := sn.Mask.Size()
+	for _, r := range ranges {
+		rOnes, rBits := r.cidr.Mask.Size()
+		if rBits == bits && rOnes <= ones && r.cidr.Contains(sn.IP) {
+			return r.hop, true
+		}
+	}
+	return routeNextHop{}, false
+}
+
+// validateSubnet returns an error if subnet is not a CIDR, so that it fails
+// before reaching the API
+func validateSubnet(subnet string) error {
+	if _, _, err := net.ParseCIDR(subnet); err != nil {
+		return fmt.Errorf("invalid subnet %q: %v", subnet, err)
+	}
+	return nil
 }
 
-func formatRouteName(subnet string) string {
-	return fmt.Sprintf("flannel-%s", replacer.Replace(subnet))
+// isIPv6 returns true if subnet is an IPv6 CIDR
+func isIPv6(subnet string) bool {
+	_, ipn, err := net.ParseCIDR(subnet)
+	return err == nil && ipn.IP.To4() == nil
 }
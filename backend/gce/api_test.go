@@ -0,0 +1,1753 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package gce
+
+import (
+	"context"
+	cryptorand "crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"google.golang.org/api/compute/v1"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/subnet"
+	"github.com/coreos/flannel/version"
+)
+
+// newTestAPI returns a gceAPI whose compute service talks to handler
+func newTestAPI(t *testing.T, handler http.Handler) (*gceAPI, func()) {
+	srv := httptest.NewServer(handler)
+	cs, err := compute.New(srv.Client())
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+	cs.BasePath = srv.URL + "/"
+
+	api := &gceAPI{
+		networkProject:  "test-project",
+		computeService:  cs,
+		httpClient:      srv.Client(),
+		metadata:        &fakeMetadata{},
+		gceNetwork:      &compute.Network{SelfLink: "projects/test-project/global/networks/default"},
+		gceInstance:     &compute.Instance{SelfLink: "projects/test-project/zones/z/instances/node"},
+		clock:           clockwork.NewRealClock(),
+		pollBackoff:     defaultPollBackoff,
+		routePriority:   defaultRoutePriority,
+		routeNamePrefix: defaultRouteNamePrefix,
+	}
+	return api, srv.Close
+}
+
+func TestPollOperationStatusBackoff(t *testing.T) {
+	fc := clockwork.NewFakeClock()
+	start := fc.Now()
+
+	var polls []time.Duration
+	api, done := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		polls = append(polls, fc.Now().Sub(start))
+		status := "RUNNING"
+		if len(polls) == 5 {
+			status = "DONE"
+		}
+		writeObject(w, &compute.Operation{Name: "op", Status: status})
+	}))
+	defer done()
+
+	api.clock = fc
+	api.pollBackoff = backoffPolicy{
+		initialInterval: time.Second,
+		maxInterval:     4 * time.Second,
+		multiplier:      2,
+		deadline:        time.Minute,
+	}
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- api.pollOperationStatus(context.Background(), &compute.Operation{Name: "op"})
+	}()
+
+	waits := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second}
+	for _, d := range waits {
+		fc.BlockUntil(1)
+		fc.Advance(d)
+	}
+
+	if err := <-errCh; err != nil {
+		t.Fatalf("pollOperationStatus failed: %v", err)
+	}
+
+	expected := []time.Duration{0, time.Second, 3 * time.Second, 7 * time.Second, 11 * time.Second}
+	if len(polls) != len(expected) {
+		t.Fatalf("expected %d polls, got %d", len(expected), len(polls))
+	}
+	for i := range expected {
+		if polls[i] != expected[i] {
+			t.Errorf("poll %d: expected at %v, got %v", i, expected[i], polls[i])
+		}
+	}
+}
+
+func TestPollOperationStatusDeadline(t *testing.T) {
+	fc := clockwork.NewFakeClock()
+
+	polls := 0
+	api, done := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		polls++
+		writeObject(w, &compute.Operation{Name: "op", Status: "RUNNING"})
+	}))
+	defer done()
+
+	api.clock = fc
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- api.pollOperationStatus(context.Background(), &compute.Operation{Name: "op"})
+	}()
+
+	// the default policy sleeps between each of its 100 polls
+	for i := 0; i < 99; i++ {
+		fc.BlockUntil(1)
+		fc.Advance(time.Second)
+	}
+
+	err := <-errCh
+	timeout, ok := err.(*OperationTimeoutError)
+	if !ok {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+	if timeout.Operation != "op" || timeout.Status != "RUNNING" || timeout.Elapsed != 99*time.Second || timeout.Timeout != 100*time.Second {
+		t.Errorf("unexpected timeout error %+v", timeout)
+	}
+	if !strings.Contains(err.Error(), "operation op") || !strings.Contains(err.Error(), "after 1m39s") {
+		t.Errorf("expected the operation and elapsed time in the error, got %q", err)
+	}
+	if polls != 100 {
+		t.Errorf("expected 100 polls with the default policy, got %d", polls)
+	}
+}
+
+func TestNewAPIWithServiceClock(t *testing.T) {
+	fake := newFakeCompute()
+	fake.networks["default"] = &compute.Network{Name: "default", SelfLink: "projects/test-project/global/networks/default"}
+	fake.instances["node"] = &compute.Instance{Name: "node", SelfLink: "projects/test-project/zones/z/instances/node"}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	cs, err := compute.New(srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs.BasePath = srv.URL + "/"
+
+	id := gceIdentity{networkProject: "test-project", networkName: "default", instanceProject: "test-project", instanceZone: "z", instanceName: "node"}
+	fc := clockwork.NewFakeClock()
+	for _, tc := range []struct {
+		timeout  int
+		deadline time.Duration
+	}{
+		{0, defaultPollBackoff.deadline},
+		{defaultOperationTimeout, defaultPollBackoff.deadline},
+		{30, 30 * time.Second},
+	} {
+		api, err := newAPIWithService(context.Background(), cs, srv.Client(), &fakeMetadata{}, fc, id, &backendConfig{OperationTimeout: tc.timeout, CircuitBreakerThreshold: 1, CircuitBreakerCooldown: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if api.pollBackoff.deadline != tc.deadline {
+			t.Errorf("OperationTimeout %d: expected deadline %v, got %v", tc.timeout, tc.deadline, api.pollBackoff.deadline)
+		}
+		if api.clock != fc || api.breaker.clock != fc {
+			t.Errorf("expected the API to use the given clock")
+		}
+	}
+}
+
+func TestPollOperationStatusError(t *testing.T) {
+	api, done := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeObject(w, &compute.Operation{
+			Name:   "op",
+			Status: "DONE",
+			Error: &compute.OperationError{
+				Errors: []*compute.OperationErrorErrors{{Code: "RESOURCE_NOT_FOUND"}},
+			},
+		})
+	}))
+	defer done()
+
+	err := api.pollOperationStatus(context.Background(), &compute.Operation{Name: "op"})
+	if err == nil || !strings.Contains(err.Error(), "error running operation") {
+		t.Fatalf("expected operation error, got %v", err)
+	}
+}
+
+func TestPollOperationStatusCancel(t *testing.T) {
+	fc := clockwork.NewFakeClock()
+	api, done := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeObject(w, &compute.Operation{Name: "op", Status: "RUNNING"})
+	}))
+	defer done()
+
+	api.clock = fc
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error)
+	go func() {
+		errCh <- api.pollOperationStatus(ctx, &compute.Operation{Name: "op"})
+	}()
+
+	fc.BlockUntil(1)
+	cancel()
+
+	if err := <-errCh; err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestPollOperationStatusWait(t *testing.T) {
+	var paths []string
+	api, done := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		status := "RUNNING"
+		if len(paths) == 3 {
+			status = "DONE"
+		}
+		writeObject(w, &compute.Operation{Name: "op", Status: status})
+	}))
+	defer done()
+
+	// waits return as soon as the server responds, without sleeping on
+	// the client
+	api.clock = clockwork.NewFakeClock()
+	api.waitForOperations = true
+	if err := api.pollOperationStatus(context.Background(), &compute.Operation{Name: "op"}); err != nil {
+		t.Fatalf("pollOperationStatus failed: %v", err)
+	}
+
+	for _, path := range paths {
+		if path != "POST /test-project/global/operations/op/wait" {
+			t.Errorf("expected only waits, got %v", paths)
+			break
+		}
+	}
+	if len(paths) != 3 {
+		t.Errorf("expected 3 waits, got %v", paths)
+	}
+}
+
+func TestPollOperationStatusWaitFallback(t *testing.T) {
+	waits := 0
+	api, done := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/wait") {
+			waits++
+			writeError(w, http.StatusNotFound, "notFound")
+			return
+		}
+		writeObject(w, &compute.Operation{Name: "op", Status: "DONE"})
+	}))
+	defer done()
+
+	api.waitForOperations = true
+	for i := 0; i < 2; i++ {
+		if err := api.pollOperationStatus(context.Background(), &compute.Operation{Name: "op"}); err != nil {
+			t.Fatalf("pollOperationStatus failed: %v", err)
+		}
+	}
+	if waits != 1 {
+		t.Errorf("expected polling to be used once waiting failed, got %d waits", waits)
+	}
+}
+
+func TestInsertRoutePriority(t *testing.T) {
+	var inserted compute.Route
+	api, done := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&inserted); err != nil {
+			t.Error(err)
+		}
+		writeObject(w, &compute.Operation{Name: "op"})
+	}))
+	defer done()
+
+	api.routePriority = 900
+	if _, err := api.insertRoute(context.Background(), "10.0.1.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	if inserted.Priority != 900 {
+		t.Errorf("expected priority 900, got %d", inserted.Priority)
+	}
+}
+
+func TestInsertRoutePriorityByRange(t *testing.T) {
+	var inserted compute.Route
+	api, done := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&inserted); err != nil {
+			t.Error(err)
+		}
+		writeObject(w, &compute.Operation{Name: "op"})
+	}))
+	defer done()
+
+	var err error
+	api.priorityRanges, err = parseRoutePriorities(map[string]int64{
+		"10.0.0.0/8":     900,
+		"10.1.0.0/16":    800,
+		"10.1.2.0/24":    700,
+		"10.1.3.0/25":    600,
+		"fd00::/8":       500,
+		"fd00:1234::/32": 400,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		subnet   string
+		priority int64
+	}{
+		// the most specific range containing the subnet wins
+		{"10.0.1.0/24", 900},
+		{"10.1.1.0/24", 800},
+		{"10.1.2.0/24", 700},
+		// a range smaller than the subnet doesn't contain it
+		{"10.1.3.0/24", 800},
+		{"fd00:1234:5678::/64", 400},
+		{"fd01::/64", 500},
+		// in no range
+		{"11.0.0.0/24", defaultRoutePriority},
+		{"fe80::/64", defaultRoutePriority},
+	} {
+		if _, err := api.insertRoute(context.Background(), tc.subnet); err != nil {
+			t.Fatal(err)
+		}
+		if inserted.Priority != tc.priority {
+			t.Errorf("%v: expected priority %d, got %d", tc.subnet, tc.priority, inserted.Priority)
+		}
+	}
+}
+
+func TestInsertRouteTags(t *testing.T) {
+	var inserted map[string]interface{}
+	api, done := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inserted = nil
+		if err := json.NewDecoder(r.Body).Decode(&inserted); err != nil {
+			t.Error(err)
+		}
+		writeObject(w, &compute.Operation{Name: "op"})
+	}))
+	defer done()
+
+	if _, err := api.insertRoute(context.Background(), "10.0.1.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := inserted["tags"]; ok {
+		t.Errorf("expected no tags, got %v", inserted["tags"])
+	}
+
+	api.tags = []string{"flannel", "pool-a"}
+	if _, err := api.insertRoute(context.Background(), "10.0.1.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	tags, _ := inserted["tags"].([]interface{})
+	if len(tags) != 2 || tags[0] != "flannel" || tags[1] != "pool-a" {
+		t.Errorf("expected tags [flannel pool-a], got %v", inserted["tags"])
+	}
+}
+
+func TestInsertRouteDescription(t *testing.T) {
+	var inserted compute.Route
+	api, done := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&inserted); err != nil {
+			t.Error(err)
+		}
+		writeObject(w, &compute.Operation{Name: "op"})
+	}))
+	defer done()
+
+	api.gceInstance.Name = "node"
+	api.clusterName = "prod"
+	api.description, _ = parseRouteDescription("{{.Subnet}} for {{.Instance}} in {{.Cluster}}")
+	if _, err := api.insertRoute(context.Background(), "10.0.1.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	owner, description := decodeRouteDescription(inserted.Description)
+	if expected := "10.0.1.0/24 for node in prod"; description != expected {
+		t.Errorf("expected description %q, got %q", expected, inserted.Description)
+	}
+	if expected := (routeOwner{Cluster: "prod", Node: "node", Version: version.Version, Schema: routeSchemaVersion}); owner == nil || *owner != expected {
+		t.Errorf("expected owner %+v, got %+v", expected, owner)
+	}
+
+	api.description, _ = parseRouteDescription(defaultRouteDescription)
+	if _, err := api.insertRoute(context.Background(), "10.0.1.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	if _, description := decodeRouteDescription(inserted.Description); description != "Created by flannel on node" {
+		t.Errorf("expected description %q, got %q", "Created by flannel on node", inserted.Description)
+	}
+}
+
+func TestFormatRouteName(t *testing.T) {
+	for _, tc := range []struct {
+		subnet string
+		name   string
+	}{
+		{"10.0.1.0/24", "flannel-10-0-1-0-24"},
+		{"192.168.100.0/22", "flannel-192-168-100-0-22"},
+		{"fd00:10:244:1::/64", "flannel-fd00-10-244-1---64"},
+		{"FD00:10:244:0001::/64", "flannel-fd00-10-244-1---64"},
+		{"2001:db8::/48", "flannel-2001-db8---48"},
+		{"::ffff:10.0.0.0/120", "flannel-10-0-0-0-24"},
+		{"::ffff:a00:0/120", "flannel-10-0-0-0-24"},
+		{"::ffff:10:0:0:0/120", "flannel---ffff-10-0-0-0-120"},
+	} {
+		if name := formatRouteName(defaultRouteNamePrefix, tc.subnet); name != tc.name {
+			t.Errorf("formatRouteName(%q): expected %q, got %q", tc.subnet, tc.name, name)
+		}
+	}
+}
+
+func TestRouteName(t *testing.T) {
+	for _, tc := range []struct {
+		prefix       string
+		subnet       string
+		replacements map[string]string
+		name         string
+	}{
+		{"", "10.0.1.0/24", nil, "flannel-10-0-1-0-24"},
+		{"prod-", "10.244.16.0/20", nil, "prod-10-244-16-0-20"},
+		{"", "fd00:10:244:1::/64", nil, "flannel-fd00-10-244-1---64"},
+		{"", "10.0.1.0/24", map[string]string{"/": "-len-"}, "flannel-10-0-1-0-len-24"},
+		{"", "fd00:10:244:1::/64", map[string]string{"::": "-z-"}, "flannel-fd00-10-244-1-z--64"},
+		{"", "10.0.1.0/24", map[string]string{".": ""}, "flannel-10010-24"},
+	} {
+		if name := RouteName(tc.prefix, tc.subnet, tc.replacements); name != tc.name {
+			t.Errorf("RouteName(%q, %q, %v): expected %q, got %q", tc.prefix, tc.subnet, tc.replacements, tc.name, name)
+		}
+	}
+
+	// the backend names routes the same way
+	api := &gceAPI{routeNamePrefix: defaultRouteNamePrefix, routeNameReplacer: newRouteNameReplacer(map[string]string{"/": "-len-"})}
+	if name := api.routeName("10.0.1.0/24"); name != "flannel-10-0-1-0-len-24" {
+		t.Errorf("unexpected route name %q", name)
+	}
+	api.routeNameReplacer = nil
+	if name := api.routeName("10.0.1.0/24"); name != RouteName("", "10.0.1.0/24", nil) {
+		t.Errorf("unexpected route name %q", name)
+	}
+}
+
+func TestBackendConfigValidateRouteNameReplacements(t *testing.T) {
+	for _, tc := range []struct {
+		replacements map[string]string
+		valid        bool
+	}{
+		{nil, true},
+		{map[string]string{"/": "-len-"}, true},
+		{map[string]string{".": ""}, true},
+		{map[string]string{"": "-"}, false},
+		{map[string]string{"/": "_"}, false},
+		{map[string]string{"/": "A"}, false},
+	} {
+		cfg := backendConfig{RouteNameReplacements: tc.replacements}
+		err := cfg.validate()
+		if tc.valid && err != nil {
+			t.Errorf("replacements %v: unexpected error: %v", tc.replacements, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("replacements %v: expected an error", tc.replacements)
+		}
+	}
+}
+
+func TestFormatRouteNameLimits(t *testing.T) {
+	long := strings.Repeat("a.", 40)
+	subnets := []string{long + "1/24", long + "2/24", "10.0.1.0_24", "10.0.1.0/24 "}
+	names := make(map[string]bool)
+	for _, subnet := range subnets {
+		name := formatRouteName(defaultRouteNamePrefix, subnet)
+		if len(name) > maxRouteNameLength || !routeNameRegexp.MatchString(name) {
+			t.Errorf("formatRouteName(%q): %q is not a valid name", subnet, name)
+		}
+		if !strings.HasPrefix(name, defaultRouteNamePrefix) {
+			t.Errorf("formatRouteName(%q): expected %q to have the flannel prefix", subnet, name)
+		}
+		if name != formatRouteName(defaultRouteNamePrefix, subnet) {
+			t.Errorf("formatRouteName(%q): expected a deterministic name", subnet)
+		}
+		names[name] = true
+	}
+	if len(names) != len(subnets) {
+		t.Errorf("expected distinct names, got %v", names)
+	}
+}
+
+func TestInsertRouteNextHop(t *testing.T) {
+	for _, tc := range []struct {
+		subnet       string
+		useIPNextHop bool
+		forceInst    bool
+		instanceIPv6 string
+		nicIPv6s     []string
+		nextHopIP    string
+		nextHopInst  string
+		fail         bool
+	}{
+		{subnet: "10.0.1.0/24", nextHopInst: "projects/test-project/zones/z/instances/node"},
+		{subnet: "10.0.1.0/24", useIPNextHop: true, nextHopIP: "10.128.0.2"},
+		{subnet: "fd00:1::/64", nextHopInst: "projects/test-project/zones/z/instances/node"},
+		{subnet: "fd00:1::/64", useIPNextHop: true, instanceIPv6: "fd20::2", nextHopIP: "fd20::2"},
+		{subnet: "fd00:1::/64", useIPNextHop: true, fail: true},
+		{subnet: "fd00:1::/64", useIPNextHop: true, instanceIPv6: "fd20::2", nicIPv6s: []string{"fd20::3"}, nextHopIP: "fd20::3"},
+		{subnet: "fd00:1::/64", useIPNextHop: true, nicIPv6s: []string{""}, fail: true},
+		{subnet: "10.0.1.0/24", useIPNextHop: true, nicIPv6s: []string{"fd20::3"}, nextHopIP: "10.128.0.2"},
+		{subnet: "10.0.1.0/24", useIPNextHop: true, forceInst: true, nextHopInst: "projects/test-project/zones/z/instances/node"},
+		{subnet: "fd00:1::/64", useIPNextHop: true, forceInst: true, nextHopInst: "projects/test-project/zones/z/instances/node"},
+	} {
+		var inserted compute.Route
+		api, done := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := json.NewDecoder(r.Body).Decode(&inserted); err != nil {
+				t.Error(err)
+			}
+			writeObject(w, &compute.Operation{Name: "op"})
+		}))
+
+		api.useIPNextHop = tc.useIPNextHop
+		api.forceNextHopInstance = tc.forceInst
+		api.instanceIPv6 = tc.instanceIPv6
+		api.nicIPv6s = tc.nicIPv6s
+		api.gceInstance.NetworkInterfaces = []*compute.NetworkInterface{{NetworkIP: "10.128.0.2"}}
+
+		_, err := api.insertRoute(context.Background(), tc.subnet)
+		done()
+
+		switch {
+		case tc.fail && err == nil:
+			t.Errorf("%v: expected an error", tc.subnet)
+		case tc.fail:
+		case err != nil:
+			t.Errorf("%v: unexpected error: %v", tc.subnet, err)
+		case inserted.DestRange != tc.subnet || inserted.NextHopIp != tc.nextHopIP || inserted.NextHopInstance != tc.nextHopInst:
+			t.Errorf("%v: unexpected route %+v", tc.subnet, inserted)
+		}
+	}
+}
+
+func TestInsertRouteForcedInstanceRejected(t *testing.T) {
+	api, done := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusBadRequest, "invalid")
+	}))
+	defer done()
+
+	api.useIPNextHop = true
+	api.forceNextHopInstance = true
+	_, err := api.insertRoute(context.Background(), "10.0.1.0/24")
+	if err == nil || !strings.Contains(err.Error(), "ForceNextHopInstance") {
+		t.Errorf("expected the error to explain ForceNextHopInstance, got %v", err)
+	}
+}
+
+func TestPruneOrphanedRoutes(t *testing.T) {
+	network := "projects/test-project/global/networks/default"
+	fake := newFakeCompute(
+		&compute.Route{Name: "flannel-10-0-1-0-24", DestRange: "10.0.1.0/24", Network: network},
+		&compute.Route{Name: "flannel-10-0-2-0-24", DestRange: "10.0.2.0/24", Network: network},
+		&compute.Route{Name: "flannel-10-0-3-0-24", DestRange: "10.0.3.0/24", Network: network},
+		// not generated by formatRouteName
+		&compute.Route{Name: "flannel-custom", DestRange: "10.0.4.0/24", Network: network},
+		// not created by flannel
+		&compute.Route{Name: "default-route", DestRange: "0.0.0.0/0", Network: network},
+		// in another network
+		&compute.Route{Name: "flannel-10-0-5-0-24", DestRange: "10.0.5.0/24", Network: "projects/test-project/global/networks/other"},
+	)
+	fake.pageSize = 2
+	api, done := newTestAPI(t, fake)
+	defer done()
+
+	if err := api.pruneOrphanedRoutes(context.Background(), []string{"10.0.1.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"flannel-10-0-2-0-24", "flannel-10-0-3-0-24"}
+	if strings.Join(fake.deleted, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected %v to be deleted, got %v", expected, fake.deleted)
+	}
+}
+
+func TestPruneOrphanedRoutesMaxFraction(t *testing.T) {
+	network := "projects/test-project/global/networks/default"
+	var routes []*compute.Route
+	for i := 1; i <= 4; i++ {
+		subnet := fmt.Sprintf("10.0.%d.0/24", i)
+		routes = append(routes, &compute.Route{Name: formatRouteName(defaultRouteNamePrefix, subnet), DestRange: subnet, Network: network})
+	}
+	fake := newFakeCompute(routes...)
+	api, done := newTestAPI(t, fake)
+	defer done()
+	api.maxPruneFraction = defaultMaxPruneFraction
+
+	// an empty lease list would delete all routes
+	err := api.pruneOrphanedRoutes(context.Background(), nil)
+	if err == nil || !strings.Contains(err.Error(), "refusing to delete 4 of the 4 flannel routes") {
+		t.Fatalf("expected the prune to be refused, got %v", err)
+	}
+	if len(fake.deleted) != 0 {
+		t.Fatalf("expected no route to be deleted, got %v", fake.deleted)
+	}
+
+	// half of them is still allowed
+	if err := api.pruneOrphanedRoutes(context.Background(), []string{"10.0.1.0/24", "10.0.2.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"flannel-10-0-3-0-24", "flannel-10-0-4-0-24"}
+	if strings.Join(fake.deleted, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected %v to be deleted, got %v", expected, fake.deleted)
+	}
+
+	api.forcePrune = true
+	if err := api.pruneOrphanedRoutes(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.routes) != 0 {
+		t.Errorf("expected all routes to be deleted with ForcePrune, got %v left", len(fake.routes))
+	}
+}
+
+func TestPruneOrphanedRoutesOfOtherClusters(t *testing.T) {
+	network := "projects/test-project/global/networks/default"
+	owned := func(cluster string) string {
+		return encodeRouteDescription(&routeOwner{Cluster: cluster, Node: "node", Version: "v1"}, "")
+	}
+	fake := newFakeCompute(
+		&compute.Route{Name: "flannel-10-0-1-0-24", DestRange: "10.0.1.0/24", Network: network, Description: owned("prod")},
+		// created by flannel for another cluster with the same prefix
+		&compute.Route{Name: "flannel-10-0-2-0-24", DestRange: "10.0.2.0/24", Network: network, Description: owned("staging")},
+		// created by an older flannel
+		&compute.Route{Name: "flannel-10-0-3-0-24", DestRange: "10.0.3.0/24", Network: network, Description: "Created by flannel on node"},
+	)
+	api, done := newTestAPI(t, fake)
+	defer done()
+	api.clusterName = "prod"
+
+	if err := api.pruneOrphanedRoutes(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"flannel-10-0-1-0-24", "flannel-10-0-3-0-24"}
+	if strings.Join(fake.deleted, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected %v to be deleted, got %v", expected, fake.deleted)
+	}
+}
+
+func TestPruneOwnStaleRoutes(t *testing.T) {
+	network := "projects/test-project/global/networks/default"
+	instance := "projects/test-project/zones/z/instances/node"
+	fake := newFakeCompute(
+		&compute.Route{Name: "flannel-10-0-1-0-24", DestRange: "10.0.1.0/24", Network: network, NextHopIp: "10.128.0.2"},
+		// this instance's, by IP and by link
+		&compute.Route{Name: "flannel-10-0-2-0-24", DestRange: "10.0.2.0/24", Network: network, NextHopIp: "10.128.0.2"},
+		&compute.Route{Name: "flannel-10-0-3-0-24", DestRange: "10.0.3.0/24", Network: network, NextHopInstance: selfLinkBase + instance},
+		// another instance's
+		&compute.Route{Name: "flannel-10-0-4-0-24", DestRange: "10.0.4.0/24", Network: network, NextHopIp: "10.128.0.9"},
+		&compute.Route{Name: "flannel-10-0-5-0-24", DestRange: "10.0.5.0/24", Network: network, NextHopInstance: "projects/test-project/zones/z/instances/other"},
+		// not generated by formatRouteName
+		&compute.Route{Name: "flannel-custom", DestRange: "10.0.6.0/24", Network: network, NextHopIp: "10.128.0.2"},
+	)
+	api, done := newTestAPI(t, fake)
+	defer done()
+	api.useIPNextHop = true
+	api.gceInstance.NetworkInterfaces = []*compute.NetworkInterface{{NetworkIP: "10.128.0.2"}}
+
+	if err := api.pruneOwnStaleRoutes(context.Background(), []string{"10.0.1.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"flannel-10-0-2-0-24", "flannel-10-0-3-0-24"}
+	if strings.Join(fake.deleted, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected %v to be deleted, got %v", expected, fake.deleted)
+	}
+}
+
+func TestInsertRouteAlreadyExists(t *testing.T) {
+	network := "projects/test-project/global/networks/default"
+	fake := newFakeCompute(
+		&compute.Route{Name: "flannel-10-0-1-0-24", DestRange: "10.0.1.0/24", Network: network,
+			NextHopInstance: "projects/test-project/zones/z/instances/node"},
+		&compute.Route{Name: "flannel-10-0-2-0-24", DestRange: "10.0.2.0/24", Network: network,
+			NextHopInstance: "projects/test-project/zones/z/instances/other"},
+	)
+	api, done := newTestAPI(t, fake)
+	defer done()
+
+	operation, err := api.insertRoute(context.Background(), "10.0.1.0/24")
+	if err != nil {
+		t.Fatalf("expected matching route to be accepted, got %v", err)
+	}
+	if operation != nil {
+		t.Errorf("expected no operation for an existing route, got %v", operation.Name)
+	}
+
+	if _, err := api.insertRoute(context.Background(), "10.0.2.0/24"); err == nil {
+		t.Error("expected an error for a conflicting route")
+	}
+}
+
+func TestListFlannelRoutes(t *testing.T) {
+	fake := newFakeCompute(&compute.Route{Name: "default-route", DestRange: "0.0.0.0/0"})
+	for i := 0; i < 7; i++ {
+		subnet := fmt.Sprintf("10.0.%d.0/24", i)
+		fake.routes[formatRouteName(defaultRouteNamePrefix, subnet)] = &compute.Route{Name: formatRouteName(defaultRouteNamePrefix, subnet), DestRange: subnet}
+	}
+	fake.pageSize = 3
+	api, done := newTestAPI(t, fake)
+	defer done()
+
+	routes, err := api.listFlannelRoutes(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(routes) != 7 {
+		t.Errorf("expected 7 routes, got %d", len(routes))
+	}
+	for _, route := range routes {
+		if !strings.HasPrefix(route.Name, defaultRouteNamePrefix) {
+			t.Errorf("unexpected route %v", route.Name)
+		}
+	}
+	if fake.listed != 3 {
+		t.Errorf("expected 3 pages to be fetched, got %d", fake.listed)
+	}
+}
+
+func TestNextHopInterface(t *testing.T) {
+	network := "projects/test-project/global/networks/default"
+	nics := []*compute.NetworkInterface{
+		{Network: "projects/test-project/global/networks/storage", NetworkIP: "10.200.0.2"},
+		{Network: network, NetworkIP: "10.128.0.2"},
+	}
+
+	for _, tc := range []struct {
+		index   int
+		match   bool
+		hopIP   string
+		nics    []*compute.NetworkInterface
+		ip      string
+		success bool
+	}{
+		{index: 0, nics: nics, ip: "10.200.0.2", success: true},
+		{index: 1, nics: nics, ip: "10.128.0.2", success: true},
+		{index: 2, nics: nics},
+		{match: true, nics: nics, ip: "10.128.0.2", success: true},
+		{match: true, nics: nics[:1]},
+		// the network links of the interfaces may be full or partial
+		{match: true, nics: []*compute.NetworkInterface{
+			{Network: "https://www.googleapis.com/compute/v1/" + network, NetworkIP: "10.128.0.3"},
+		}, ip: "10.128.0.3", success: true},
+		{match: true, nics: []*compute.NetworkInterface{
+			{Network: "projects/other-project/global/networks/default", NetworkIP: "10.128.0.4"},
+		}},
+		{index: 0},
+		{hopIP: "10.128.0.2", nics: nics, ip: "10.128.0.2", success: true},
+		// the IP must be that of an interface in the network
+		{hopIP: "10.128.0.9", nics: nics},
+		{hopIP: "10.200.0.2", nics: nics},
+	} {
+		api := &gceAPI{
+			gceNetwork:        &compute.Network{SelfLink: network},
+			gceInstance:       &compute.Instance{SelfLink: "node", NetworkInterfaces: tc.nics},
+			nicIndex:          tc.index,
+			matchNICByNetwork: tc.match,
+			nextHopIP:         tc.hopIP,
+		}
+
+		nic, err := api.nextHopInterface(api.gceNetwork, api.gceInstance)
+		switch {
+		case tc.success && err != nil:
+			t.Errorf("index=%d match=%v ip=%q: unexpected error: %v", tc.index, tc.match, tc.hopIP, err)
+		case !tc.success && err == nil:
+			t.Errorf("index=%d match=%v ip=%q: expected an error", tc.index, tc.match, tc.hopIP)
+		case tc.success && nic.NetworkIP != tc.ip:
+			t.Errorf("index=%d match=%v ip=%q: expected %v, got %v", tc.index, tc.match, tc.hopIP, tc.ip, nic.NetworkIP)
+		}
+	}
+}
+
+func TestCheckInstanceNetwork(t *testing.T) {
+	network := &compute.Network{SelfLink: "https://www.googleapis.com/compute/v1/projects/host-project/global/networks/shared"}
+	for _, tc := range []struct {
+		name  string
+		api   *gceAPI
+		nics  []*compute.NetworkInterface
+		valid bool
+	}{
+		{"attached", &gceAPI{}, []*compute.NetworkInterface{{Network: "projects/host-project/global/networks/shared"}}, true},
+		{"second interface", &gceAPI{}, []*compute.NetworkInterface{
+			{Network: "projects/service-project/global/networks/default"},
+			{Network: "projects/host-project/global/networks/shared"},
+		}, true},
+		// the network of the same name in the service project
+		{"other project", &gceAPI{}, []*compute.NetworkInterface{{Network: "projects/service-project/global/networks/shared"}}, false},
+		{"no interfaces", &gceAPI{}, nil, false},
+		{"load balancer", &gceAPI{nextHopIlb: "projects/host-project/regions/r/forwardingRules/egress"}, nil, true},
+		{"not looked up", &gceAPI{skipInstanceLookup: true}, nil, true},
+	} {
+		err := tc.api.checkInstanceNetwork(network, &compute.Instance{SelfLink: "node", NetworkInterfaces: tc.nics})
+		if tc.valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		}
+	}
+}
+
+func TestNextHopIPv6(t *testing.T) {
+	network := "projects/test-project/global/networks/default"
+	api := &gceAPI{
+		useIPNextHop: true,
+		nicIndex:     1,
+		gceNetwork:   &compute.Network{SelfLink: network},
+		gceInstance: &compute.Instance{SelfLink: "projects/test-project/zones/z/instances/node", NetworkInterfaces: []*compute.NetworkInterface{
+			{NetworkIP: "10.128.0.2", Network: network},
+			{NetworkIP: "10.129.0.2", Network: "projects/test-project/global/networks/other"},
+		}},
+	}
+
+	for _, tc := range []struct {
+		nicIPv6s []string
+		ip       string
+	}{
+		// the interface IPv4 routes go to
+		{[]string{"fd20::2", "fd21::2"}, "fd21::2"},
+		// otherwise one in the network of the route
+		{[]string{"fd20::2", ""}, "fd20::2"},
+		{nil, ""},
+	} {
+		api.nicIPv6s = tc.nicIPv6s
+		ip, err := api.nextHopIPv6(api.resources())
+		if tc.ip == "" {
+			if err == nil || !strings.Contains(err.Error(), "IPv6") {
+				t.Errorf("%v: expected an error naming IPv6, got %q, %v", tc.nicIPv6s, ip, err)
+			}
+			continue
+		}
+		if err != nil || ip != tc.ip {
+			t.Errorf("%v: expected %v, got %q, %v", tc.nicIPv6s, tc.ip, ip, err)
+		}
+	}
+}
+
+func TestGetInstanceIPv6(t *testing.T) {
+	api, done := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/test-project/zones/z/instances/node" {
+			writeError(w, http.StatusNotFound, "notFound")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"name": "node", "networkInterfaces": [
+			{"networkIP": "10.128.0.2"},
+			{"networkIP": "10.129.0.2", "ipv6Address": "fd20::2"},
+			{"networkIP": "10.130.0.2", "ipv6AccessConfigs": [{"externalIpv6": "2600:1900::2"}]}]}`)
+	}))
+	defer done()
+	api.instanceProject, api.instanceZone, api.instanceName = "test-project", "z", "node"
+
+	gi, nicIPv6s, err := api.getInstance(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gi.Name != "node" || len(gi.NetworkInterfaces) != 3 {
+		t.Errorf("unexpected instance %+v", gi)
+	}
+	if expected := []string{"", "fd20::2", "2600:1900::2"}; strings.Join(nicIPv6s, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected IPv6 addresses %v, got %v", expected, nicIPv6s)
+	}
+}
+
+func TestDeleteRouteNotFound(t *testing.T) {
+	fake := newFakeCompute()
+	api, done := newTestAPI(t, fake)
+	defer done()
+
+	operation, err := api.deleteRoute(context.Background(), "10.0.1.0/24")
+	if err != nil || operation != nil {
+		t.Errorf("expected deleting a nonexistent route to succeed without an operation, got %v, %v", operation, err)
+	}
+
+	// other errors still fail
+	api, done2 := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusForbidden, "forbidden")
+	}))
+	defer done2()
+	if _, err := api.deleteRoute(context.Background(), "10.0.1.0/24"); err == nil {
+		t.Error("expected a forbidden delete to fail")
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	network := "projects/test-project/global/networks/default"
+	fake := newFakeCompute(&compute.Route{Name: "flannel-10-0-1-0-24", DestRange: "10.0.1.0/24", Network: network})
+	api, done := newTestAPI(t, fake)
+	defer done()
+
+	api.dryRun = true
+
+	if _, err := api.getRoute(context.Background(), "10.0.1.0/24"); err != nil {
+		t.Errorf("expected getRoute to read the route, got %v", err)
+	}
+	if operation, err := api.deleteRoute(context.Background(), "10.0.1.0/24"); err != nil || operation != nil {
+		t.Errorf("expected no delete operation, got %v, %v", operation, err)
+	}
+	if operation, err := api.insertRoute(context.Background(), "10.0.2.0/24"); err != nil || operation != nil {
+		t.Errorf("expected no insert operation, got %v, %v", operation, err)
+	}
+
+	if len(fake.inserted) != 0 || len(fake.deleted) != 0 {
+		t.Errorf("expected no changes, got inserted=%v deleted=%v", fake.inserted, fake.deleted)
+	}
+}
+
+func TestRefreshPeriodically(t *testing.T) {
+	fake := newFakeCompute()
+	fake.networks["default"] = &compute.Network{Name: "default", SelfLink: "projects/test-project/global/networks/default"}
+	fake.instances["node"] = &compute.Instance{
+		Name:              "node",
+		SelfLink:          "projects/test-project/zones/z/instances/node",
+		NetworkInterfaces: []*compute.NetworkInterface{{NetworkIP: "10.128.0.3"}},
+	}
+	api, done := newTestAPI(t, fake)
+	defer done()
+
+	fc := clockwork.NewFakeClock()
+	api.clock = fc
+	api.networkName = "default"
+	api.instanceProject = "test-project"
+	api.instanceZone = "z"
+	api.instanceName = "node"
+	api.stopRefresh = make(chan struct{})
+
+	stopped := make(chan struct{})
+	go func() {
+		api.refreshPeriodically(context.Background(), time.Minute)
+		close(stopped)
+	}()
+
+	fc.BlockUntil(1)
+	fc.Advance(time.Minute)
+	// the refresh is complete once the next one is scheduled
+	fc.BlockUntil(1)
+
+	_, gi, _ := api.resources()
+	if len(gi.NetworkInterfaces) != 1 || gi.NetworkInterfaces[0].NetworkIP != "10.128.0.3" {
+		t.Errorf("expected the instance to be refreshed, got %+v", gi)
+	}
+
+	api.Close()
+	<-stopped
+}
+
+func TestPollOperationStatusScope(t *testing.T) {
+	for _, tc := range []struct {
+		operation *compute.Operation
+		path      string
+	}{
+		{&compute.Operation{Name: "op"}, "/test-project/global/operations/op"},
+		{&compute.Operation{Name: "op", SelfLink: "https://www.googleapis.com/compute/v1/projects/test-project/global/operations/op"},
+			"/test-project/global/operations/op"},
+		{&compute.Operation{Name: "op", SelfLink: "https://www.googleapis.com/compute/v1/projects/other/regions/us-central1/operations/op"},
+			"/other/regions/us-central1/operations/op"},
+		{&compute.Operation{Name: "op", SelfLink: "https://www.googleapis.com/compute/v1/projects/test-project/zones/us-central1-b/operations/op"},
+			"/test-project/zones/us-central1-b/operations/op"},
+		{&compute.Operation{Name: "op", Zone: "https://www.googleapis.com/compute/v1/projects/test-project/zones/us-central1-c"},
+			"/test-project/zones/us-central1-c/operations/op"},
+	} {
+		var path string
+		api, done := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path = r.URL.Path
+			writeObject(w, &compute.Operation{Name: "op", Status: "DONE"})
+		}))
+
+		if err := api.pollOperationStatus(context.Background(), tc.operation); err != nil {
+			t.Errorf("%+v: unexpected error: %v", tc.operation, err)
+		}
+		done()
+
+		if path != tc.path {
+			t.Errorf("%+v: expected %v to be polled, got %v", tc.operation, tc.path, path)
+		}
+	}
+}
+
+func TestInvalidSubnet(t *testing.T) {
+	fake := newFakeCompute()
+	api, done := newTestAPI(t, fake)
+	defer done()
+
+	ctx := context.Background()
+	for _, subnet := range []string{"", "10.0.1.0", "10.0.1.0/33", "not-a-subnet"} {
+		if _, err := api.getRoute(ctx, subnet); err == nil || !strings.Contains(err.Error(), "invalid subnet") {
+			t.Errorf("getRoute(%q): expected invalid subnet error, got %v", subnet, err)
+		}
+		if _, err := api.deleteRoute(ctx, subnet); err == nil || !strings.Contains(err.Error(), "invalid subnet") {
+			t.Errorf("deleteRoute(%q): expected invalid subnet error, got %v", subnet, err)
+		}
+		if _, err := api.insertRoute(ctx, subnet); err == nil || !strings.Contains(err.Error(), "invalid subnet") {
+			t.Errorf("insertRoute(%q): expected invalid subnet error, got %v", subnet, err)
+		}
+	}
+
+	if len(fake.inserted) != 0 || len(fake.deleted) != 0 {
+		t.Errorf("expected no API calls, got inserted=%v deleted=%v", fake.inserted, fake.deleted)
+	}
+}
+
+func TestNewAPIWithService(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		networkProject string
+		wantIPNextHop  bool
+	}{
+		{"same project", "test-project", false},
+		{"shared vpc", "host-project", true},
+	} {
+		fake := newFakeCompute()
+		fake.networks["default"] = &compute.Network{Name: "default", SelfLink: "projects/" + tc.networkProject + "/global/networks/default"}
+		fake.instances["node"] = &compute.Instance{Name: "node", SelfLink: "projects/test-project/zones/z/instances/node"}
+		srv := httptest.NewServer(fake)
+		cs, err := compute.New(srv.Client())
+		if err != nil {
+			t.Fatal(err)
+		}
+		cs.BasePath = srv.URL + "/"
+
+		id := gceIdentity{
+			networkProject:  tc.networkProject,
+			networkName:     "default",
+			instanceProject: "test-project",
+			instanceZone:    "z",
+			instanceName:    "node",
+		}
+		api, err := newAPIWithService(context.Background(), cs, srv.Client(), &fakeMetadata{}, clockwork.NewRealClock(), id, &backendConfig{RoutePriority: defaultRoutePriority})
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if api.networkProject != tc.networkProject {
+			t.Errorf("%s: expected project %v, got %v", tc.name, tc.networkProject, api.networkProject)
+		}
+		if api.useIPNextHop != tc.wantIPNextHop {
+			t.Errorf("%s: expected useIPNextHop=%v, got %v", tc.name, tc.wantIPNextHop, api.useIPNextHop)
+		}
+		if api.gceInstance.SelfLink != fake.instances["node"].SelfLink {
+			t.Errorf("%s: expected instance to be fetched, got %+v", tc.name, api.gceInstance)
+		}
+
+		delete(fake.instances, "node")
+		if _, err := newAPIWithService(context.Background(), cs, srv.Client(), &fakeMetadata{}, clockwork.NewRealClock(), id, &backendConfig{}); err == nil {
+			t.Errorf("%s: expected an error for a missing instance", tc.name)
+		}
+		srv.Close()
+	}
+}
+
+func TestIdentityFromMetadata(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		envProject     string
+		networkProject string
+		wantIPNextHop  bool
+	}{
+		{"same project", "", "test-project", false},
+		{"shared vpc", "host-project", "host-project", true},
+	} {
+		os.Setenv(EnvGCENetworkProjectID, tc.envProject)
+		md := newFakeMetadata()
+		md.ipv6 = "fd20::2"
+		id, err := identityFromMetadata(md, &backendConfig{})
+		os.Unsetenv(EnvGCENetworkProjectID)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		expected := gceIdentity{
+			networkProject:  tc.networkProject,
+			networkName:     "default",
+			instanceProject: "test-project",
+			instanceZone:    "z",
+			instanceName:    "node",
+			instanceIPv6:    "fd20::2",
+		}
+		if id != expected {
+			t.Fatalf("%s: expected %+v, got %+v", tc.name, expected, id)
+		}
+
+		fake := newFakeCompute()
+		fake.networks["default"] = &compute.Network{Name: "default", SelfLink: "projects/" + tc.networkProject + "/global/networks/default"}
+		fake.instances["node"] = &compute.Instance{Name: "node", SelfLink: "projects/test-project/zones/z/instances/node"}
+		srv := httptest.NewServer(fake)
+		cs, err := compute.New(srv.Client())
+		if err != nil {
+			t.Fatal(err)
+		}
+		cs.BasePath = srv.URL + "/"
+		api, err := newAPIWithService(context.Background(), cs, srv.Client(), md, clockwork.NewRealClock(), id, &backendConfig{})
+		srv.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if api.useIPNextHop != tc.wantIPNextHop {
+			t.Errorf("%s: expected useIPNextHop=%v, got %v", tc.name, tc.wantIPNextHop, api.useIPNextHop)
+		}
+	}
+
+	// the IPv6 address is optional, the rest is required
+	md := newFakeMetadata()
+	md.zone = ""
+	if _, err := identityFromMetadata(md, &backendConfig{}); err == nil || !strings.Contains(err.Error(), "instance zone") {
+		t.Errorf("expected an error for the missing zone, got %v", err)
+	}
+}
+
+func TestNetworkProjectFromEnv(t *testing.T) {
+	defer os.Unsetenv(EnvGCENetworkProjectID)
+	for _, tc := range []struct {
+		env      string
+		expected string
+		err      string
+	}{
+		{"", "", ""},
+		{"host-project", "host-project", ""},
+		{" host-project\n", "host-project", ""},
+		{"example.com:host-project", "example.com:host-project", ""},
+		{"123456789012", "", "project number"},
+		{"Host_Project", "", "not a project ID"},
+	} {
+		os.Setenv(EnvGCENetworkProjectID, tc.env)
+		prj, err := networkProjectFromEnv()
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%q: expected an error about the %s, got %v", tc.env, tc.err, err)
+			}
+			continue
+		}
+		if err != nil || prj != tc.expected {
+			t.Errorf("%q: expected %q, got %q, %v", tc.env, tc.expected, prj, err)
+		}
+	}
+
+	// the identity isn't resolved with an invalid network project
+	os.Setenv(EnvGCENetworkProjectID, "123456789012")
+	if _, err := identityFromMetadata(newFakeMetadata(), &backendConfig{}); err == nil || !strings.Contains(err.Error(), EnvGCENetworkProjectID) {
+		t.Errorf("expected an error naming %s, got %v", EnvGCENetworkProjectID, err)
+	}
+}
+
+func TestIdentityFromMetadataOverrides(t *testing.T) {
+	// the metadata server reports another identity than the instance's
+	md := &fakeMetadata{networkName: "other", projectID: "other-project", name: "other", zone: "other"}
+	cfg := &backendConfig{Project: "test-project", Zone: "z", InstanceName: "node", Networks: []string{"default"}}
+	id, err := identityFromMetadata(md, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := gceIdentity{
+		networkProject:  "test-project",
+		networkName:     "default",
+		instanceProject: "test-project",
+		instanceZone:    "z",
+		instanceName:    "node",
+	}
+	if id != expected {
+		t.Fatalf("expected %+v, got %+v", expected, id)
+	}
+	// only the optional IPv6 address is looked up
+	if md.requests != 1 {
+		t.Errorf("expected only the IPv6 address to be looked up, got %d lookups", md.requests)
+	}
+
+	// without overrides the lookups fail for an unreachable metadata server
+	for _, cfg := range []*backendConfig{
+		{Zone: "z", InstanceName: "node", Networks: []string{"default"}},
+		{Project: "test-project", InstanceName: "node", Networks: []string{"default"}},
+		{Project: "test-project", Zone: "z", Networks: []string{"default"}},
+		{Project: "test-project", Zone: "z", InstanceName: "node"},
+	} {
+		if _, err := identityFromMetadata(&fakeMetadata{}, cfg); err == nil {
+			t.Errorf("expected an error for %+v without metadata", cfg)
+		}
+	}
+}
+
+func TestDeleteRoutes(t *testing.T) {
+	network := "projects/test-project/global/networks/default"
+	var routes []*compute.Route
+	var subnets []string
+	for i := 0; i < 3*defaultWriteConcurrency; i++ {
+		subnet := fmt.Sprintf("10.0.%d.0/24", i)
+		routes = append(routes, &compute.Route{Name: formatRouteName(defaultRouteNamePrefix, subnet), DestRange: subnet, Network: network})
+		subnets = append(subnets, subnet)
+	}
+	fake := newFakeCompute(routes...)
+	// deleting these is forbidden, so their deletes fail
+	forbidden := []string{"10.1.0.0/24", "10.1.1.0/24"}
+	api, done := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, subnet := range forbidden {
+			if r.Method == "DELETE" && strings.HasSuffix(r.URL.Path, "/"+formatRouteName(defaultRouteNamePrefix, subnet)) {
+				writeError(w, http.StatusForbidden, "forbidden")
+				return
+			}
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	defer done()
+
+	// this has no route, which counts as deleted
+	missing := "10.2.0.0/24"
+	err := api.deleteRoutes(context.Background(), append(append(subnets, forbidden...), missing))
+
+	errs, ok := err.(multiError)
+	if !ok || len(errs) != len(forbidden) {
+		t.Fatalf("expected %d aggregated errors, got %v", len(forbidden), err)
+	}
+	for i, subnet := range forbidden {
+		if !strings.Contains(errs[i].Error(), subnet) {
+			t.Errorf("expected error %d to be for %v, got %v", i, subnet, errs[i])
+		}
+	}
+	if len(fake.deleted) != len(subnets) || len(fake.routes) != 0 {
+		t.Errorf("expected all %d routes to be deleted, got %v", len(subnets), fake.deleted)
+	}
+}
+
+func TestCrossProjectRequests(t *testing.T) {
+	fake := newFakeCompute()
+	fake.networks["default"] = &compute.Network{Name: "default", SelfLink: "projects/host-project/global/networks/default"}
+	fake.instances["node"] = &compute.Instance{
+		Name:              "node",
+		SelfLink:          "projects/service-project/zones/z/instances/node",
+		NetworkInterfaces: []*compute.NetworkInterface{{NetworkIP: "10.128.0.2"}},
+	}
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		fake.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	cs, err := compute.New(srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs.BasePath = srv.URL + "/"
+
+	id := gceIdentity{
+		networkProject:  "host-project",
+		networkName:     "default",
+		instanceProject: "service-project",
+		instanceZone:    "z",
+		instanceName:    "node",
+	}
+	api, err := newAPIWithService(context.Background(), cs, srv.Client(), &fakeMetadata{}, clockwork.NewRealClock(), id, &backendConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := api.insertRoute(context.Background(), "10.0.1.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	if err := api.refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"GET /host-project/global/networks/default",
+		"GET /service-project/zones/z/instances/node",
+		"POST /host-project/global/routes",
+		"GET /host-project/global/networks/default",
+		"GET /service-project/zones/z/instances/node",
+	}
+	if strings.Join(paths, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected requests %v, got %v", expected, paths)
+	}
+	if route := fake.routes["flannel-10-0-1-0-24"]; route == nil || route.NextHopIp != "10.128.0.2" {
+		t.Errorf("expected a route via the instance IP, got %+v", route)
+	}
+}
+
+func TestLogFields(t *testing.T) {
+	api := &gceAPI{networkProject: "host-project"}
+	for _, tc := range []struct {
+		route    *compute.Route
+		expected string
+	}{
+		{&compute.Route{Name: "flannel-10-0-1-0-24", DestRange: "10.0.1.0/24", NextHopIp: "10.128.0.2"},
+			"route=flannel-10-0-1-0-24 subnet=10.0.1.0/24 nextHop=10.128.0.2 project=host-project"},
+		{&compute.Route{Name: "flannel-10-0-1-0-24", DestRange: "10.0.1.0/24", NextHopInstance: "projects/p/zones/z/instances/node"},
+			"route=flannel-10-0-1-0-24 subnet=10.0.1.0/24 nextHop=projects/p/zones/z/instances/node project=host-project"},
+		{&compute.Route{Name: "flannel-10-0-1-0-24", DestRange: "10.0.1.0/24"},
+			"route=flannel-10-0-1-0-24 subnet=10.0.1.0/24 nextHop=- project=host-project"},
+	} {
+		if fields := api.logFields(tc.route); fields != tc.expected {
+			t.Errorf("expected %q, got %q", tc.expected, fields)
+		}
+	}
+}
+
+func TestRouteNamePrefix(t *testing.T) {
+	network := "projects/test-project/global/networks/default"
+	fake := newFakeCompute(
+		&compute.Route{Name: "flannel-10-0-1-0-24", DestRange: "10.0.1.0/24", Network: network},
+		&compute.Route{Name: "cluster-b-10-0-1-0-24", DestRange: "10.0.1.0/24", Network: network},
+		&compute.Route{Name: "cluster-b-10-0-2-0-24", DestRange: "10.0.2.0/24", Network: network},
+	)
+	api, done := newTestAPI(t, fake)
+	defer done()
+
+	api.routeNamePrefix = "cluster-b-"
+	if name := api.routeName("10.0.3.0/24"); name != "cluster-b-10-0-3-0-24" {
+		t.Errorf("expected the prefix to be used, got %v", name)
+	}
+
+	if err := api.pruneOrphanedRoutes(context.Background(), []string{"10.0.1.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.deleted) != 1 || fake.deleted[0] != "cluster-b-10-0-2-0-24" {
+		t.Errorf("expected only cluster-b-10-0-2-0-24 to be deleted, got %v", fake.deleted)
+	}
+}
+
+func TestWriteRateLimit(t *testing.T) {
+	fake := newFakeCompute()
+	api, done := newTestAPI(t, fake)
+	defer done()
+
+	fc := clockwork.NewFakeClock()
+	api.clock = fc
+	api.writeLimiter = newWriteLimiter(&backendConfig{WriteRateLimit: 0.01, WriteBurst: 1})
+
+	// the first write uses the burst
+	if _, err := api.insertRoute(context.Background(), "10.0.1.0/24"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error)
+	go func() {
+		_, err := api.insertRoute(ctx, "10.0.2.0/24")
+		errc <- err
+	}()
+
+	fc.BlockUntil(1)
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("expected the wait to be cancelled, got %v", err)
+	}
+	if len(fake.inserted) != 1 {
+		t.Errorf("expected only one insert, got %v", fake.inserted)
+	}
+}
+
+func TestComputeEndpoint(t *testing.T) {
+	fake := newFakeCompute(&compute.Route{Name: "flannel-10-0-1-0-24", DestRange: "10.0.1.0/24"})
+	var authorization string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			writeObject(w, map[string]interface{}{"access_token": "test-token", "token_type": "Bearer", "expires_in": 3600})
+			return
+		}
+		authorization = r.Header.Get("Authorization")
+		r.URL.Path = strings.TrimPrefix(r.URL.Path, "/compute/v1/projects")
+		fake.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	credentialsFile := writeTestCredentials(t, srv.URL+"/token")
+	defer os.Remove(credentialsFile)
+
+	cs, _, err := newComputeService(context.Background(), credentialsFile, srv.URL+"/compute/v1/projects", "", newTransport(&backendConfig{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	route, err := cs.Routes.Get("test-project", "flannel-10-0-1-0-24").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if route.DestRange != "10.0.1.0/24" {
+		t.Errorf("unexpected route %+v", route)
+	}
+	if authorization != "Bearer test-token" {
+		t.Errorf("expected the request to be authorized, got %q", authorization)
+	}
+}
+
+// writeTestCredentials writes a service account key file whose tokens are
+// fetched from tokenURI, and returns its name
+func writeTestCredentials(t *testing.T, tokenURI string) string {
+	key, err := rsa.GenerateKey(cryptorand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials, err := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "flannel@test-project.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+		"token_uri":    tokenURI,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(credentials)
+	f.Close()
+	return f.Name()
+}
+
+func TestComputeServiceQuotaProject(t *testing.T) {
+	fake := newFakeCompute(&compute.Route{Name: "flannel-10-0-1-0-24", DestRange: "10.0.1.0/24"})
+	var tokenQuotaProject, quotaProject string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			tokenQuotaProject = r.Header.Get("X-Goog-User-Project")
+			writeObject(w, map[string]interface{}{"access_token": "test-token", "token_type": "Bearer", "expires_in": 3600})
+			return
+		}
+		quotaProject = r.Header.Get("X-Goog-User-Project")
+		fake.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	credentialsFile := writeTestCredentials(t, srv.URL+"/token")
+	defer os.Remove(credentialsFile)
+
+	cs, client, err := newComputeService(context.Background(), credentialsFile, srv.URL, "service-project", newTransport(&backendConfig{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.Routes.Get("test-project", "flannel-10-0-1-0-24").Do(); err != nil {
+		t.Fatal(err)
+	}
+	if quotaProject != "service-project" {
+		t.Errorf("expected the request to be attributed to service-project, got %q", quotaProject)
+	}
+	if tokenQuotaProject != "" {
+		t.Errorf("expected the token request not to be attributed, got %q", tokenQuotaProject)
+	}
+
+	// requests sent directly use the same client
+	quotaProject = ""
+	api := &gceAPI{computeService: cs, httpClient: client, instanceProject: "test-project", instanceZone: "z", instanceName: "node"}
+	fake.instances["node"] = &compute.Instance{Name: "node"}
+	if _, err := api.getInstanceJSON(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if quotaProject != "service-project" {
+		t.Errorf("expected the direct request to be attributed to service-project, got %q", quotaProject)
+	}
+}
+
+func TestQuotaProject(t *testing.T) {
+	old := os.Getenv(EnvGCEQuotaProject)
+	defer os.Setenv(EnvGCEQuotaProject, old)
+
+	os.Setenv(EnvGCEQuotaProject, "env-project")
+	if got := quotaProject(&backendConfig{}); got != "env-project" {
+		t.Errorf("expected the quota project of the environment, got %q", got)
+	}
+	if got := quotaProject(&backendConfig{QuotaProject: "config-project"}); got != "config-project" {
+		t.Errorf("expected the configured quota project to take precedence, got %q", got)
+	}
+}
+
+func TestProxyFunc(t *testing.T) {
+	for _, name := range []string{"HTTPS_PROXY", "https_proxy", "NO_PROXY", "no_proxy"} {
+		old, ok := os.LookupEnv(name)
+		os.Unsetenv(name)
+		if ok {
+			defer os.Setenv(name, old)
+		}
+	}
+	os.Setenv("HTTPS_PROXY", "http://env-proxy:3128")
+	defer os.Unsetenv("HTTPS_PROXY")
+
+	for _, tc := range []struct {
+		cfg   backendConfig
+		url   string
+		proxy string
+	}{
+		{backendConfig{HTTPSProxy: "http://proxy:3128"}, "https://compute.googleapis.com/compute/v1/projects", "http://proxy:3128"},
+		{backendConfig{HTTPSProxy: "proxy:3128"}, "https://compute.googleapis.com/compute/v1/projects", "http://proxy:3128"},
+		{backendConfig{HTTPSProxy: "http://proxy:3128", NoProxy: ".googleapis.com"}, "https://compute.googleapis.com/compute/v1/projects", ""},
+		{backendConfig{HTTPSProxy: "http://proxy:3128", NoProxy: ".googleapis.com"}, "https://oauth2.example.com/token", "http://proxy:3128"},
+		// the proxy of the environment still applies
+		{backendConfig{NoProxy: "oauth2.example.com"}, "https://compute.googleapis.com/compute/v1/projects", "http://env-proxy:3128"},
+		{backendConfig{NoProxy: "oauth2.example.com"}, "https://oauth2.example.com/token", ""},
+	} {
+		req, err := http.NewRequest("GET", tc.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxy, err := proxyFunc(&tc.cfg)(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if proxy != nil {
+			got = proxy.String()
+		}
+		if got != tc.proxy {
+			t.Errorf("%+v, %v: expected proxy %q, got %q", tc.cfg, tc.url, tc.proxy, got)
+		}
+	}
+}
+
+func TestNewTransport(t *testing.T) {
+	cfg, err := parseBackendConfig(&subnet.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := newTransport(cfg)
+	if transport.MaxIdleConnsPerHost != defaultMaxIdleConnsPerHost || transport.IdleConnTimeout != defaultIdleConnTimeout*time.Second {
+		t.Errorf("unexpected transport settings %v, %v", transport.MaxIdleConnsPerHost, transport.IdleConnTimeout)
+	}
+
+	var mu sync.Mutex
+	conns := 0
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeObject(w, &compute.Route{Name: "flannel-10-0-1-0-24"})
+	}))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			conns++
+			mu.Unlock()
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	// requests one after the other reuse the connection
+	client := &http.Client{Transport: transport}
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if conns != 1 {
+		t.Errorf("expected one connection, got %v", conns)
+	}
+}
+
+func TestSameLink(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		same bool
+	}{
+		{"https://www.googleapis.com/compute/v1/projects/p/zones/z/instances/node", "projects/p/zones/z/instances/node", true},
+		{"https://www.googleapis.com/compute/v1/projects/p/zones/z/instances/node", "node", true},
+		{"projects/p/zones/z/instances/node", "projects/p/zones/y/instances/node", false},
+		{"projects/p/zones/z/instances/node", "projects/p/zones/z/instances/other", false},
+	} {
+		if same := sameLink(tc.a, tc.b); same != tc.same {
+			t.Errorf("sameLink(%q, %q): expected %v, got %v", tc.a, tc.b, tc.same, same)
+		}
+	}
+}
+
+func TestRepairRoute(t *testing.T) {
+	network := "projects/test-project/global/networks/default"
+	fake := newFakeCompute(
+		&compute.Route{Name: "flannel-10-0-1-0-24", DestRange: "10.0.1.0/24", Network: network, NextHopIp: "10.128.0.2", Priority: defaultRoutePriority},
+		&compute.Route{Name: "flannel-10-0-2-0-24", DestRange: "10.0.2.0/24", Network: network, NextHopIp: "10.128.0.9", Priority: defaultRoutePriority},
+		&compute.Route{Name: "flannel-10-0-4-0-24", DestRange: "10.0.4.0/24", Network: network, NextHopIp: "10.128.0.2", Priority: 500},
+	)
+	api, done := newTestAPI(t, fake)
+	defer done()
+
+	api.useIPNextHop = true
+	api.gceInstance.NetworkInterfaces = []*compute.NetworkInterface{{NetworkIP: "10.128.0.2"}}
+
+	for _, tc := range []struct {
+		subnet   string
+		repaired bool
+	}{
+		{"10.0.1.0/24", false},
+		{"10.0.2.0/24", true},
+		{"10.0.3.0/24", true},
+		// the priority differs from the config
+		{"10.0.4.0/24", true},
+	} {
+		state, repaired, err := api.repairRoute(context.Background(), tc.subnet)
+		if err != nil {
+			t.Fatalf("%v: %v", tc.subnet, err)
+		}
+		if state != backend.RoutePresent {
+			t.Errorf("%v: expected the route to be present, got %v", tc.subnet, state)
+		}
+		if repaired != tc.repaired {
+			t.Errorf("%v: expected repaired=%v, got %v", tc.subnet, tc.repaired, repaired)
+		}
+		if route := fake.routes[formatRouteName(defaultRouteNamePrefix, tc.subnet)]; route == nil || route.NextHopIp != "10.128.0.2" {
+			t.Errorf("%v: expected a route via 10.128.0.2, got %+v", tc.subnet, route)
+		}
+	}
+
+	if strings.Join(fake.deleted, ",") != "flannel-10-0-2-0-24,flannel-10-0-4-0-24" {
+		t.Errorf("expected only the drifted routes to be deleted, got %v", fake.deleted)
+	}
+	if route := fake.routes["flannel-10-0-4-0-24"]; route.Priority != defaultRoutePriority {
+		t.Errorf("expected the route to be recreated with priority %v, got %v", defaultRoutePriority, route.Priority)
+	}
+}
+
+func TestRepairRouteOutdated(t *testing.T) {
+	network := "projects/test-project/global/networks/default"
+	current := encodeRouteDescription(&routeOwner{Schema: routeSchemaVersion}, "")
+	fake := newFakeCompute(
+		&compute.Route{Name: "flannel-10-0-1-0-24", DestRange: "10.0.1.0/24", Network: network, NextHopIp: "10.128.0.2", Priority: defaultRoutePriority, Description: current},
+		&compute.Route{Name: "flannel-10-0-2-0-24", DestRange: "10.0.2.0/24", Network: network, NextHopIp: "10.128.0.2", Priority: defaultRoutePriority, Description: "Created by flannel"},
+	)
+	api, done := newTestAPI(t, fake)
+	defer done()
+
+	api.useIPNextHop = true
+	api.gceInstance.NetworkInterfaces = []*compute.NetworkInterface{{NetworkIP: "10.128.0.2"}}
+
+	// outdated routes are left alone unless asked for
+	for _, subnet := range []string{"10.0.1.0/24", "10.0.2.0/24"} {
+		if _, repaired, err := api.repairRoute(context.Background(), subnet); err != nil || repaired {
+			t.Errorf("%v: expected the route to be left alone, got %v, %v", subnet, repaired, err)
+		}
+	}
+
+	api.recreateOutdated = true
+	for i, tc := range []struct {
+		subnet   string
+		repaired bool
+	}{
+		{"10.0.1.0/24", false},
+		{"10.0.2.0/24", true},
+		// the recreated route has the current schema
+		{"10.0.2.0/24", false},
+	} {
+		state, repaired, err := api.repairRoute(context.Background(), tc.subnet)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if state != backend.RoutePresent || repaired != tc.repaired {
+			t.Errorf("%d: expected a present route and repaired=%v, got %v and %v", i, tc.repaired, state, repaired)
+		}
+	}
+
+	if strings.Join(fake.deleted, ",") != "flannel-10-0-2-0-24" {
+		t.Errorf("expected only the outdated route to be deleted, got %v", fake.deleted)
+	}
+	if route := fake.routes["flannel-10-0-2-0-24"]; routeOutdated(route) {
+		t.Errorf("expected the route to be recreated with the current schema, got %q", route.Description)
+	}
+}
+
+func TestInsertRouteNextHopIlb(t *testing.T) {
+	ilb := "projects/test-project/regions/r/forwardingRules/egress"
+	fake := newFakeCompute()
+	var inserted map[string]interface{}
+	api, done := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			data, _ := ioutil.ReadAll(r.Body)
+			if err := json.Unmarshal(data, &inserted); err != nil {
+				t.Error(err)
+			}
+			r.Body = ioutil.NopCloser(strings.NewReader(string(data)))
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	defer done()
+
+	api.nextHopIlb = ilb
+	operation, err := api.insertRoute(context.Background(), "10.0.1.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if operation == nil || operation.Name != "insert-flannel-10-0-1-0-24" {
+		t.Errorf("unexpected operation %+v", operation)
+	}
+	if inserted["nextHopIlb"] != ilb || inserted["nextHopInstance"] != nil || inserted["destRange"] != "10.0.1.0/24" {
+		t.Errorf("unexpected route %v", inserted)
+	}
+
+	// the existing route is read back without a next hop
+	if operation, err := api.insertRoute(context.Background(), "10.0.1.0/24"); err != nil || operation != nil {
+		t.Errorf("expected the existing route to match, got %v, %v", operation, err)
+	}
+}
+
+func TestSkipInstanceLookup(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		networkProject string
+		cfg            backendConfig
+		lookup         bool
+	}{
+		{"default", "test-project", backendConfig{}, true},
+		{"skip", "test-project", backendConfig{SkipInstanceLookup: true}, false},
+		{"skip with ip next hop", "host-project", backendConfig{SkipInstanceLookup: true}, true},
+		{"skip with forced instance", "host-project", backendConfig{SkipInstanceLookup: true, ForceNextHopInstance: true}, false},
+	} {
+		fake := newFakeCompute()
+		fake.networks["default"] = &compute.Network{Name: "default", SelfLink: "projects/" + tc.networkProject + "/global/networks/default"}
+		fake.instances["node"] = &compute.Instance{Name: "node", SelfLink: "projects/test-project/zones/z/instances/node"}
+		lookups := 0
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.Contains(r.URL.Path, "/instances/") {
+				lookups++
+			}
+			fake.ServeHTTP(w, r)
+		}))
+		cs, err := compute.New(srv.Client())
+		if err != nil {
+			t.Fatal(err)
+		}
+		cs.BasePath = srv.URL + "/"
+
+		id := gceIdentity{networkProject: tc.networkProject, networkName: "default", instanceProject: "test-project", instanceZone: "z", instanceName: "node"}
+		api, err := newAPIWithService(context.Background(), cs, srv.Client(), &fakeMetadata{}, clockwork.NewRealClock(), id, &tc.cfg)
+		srv.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if (lookups > 0) != tc.lookup {
+			t.Errorf("%s: expected lookup=%v, got %d lookups", tc.name, tc.lookup, lookups)
+		}
+		if _, gi, _ := api.resources(); !sameLink(gi.SelfLink, "projects/test-project/zones/z/instances/node") {
+			t.Errorf("%s: unexpected instance link %v", tc.name, gi.SelfLink)
+		}
+	}
+}
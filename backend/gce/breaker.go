@@ -0,0 +1,148 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package gce
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/jonboulle/clockwork"
+	"google.golang.org/api/googleapi"
+)
+
+// circuitBreaker pauses route writes once threshold of them failed in a row,
+// e.g. because the credentials lost access or the quota is exhausted, so that
+// reconciles don't keep calling the API in vain. After cooldown, a single
+// write probes whether the API accepts writes again, and closes the breaker
+// if it succeeds. A nil breaker never opens.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	clock     clockwork.Clock
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+	// changed is closed and replaced whenever the state changes, waking
+	// the writes waiting for the breaker
+	changed chan struct{}
+}
+
+// newCircuitBreaker returns the breaker configured by cfg, nil if it is
+// disabled
+func newCircuitBreaker(cfg *backendConfig, clock clockwork.Clock) *circuitBreaker {
+	if cfg.CircuitBreakerThreshold <= 0 {
+		return nil
+	}
+	return &circuitBreaker{
+		threshold: cfg.CircuitBreakerThreshold,
+		cooldown:  time.Duration(cfg.CircuitBreakerCooldown) * time.Second,
+		clock:     clock,
+		changed:   make(chan struct{}),
+	}
+}
+
+// wait blocks while the breaker is open, or another write is probing the
+// API, until the write may be made or ctx is done. probe is true if the
+// write is the probe, its result must be passed to done in any case.
+func (b *circuitBreaker) wait(ctx context.Context) (probe bool, err error) {
+	if b == nil {
+		return false, nil
+	}
+
+	for {
+		b.mu.Lock()
+		if b.failures < b.threshold {
+			b.mu.Unlock()
+			return false, nil
+		}
+		delay := b.openUntil.Sub(b.clock.Now())
+		if !b.probing && delay <= 0 {
+			b.probing = true
+			b.mu.Unlock()
+			return true, nil
+		}
+		changed := b.changed
+		b.mu.Unlock()
+
+		var cooledDown <-chan time.Time
+		if delay > 0 {
+			cooledDown = b.clock.After(delay)
+		}
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-changed:
+		case <-cooledDown:
+		}
+	}
+}
+
+// done records the result of a write which wait let through
+func (b *circuitBreaker) done(probe bool, err error) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch {
+	case err == context.Canceled || err == context.DeadlineExceeded:
+		// says nothing about the API, let another write probe it
+	case probe && isBreakerFailure(err):
+		b.openUntil = b.clock.Now().Add(b.cooldown)
+		log.Warningf("Route write still failing, pausing route writes for another %v: %v", b.cooldown, err)
+	case probe:
+		b.failures = 0
+		circuitBreakerOpen.Set(0)
+		log.Infof("Route write succeeded, resuming route writes")
+	case b.failures >= b.threshold:
+		// started before the breaker opened, the probe decides
+	case isBreakerFailure(err):
+		b.failures++
+		if b.failures == b.threshold {
+			b.openUntil = b.clock.Now().Add(b.cooldown)
+			circuitBreakerOpen.Set(1)
+			log.Errorf("%d route writes in a row failed, pausing route writes for %v before trying again: %v", b.failures, b.cooldown, err)
+		}
+	default:
+		b.failures = 0
+	}
+	if probe {
+		b.probing = false
+	}
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// isBreakerFailure returns true if err counts as a failed write. Routes which
+// already exist or were already deleted, and network interfaces which changed
+// since they were read, are handled by the callers.
+func isBreakerFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	if apiError, ok := err.(*googleapi.Error); ok {
+		return apiError.Code != http.StatusNotFound && apiError.Code != http.StatusConflict &&
+			apiError.Code != http.StatusPreconditionFailed
+	}
+	return true
+}
@@ -0,0 +1,132 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package gce
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"google.golang.org/api/compute/v1"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var inserts, forbidden int32 = 0, 1
+	api, done := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&inserts, 1)
+		if atomic.LoadInt32(&forbidden) == 1 {
+			writeError(w, http.StatusForbidden, "forbidden")
+			return
+		}
+		writeObject(w, &compute.Operation{Name: "op"})
+	}))
+	defer done()
+
+	fc := clockwork.NewFakeClock()
+	api.breaker = newCircuitBreaker(&backendConfig{CircuitBreakerThreshold: 2, CircuitBreakerCooldown: 60}, fc)
+	insert := func() <-chan error {
+		errs := make(chan error, 1)
+		go func() {
+			_, err := api.insertRoute(context.Background(), "10.0.1.0/24")
+			errs <- err
+		}()
+		return errs
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := <-insert(); err == nil {
+			t.Fatal("expected an error")
+		}
+	}
+
+	// the breaker is open, the next insert waits for the cooldown and
+	// probes the API, which still fails
+	errs := insert()
+	fc.BlockUntil(1)
+	if n := atomic.LoadInt32(&inserts); n != 2 {
+		t.Fatalf("expected no insert while the breaker is open, got %d", n)
+	}
+	fc.Advance(time.Minute)
+	if err := <-errs; err == nil {
+		t.Fatal("expected the probe to fail")
+	}
+
+	// the failed probe reopened the breaker, the next probe succeeds
+	atomic.StoreInt32(&forbidden, 0)
+	errs = insert()
+	fc.BlockUntil(1)
+	if n := atomic.LoadInt32(&inserts); n != 3 {
+		t.Fatalf("expected only the probe to be inserted, got %d inserts", n)
+	}
+	fc.Advance(time.Minute)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	// closed again, inserts don't wait
+	if err := <-insert(); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&inserts); n != 5 {
+		t.Errorf("expected 5 inserts, got %d", n)
+	}
+}
+
+func TestCircuitBreakerProbeAlone(t *testing.T) {
+	fc := clockwork.NewFakeClock()
+	b := newCircuitBreaker(&backendConfig{CircuitBreakerThreshold: 1, CircuitBreakerCooldown: 60}, fc)
+	b.done(false, errors.New("quota exceeded"))
+
+	fc.Advance(time.Minute)
+	probe, err := b.wait(context.Background())
+	if err != nil || !probe {
+		t.Fatalf("expected a probe, got %v, %v", probe, err)
+	}
+
+	// other writes wait for the probe, until they give up
+	ctx, cancel := context.WithCancel(context.Background())
+	waited := make(chan error, 1)
+	go func() {
+		_, err := b.wait(ctx)
+		waited <- err
+	}()
+	select {
+	case err := <-waited:
+		t.Fatalf("expected to wait for the probe, got %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	cancel()
+	if err := <-waited; err != context.Canceled {
+		t.Errorf("expected the wait to be canceled, got %v", err)
+	}
+
+	// a successful probe lets them through
+	go func() {
+		probe, err := b.wait(context.Background())
+		if probe {
+			t.Error("expected not to probe once the breaker closed")
+		}
+		waited <- err
+	}()
+	b.done(true, nil)
+	if err := <-waited; err != nil {
+		t.Error(err)
+	}
+}
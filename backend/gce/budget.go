@@ -0,0 +1,61 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package gce
+
+import (
+	"errors"
+
+	"github.com/jonboulle/clockwork"
+	"golang.org/x/time/rate"
+)
+
+// errRetryBudgetExhausted is returned by operations given up because the
+// retry budget ran out
+var errRetryBudgetExhausted = errors.New("retry budget exhausted, deferring to the next reconcile")
+
+// retryBudget bounds the compute API calls the backend makes beyond the first
+// attempt of each operation, the retries of writes and the repeated polls of
+// operations, however many subnets are churning. It holds up to size tokens,
+// refilled at refill per second. Retries and polls which find it empty are
+// given up, and left to the next reconcile. A nil budget is unlimited.
+type retryBudget struct {
+	limiter *rate.Limiter
+	clock   clockwork.Clock
+}
+
+// newRetryBudget returns the budget configured by cfg, nil if it is disabled
+func newRetryBudget(cfg *backendConfig, clock clockwork.Clock) *retryBudget {
+	if cfg.RetryBudget <= 0 {
+		return nil
+	}
+	return &retryBudget{
+		limiter: rate.NewLimiter(rate.Limit(cfg.RetryBudgetRefillRate), cfg.RetryBudget),
+		clock:   clock,
+	}
+}
+
+// allow takes a token for another call, and returns false if there is none
+// left
+func (b *retryBudget) allow() bool {
+	if b == nil {
+		return true
+	}
+	if !b.limiter.AllowN(b.clock.Now(), 1) {
+		retryBudgetExhausted.Inc()
+		return false
+	}
+	return true
+}
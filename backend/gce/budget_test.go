@@ -0,0 +1,94 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package gce
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+func TestRetryBudget(t *testing.T) {
+	fc := clockwork.NewFakeClock()
+	budget := newRetryBudget(&backendConfig{RetryBudget: 2, RetryBudgetRefillRate: 0.5}, fc)
+	if !budget.allow() || !budget.allow() {
+		t.Fatal("expected the budget to allow 2 calls")
+	}
+	if budget.allow() {
+		t.Fatal("expected the budget to be exhausted")
+	}
+	fc.Advance(2 * time.Second)
+	if !budget.allow() {
+		t.Fatal("expected the budget to be refilled by a call after 2s")
+	}
+	if budget.allow() {
+		t.Fatal("expected the budget to be exhausted again")
+	}
+
+	if newRetryBudget(&backendConfig{}, fc) != nil {
+		t.Error("expected no budget without RetryBudget")
+	}
+	var unlimited *retryBudget
+	if !unlimited.allow() {
+		t.Error("expected a nil budget to allow all calls")
+	}
+}
+
+func TestWithRetriesBudget(t *testing.T) {
+	fc := clockwork.NewFakeClock()
+	api := &gceAPI{clock: fc, retryBackoff: defaultRetryBackoff, maxAttempts: 5}
+	api.retryBudget = newRetryBudget(&backendConfig{RetryBudget: 1, RetryBudgetRefillRate: 0.01}, fc)
+
+	attempts := 0
+	errc := make(chan error, 1)
+	go func() {
+		errc <- api.withRetries(context.Background(), "testing", func() error {
+			attempts++
+			return &googleapi.Error{Code: http.StatusServiceUnavailable}
+		})
+	}()
+	fc.BlockUntil(1)
+	fc.Advance(time.Minute)
+
+	// the second failure finds the budget empty and isn't retried
+	err := <-errc
+	if apiErr, ok := err.(*googleapi.Error); !ok || apiErr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected the last error, got %v", err)
+	}
+	if attempts != 2 {
+		t.Errorf("expected 2 attempts, got %d", attempts)
+	}
+}
+
+func TestPollOperationStatusBudget(t *testing.T) {
+	api, replay, done := newReplayAPI(t, replayPolicy, opPending, opRunning, opRunning, opDone)
+	defer done()
+	api.retryBudget = newRetryBudget(&backendConfig{RetryBudget: 2, RetryBudgetRefillRate: 0.01}, api.clock)
+
+	// the fourth poll, after 7s, finds the budget empty
+	err := replayPoll(api, &compute.Operation{Name: "op"}, time.Second, 2*time.Second, 4*time.Second)
+	if err != errRetryBudgetExhausted {
+		t.Fatalf("expected %v, got %v", errRetryBudgetExhausted, err)
+	}
+	if polls := len(replay.times()); polls != 3 {
+		t.Errorf("expected the first poll and 2 more, got %d polls", polls)
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package gce
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// routeDiff is the smallest set of changes which turns the flannel routes of a
+// network into the desired ones
+type routeDiff struct {
+	// create are the desired routes which are missing, or replace one of
+	// remove
+	create []*route
+	// remove are the routes which aren't desired, or differ from the
+	// desired route for their subnet
+	remove []*compute.Route
+	// unchanged are the subnets whose routes are already as desired
+	unchanged []string
+}
+
+// sameRouteTarget returns true if the actual route got sends the same range to
+// the same next hop as want
+func sameRouteTarget(want *route, got *compute.Route) bool {
+	return want.sameTarget(routeFromCompute(got))
+}
+
+// diffRoutes compares the desired routes, by subnet, with the actual routes of
+// the network of api. A nil desired route keeps whichever route exists for its
+// subnet, e.g. that of another node's lease. Only the routes in the network
+// which flannel named and owns are considered, others are never removed.
+// Routes for which same returns true are left unchanged. The changes are
+// sorted by subnet.
+func (api *gceAPI) diffRoutes(desired map[string]*route, actual []*compute.Route, same func(want *route, got *compute.Route) bool) *routeDiff {
+	gn, _, _ := api.resources()
+	d := &routeDiff{}
+	existing := make(map[string]bool)
+	for _, cr := range actual {
+		// only touch routes whose name flannel would have generated
+		if cr.Network != gn.SelfLink || cr.Name != api.routeName(cr.DestRange) || !api.ownsRoute(cr) {
+			continue
+		}
+		existing[cr.DestRange] = true
+
+		want, ok := desired[cr.DestRange]
+		switch {
+		case !ok:
+			d.remove = append(d.remove, cr)
+		case want == nil || same(want, cr):
+			d.unchanged = append(d.unchanged, cr.DestRange)
+		default:
+			d.remove = append(d.remove, cr)
+			d.create = append(d.create, want)
+		}
+	}
+	for sn, want := range desired {
+		if want != nil && !existing[sn] {
+			d.create = append(d.create, want)
+		}
+	}
+
+	sort.Slice(d.create, func(i, j int) bool { return d.create[i].destRange < d.create[j].destRange })
+	sort.Slice(d.remove, func(i, j int) bool { return d.remove[i].DestRange < d.remove[j].DestRange })
+	sort.Strings(d.unchanged)
+	return d
+}
+
+// removedSubnets returns the subnets of the routes d removes
+func (d *routeDiff) removedSubnets() []string {
+	var subnets []string
+	for _, cr := range d.remove {
+		subnets = append(subnets, cr.DestRange)
+	}
+	return subnets
+}
+
+// applyRouteDiff deletes the routes d removes, then inserts the routes it
+// creates, some of which replace deleted ones of the same name, both
+// writeConcurrency at once. It returns the subnets whose routes were deleted,
+// none unless all of them were, and those whose routes were inserted.
+func (api *gceAPI) applyRouteDiff(ctx context.Context, d *routeDiff) ([]string, []string, error) {
+	logger.V(2).Infof("Applying route changes: %d to create, %d to remove, %d unchanged", len(d.create), len(d.remove), len(d.unchanged))
+	removed := d.removedSubnets()
+	if err := api.deleteRoutes(ctx, removed); err != nil {
+		return nil, nil, err
+	}
+
+	inserted := make([]bool, len(d.create))
+	err := runWorkers(ctx, len(d.create), api.writeConcurrency, func(ctx context.Context, i int) error {
+		r := d.create[i]
+		operation, err := api.insertPlannedRoute(ctx, r)
+		if err == nil && operation != nil {
+			err = api.pollOperationStatus(ctx, operation)
+		}
+		api.recordInsert(ctx, r.destRange, err)
+		if err != nil {
+			return fmt.Errorf("error inserting route for subnet %v: %v", r.destRange, err)
+		}
+		inserted[i] = true
+		return nil
+	})
+
+	var created []string
+	for i, r := range d.create {
+		if inserted[i] {
+			created = append(created, r.destRange)
+		}
+	}
+	return removed, created, err
+}
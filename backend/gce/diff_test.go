@@ -0,0 +1,120 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+// +build !windows
+
+package gce
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"google.golang.org/api/compute/v1"
+)
+
+func TestDiffRoutes(t *testing.T) {
+	network := "projects/test-project/global/networks/default"
+	actual := []*compute.Route{
+		// same next hop, another priority
+		{Name: "flannel-10-0-0-0-24", DestRange: "10.0.0.0/24", Network: network, NextHopIp: "10.128.0.5", Priority: 900},
+		// another next hop
+		{Name: "flannel-10-0-1-0-24", DestRange: "10.0.1.0/24", Network: network, NextHopIp: "10.128.0.9"},
+		// leased by another node
+		{Name: "flannel-10-0-2-0-24", DestRange: "10.0.2.0/24", Network: network, NextHopIp: "10.128.0.7"},
+		// not leased
+		{Name: "flannel-10-0-3-0-24", DestRange: "10.0.3.0/24", Network: network, NextHopIp: "10.128.0.7"},
+		// not named by flannel, in another network, of another cluster
+		{Name: "flannel-custom", DestRange: "10.0.4.0/24", Network: network},
+		{Name: "flannel-10-0-5-0-24", DestRange: "10.0.5.0/24", Network: "projects/test-project/global/networks/other"},
+		{Name: "flannel-10-0-6-0-24", DestRange: "10.0.6.0/24", Network: network,
+			Description: encodeRouteDescription(&routeOwner{Cluster: "other"}, "")},
+	}
+
+	api, done := newTestAPI(t, newFakeCompute())
+	defer done()
+	api.clusterName = "prod"
+
+	gn, _, _ := api.resources()
+	desired := map[string]*route{"10.0.2.0/24": nil}
+	for _, sn := range []string{"10.0.0.0/24", "10.0.1.0/24", "10.0.7.0/24"} {
+		r, err := api.planRouteVia(gn, sn, routeNextHop{ip: "10.128.0.5"}, "node")
+		if err != nil {
+			t.Fatal(err)
+		}
+		desired[sn] = r
+	}
+
+	d := api.diffRoutes(desired, actual, sameRouteTarget)
+	var created []string
+	for _, r := range d.create {
+		created = append(created, r.destRange)
+	}
+	if expected := []string{"10.0.1.0/24", "10.0.7.0/24"}; !reflect.DeepEqual(created, expected) {
+		t.Errorf("expected to create %v, got %v", expected, created)
+	}
+	if expected := []string{"10.0.1.0/24", "10.0.3.0/24"}; !reflect.DeepEqual(d.removedSubnets(), expected) {
+		t.Errorf("expected to remove %v, got %v", expected, d.removedSubnets())
+	}
+	if expected := []string{"10.0.0.0/24", "10.0.2.0/24"}; !reflect.DeepEqual(d.unchanged, expected) {
+		t.Errorf("expected %v to be unchanged, got %v", expected, d.unchanged)
+	}
+
+	// the same routes give no changes
+	if d := api.diffRoutes(map[string]*route{"10.0.2.0/24": nil}, actual[2:3], sameRouteTarget); len(d.create) != 0 || len(d.remove) != 0 {
+		t.Errorf("expected no changes, got %+v", d)
+	}
+}
+
+func TestApplyRouteDiff(t *testing.T) {
+	network := "projects/test-project/global/networks/default"
+	fake := newFakeCompute(
+		&compute.Route{Name: "flannel-10-0-1-0-24", DestRange: "10.0.1.0/24", Network: network, NextHopIp: "10.128.0.9"},
+		&compute.Route{Name: "flannel-10-0-3-0-24", DestRange: "10.0.3.0/24", Network: network, NextHopIp: "10.128.0.7"},
+	)
+	api, done := newTestAPI(t, fake)
+	defer done()
+
+	gn, _, _ := api.resources()
+	desired := make(map[string]*route)
+	for _, sn := range []string{"10.0.1.0/24", "10.0.7.0/24"} {
+		r, err := api.planRouteVia(gn, sn, routeNextHop{ip: "10.128.0.5"}, "node")
+		if err != nil {
+			t.Fatal(err)
+		}
+		desired[sn] = r
+	}
+	actual, err := api.listFlannelRoutes(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	removed, created, err := api.applyRouteDiff(context.Background(), api.diffRoutes(desired, actual, sameRouteTarget))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"10.0.1.0/24", "10.0.3.0/24"}; !reflect.DeepEqual(removed, expected) {
+		t.Errorf("expected %v to be removed, got %v", expected, removed)
+	}
+	if expected := []string{"10.0.1.0/24", "10.0.7.0/24"}; !reflect.DeepEqual(created, expected) {
+		t.Errorf("expected %v to be created, got %v", expected, created)
+	}
+	// only the routes which differ are written
+	if len(fake.deleted) != 2 || len(fake.inserted) != 2 {
+		t.Errorf("expected 2 deletes and 2 inserts, got %v and %v", fake.deleted, fake.inserted)
+	}
+	if route := fake.routes["flannel-10-0-1-0-24"]; route == nil || route.NextHopIp != "10.128.0.5" {
+		t.Errorf("expected the route to be recreated via 10.128.0.5, got %+v", route)
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package gce
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+	"google.golang.org/api/googleapi"
+)
+
+// RateLimitError is returned when the compute API rejected a call because a
+// rate limit or quota was exceeded. Such calls may succeed when retried later.
+type RateLimitError struct {
+	// RetryAfter is how long the API asked to wait before retrying, or zero
+	// if it didn't say
+	RetryAfter time.Duration
+	Err        *googleapi.Error
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limit exceeded: %v", e.Err)
+}
+
+// OperationTimeoutError is returned when an operation didn't finish within
+// the OperationTimeout. The operation may still complete later.
+type OperationTimeoutError struct {
+	Operation string
+	// Status is the last status of the operation, e.g. RUNNING
+	Status string
+	// Elapsed is how long flannel waited, and Timeout how long it may
+	Elapsed time.Duration
+	Timeout time.Duration
+}
+
+func (e *OperationTimeoutError) Error() string {
+	return fmt.Sprintf("timeout waiting for operation %s to finish: still %s after %v, giving up as the operation timeout is %v",
+		e.Operation, e.Status, e.Elapsed, e.Timeout)
+}
+
+// rateLimitReasons are the error reasons the compute API uses for 403
+// responses caused by rate limits or quotas
+var rateLimitReasons = map[string]bool{
+	"rateLimitExceeded":     true,
+	"userRateLimitExceeded": true,
+	"quotaExceeded":         true,
+	"dailyLimitExceeded":    true,
+}
+
+// wrapRateLimitError returns a *RateLimitError if err is a rate limit or quota
+// error from the compute API, and err unchanged otherwise
+func wrapRateLimitError(err error) error {
+	apiError, ok := err.(*googleapi.Error)
+	if !ok || !isRateLimited(apiError) {
+		return err
+	}
+
+	rlErr := &RateLimitError{Err: apiError}
+	if secs, err := strconv.Atoi(apiError.Header.Get("Retry-After")); err == nil && secs > 0 {
+		rlErr.RetryAfter = time.Duration(secs) * time.Second
+	}
+	return rlErr
+}
+
+func isRateLimited(err *googleapi.Error) bool {
+	if err.Code == http.StatusTooManyRequests {
+		return true
+	}
+	if err.Code != http.StatusForbidden {
+		return false
+	}
+	for _, item := range err.Errors {
+		if rateLimitReasons[item.Reason] {
+			return true
+		}
+	}
+	return false
+}
+
+// multiError aggregates the errors of a batch of calls so that one failure
+// doesn't hide the others
+type multiError []error
+
+func (m multiError) Error() string {
+	msgs := make([]string, len(m))
+	for i, err := range m {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d errors occurred: %s", len(m), strings.Join(msgs, "; "))
+}
+
+// retriableCodes are the HTTP status codes of compute API errors which may
+// succeed when retried
+var retriableCodes = map[int]bool{
+	http.StatusTooManyRequests:     true,
+	http.StatusInternalServerError: true,
+	http.StatusBadGateway:          true,
+	http.StatusServiceUnavailable:  true,
+}
+
+func isRetriable(err error) bool {
+	apiError, ok := err.(*googleapi.Error)
+	return ok && retriableCodes[apiError.Code]
+}
+
+// withRetries calls f until it succeeds, fails with an error which isn't
+// retriable, or maxAttempts calls were made. Waits between calls grow
+// following retryBackoff, or follow the Retry-After the API asked for. Each
+// retry takes from the retry budget, the last error is returned once it is
+// exhausted.
+func (api *gceAPI) withRetries(ctx context.Context, what string, f func() error) error {
+	interval := api.retryBackoff.initialInterval
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || !isRetriable(err) || attempt >= api.maxAttempts {
+			return err
+		}
+
+		if !api.retryBudget.allow() {
+			log.Warningf("Error %s (attempt %d of %d), not retrying as the retry budget is exhausted: %v", what, attempt, api.maxAttempts, err)
+			return err
+		}
+
+		wait := api.retryBackoff.jittered(interval)
+		if rlErr, ok := wrapRateLimitError(err).(*RateLimitError); ok && rlErr.RetryAfter > wait {
+			wait = rlErr.RetryAfter
+		}
+		log.Warningf("Error %s (attempt %d of %d), retrying in %v: %v", what, attempt, api.maxAttempts, wait, err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-api.clock.After(wait):
+		}
+		interval = api.retryBackoff.next(interval)
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package gce
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+func TestWrapRateLimitError(t *testing.T) {
+	for _, tc := range []struct {
+		err         *googleapi.Error
+		rateLimited bool
+	}{
+		{&googleapi.Error{Code: 429}, true},
+		{&googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}}}, true},
+		{&googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "quotaExceeded"}}}, true},
+		{&googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "forbidden"}}}, false},
+		{&googleapi.Error{Code: 500}, false},
+	} {
+		err := wrapRateLimitError(tc.err)
+		if _, ok := err.(*RateLimitError); ok != tc.rateLimited {
+			t.Errorf("%v: expected rate limited=%v, got %T", tc.err, tc.rateLimited, err)
+		}
+		if !tc.rateLimited && err != error(tc.err) {
+			t.Errorf("%v: expected the error to be returned unchanged", tc.err)
+		}
+	}
+}
+
+func TestRateLimitErrorRetryAfter(t *testing.T) {
+	err := wrapRateLimitError(&googleapi.Error{Code: 429, Header: http.Header{"Retry-After": {"30"}}})
+	rlErr, ok := err.(*RateLimitError)
+	if !ok {
+		t.Fatalf("expected a *RateLimitError, got %T", err)
+	}
+	if rlErr.RetryAfter != 30*time.Second {
+		t.Errorf("expected RetryAfter of 30s, got %v", rlErr.RetryAfter)
+	}
+}
+
+func TestInsertRouteRateLimited(t *testing.T) {
+	api, done := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusForbidden, "rateLimitExceeded")
+	}))
+	defer done()
+
+	if _, err := api.insertRoute(context.Background(), "10.0.1.0/24"); err == nil {
+		t.Fatal("expected an error")
+	} else if _, ok := err.(*RateLimitError); !ok {
+		t.Errorf("expected a *RateLimitError, got %T: %v", err, err)
+	}
+
+	if err := api.pollOperationStatus(context.Background(), &compute.Operation{Name: "op"}); err == nil {
+		t.Fatal("expected an error")
+	} else if _, ok := err.(*RateLimitError); !ok {
+		t.Errorf("expected a *RateLimitError, got %T: %v", err, err)
+	}
+}
+
+func TestWithRetries(t *testing.T) {
+	for _, tc := range []struct {
+		codes    []int
+		attempts int
+		success  bool
+	}{
+		{[]int{503, 500, 200}, 3, true},
+		{[]int{502, 429, 503}, 3, false},
+		{[]int{400}, 1, false},
+		{[]int{403}, 1, false},
+		{[]int{404}, 1, false},
+	} {
+		api := &gceAPI{clock: clockwork.NewFakeClock(), retryBackoff: defaultRetryBackoff, maxAttempts: 3}
+		fc := api.clock.(clockwork.FakeClock)
+		attempts := 0
+		errc := make(chan error)
+		go func() {
+			errc <- api.withRetries(context.Background(), "testing", func() error {
+				code := tc.codes[attempts]
+				attempts++
+				if code == http.StatusOK {
+					return nil
+				}
+				return &googleapi.Error{Code: code}
+			})
+		}()
+
+		var err error
+	wait:
+		for {
+			select {
+			case err = <-errc:
+				break wait
+			default:
+				fc.Advance(time.Minute)
+				time.Sleep(time.Millisecond)
+			}
+		}
+
+		if attempts != tc.attempts {
+			t.Errorf("%v: expected %d attempts, got %d", tc.codes, tc.attempts, attempts)
+		}
+		if (err == nil) != tc.success {
+			t.Errorf("%v: expected success=%v, got %v", tc.codes, tc.success, err)
+		}
+	}
+}
+
+func TestWithRetriesCancel(t *testing.T) {
+	api := &gceAPI{clock: clockwork.NewFakeClock(), retryBackoff: defaultRetryBackoff, maxAttempts: 3}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := api.withRetries(ctx, "testing", func() error {
+		return &googleapi.Error{Code: http.StatusServiceUnavailable}
+	})
+	if err != context.Canceled {
+		t.Errorf("expected the retries to be cancelled, got %v", err)
+	}
+}
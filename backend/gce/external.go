@@ -0,0 +1,239 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package gce
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/jonboulle/clockwork"
+	"google.golang.org/api/compute/v1"
+
+	"github.com/coreos/flannel/subnet"
+)
+
+// ExternalRoute is a route for Subnet to NextHop, the IP address or the link
+// of an instance, which comes from outside flannel's leases
+type ExternalRoute struct {
+	Subnet  string
+	NextHop string
+}
+
+// ExternalRoutesSummary lists the subnets whose routes ReconcileExternalRoutes
+// created, deleted or left unchanged. A route which pointed elsewhere is both
+// deleted and created.
+type ExternalRoutesSummary struct {
+	Created   []string
+	Deleted   []string
+	Unchanged []string
+}
+
+// ReadExternalRoutes reads routes from r, one per line as the subnet and the
+// next hop separated by whitespace. Empty lines and lines starting with # are
+// skipped.
+func ReadExternalRoutes(r io.Reader) ([]ExternalRoute, error) {
+	var routes []ExternalRoute
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected a subnet and a next hop, got %q", n, line)
+		}
+		routes = append(routes, ExternalRoute{Subnet: fields[0], NextHop: fields[1]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return routes, nil
+}
+
+// ReconcileExternalRoutes makes routes the only routes managed by flannel in
+// the network: missing routes are created, routes which point elsewhere are
+// recreated and routes for other subnets are deleted. config is the GCE
+// backend config, as in the network config, whose RouteNamePrefix must not be
+// the default one of the flannel nodes sharing the network, whose routes
+// would otherwise be deleted. The network is the one of Networks if it names
+// one, and the project is GCE_NETWORK_PROJECT_ID if set, otherwise both are
+// read from the metadata server. As an empty or truncated route list would
+// delete most routes, no routes are refused unless allowEmpty is set, and
+// deleting more than MaxPruneFraction of the routes unless ForcePrune is. With
+// DryRun, the summary lists the changes which would have been made.
+func ReconcileExternalRoutes(ctx context.Context, config json.RawMessage, routes []ExternalRoute, allowEmpty bool) (*ExternalRoutesSummary, error) {
+	if len(routes) == 0 && !allowEmpty {
+		return nil, errNoExternalRoutes
+	}
+	desired, err := parseExternalRoutes(routes)
+	if err != nil {
+		return nil, err
+	}
+	api, err := newExternalAPI(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	defer api.Close()
+
+	return api.reconcileExternalRoutes(ctx, desired)
+}
+
+// errNoExternalRoutes refuses to delete all external routes for an empty
+// route list, e.g. read from an empty stdin by mistake
+var errNoExternalRoutes = errors.New("refusing to delete all external routes for an empty route list, which may have been truncated")
+
+// DeleteInstanceRoutes deletes the routes managed by flannel in the network
+// which point at target, the link of an instance or an IP address, whatever
+// their subnet, e.g. when the node is permanently removed. Only routes named
+// with the RouteNamePrefix of config, the GCE backend config as for
+// ReconcileExternalRoutes, are considered. It returns the subnets whose routes
+// were deleted, or with DryRun would have been.
+func DeleteInstanceRoutes(ctx context.Context, config json.RawMessage, target string) ([]string, error) {
+	hop, ok := parseNextHop(target)
+	if !ok {
+		return nil, fmt.Errorf("invalid instance %q: must be an IP address or an instance link", target)
+	}
+	api, err := newExternalAPI(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	defer api.Close()
+
+	return api.deleteRoutesForInstance(ctx, hop)
+}
+
+// newExternalAPI returns a gceAPI for the network of config which manages
+// routes to other instances than this one
+func newExternalAPI(ctx context.Context, config json.RawMessage) (*gceAPI, error) {
+	cfg, err := parseBackendConfig(&subnet.Config{Backend: config})
+	if err != nil {
+		return nil, err
+	}
+	// the routes don't go to this instance, so it isn't needed unless
+	// the metadata identity routes via its IP
+	cfg.SkipInstanceLookup = true
+	cfg.RefreshInterval = 0
+
+	md := newMetadataServer()
+	id, err := externalIdentity(cfg, md)
+	if err != nil {
+		return nil, err
+	}
+	cs, client, err := newComputeService(ctx, cfg.CredentialsFile, computeEndpoint(cfg), quotaProject(cfg), newTransport(cfg))
+	if err != nil {
+		return nil, err
+	}
+	return newAPIWithService(ctx, cs, client, md, clockwork.NewRealClock(), id, cfg)
+}
+
+// externalIdentity returns the network the external routes go in. Without
+// the network and its project configured, they are those of this instance.
+func externalIdentity(cfg *backendConfig, md metadataClient) (gceIdentity, error) {
+	if len(cfg.Networks) > 1 {
+		return gceIdentity{}, fmt.Errorf("external routes can only be reconciled in one network, got Networks %v", cfg.Networks)
+	}
+	prj, err := networkProjectFromEnv()
+	if err != nil {
+		return gceIdentity{}, err
+	}
+	if prj != "" && len(cfg.Networks) == 1 {
+		return gceIdentity{networkProject: prj, networkName: cfg.Networks[0], instanceProject: prj}, nil
+	}
+
+	return identityFromMetadata(md, cfg)
+}
+
+// parseExternalRoutes returns the next hops of routes by subnet
+func parseExternalRoutes(routes []ExternalRoute) (map[string]routeNextHop, error) {
+	desired := make(map[string]routeNextHop)
+	for _, r := range routes {
+		_, ipn, err := net.ParseCIDR(r.Subnet)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subnet %q: %v", r.Subnet, err)
+		}
+		sn := ipn.String()
+		if _, ok := desired[sn]; ok {
+			return nil, fmt.Errorf("duplicate route for subnet %v", sn)
+		}
+
+		hop, ok := parseNextHop(r.NextHop)
+		if !ok {
+			return nil, fmt.Errorf("invalid next hop %q of subnet %v: must be an IP address or an instance link", r.NextHop, sn)
+		}
+		desired[sn] = hop
+	}
+	return desired, nil
+}
+
+// parseNextHop returns the next hop hop, an IP address or an instance link,
+// and false if it is neither
+func parseNextHop(hop string) (routeNextHop, bool) {
+	switch {
+	case net.ParseIP(hop) != nil:
+		return routeNextHop{ip: hop}, true
+	case strings.Contains(hop, "/instances/"):
+		return routeNextHop{instance: hop}, true
+	}
+	return routeNextHop{}, false
+}
+
+// reconcileExternalRoutes makes the routes to desired next hops, by subnet,
+// the only flannel routes in the network
+func (api *gceAPI) reconcileExternalRoutes(ctx context.Context, desired map[string]routeNextHop) (*ExternalRoutesSummary, error) {
+	if api.routeNamePrefix == defaultRouteNamePrefix {
+		return nil, fmt.Errorf("refusing to reconcile external routes named with the default RouteNamePrefix %q, "+
+			"the routes of the flannel nodes would be deleted: set a RouteNamePrefix of their own", defaultRouteNamePrefix)
+	}
+	existing, err := api.listFlannelRoutes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	gn, _, _ := api.resources()
+	planned := make(map[string]*route)
+	for sn, hop := range desired {
+		if planned[sn], err = api.planRouteVia(gn, sn, hop, hop.String()); err != nil {
+			return nil, err
+		}
+	}
+
+	// external routes also follow changes to their priority and tags
+	d := api.diffRoutes(planned, existing, func(want *route, got *compute.Route) bool {
+		return sameRouteTarget(want, got) && got.Priority == want.priority && sameStrings(got.Tags, want.tags) &&
+			!(api.recreateOutdated && routeOutdated(got))
+	})
+	deletes := 0
+	for _, cr := range d.remove {
+		if planned[cr.DestRange] != nil {
+			logger.V(1).Infof("Recreating route which differs from the external route %s", api.logFields(cr))
+		} else {
+			deletes++
+		}
+	}
+	if err := api.checkPruneFraction(deletes, len(d.remove)+len(d.unchanged), "route list"); err != nil {
+		return nil, err
+	}
+
+	removed, created, err := api.applyRouteDiff(ctx, d)
+	return &ExternalRoutesSummary{Created: created, Deleted: removed, Unchanged: d.unchanged}, err
+}
@@ -0,0 +1,229 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package gce
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/compute/v1"
+)
+
+func TestReadExternalRoutes(t *testing.T) {
+	routes, err := ReadExternalRoutes(strings.NewReader(`
+# pods of the build farm
+10.10.0.0/24 10.128.0.5
+
+10.10.1.0/24	projects/p/zones/z/instances/builder
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ExternalRoute{
+		{Subnet: "10.10.0.0/24", NextHop: "10.128.0.5"},
+		{Subnet: "10.10.1.0/24", NextHop: "projects/p/zones/z/instances/builder"},
+	}
+	if !reflect.DeepEqual(routes, expected) {
+		t.Errorf("expected %+v, got %+v", expected, routes)
+	}
+
+	if _, err := ReadExternalRoutes(strings.NewReader("10.10.0.0/24\n")); err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Errorf("expected an error for line 1, got %v", err)
+	}
+}
+
+func TestParseExternalRoutes(t *testing.T) {
+	for _, routes := range [][]ExternalRoute{
+		{{Subnet: "10.10.0.0", NextHop: "10.128.0.5"}},
+		{{Subnet: "10.10.0.0/24", NextHop: "builder"}},
+		{{Subnet: "10.10.0.0/24", NextHop: "10.128.0.5"}, {Subnet: "10.10.0.1/24", NextHop: "10.128.0.6"}},
+	} {
+		if _, err := parseExternalRoutes(routes); err == nil {
+			t.Errorf("%+v: expected an error", routes)
+		}
+	}
+}
+
+func TestReconcileExternalRoutes(t *testing.T) {
+	network := "projects/test-project/global/networks/default"
+	fake := newFakeCompute(
+		// unchanged
+		&compute.Route{Name: "builds-10-10-0-0-24", DestRange: "10.10.0.0/24", Network: network, NextHopIp: "10.128.0.5", Priority: defaultRoutePriority},
+		// to another next hop
+		&compute.Route{Name: "builds-10-10-1-0-24", DestRange: "10.10.1.0/24", Network: network, NextHopIp: "10.128.0.9", Priority: defaultRoutePriority},
+		// no longer wanted
+		&compute.Route{Name: "builds-10-10-2-0-24", DestRange: "10.10.2.0/24", Network: network, NextHopIp: "10.128.0.5", Priority: defaultRoutePriority},
+		// not managed by flannel
+		&compute.Route{Name: "default-route", DestRange: "0.0.0.0/0", Network: network, NextHopIp: "10.128.0.1"},
+	)
+	api, done := newTestAPI(t, fake)
+	defer done()
+	api.routeNamePrefix = "builds-"
+
+	desired, err := parseExternalRoutes([]ExternalRoute{
+		{Subnet: "10.10.0.0/24", NextHop: "10.128.0.5"},
+		{Subnet: "10.10.1.0/24", NextHop: "10.128.0.5"},
+		{Subnet: "10.10.3.0/24", NextHop: "projects/test-project/zones/z/instances/builder"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary, err := api.reconcileExternalRoutes(context.Background(), desired)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &ExternalRoutesSummary{
+		Created:   []string{"10.10.1.0/24", "10.10.3.0/24"},
+		Deleted:   []string{"10.10.1.0/24", "10.10.2.0/24"},
+		Unchanged: []string{"10.10.0.0/24"},
+	}
+	if !reflect.DeepEqual(summary, expected) {
+		t.Errorf("expected %+v, got %+v", expected, summary)
+	}
+	if route := fake.routes["builds-10-10-1-0-24"]; route == nil || route.NextHopIp != "10.128.0.5" {
+		t.Errorf("expected the route to be recreated via 10.128.0.5, got %+v", route)
+	}
+	if route := fake.routes["builds-10-10-3-0-24"]; route == nil || route.NextHopInstance != "projects/test-project/zones/z/instances/builder" {
+		t.Errorf("expected a route via the builder, got %+v", route)
+	}
+	if fake.routes["default-route"] == nil {
+		t.Error("expected the route not managed by flannel to be kept")
+	}
+}
+
+func TestReconcileExternalRoutesDryRun(t *testing.T) {
+	network := "projects/test-project/global/networks/default"
+	fake := newFakeCompute(&compute.Route{Name: "builds-10-10-2-0-24", DestRange: "10.10.2.0/24", Network: network, NextHopIp: "10.128.0.5"})
+	api, done := newTestAPI(t, fake)
+	defer done()
+	api.routeNamePrefix = "builds-"
+	api.dryRun = true
+
+	desired, _ := parseExternalRoutes([]ExternalRoute{{Subnet: "10.10.0.0/24", NextHop: "10.128.0.5"}})
+	summary, err := api.reconcileExternalRoutes(context.Background(), desired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &ExternalRoutesSummary{Created: []string{"10.10.0.0/24"}, Deleted: []string{"10.10.2.0/24"}}
+	if !reflect.DeepEqual(summary, expected) {
+		t.Errorf("expected %+v, got %+v", expected, summary)
+	}
+	if len(fake.inserted) != 0 || len(fake.deleted) != 0 {
+		t.Errorf("expected no changes, got inserted=%v deleted=%v", fake.inserted, fake.deleted)
+	}
+}
+
+func TestReconcileExternalRoutesDefaultPrefix(t *testing.T) {
+	network := "projects/test-project/global/networks/default"
+	fake := newFakeCompute(&compute.Route{Name: "flannel-10-10-2-0-24", DestRange: "10.10.2.0/24", Network: network, NextHopIp: "10.128.0.5"})
+	api, done := newTestAPI(t, fake)
+	defer done()
+
+	desired, _ := parseExternalRoutes([]ExternalRoute{{Subnet: "10.10.0.0/24", NextHop: "10.128.0.5"}})
+	if _, err := api.reconcileExternalRoutes(context.Background(), desired); err == nil || !strings.Contains(err.Error(), "RouteNamePrefix") {
+		t.Errorf("expected the default RouteNamePrefix to be refused, got %v", err)
+	}
+	if len(fake.inserted) != 0 || len(fake.deleted) != 0 {
+		t.Errorf("expected no changes, got inserted=%v deleted=%v", fake.inserted, fake.deleted)
+	}
+}
+
+func TestReconcileExternalRoutesEmpty(t *testing.T) {
+	if _, err := ReconcileExternalRoutes(context.Background(), json.RawMessage(`{"RouteNamePrefix": "builds-"}`), nil, false); err != errNoExternalRoutes {
+		t.Errorf("expected an empty route list to be refused, got %v", err)
+	}
+
+	network := "projects/test-project/global/networks/default"
+	fake := newFakeCompute(
+		&compute.Route{Name: "builds-10-10-0-0-24", DestRange: "10.10.0.0/24", Network: network, NextHopIp: "10.128.0.5"},
+		&compute.Route{Name: "builds-10-10-1-0-24", DestRange: "10.10.1.0/24", Network: network, NextHopIp: "10.128.0.5"},
+	)
+	api, done := newTestAPI(t, fake)
+	defer done()
+	api.routeNamePrefix = "builds-"
+	api.maxPruneFraction = defaultMaxPruneFraction
+
+	// allowed empty, the list still can't delete most routes
+	if _, err := api.reconcileExternalRoutes(context.Background(), map[string]routeNextHop{}); err == nil || !strings.Contains(err.Error(), "MaxPruneFraction") {
+		t.Errorf("expected deleting all routes to be refused, got %v", err)
+	}
+	if len(fake.deleted) != 0 {
+		t.Errorf("expected no routes deleted, got %v", fake.deleted)
+	}
+
+	// recreating a route to another next hop doesn't count as a deletion
+	desired, _ := parseExternalRoutes([]ExternalRoute{
+		{Subnet: "10.10.0.0/24", NextHop: "10.128.0.6"},
+		{Subnet: "10.10.1.0/24", NextHop: "10.128.0.6"},
+	})
+	if _, err := api.reconcileExternalRoutes(context.Background(), desired); err != nil {
+		t.Errorf("expected the routes to be recreated, got %v", err)
+	}
+
+	api.forcePrune = true
+	summary, err := api.reconcileExternalRoutes(context.Background(), map[string]routeNextHop{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"10.10.0.0/24", "10.10.1.0/24"}; !reflect.DeepEqual(summary.Deleted, expected) {
+		t.Errorf("expected %v deleted with ForcePrune, got %v", expected, summary.Deleted)
+	}
+}
+
+func TestDeleteRoutesForInstance(t *testing.T) {
+	network := "projects/test-project/global/networks/default"
+	node := "https://www.googleapis.com/compute/v1/projects/test-project/zones/z/instances/old-node"
+	fake := newFakeCompute(
+		&compute.Route{Name: "flannel-10-10-0-0-24", DestRange: "10.10.0.0/24", Network: network, NextHopInstance: node},
+		&compute.Route{Name: "flannel-10-10-1-0-24", DestRange: "10.10.1.0/24", Network: network, NextHopInstance: node},
+		// to another node
+		&compute.Route{Name: "flannel-10-10-2-0-24", DestRange: "10.10.2.0/24", Network: network, NextHopInstance: node + "-2"},
+		// by IP
+		&compute.Route{Name: "flannel-10-10-3-0-24", DestRange: "10.10.3.0/24", Network: network, NextHopIp: "10.128.0.5"},
+		// not managed by flannel
+		&compute.Route{Name: "custom-route", DestRange: "10.20.0.0/24", Network: network, NextHopInstance: node},
+		// created by flannel for another cluster
+		&compute.Route{Name: "flannel-10-10-4-0-24", DestRange: "10.10.4.0/24", Network: network, NextHopInstance: node,
+			Description: encodeRouteDescription(&routeOwner{Cluster: "other"}, "")},
+	)
+	api, done := newTestAPI(t, fake)
+	defer done()
+
+	deleted, err := api.deleteRoutesForInstance(context.Background(), routeNextHop{instance: "projects/test-project/zones/z/instances/old-node"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"10.10.0.0/24", "10.10.1.0/24"}; !reflect.DeepEqual(deleted, expected) {
+		t.Errorf("expected the routes of %v to be deleted, got %v", expected, deleted)
+	}
+	for _, name := range []string{"flannel-10-10-2-0-24", "flannel-10-10-3-0-24", "custom-route", "flannel-10-10-4-0-24"} {
+		if fake.routes[name] == nil {
+			t.Errorf("expected route %s to be kept", name)
+		}
+	}
+
+	deleted, err = api.deleteRoutesForInstance(context.Background(), routeNextHop{ip: "10.128.0.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"10.10.3.0/24"}; !reflect.DeepEqual(deleted, expected) {
+		t.Errorf("expected the routes of %v to be deleted, got %v", expected, deleted)
+	}
+}
@@ -0,0 +1,322 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package gce
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// fakeCompute implements the subset of the compute API used for routes and
+// firewall rules. Operations complete immediately.
+type fakeCompute struct {
+	mu        sync.Mutex
+	routes    map[string]*compute.Route
+	firewalls map[string]*compute.Firewall
+	networks  map[string]*compute.Network
+	instances map[string]*compute.Instance
+	pageSize  int
+	listed    int
+	inserted  []string
+	deleted   []string
+	updated   []string
+
+	// aliasRanges and fingerprints are those of the network interfaces of
+	// the instances, keyed by instance/interface. staleUpdates updates of
+	// network interfaces fail as if the interface changed meanwhile.
+	aliasRanges  map[string][]aliasIPRange
+	fingerprints map[string]int
+	staleUpdates int
+
+	// managedInstances are those of the instance groups, keyed by
+	// zones/{zone}/{name} or regions/{region}/{name}
+	managedInstances map[string][]*compute.ManagedInstance
+}
+
+func newFakeCompute(routes ...*compute.Route) *fakeCompute {
+	f := &fakeCompute{
+		routes:    make(map[string]*compute.Route),
+		firewalls: make(map[string]*compute.Firewall),
+		networks:  make(map[string]*compute.Network),
+		instances: make(map[string]*compute.Instance),
+
+		aliasRanges:  make(map[string][]aliasIPRange),
+		fingerprints: make(map[string]int),
+
+		managedInstances: make(map[string][]*compute.ManagedInstance),
+	}
+	for _, r := range routes {
+		f.routes[r.Name] = r
+	}
+	return f
+}
+
+func (f *fakeCompute) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// paths are of the form /{project}/global/{collection}[/{name}]
+	// or /{project}/zones/{zone}/{collection}/{name}[/{method}]
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) == 6 && parts[3] == "instanceGroupManagers" && parts[5] == "listManagedInstances" && r.Method == "POST" {
+		instances, ok := f.managedInstances[parts[1]+"/"+parts[2]+"/"+parts[4]]
+		if !ok {
+			writeError(w, http.StatusNotFound, "notFound")
+			return
+		}
+		writeObject(w, &compute.InstanceGroupManagersListManagedInstancesResponse{ManagedInstances: instances})
+		return
+	}
+	if len(parts) >= 5 && parts[1] == "zones" {
+		f.serveZonal(w, r, parts)
+		return
+	}
+	if len(parts) < 3 || parts[1] != "global" {
+		writeError(w, http.StatusNotFound, "notFound")
+		return
+	}
+
+	switch {
+	case parts[2] == "networks" && len(parts) == 4:
+		if network, ok := f.networks[parts[3]]; ok {
+			writeObject(w, network)
+		} else {
+			writeError(w, http.StatusNotFound, "notFound")
+		}
+
+	case parts[2] == "operations" && len(parts) == 4:
+		writeObject(w, &compute.Operation{Name: parts[3], Status: "DONE"})
+
+	case parts[2] == "routes" && len(parts) == 3 && r.Method == "GET":
+		f.list(w, r)
+
+	case parts[2] == "routes" && len(parts) == 3 && r.Method == "POST":
+		var route compute.Route
+		if err := json.NewDecoder(r.Body).Decode(&route); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid")
+			return
+		}
+		if _, ok := f.routes[route.Name]; ok {
+			writeError(w, http.StatusConflict, "alreadyExists")
+			return
+		}
+		f.routes[route.Name] = &route
+		f.inserted = append(f.inserted, route.Name)
+		writeObject(w, &compute.Operation{Name: "insert-" + route.Name})
+
+	case parts[2] == "routes" && len(parts) == 4 && r.Method == "GET":
+		route, ok := f.routes[parts[3]]
+		if !ok {
+			writeError(w, http.StatusNotFound, "notFound")
+			return
+		}
+		writeObject(w, route)
+
+	case parts[2] == "routes" && len(parts) == 4 && r.Method == "DELETE":
+		if _, ok := f.routes[parts[3]]; !ok {
+			writeError(w, http.StatusNotFound, "notFound")
+			return
+		}
+		delete(f.routes, parts[3])
+		f.deleted = append(f.deleted, parts[3])
+		writeObject(w, &compute.Operation{Name: "delete-" + parts[3]})
+
+	case parts[2] == "firewalls":
+		f.serveFirewall(w, r, parts[3:])
+
+	default:
+		writeError(w, http.StatusNotFound, "notFound")
+	}
+}
+
+func (f *fakeCompute) serveZonal(w http.ResponseWriter, r *http.Request, parts []string) {
+	switch {
+	case parts[3] == "operations" && len(parts) == 5:
+		writeObject(w, &compute.Operation{Name: parts[4], Zone: parts[2], Status: "DONE"})
+
+	case parts[3] == "instances" && len(parts) == 5 && r.Method == "GET":
+		instance, ok := f.instances[parts[4]]
+		if !ok {
+			writeError(w, http.StatusNotFound, "notFound")
+			return
+		}
+		f.writeInstance(w, parts[4], instance)
+
+	case parts[3] == "instances" && len(parts) == 6 && parts[5] == "updateNetworkInterface" && r.Method == "PATCH":
+		var nic aliasNIC
+		if err := json.NewDecoder(r.Body).Decode(&nic); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid")
+			return
+		}
+		key := parts[4] + "/" + r.URL.Query().Get("networkInterface")
+		if _, ok := f.instances[parts[4]]; !ok {
+			writeError(w, http.StatusNotFound, "notFound")
+			return
+		}
+		if f.staleUpdates > 0 || nic.Fingerprint != strconv.Itoa(f.fingerprints[key]) {
+			f.staleUpdates--
+			f.fingerprints[key]++
+			writeError(w, http.StatusPreconditionFailed, "conditionNotMet")
+			return
+		}
+		f.aliasRanges[key] = nic.AliasIPRanges
+		f.fingerprints[key]++
+		f.updated = append(f.updated, key)
+		writeObject(w, &compute.Operation{Name: "update-" + parts[4], Zone: parts[2]})
+
+	default:
+		writeError(w, http.StatusNotFound, "notFound")
+	}
+}
+
+// writeInstance writes the instance called name with the alias IP ranges and fingerprints of
+// its network interfaces, which the vendored compute client doesn't know
+func (f *fakeCompute) writeInstance(w http.ResponseWriter, name string, instance *compute.Instance) {
+	data, _ := json.Marshal(instance)
+	var obj map[string]interface{}
+	json.Unmarshal(data, &obj)
+	nics, _ := obj["networkInterfaces"].([]interface{})
+	for _, nic := range nics {
+		nic := nic.(map[string]interface{})
+		nicName, _ := nic["name"].(string)
+		key := name + "/" + nicName
+		nic["fingerprint"] = strconv.Itoa(f.fingerprints[key])
+		if ranges := f.aliasRanges[key]; len(ranges) > 0 {
+			nic["aliasIpRanges"] = ranges
+		}
+	}
+	writeObject(w, obj)
+}
+
+func (f *fakeCompute) serveFirewall(w http.ResponseWriter, r *http.Request, name []string) {
+	switch {
+	case len(name) == 0 && r.Method == "POST":
+		var fw compute.Firewall
+		if err := json.NewDecoder(r.Body).Decode(&fw); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid")
+			return
+		}
+		if _, ok := f.firewalls[fw.Name]; ok {
+			writeError(w, http.StatusConflict, "alreadyExists")
+			return
+		}
+		f.firewalls[fw.Name] = &fw
+		f.inserted = append(f.inserted, fw.Name)
+		writeObject(w, &compute.Operation{Name: "insert-" + fw.Name})
+
+	case len(name) == 1 && r.Method == "GET":
+		fw, ok := f.firewalls[name[0]]
+		if !ok {
+			writeError(w, http.StatusNotFound, "notFound")
+			return
+		}
+		writeObject(w, fw)
+
+	case len(name) == 1 && r.Method == "PUT":
+		var fw compute.Firewall
+		if err := json.NewDecoder(r.Body).Decode(&fw); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid")
+			return
+		}
+		if _, ok := f.firewalls[name[0]]; !ok {
+			writeError(w, http.StatusNotFound, "notFound")
+			return
+		}
+		f.firewalls[name[0]] = &fw
+		f.updated = append(f.updated, name[0])
+		writeObject(w, &compute.Operation{Name: "update-" + name[0]})
+
+	case len(name) == 1 && r.Method == "DELETE":
+		if _, ok := f.firewalls[name[0]]; !ok {
+			writeError(w, http.StatusNotFound, "notFound")
+			return
+		}
+		delete(f.firewalls, name[0])
+		f.deleted = append(f.deleted, name[0])
+		writeObject(w, &compute.Operation{Name: "delete-" + name[0]})
+
+	default:
+		writeError(w, http.StatusNotFound, "notFound")
+	}
+}
+
+func (f *fakeCompute) list(w http.ResponseWriter, r *http.Request) {
+	f.listed++
+
+	// only the "name eq <regexp>" and "destRange eq <regexp>" forms of
+	// filter are supported
+	match := func(*compute.Route) bool { return true }
+	if filter := r.URL.Query().Get("filter"); filter != "" {
+		parts := strings.SplitN(filter, " eq ", 2)
+		if len(parts) != 2 || (parts[0] != "name" && parts[0] != "destRange") {
+			writeError(w, http.StatusBadRequest, "invalid")
+			return
+		}
+		re, err := regexp.Compile("^" + parts[1] + "$")
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid")
+			return
+		}
+		match = func(route *compute.Route) bool {
+			if parts[0] == "destRange" {
+				return re.MatchString(route.DestRange)
+			}
+			return re.MatchString(route.Name)
+		}
+	}
+
+	var names []string
+	for name, route := range f.routes {
+		if match(route) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	start, _ := strconv.Atoi(r.URL.Query().Get("pageToken"))
+	end := len(names)
+	if f.pageSize > 0 && start+f.pageSize < end {
+		end = start + f.pageSize
+	}
+
+	list := &compute.RouteList{}
+	for _, name := range names[start:end] {
+		list.Items = append(list.Items, f.routes[name])
+	}
+	if end < len(names) {
+		list.NextPageToken = strconv.Itoa(end)
+	}
+	writeObject(w, list)
+}
+
+func writeObject(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, reason string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, `{"error": {"code": %d, "message": %q, "errors": [{"reason": %q}]}}`, code, reason, reason)
+}
@@ -0,0 +1,215 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package gce
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+
+	"github.com/coreos/flannel/subnet"
+)
+
+// firewallRuleSuffix and firewallRuleIPv6Suffix end the names of the firewall
+// rules allowing traffic from the IPv4 and IPv6 flannel networks. A rule can't
+// have source ranges of both families.
+const (
+	firewallRuleSuffix     = "allow-pods"
+	firewallRuleIPv6Suffix = "allow-pods-ipv6"
+)
+
+const firewallDescription = "Allows traffic from the flannel network, managed by flannel"
+
+// firewallAllowed is a protocol, and optionally its ports, which the firewall
+// rule allows
+type firewallAllowed struct {
+	Protocol string
+	Ports    []string
+}
+
+// defaultFirewallAllowed allows all protocols
+var defaultFirewallAllowed = []firewallAllowed{{Protocol: "all"}}
+
+// firewallRuleName returns the name of the firewall rule for the IPv4 or IPv6
+// flannel network
+func (api *gceAPI) firewallRuleName(ipv6 bool) string {
+	if ipv6 {
+		return api.routeNamePrefix + firewallRuleIPv6Suffix
+	}
+	return api.routeNamePrefix + firewallRuleSuffix
+}
+
+// planFirewall returns the firewall rule allowing traffic from sourceRanges to
+// the instances of the network
+func (api *gceAPI) planFirewall(cfg *backendConfig, name string, sourceRanges ...string) *compute.Firewall {
+	gn, _, _ := api.resources()
+	allowed := cfg.FirewallAllowed
+	if len(allowed) == 0 {
+		allowed = defaultFirewallAllowed
+	}
+
+	fw := &compute.Firewall{
+		Name:         name,
+		Network:      gn.SelfLink,
+		Description:  firewallDescription,
+		SourceRanges: sourceRanges,
+		SourceTags:   cfg.FirewallSourceTags,
+		TargetTags:   cfg.FirewallTargetTags,
+	}
+	if api.clusterName != "" {
+		fw.Description += " for cluster " + api.clusterName
+	}
+	for _, a := range allowed {
+		fw.Allowed = append(fw.Allowed, &compute.FirewallAllowed{IPProtocol: strings.ToLower(a.Protocol), Ports: a.Ports})
+	}
+	return fw
+}
+
+// ensureFirewalls makes sure the firewall rules allowing traffic from the
+// flannel networks of config exist and are as configured. The rule for an
+// IPv6 network which is no longer configured is deleted.
+func (api *gceAPI) ensureFirewalls(ctx context.Context, cfg *backendConfig, config *subnet.Config) error {
+	var sourceRanges []string
+	for _, n := range config.Networks() {
+		sourceRanges = append(sourceRanges, n.String())
+	}
+	if err := api.ensureFirewall(ctx, api.planFirewall(cfg, api.firewallRuleName(false), sourceRanges...)); err != nil {
+		return err
+	}
+
+	if !config.IPv6Network.Empty() {
+		return api.ensureFirewall(ctx, api.planFirewall(cfg, api.firewallRuleName(true), config.IPv6Network.String()))
+	}
+	return api.deleteFirewall(ctx, api.firewallRuleName(true))
+}
+
+// ensureFirewall inserts want, or updates the existing rule of the same name
+// if it differs
+func (api *gceAPI) ensureFirewall(ctx context.Context, want *compute.Firewall) error {
+	existing, err := api.getFirewall(ctx, want.Name)
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("error getting firewall rule %v: %v", want.Name, err)
+	}
+
+	if existing != nil {
+		if sameFirewall(existing, want) {
+			logger.V(2).Infof("Firewall rule %v already exists in network %v", want.Name, api.networkName)
+			return nil
+		}
+		return api.writeFirewall(ctx, "updating", want, func() (*compute.Operation, error) {
+			return api.computeService.Firewalls.Update(api.networkProject, want.Name, want).Context(ctx).Do()
+		})
+	}
+
+	err = api.writeFirewall(ctx, "inserting", want, func() (*compute.Operation, error) {
+		return api.computeService.Firewalls.Insert(api.networkProject, want).Context(ctx).Do()
+	})
+	if apiError, ok := err.(*googleapi.Error); ok && apiError.Code == http.StatusConflict {
+		// another node created it since, check it is the same
+		return api.ensureFirewall(ctx, want)
+	}
+	return err
+}
+
+// deleteFirewall deletes the firewall rule name if it exists
+func (api *gceAPI) deleteFirewall(ctx context.Context, name string) error {
+	if _, err := api.getFirewall(ctx, name); err != nil {
+		if isNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("error getting firewall rule %v: %v", name, err)
+	}
+
+	err := api.writeFirewall(ctx, "deleting", &compute.Firewall{Name: name}, func() (*compute.Operation, error) {
+		return api.computeService.Firewalls.Delete(api.networkProject, name).Context(ctx).Do()
+	})
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (api *gceAPI) getFirewall(ctx context.Context, name string) (*compute.Firewall, error) {
+	start := time.Now()
+	fw, err := api.computeService.Firewalls.Get(api.networkProject, name).Context(ctx).Do()
+	observeAPICall("getFirewall", start, err)
+	return fw, err
+}
+
+// writeFirewall changes the firewall rule fw with write, subject to the write
+// rate limit and retries like routes, and waits for the operation to complete
+func (api *gceAPI) writeFirewall(ctx context.Context, what string, fw *compute.Firewall, write func() (*compute.Operation, error)) error {
+	if api.dryRun {
+		logger.V(1).Infof("Dry run: not %s firewall rule %v in network %v", what, fw.Name, api.networkName)
+		return nil
+	}
+	logger.V(1).Infof("%s firewall rule %v in network %v source ranges %v", strings.Title(what), fw.Name, api.networkName, fw.SourceRanges)
+	if err := api.waitForWrite(ctx); err != nil {
+		return err
+	}
+
+	var operation *compute.Operation
+	err := api.withRetries(ctx, what+" firewall rule "+fw.Name, func() error {
+		var err error
+		start := time.Now()
+		operation, err = write()
+		observeAPICall("writeFirewall", start, err)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := api.pollOperationStatus(ctx, operation); err != nil {
+		return fmt.Errorf("error %s firewall rule %v: %v", what, fw.Name, err)
+	}
+	return nil
+}
+
+// sameFirewall returns true if actual, as read from the API, allows what want
+// does. The order of ranges, tags and protocols doesn't matter.
+func sameFirewall(actual, want *compute.Firewall) bool {
+	return sameLink(actual.Network, want.Network) &&
+		sameStrings(actual.SourceRanges, want.SourceRanges) &&
+		sameStrings(actual.SourceTags, want.SourceTags) &&
+		sameStrings(actual.TargetTags, want.TargetTags) &&
+		sameStrings(allowedStrings(actual.Allowed), allowedStrings(want.Allowed))
+}
+
+func allowedStrings(allowed []*compute.FirewallAllowed) []string {
+	var s []string
+	for _, a := range allowed {
+		s = append(s, strings.ToLower(a.IPProtocol)+":"+strings.Join(a.Ports, ","))
+	}
+	return s
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	return reflect.DeepEqual(a, b)
+}
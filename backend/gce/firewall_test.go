@@ -0,0 +1,180 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package gce
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/api/compute/v1"
+
+	"github.com/coreos/flannel/subnet"
+)
+
+func firewallTestConfig(t *testing.T, ipv6 string) *subnet.Config {
+	s := `{"Network": "10.0.0.0/16"`
+	if ipv6 != "" {
+		s += `, "IPv6Network": "` + ipv6 + `"`
+	}
+	config, err := subnet.ParseConfig(s + "}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestEnsureFirewalls(t *testing.T) {
+	fake := newFakeCompute()
+	api, done := newTestAPI(t, fake)
+	defer done()
+
+	cfg := &backendConfig{FirewallTargetTags: []string{"nodes"}}
+	config := firewallTestConfig(t, "fd00::/48")
+	if err := api.ensureFirewalls(context.Background(), cfg, config); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	fw := fake.firewalls["flannel-allow-pods"]
+	if fw == nil {
+		t.Fatalf("expected the firewall rule to be inserted, got %v", fake.inserted)
+	}
+	if len(fw.SourceRanges) != 1 || fw.SourceRanges[0] != "10.0.0.0/16" {
+		t.Errorf("unexpected source ranges %v", fw.SourceRanges)
+	}
+	if len(fw.Allowed) != 1 || fw.Allowed[0].IPProtocol != "all" {
+		t.Errorf("unexpected allowed %v", allowedStrings(fw.Allowed))
+	}
+	if fw.Network != api.gceNetwork.SelfLink {
+		t.Errorf("unexpected network %v", fw.Network)
+	}
+	if fw6 := fake.firewalls["flannel-allow-pods-ipv6"]; fw6 == nil || fw6.SourceRanges[0] != "fd00::/48" {
+		t.Errorf("expected the IPv6 firewall rule to be inserted, got %v", fw6)
+	}
+
+	// ensuring it again changes nothing
+	fake.inserted = nil
+	if err := api.ensureFirewalls(context.Background(), cfg, config); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(fake.inserted) != 0 || len(fake.updated) != 0 {
+		t.Errorf("expected no changes, got inserted %v updated %v", fake.inserted, fake.updated)
+	}
+
+	// the IPv6 rule is deleted once the IPv6 network is no longer configured
+	if err := api.ensureFirewalls(context.Background(), cfg, firewallTestConfig(t, "")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := fake.firewalls["flannel-allow-pods-ipv6"]; ok {
+		t.Errorf("expected the IPv6 firewall rule to be deleted")
+	}
+}
+
+func TestEnsureFirewallsUpdate(t *testing.T) {
+	fake := newFakeCompute()
+	api, done := newTestAPI(t, fake)
+	defer done()
+
+	fake.firewalls["flannel-allow-pods"] = &compute.Firewall{
+		Name:         "flannel-allow-pods",
+		Network:      api.gceNetwork.SelfLink,
+		SourceRanges: []string{"10.1.0.0/16"},
+		Allowed:      []*compute.FirewallAllowed{{IPProtocol: "all"}},
+	}
+
+	cfg := &backendConfig{FirewallAllowed: []firewallAllowed{{Protocol: "udp", Ports: []string{"8472"}}, {Protocol: "TCP"}}}
+	if err := api.ensureFirewalls(context.Background(), cfg, firewallTestConfig(t, "")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(fake.updated) != 1 {
+		t.Fatalf("expected the firewall rule to be updated, got %v", fake.updated)
+	}
+	fw := fake.firewalls["flannel-allow-pods"]
+	if fw.SourceRanges[0] != "10.0.0.0/16" {
+		t.Errorf("unexpected source ranges %v", fw.SourceRanges)
+	}
+	if !sameStrings(allowedStrings(fw.Allowed), []string{"tcp:", "udp:8472"}) {
+		t.Errorf("unexpected allowed %v", allowedStrings(fw.Allowed))
+	}
+}
+
+func TestEnsureFirewallsSecondaryNetworks(t *testing.T) {
+	fake := newFakeCompute()
+	api, done := newTestAPI(t, fake)
+	defer done()
+
+	cfg := &backendConfig{}
+	if err := api.ensureFirewalls(context.Background(), cfg, firewallTestConfig(t, "")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// adding a secondary network lets its pods in too
+	config, err := subnet.ParseConfig(`{"Network": "10.0.0.0/16", "SecondaryNetworks": ["10.5.0.0/16"]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := api.ensureFirewalls(context.Background(), cfg, config); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(fake.updated) != 1 {
+		t.Fatalf("expected the firewall rule to be updated, got %v", fake.updated)
+	}
+	if fw := fake.firewalls["flannel-allow-pods"]; !sameStrings(fw.SourceRanges, []string{"10.0.0.0/16", "10.5.0.0/16"}) {
+		t.Errorf("unexpected source ranges %v", fw.SourceRanges)
+	}
+}
+
+func TestEnsureFirewallsDryRun(t *testing.T) {
+	fake := newFakeCompute()
+	api, done := newTestAPI(t, fake)
+	defer done()
+
+	api.dryRun = true
+	if err := api.ensureFirewalls(context.Background(), &backendConfig{}, firewallTestConfig(t, "")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(fake.firewalls) != 0 {
+		t.Errorf("expected no firewall rule to be inserted in a dry run")
+	}
+}
+
+func TestSameFirewall(t *testing.T) {
+	a := &compute.Firewall{
+		Network:      "https://www.googleapis.com/compute/v1/projects/p/global/networks/default",
+		SourceRanges: []string{"10.0.0.0/16"},
+		TargetTags:   []string{"b", "a"},
+		Allowed:      []*compute.FirewallAllowed{{IPProtocol: "udp"}, {IPProtocol: "tcp", Ports: []string{"80"}}},
+	}
+	b := &compute.Firewall{
+		Network:      "projects/p/global/networks/default",
+		SourceRanges: []string{"10.0.0.0/16"},
+		TargetTags:   []string{"a", "b"},
+		Allowed:      []*compute.FirewallAllowed{{IPProtocol: "tcp", Ports: []string{"80"}}, {IPProtocol: "udp"}},
+	}
+	if !sameFirewall(a, b) {
+		t.Errorf("expected the firewall rules to be the same")
+	}
+	b.Allowed[0].Ports = []string{"443"}
+	if sameFirewall(a, b) {
+		t.Errorf("expected the firewall rules to differ")
+	}
+}
+
+func TestBackendConfigValidateFirewallAllowed(t *testing.T) {
+	cfg := backendConfig{FirewallAllowed: []firewallAllowed{{Protocol: "tcp"}, {Ports: []string{"80"}}}}
+	if err := cfg.validate(); err == nil {
+		t.Errorf("expected an error for a missing protocol")
+	}
+}
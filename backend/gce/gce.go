@@ -39,16 +39,26 @@
 package gce
 
 import (
+	"encoding/json"
 	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
 	"strings"
 	"sync"
+	"time"
 
 	log "github.com/golang/glog"
+	"github.com/jonboulle/clockwork"
 	"golang.org/x/net/context"
+	"google.golang.org/api/compute/v1"
 	"google.golang.org/api/googleapi"
 
 	"github.com/coreos/flannel/backend"
 	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/logging"
 	"github.com/coreos/flannel/subnet"
 )
 
@@ -58,32 +68,667 @@ func init() {
 
 var metadataEndpoint = "http://169.254.169.254/computeMetadata/v1"
 
-var replacer = strings.NewReplacer(".", "-", "/", "-")
+const defaultRouteNamePrefix = "flannel-"
+
+// route name prefixes must start a valid name, and leave room for the subnet
+var routeNamePrefixRegexp = regexp.MustCompile(`^[a-z][-a-z0-9]*$`)
+
+const maxRouteNamePrefixLength = 24
+
+// route name replacements may only produce characters valid in names
+var routeNameReplacementRegexp = regexp.MustCompile(`^[-a-z0-9]*$`)
+
+// GCE resource names must match this and be at most maxRouteNameLength long
+var routeNameRegexp = regexp.MustCompile(`^[a-z]([-a-z0-9]*[a-z0-9])?$`)
+
+// projectIDRegexp matches project IDs, optionally scoped to a domain
+var projectIDRegexp = regexp.MustCompile(`^([-a-z0-9.]+:)?[a-z][-a-z0-9]{4,28}[a-z0-9]$`)
+
+// logger gates the verbose logs of the backend on the level of the gce
+// subsystem
+var logger = logging.New("gce")
+
+const (
+	maxRouteNameLength = 63
+	// routeNameHashLength is the number of hex digits of the subnet hash
+	// used in names which would otherwise be invalid
+	routeNameHashLength = 16
+	// maxQualifiedRouteNamePrefixLength bounds route name prefixes which
+	// include the network name, longer ones use networkNameHashLength hex
+	// digits of a hash of the network name instead
+	maxQualifiedRouteNamePrefixLength = 40
+	networkNameHashLength             = 8
+)
+
+const (
+	defaultRoutePriority = 1000
+	maxRoutePriority     = 65535
+
+	defaultRefreshInterval = 300
+
+	defaultReconcileInterval = 300
+
+	defaultOperationLogInterval = 10
+
+	// defaultOperationTimeout matches the deadline of defaultPollBackoff
+	defaultOperationTimeout = 100
+
+	// operationPollModeGet fetches operations until they are done,
+	// operationPollModeWait waits for them on the server instead
+	operationPollModeGet  = "get"
+	operationPollModeWait = "wait"
+
+	// shutdownModeRetain leaves the routes of the lease in place on
+	// shutdown, shutdownModeClean deletes them
+	shutdownModeRetain = "retain"
+	shutdownModeClean  = "clean"
+
+	// adoptRoutesKeep uses an existing route which flannel didn't create,
+	// to the same range and next hop as the route flannel wants, instead
+	// of creating its own, adoptRoutesRecreate replaces it with a route
+	// named by flannel
+	adoptRoutesKeep     = "keep"
+	adoptRoutesRecreate = "recreate"
+
+	// routingModeRoutes creates a route for each subnet of the lease,
+	// routingModeAliasIP assigns them as alias IP ranges to the network
+	// interface of the instance instead
+	routingModeRoutes  = "routes"
+	routingModeAliasIP = "alias-ip"
+
+	// nextHopResolutionInstance routes via the link of the instance, unless
+	// it is in another project than the network, nextHopResolutionIP via
+	// its IP, and nextHopResolutionInstanceGroup via the link the managed
+	// instance group reports for it, or its IP while the group replaces it
+	nextHopResolutionInstance      = "instance"
+	nextHopResolutionIP            = "ip"
+	nextHopResolutionInstanceGroup = "instance-group"
+
+	// defaultShutdownTimeout bounds deleting the routes on shutdown, in
+	// seconds
+	defaultShutdownTimeout = 60
+
+	defaultMaxAttempts = 3
+
+	// the flannel routes in each network are counted every
+	// defaultRouteQuotaCheckInterval seconds, and a warning logged once
+	// they reach defaultRouteQuotaWarnThreshold of defaultRouteQuota, the
+	// default route quota of a project
+	defaultRouteQuota              = 250
+	defaultRouteQuotaWarnThreshold = 0.8
+	defaultRouteQuotaCheckInterval = 600
+
+	defaultRouteDescription = "Created by flannel on {{.Instance}}"
+
+	// route writes are limited to defaultWriteRateLimit per second by
+	// default, well below the default per project write quota
+	defaultWriteRateLimit = 2
+	defaultWriteBurst     = 5
+	// pruning stale routes is refused by default when it would delete
+	// more than half of the flannel routes in a network, e.g. because of
+	// a transiently empty lease list
+	defaultMaxPruneFraction = 0.5
+	// writeJitterFraction adds up to 1/writeJitterFraction of a rate
+	// limited write's delay
+	writeJitterFraction = 10
+
+	// route writes are paused for defaultCircuitBreakerCooldown seconds
+	// once defaultCircuitBreakerThreshold of them failed in a row
+	defaultCircuitBreakerThreshold = 5
+	defaultCircuitBreakerCooldown  = 60
+
+	// defaultWriteConcurrency bounds the route inserts and deletes issued
+	// at once when changing many routes
+	defaultWriteConcurrency = 5
+
+	// connections to the compute API are kept for concurrent writes, and
+	// idle for a little longer than the default reconcile interval
+	defaultMaxIdleConnsPerHost = defaultWriteConcurrency
+	defaultIdleConnTimeout     = defaultReconcileInterval + 60
+	defaultKeepAlive           = 30
+)
+
+type backendConfig struct {
+	RoutePriority    int64
+	Tags             []string
+	PruneStaleRoutes bool
+	// MaxPruneFraction is the largest fraction of the flannel routes in a
+	// network which pruning stale routes may delete, it deletes none
+	// rather than more unless ForcePrune is set. Zero disables the check.
+	MaxPruneFraction float64
+	ForcePrune       bool
+	CredentialsFile  string
+	// RoutePriorities maps destination ranges to the priority of the
+	// routes for the subnets within them, the most specific range applies.
+	// RoutePriority applies to the subnets in none.
+	RoutePriorities map[string]int64
+	// PruneOwnStaleRoutes deletes the routes to this instance for subnets
+	// other than those of its lease at startup
+	PruneOwnStaleRoutes bool
+	// ComputeEndpoint is the base URL of the compute API, including the
+	// version path, e.g. https://www.googleapis.com/compute/v1/projects/
+	ComputeEndpoint string
+	// QuotaProject is the project compute API requests are billed to and
+	// count against the quota of. Empty means EnvGCEQuotaProject, if set,
+	// else the project of the credentials.
+	QuotaProject string
+	// HTTPSProxy and NoProxy override the HTTPS_PROXY and NO_PROXY
+	// environment variables for the requests to the compute API
+	HTTPSProxy string
+	NoProxy    string
+	// NextHopInterface and MatchNextHopInterfaceNetwork select the network
+	// interface whose IP is the next hop when routing by IP. NextHopIP
+	// selects the interface with that IP instead, and
+	// MatchNextHopInterfaceIP the interface with the IP of the interface
+	// flannel uses, failing if the instance has none.
+	NextHopInterface             int
+	MatchNextHopInterfaceNetwork bool
+	NextHopIP                    string
+	MatchNextHopInterfaceIP      bool
+	// RouteNamePrefix starts the names of the routes flannel manages, so
+	// that several clusters can share a network. Empty means
+	// defaultRouteNamePrefix.
+	RouteNamePrefix string
+	// RouteNameReplacements maps strings in subnets to what replaces them
+	// in route names, on top of DefaultRouteNameReplacements. Replacements
+	// may only contain lowercase letters, digits and dashes.
+	RouteNameReplacements map[string]string
+	// NextHopIlb is the link of an internal load balancer forwarding rule
+	// which routes go to instead of the instance
+	NextHopIlb string
+	// RouteNextHops maps destination ranges to the link of a gateway or
+	// VPN tunnel which the routes for the subnets within them go to
+	// instead of the instance, the most specific range applies
+	RouteNextHops map[string]string
+	// NextHopResolution selects how the next hop of the routes to the
+	// instance is resolved, nextHopResolutionInstance if empty
+	NextHopResolution string
+	// ForceNextHopInstance routes via the instance rather than its IP,
+	// even when the network is in another project
+	ForceNextHopInstance bool
+	DryRun               bool
+	// ReadOnly only checks that the routes of the lease exist and point
+	// at the instance, and never inserts or deletes routes, for routes
+	// managed by a separate privileged process
+	ReadOnly bool
+	// RefreshInterval is how often, in seconds, the network and instance
+	// are fetched again. Zero disables refreshing.
+	RefreshInterval int
+	// ReconcileInterval is how often, in seconds, the routes of the lease
+	// are checked and repaired. Zero disables periodic reconciles, they
+	// can still be triggered on demand.
+	ReconcileInterval int
+	// OperationLogInterval is how often, in seconds, an operation which is
+	// still running is logged. Zero disables it.
+	OperationLogInterval int
+	// OperationTimeout is how long, in seconds, flannel waits for an
+	// operation to complete. Zero means defaultOperationTimeout.
+	OperationTimeout int
+	// OperationPollMode is how flannel waits for operations to complete,
+	// operationPollModeGet or operationPollModeWait. Empty means
+	// operationPollModeGet.
+	OperationPollMode string
+	// RouteDescription is a text/template for the description of created
+	// routes, see routeDescriptionData
+	RouteDescription string
+	ClusterName      string
+	// WriteRateLimit is the number of route inserts and deletes allowed per
+	// second, with bursts of up to WriteBurst. Zero disables the limit.
+	WriteRateLimit float64
+	WriteBurst     int
+	// WriteConcurrency is the number of route inserts and deletes of a
+	// batch, e.g. pruning stale routes or applying a route diff, which are
+	// in flight at once. Zero means defaultWriteConcurrency.
+	WriteConcurrency int
+	// MaxAttempts is the number of times a route insert or delete which
+	// failed transiently is tried
+	MaxAttempts int
+	// CircuitBreakerThreshold is the number of route inserts and deletes
+	// failing in a row, after their retries, which pause route writes for
+	// CircuitBreakerCooldown seconds. Zero disables pausing.
+	CircuitBreakerThreshold int
+	CircuitBreakerCooldown  int
+	// RetryBudget is the number of retries and repeated operation polls
+	// the backend may make at once, refilled at RetryBudgetRefillRate
+	// per second. Zero disables the budget.
+	RetryBudget           int
+	RetryBudgetRefillRate float64
+	// SkipInstanceLookup avoids fetching the instance at startup when
+	// routes don't go to its IP, so only its link is needed
+	SkipInstanceLookup bool
+	// VerifyPermissions checks the credentials can manage routes at startup
+	VerifyPermissions bool
+	// Networks are the names of the networks to create routes in. Empty
+	// means the network of the instance, from the metadata server.
+	Networks []string
+	// Project, Zone and InstanceName identify the instance instead of the
+	// metadata server, for environments where it reports another identity
+	// than the instance's in the compute API. Empty means the metadata
+	// server's. Networks likewise replaces the network it reports.
+	Project      string
+	Zone         string
+	InstanceName string
+	// ManageFirewall ensures a firewall rule in each network allowing
+	// FirewallAllowed from the flannel network, and from instances with
+	// FirewallSourceTags, to instances with FirewallTargetTags. Empty
+	// FirewallAllowed allows all protocols, empty FirewallTargetTags all
+	// instances.
+	ManageFirewall     bool
+	FirewallAllowed    []firewallAllowed
+	FirewallSourceTags []string
+	FirewallTargetTags []string
+	// MaxIdleConnsPerHost, IdleConnTimeout and KeepAlive tune the reuse
+	// of connections to the compute API, the timeouts are in seconds
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     int
+	KeepAlive           int
+	// ShutdownMode is what happens to the routes of the lease when flannel
+	// stops, shutdownModeRetain or shutdownModeClean. Empty means
+	// shutdownModeRetain. With shutdownModeRetain, a ShutdownGracePeriod
+	// in seconds deletes them once it has passed, or the lease expired.
+	// ShutdownTimeout is how long, in seconds, deleting them may take
+	// before the rest are left in place.
+	ShutdownMode        string
+	ShutdownGracePeriod int
+	ShutdownTimeout     int
+	// AdoptRoutes is what happens to existing routes which flannel didn't
+	// create but which are equivalent to the route it wants for a subnet
+	// of the lease, adoptRoutesKeep or adoptRoutesRecreate. Empty means
+	// they are ignored, and flannel creates its route alongside them.
+	AdoptRoutes string
+	// RecreateOutdatedRoutes recreates the routes of the lease which were
+	// created with an older routeSchemaVersion, or before it was recorded
+	// in their description, so that they get the fields flannel sets now
+	RecreateOutdatedRoutes bool
+	// RoutingMode is how the subnets of the lease are routed to the
+	// instance, routingModeRoutes or routingModeAliasIP. Empty means
+	// routingModeRoutes. AliasIPRangeName is the secondary range of the
+	// subnetwork the alias IP ranges come from, empty means its primary
+	// range.
+	RoutingMode      string
+	AliasIPRangeName string
+	// RouteQuota is the number of flannel routes a network may hold, a
+	// warning is logged once RouteQuotaWarnThreshold of it is used. The
+	// routes are counted every RouteQuotaCheckInterval seconds, a zero
+	// RouteQuota or RouteQuotaCheckInterval disables counting them.
+	RouteQuota              int
+	RouteQuotaWarnThreshold float64
+	RouteQuotaCheckInterval int
+}
+
+func (c *backendConfig) validate() error {
+	if c.RoutePriority < 0 || c.RoutePriority > maxRoutePriority {
+		return fmt.Errorf("invalid RoutePriority %d: must be between 0 and %d", c.RoutePriority, maxRoutePriority)
+	}
+	if c.NextHopInterface < 0 {
+		return fmt.Errorf("invalid NextHopInterface %d: must not be negative", c.NextHopInterface)
+	}
+	if c.NextHopIP != "" || c.MatchNextHopInterfaceIP {
+		if c.NextHopIP != "" && c.MatchNextHopInterfaceIP {
+			return fmt.Errorf("invalid NextHopIP %q: can't be combined with MatchNextHopInterfaceIP", c.NextHopIP)
+		}
+		if c.NextHopIP != "" {
+			if ip := net.ParseIP(c.NextHopIP); ip == nil || ip.To4() == nil {
+				return fmt.Errorf("invalid NextHopIP %q: must be an IPv4 address", c.NextHopIP)
+			}
+		}
+		if c.NextHopInterface != 0 || c.MatchNextHopInterfaceNetwork || len(c.Networks) > 1 {
+			return fmt.Errorf("invalid NextHopIP or MatchNextHopInterfaceIP: can't be combined with NextHopInterface, MatchNextHopInterfaceNetwork or several Networks")
+		}
+	}
+	if c.MaxPruneFraction < 0 || c.MaxPruneFraction > 1 {
+		return fmt.Errorf("invalid MaxPruneFraction %v: must be between 0 and 1", c.MaxPruneFraction)
+	}
+	if c.WriteRateLimit < 0 {
+		return fmt.Errorf("invalid WriteRateLimit %v: must not be negative", c.WriteRateLimit)
+	}
+	if c.WriteBurst < 0 {
+		return fmt.Errorf("invalid WriteBurst %d: must not be negative", c.WriteBurst)
+	}
+	if c.WriteConcurrency < 0 {
+		return fmt.Errorf("invalid WriteConcurrency %d: must not be negative", c.WriteConcurrency)
+	}
+	if c.CircuitBreakerThreshold < 0 {
+		return fmt.Errorf("invalid CircuitBreakerThreshold %d: must not be negative", c.CircuitBreakerThreshold)
+	}
+	if c.CircuitBreakerThreshold > 0 && c.CircuitBreakerCooldown <= 0 {
+		return fmt.Errorf("invalid CircuitBreakerCooldown %d: must be positive", c.CircuitBreakerCooldown)
+	}
+	if c.RetryBudget < 0 {
+		return fmt.Errorf("invalid RetryBudget %d: must not be negative", c.RetryBudget)
+	}
+	if c.RetryBudget > 0 && c.RetryBudgetRefillRate <= 0 {
+		return fmt.Errorf("invalid RetryBudgetRefillRate %v: must be positive", c.RetryBudgetRefillRate)
+	}
+	if c.ComputeEndpoint != "" {
+		if u, err := url.Parse(c.ComputeEndpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid ComputeEndpoint %q: must be an absolute URL", c.ComputeEndpoint)
+		}
+	}
+	if c.HTTPSProxy != "" {
+		if _, err := url.Parse(c.HTTPSProxy); err != nil {
+			return fmt.Errorf("invalid HTTPSProxy %q: %v", c.HTTPSProxy, err)
+		}
+	}
+	if c.NextHopIlb != "" && c.ForceNextHopInstance {
+		return fmt.Errorf("invalid NextHopIlb: can't be combined with ForceNextHopInstance")
+	}
+	if c.MaxAttempts < 0 {
+		return fmt.Errorf("invalid MaxAttempts %d: must not be negative", c.MaxAttempts)
+	}
+	if c.OperationLogInterval < 0 {
+		return fmt.Errorf("invalid OperationLogInterval %d: must not be negative", c.OperationLogInterval)
+	}
+	if c.OperationTimeout < 0 {
+		return fmt.Errorf("invalid OperationTimeout %d: must not be negative", c.OperationTimeout)
+	}
+	switch c.OperationPollMode {
+	case "", operationPollModeGet, operationPollModeWait:
+	default:
+		return fmt.Errorf("invalid OperationPollMode %q: must be %q or %q", c.OperationPollMode, operationPollModeGet, operationPollModeWait)
+	}
+	switch c.ShutdownMode {
+	case "", shutdownModeRetain, shutdownModeClean:
+	default:
+		return fmt.Errorf("invalid ShutdownMode %q: must be %q or %q", c.ShutdownMode, shutdownModeRetain, shutdownModeClean)
+	}
+	switch c.AdoptRoutes {
+	case "", adoptRoutesKeep, adoptRoutesRecreate:
+	default:
+		return fmt.Errorf("invalid AdoptRoutes %q: must be %q or %q", c.AdoptRoutes, adoptRoutesKeep, adoptRoutesRecreate)
+	}
+	if c.ShutdownGracePeriod < 0 {
+		return fmt.Errorf("invalid ShutdownGracePeriod %d: must not be negative", c.ShutdownGracePeriod)
+	}
+	if c.ShutdownGracePeriod > 0 && c.ShutdownMode == shutdownModeClean {
+		return fmt.Errorf("invalid ShutdownGracePeriod %d: only applies to ShutdownMode %q", c.ShutdownGracePeriod, shutdownModeRetain)
+	}
+	if c.ShutdownTimeout < 0 {
+		return fmt.Errorf("invalid ShutdownTimeout %d: must not be negative", c.ShutdownTimeout)
+	}
+	switch c.NextHopResolution {
+	case "", nextHopResolutionInstance:
+	case nextHopResolutionIP, nextHopResolutionInstanceGroup:
+		if c.ForceNextHopInstance || c.NextHopIlb != "" {
+			return fmt.Errorf("invalid NextHopResolution %q: can't be combined with ForceNextHopInstance or NextHopIlb", c.NextHopResolution)
+		}
+	default:
+		return fmt.Errorf("invalid NextHopResolution %q: must be %q, %q or %q", c.NextHopResolution,
+			nextHopResolutionInstance, nextHopResolutionIP, nextHopResolutionInstanceGroup)
+	}
+	switch c.RoutingMode {
+	case "", routingModeRoutes:
+		if c.AliasIPRangeName != "" {
+			return fmt.Errorf("invalid AliasIPRangeName %q: only applies to RoutingMode %q", c.AliasIPRangeName, routingModeAliasIP)
+		}
+	case routingModeAliasIP:
+		if c.NextHopIlb != "" || c.ForceNextHopInstance || len(c.RouteNextHops) > 0 {
+			return fmt.Errorf("invalid RoutingMode %q: can't be combined with NextHopIlb, ForceNextHopInstance or RouteNextHops", c.RoutingMode)
+		}
+		if c.AdoptRoutes != "" {
+			return fmt.Errorf("invalid AdoptRoutes %q: only applies to RoutingMode %q", c.AdoptRoutes, routingModeRoutes)
+		}
+		if c.RecreateOutdatedRoutes {
+			return fmt.Errorf("invalid RecreateOutdatedRoutes: only applies to RoutingMode %q", routingModeRoutes)
+		}
+		if len(c.Networks) > 1 {
+			return fmt.Errorf("invalid RoutingMode %q: alias IP ranges are assigned in a single network", c.RoutingMode)
+		}
+	default:
+		return fmt.Errorf("invalid RoutingMode %q: must be %q or %q", c.RoutingMode, routingModeRoutes, routingModeAliasIP)
+	}
+	if c.RouteQuota < 0 {
+		return fmt.Errorf("invalid RouteQuota %d: must not be negative", c.RouteQuota)
+	}
+	if c.RouteQuota > 0 && (c.RouteQuotaWarnThreshold <= 0 || c.RouteQuotaWarnThreshold > 1) {
+		return fmt.Errorf("invalid RouteQuotaWarnThreshold %v: must be greater than 0 and at most 1", c.RouteQuotaWarnThreshold)
+	}
+	if c.RouteQuotaCheckInterval < 0 {
+		return fmt.Errorf("invalid RouteQuotaCheckInterval %d: must not be negative", c.RouteQuotaCheckInterval)
+	}
+	if c.ReadOnly {
+		if c.ManageFirewall {
+			return fmt.Errorf("invalid ReadOnly: can't be combined with ManageFirewall")
+		}
+		if c.ShutdownMode == shutdownModeClean || c.ShutdownGracePeriod > 0 {
+			return fmt.Errorf("invalid ReadOnly: routes can't be deleted on shutdown")
+		}
+		if c.AdoptRoutes == adoptRoutesRecreate {
+			return fmt.Errorf("invalid ReadOnly: adopted routes can't be recreated")
+		}
+		if c.RecreateOutdatedRoutes {
+			return fmt.Errorf("invalid ReadOnly: outdated routes can't be recreated")
+		}
+	}
+	if c.MaxIdleConnsPerHost < 0 {
+		return fmt.Errorf("invalid MaxIdleConnsPerHost %d: must not be negative", c.MaxIdleConnsPerHost)
+	}
+	if c.IdleConnTimeout < 0 {
+		return fmt.Errorf("invalid IdleConnTimeout %d: must not be negative", c.IdleConnTimeout)
+	}
+	if c.RefreshInterval < 0 {
+		return fmt.Errorf("invalid RefreshInterval %d: must not be negative", c.RefreshInterval)
+	}
+	if c.ReconcileInterval < 0 {
+		return fmt.Errorf("invalid ReconcileInterval %d: must not be negative", c.ReconcileInterval)
+	}
+	if c.RouteNamePrefix != "" && (!routeNamePrefixRegexp.MatchString(c.RouteNamePrefix) || len(c.RouteNamePrefix) > maxRouteNamePrefixLength) {
+		return fmt.Errorf("invalid RouteNamePrefix %q: must start with a lowercase letter, contain only lowercase letters, digits and dashes and be at most %d characters long",
+			c.RouteNamePrefix, maxRouteNamePrefixLength)
+	}
+	for old, repl := range c.RouteNameReplacements {
+		if old == "" || !routeNameReplacementRegexp.MatchString(repl) {
+			return fmt.Errorf("invalid RouteNameReplacements %q: %q: must replace a non-empty string with lowercase letters, digits and dashes", old, repl)
+		}
+	}
+	if _, err := parseRouteDescription(c.RouteDescription); err != nil {
+		return err
+	}
+	if _, err := parseRoutePriorities(c.RoutePriorities); err != nil {
+		return err
+	}
+	if _, err := parseRouteNextHops(c.RouteNextHops); err != nil {
+		return err
+	}
+	for _, a := range c.FirewallAllowed {
+		if a.Protocol == "" {
+			return fmt.Errorf("invalid FirewallAllowed: Protocol must be set")
+		}
+	}
+	seen := make(map[string]bool)
+	for _, name := range c.Networks {
+		if !routeNameRegexp.MatchString(name) || len(name) > maxRouteNameLength {
+			return fmt.Errorf("invalid network name %q in Networks", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("invalid Networks: %q is listed more than once", name)
+		}
+		seen[name] = true
+	}
+	if c.Project != "" && !projectIDRegexp.MatchString(c.Project) {
+		return fmt.Errorf("invalid Project %q", c.Project)
+	}
+	if c.Zone != "" && (!routeNameRegexp.MatchString(c.Zone) || len(c.Zone) > maxRouteNameLength) {
+		return fmt.Errorf("invalid Zone %q", c.Zone)
+	}
+	if c.InstanceName != "" && (!routeNameRegexp.MatchString(c.InstanceName) || len(c.InstanceName) > maxRouteNameLength) {
+		return fmt.Errorf("invalid InstanceName %q", c.InstanceName)
+	}
+	return nil
+}
 
 type GCEBackend struct {
 	sm       subnet.Manager
 	extIface *backend.ExternalInterface
-	apiInit  sync.Once
-	api      *gceAPI
+
+	// mu guards the fields below. The compute service and identity are
+	// kept when creating the API fails, so that retrying is cheap.
+	mu             sync.Mutex
+	computeService *compute.Service
+	httpClient     *http.Client
+	identity       *gceIdentity
+	// clock drives the waits and timeouts of the APIs, the real clock
+	// unless replaced in tests
+	clock clockwork.Clock
+	// metadata resolves the identity, the live metadata server unless
+	// replaced in tests
+	metadata metadataClient
+	// apis manage the routes in each network, the first is the network
+	// of the instance unless Networks is configured
+	apis []*gceAPI
 }
 
 func New(sm subnet.Manager, extIface *backend.ExternalInterface) (backend.Backend, error) {
 	gb := GCEBackend{
 		sm:       sm,
 		extIface: extIface,
+		metadata: newMetadataServer(),
+		clock:    clockwork.NewRealClock(),
 	}
 	return &gb, nil
 }
 
-func (g *GCEBackend) ensureAPI() error {
-	var err error
-	g.apiInit.Do(func() {
-		g.api, err = newAPI()
-	})
-	return err
+// Capabilities reports the IPv6 routes, dry runs, firewall rules, alias IP
+// ranges and route reconciles the backend supports
+func (g *GCEBackend) Capabilities() backend.Capabilities {
+	return backend.Capabilities{
+		IPv6:           true,
+		DryRun:         true,
+		Firewall:       true,
+		AliasIP:        true,
+		RouteReconcile: true,
+	}
+}
+
+func (g *GCEBackend) ensureAPI(ctx context.Context, cfg *backendConfig) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if len(g.apis) > 0 {
+		return nil
+	}
+
+	if g.computeService == nil {
+		cs, client, err := newComputeService(ctx, cfg.CredentialsFile, computeEndpoint(cfg), quotaProject(cfg), newTransport(cfg))
+		if err != nil {
+			return err
+		}
+		g.computeService = cs
+		g.httpClient = client
+	}
+
+	if g.identity == nil {
+		id, err := identityFromMetadata(g.metadata, cfg)
+		if err != nil {
+			return err
+		}
+		g.identity = &id
+	}
+
+	ids := []gceIdentity{*g.identity}
+	if len(cfg.Networks) > 0 {
+		ids = nil
+		for _, name := range cfg.Networks {
+			id := *g.identity
+			id.networkName = name
+			ids = append(ids, id)
+		}
+	}
+
+	var apis []*gceAPI
+	closeAPIs := func() {
+		for _, api := range apis {
+			api.Close()
+		}
+	}
+	for _, id := range ids {
+		api, err := newAPIWithService(ctx, g.computeService, g.httpClient, g.metadata, g.clock, id, cfg)
+		if err != nil {
+			closeAPIs()
+			return fmt.Errorf("error creating API for network %v: %v", id.networkName, err)
+		}
+		gn, gi, _ := api.resources()
+		if err := api.checkInstanceNetwork(gn, gi); err != nil {
+			api.Close()
+			closeAPIs()
+			return err
+		}
+		if len(apis) > 0 {
+			// the networks share the project and credentials, so
+			// writes to all of them fail together, and count
+			// against the same quota
+			api.breaker = apis[0].breaker
+			api.retryBudget = apis[0].retryBudget
+		}
+		api.recorder = subnet.RecorderFor(g.sm)
+		if cfg.MatchNextHopInterfaceIP && g.extIface != nil {
+			api.nextHopIP = g.extIface.IfaceAddr.String()
+		}
+		apis = append(apis, api)
+
+		if cfg.VerifyPermissions {
+			// dry runs and read-only mode don't change routes, so
+			// don't need write access
+			if err := api.Verify(ctx, !cfg.DryRun && !cfg.ReadOnly); err != nil {
+				closeAPIs()
+				return err
+			}
+		}
+	}
+
+	g.apis = apis
+	return nil
+}
+
+// parseBackendConfig returns the validated backend config of config, with the
+// defaults for unset keys
+func parseBackendConfig(config *subnet.Config) (*backendConfig, error) {
+	cfg := backendConfig{
+		RoutePriority:        defaultRoutePriority,
+		PruneStaleRoutes:     true,
+		MaxPruneFraction:     defaultMaxPruneFraction,
+		PruneOwnStaleRoutes:  true,
+		RefreshInterval:      defaultRefreshInterval,
+		ReconcileInterval:    defaultReconcileInterval,
+		OperationLogInterval: defaultOperationLogInterval,
+		ShutdownTimeout:      defaultShutdownTimeout,
+		RouteDescription:     defaultRouteDescription,
+		VerifyPermissions:    true,
+		MaxAttempts:          defaultMaxAttempts,
+		WriteRateLimit:       defaultWriteRateLimit,
+		WriteBurst:           defaultWriteBurst,
+		MaxIdleConnsPerHost:  defaultMaxIdleConnsPerHost,
+		IdleConnTimeout:      defaultIdleConnTimeout,
+		KeepAlive:            defaultKeepAlive,
+
+		CircuitBreakerThreshold: defaultCircuitBreakerThreshold,
+		CircuitBreakerCooldown:  defaultCircuitBreakerCooldown,
+		RouteQuota:              defaultRouteQuota,
+		RouteQuotaWarnThreshold: defaultRouteQuotaWarnThreshold,
+		RouteQuotaCheckInterval: defaultRouteQuotaCheckInterval,
+	}
+
+	if len(config.Backend) > 0 {
+		if err := json.Unmarshal(config.Backend, &cfg); err != nil {
+			return nil, fmt.Errorf("error decoding GCE backend config: %v", err)
+		}
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
 }
 
 func (g *GCEBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
+	cfg, err := parseBackendConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.RoutingMode == routingModeAliasIP && config.EnableIPv6() {
+		return nil, fmt.Errorf("RoutingMode %q doesn't support IPv6 networks", routingModeAliasIP)
+	}
+
 	attrs := subnet.LeaseAttrs{
 		PublicIP: ip.FromIP(g.extIface.ExtAddr),
 	}
@@ -99,36 +744,370 @@ func (g *GCEBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup, co
 		return nil, fmt.Errorf("failed to acquire lease: %v", err)
 	}
 
-	if err = g.ensureAPI(); err != nil {
+	if err = g.ensureAPI(ctx, cfg); err != nil {
 		return nil, err
 	}
 
-	found, err := g.handleMatchingRoute(l.Subnet.String())
+	for _, api := range g.apis {
+		if api.readOnly {
+			// checked once the network is set up
+			continue
+		}
+		for _, sn := range leaseSubnets(l) {
+			if api.aliasIP {
+				if err := api.ensureAliasRange(ctx, sn); err != nil {
+					return nil, fmt.Errorf("error ensuring alias IP range in network %v: %v", api.networkName, err)
+				}
+				continue
+			}
+			if err := g.ensureRoute(ctx, api, sn); err != nil {
+				return nil, fmt.Errorf("error ensuring route in network %v: %v", api.networkName, err)
+			}
+		}
+	}
+
+	if cfg.ManageFirewall {
+		for _, api := range g.apis {
+			if err := api.ensureFirewalls(ctx, cfg, config); err != nil {
+				return nil, fmt.Errorf("error ensuring firewall rules in network %v: %v", api.networkName, err)
+			}
+		}
+	}
+
+	// alias IP ranges go away with their instances, there are no routes
+	// left behind to prune
+	aliasIP := cfg.RoutingMode == routingModeAliasIP
+
+	if cfg.PruneOwnStaleRoutes && !aliasIP && !cfg.ReadOnly {
+		for _, api := range g.apis {
+			if err := api.pruneOwnStaleRoutes(ctx, leaseSubnets(l)); err != nil {
+				log.Errorf("Error pruning stale routes of this instance in network %v: %v", api.networkName, err)
+			}
+		}
+	}
+
+	if cfg.PruneStaleRoutes && !aliasIP && !cfg.ReadOnly {
+		wg.Add(1)
+		go func() {
+			g.pruneStaleRoutes(ctx, l)
+			wg.Done()
+		}()
+	}
+
+	if cfg.RouteQuotaCheckInterval > 0 && cfg.RouteQuota > 0 && !aliasIP {
+		interval := time.Duration(cfg.RouteQuotaCheckInterval) * time.Second
+		for _, api := range g.apis {
+			api := api
+			wg.Add(1)
+			go func() {
+				api.checkRouteQuotaPeriodically(ctx, interval, cfg.RouteQuota, cfg.RouteQuotaWarnThreshold)
+				wg.Done()
+			}()
+		}
+	}
+
+	n := &network{
+		SimpleNetwork: backend.SimpleNetwork{
+			SubnetLease: l,
+			ExtIface:    g.extIface,
+		},
+		apis:            g.apis,
+		subnets:         leaseSubnets(l),
+		cfg:             cfg,
+		shutdownMode:    cfg.ShutdownMode,
+		shutdownGrace:   time.Duration(cfg.ShutdownGracePeriod) * time.Second,
+		shutdownTimeout: time.Duration(cfg.ShutdownTimeout) * time.Second,
+	}
+	// the routes were just ensured, in read-only mode missing ones are
+	// reported and checked again with the reconciles
+	for _, api := range n.apis {
+		if api.readOnly {
+			n.verifyRoutes(ctx, api)
+			continue
+		}
+		for _, sn := range n.subnets {
+			n.recordRouteStatus(api, sn, backend.RoutePresent, nil)
+		}
+	}
+
+	wg.Add(1)
+	go func() {
+		g.repairRoutePeriodically(ctx, n, time.Duration(cfg.ReconcileInterval)*time.Second)
+		wg.Done()
+	}()
+
+	return n, nil
+}
+
+// PlanRoutes returns the routes RegisterNetwork would ensure for lease in each
+// network, or in alias IP mode the alias IP ranges it would assign to the
+// instance. Only the network and instance are read, nothing is changed.
+func (g *GCEBackend) PlanRoutes(ctx context.Context, config *subnet.Config, lease *subnet.Lease) ([]backend.PlannedRoute, error) {
+	cfg, err := parseBackendConfig(config)
 	if err != nil {
-		return nil, fmt.Errorf("error handling matching route: %v", err)
+		return nil, err
+	}
+	// checking write permissions deletes a nonexistent route, and the
+	// resources don't need refreshing
+	cfg.VerifyPermissions = false
+	cfg.RefreshInterval = 0
+
+	if err := g.ensureAPI(ctx, cfg); err != nil {
+		return nil, err
+	}
+
+	var routes []backend.PlannedRoute
+	for _, api := range g.apis {
+		for _, sn := range leaseSubnets(lease) {
+			if api.aliasIP {
+				gn, gi, _ := api.resources()
+				routes = append(routes, backend.PlannedRoute{
+					Name:        "alias IP range",
+					Network:     gn.SelfLink,
+					Destination: sn,
+					NextHop:     gi.SelfLink,
+				})
+				continue
+			}
+			r, err := api.planRoute(sn)
+			if err != nil {
+				return nil, fmt.Errorf("error planning route for subnet %v in network %v: %v", sn, api.networkName, err)
+			}
+			routes = append(routes, backend.PlannedRoute{
+				Name:        r.name,
+				Network:     r.network,
+				Destination: r.destRange,
+				NextHop:     r.nextHop.String(),
+			})
+		}
+	}
+	return routes, nil
+}
+
+// network reports on the routes of the lease for health checks, and lets
+// their reconcile be triggered on demand
+type network struct {
+	backend.SimpleNetwork
+	backend.ReconcileHealth
+	backend.ReconcileTrigger
+	backend.RouteStatusCache
+
+	apis    []*gceAPI
+	subnets []string
+	// cfg is the backend config the network runs with, cfgMu guards it
+	cfgMu sync.Mutex
+	cfg   *backendConfig
+	// shutdownMode, shutdownGrace and shutdownTimeout are the
+	// ShutdownMode, ShutdownGracePeriod and ShutdownTimeout of the backend
+	// config
+	shutdownMode    string
+	shutdownGrace   time.Duration
+	shutdownTimeout time.Duration
+}
+
+// Run waits for ctx to be done, which stops the lease from being renewed,
+// then leaves or deletes the routes of the lease as configured
+func (n *network) Run(ctx context.Context) {
+	<-ctx.Done()
+	n.shutdown()
+}
+
+// shutdown deletes the routes of the lease in shutdownModeClean, or after
+// shutdownGrace or once the lease expired in shutdownModeRetain. Without a
+// grace period they are left for other nodes to prune once the lease expired.
+// Once reconciling was stopped, the routes are another flannel's to manage.
+func (n *network) shutdown() {
+	lease := n.SubnetLease
+	select {
+	case <-n.Stopped():
+		log.Infof("Shutting down without touching the routes of lease %v, reconciling them was stopped", lease.Subnet)
+		return
+	default:
+	}
+
+	switch {
+	case n.shutdownMode == shutdownModeClean:
+		log.Infof("Shutting down in %s mode, deleting the routes of lease %v", shutdownModeClean, lease.Subnet)
+
+	case n.shutdownGrace > 0:
+		grace := n.shutdownGrace
+		if !lease.Expiration.IsZero() {
+			if left := lease.Expiration.Sub(n.apis[0].clock.Now()); left < grace {
+				grace = left
+			}
+		}
+		log.Infof("Shutting down in %s mode, keeping the routes of lease %v for %v before deleting them", shutdownModeRetain, lease.Subnet, grace)
+		if grace > 0 {
+			<-n.apis[0].clock.After(grace)
+		}
+
+	default:
+		log.Infof("Shutting down in %s mode, leaving the routes of lease %v in place until they are pruned after it expires", shutdownModeRetain, lease.Subnet)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), n.shutdownTimeout)
+	defer cancel()
+	n.cleanup(ctx)
+}
+
+// cleanup deletes the routes of the lease which still point at this instance
+// in every network, or removes its alias IP ranges, until ctx is done. The
+// routes it didn't get to are logged and left for other nodes to prune.
+func (n *network) cleanup(ctx context.Context) {
+	lease := n.SubnetLease
+	for _, api := range n.apis {
+		if api.aliasIP {
+			if err := api.removeAliasRanges(ctx, n.subnets); err != nil {
+				log.Errorf("Error removing the alias IP ranges of lease %v from instance %v on shutdown: %v", lease.Subnet, api.instanceName, err)
+			} else {
+				log.Infof("Removed the alias IP ranges of lease %v from instance %v", lease.Subnet, api.instanceName)
+			}
+			continue
+		}
+
+		left := api.cleanupRoutes(ctx, n.subnets)
+		switch {
+		case len(left) == 0:
+			log.Infof("Deleted the routes of lease %v in network %v", lease.Subnet, api.networkName)
+		case ctx.Err() != nil:
+			log.Errorf("Shutdown deadline passed, abandoned deleting the routes for %s of lease %v in network %v, which may be left in place",
+				strings.Join(left, ", "), lease.Subnet, api.networkName)
+		default:
+			log.Errorf("Failed to delete the routes for %s of lease %v in network %v on shutdown", strings.Join(left, ", "), lease.Subnet, api.networkName)
+		}
+	}
+}
+
+// Reconfigure applies the changes to RoutePriority, RoutePriorities, Tags and
+// RouteDescription in the backend config of config, and triggers a reconcile
+// to recreate the routes whose priority or tags changed. Other changes need a
+// restart, see backend.Reconfigurer.
+func (n *network) Reconfigure(ctx context.Context, config *subnet.Config) error {
+	cfg, err := parseBackendConfig(config)
+	if err != nil {
+		return err
+	}
+
+	n.cfgMu.Lock()
+	defer n.cfgMu.Unlock()
+
+	applied := *n.cfg
+	applied.RoutePriority = cfg.RoutePriority
+	applied.RoutePriorities = cfg.RoutePriorities
+	applied.Tags = cfg.Tags
+	applied.RouteDescription = cfg.RouteDescription
+
+	if changed := backendConfigChanges(n.cfg, &applied); len(changed) > 0 {
+		// validated when parsing
+		description, _ := parseRouteDescription(applied.RouteDescription)
+		priorityRanges, _ := parseRoutePriorities(applied.RoutePriorities)
+		for _, api := range n.apis {
+			api.setRouteSettings(applied.RoutePriority, priorityRanges, applied.Tags, description)
+		}
+		n.cfg = &applied
+		log.Infof("Applied changes to %s of the backend config, reconciling the routes", strings.Join(changed, ", "))
+		n.TriggerReconcile()
+	}
+
+	if restart := backendConfigChanges(&applied, cfg); len(restart) > 0 {
+		return &backend.RestartRequiredError{Keys: restart}
+	}
+	return nil
+}
+
+// backendConfigChanges returns the keys which differ between a and b
+func backendConfigChanges(a, b *backendConfig) []string {
+	var keys []string
+	va, vb := reflect.ValueOf(*a), reflect.ValueOf(*b)
+	for i := 0; i < va.NumField(); i++ {
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			keys = append(keys, va.Type().Field(i).Name)
+		}
+	}
+	return keys
+}
+
+// CheckRoutes returns an error unless the routes for the lease exist in
+// every network and point at this instance, or in alias IP mode the alias IP
+// ranges for the lease are assigned to it
+func (n *network) CheckRoutes(ctx context.Context) error {
+	for _, api := range n.apis {
+		for _, subnet := range n.subnets {
+			if api.aliasIP {
+				ok, err := api.hasAliasRange(ctx, subnet)
+				if err != nil {
+					return fmt.Errorf("error checking alias IP range for subnet %v: %v", subnet, err)
+				}
+				if !ok {
+					return fmt.Errorf("alias IP range for subnet %v is not assigned to instance %v", subnet, api.instanceName)
+				}
+				continue
+			}
+			route, err := api.getRoute(ctx, subnet)
+			if err != nil {
+				return fmt.Errorf("error getting route for subnet %v in network %v: %v", subnet, api.networkName, err)
+			}
+			ok, err := api.routePointsHere(route)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return fmt.Errorf("route %v for subnet %v does not point at this instance", route.Name, subnet)
+			}
+		}
+	}
+	return nil
+}
+
+// leaseSubnets returns the subnets of l that need a route, its IPv6 subnet
+// is included for dual-stack networks
+func leaseSubnets(l *subnet.Lease) []string {
+	subnets := []string{l.Subnet.String()}
+	if !l.IPv6Subnet.Empty() {
+		subnets = append(subnets, l.IPv6Subnet.String())
+	}
+	return subnets
+}
+
+// ensureRoute inserts a route for subnet in the network of api unless one
+// pointing here already exists
+func (g *GCEBackend) ensureRoute(ctx context.Context, api *gceAPI, subnet string) error {
+	found, err := g.handleMatchingRoute(ctx, api, subnet)
+	if err != nil {
+		return fmt.Errorf("error handling matching route: %v", err)
 	}
 
 	if !found {
-		operation, err := g.api.insertRoute(l.Subnet.String())
+		adopted, err := api.adoptRoute(ctx, subnet)
 		if err != nil {
-			return nil, fmt.Errorf("error inserting route: %v", err)
+			return fmt.Errorf("error adopting route: %v", err)
+		}
+		if adopted {
+			return nil
 		}
 
-		err = g.api.pollOperationStatus(operation.Name)
+		operation, err := api.insertRoute(ctx, subnet)
 		if err != nil {
-			return nil, fmt.Errorf("insert operaiton failed: %v", err)
+			api.recordInsert(ctx, subnet, err)
+			return fmt.Errorf("error inserting route: %v", err)
+		}
+
+		if operation != nil {
+			err = api.pollOperationStatus(ctx, operation)
+			api.recordInsert(ctx, subnet, err)
+			if err != nil {
+				return fmt.Errorf("insert operaiton failed: %v", err)
+			}
 		}
 	}
 
-	return &backend.SimpleNetwork{
-		SubnetLease: l,
-		ExtIface:    g.extIface,
-	}, nil
+	return nil
 }
 
-//returns true if an exact matching rule is found
-func (g *GCEBackend) handleMatchingRoute(subnet string) (bool, error) {
-	matchingRoute, err := g.api.getRoute(subnet)
+// returns true if an exact matching rule is found
+func (g *GCEBackend) handleMatchingRoute(ctx context.Context, api *gceAPI, subnet string) (bool, error) {
+	matchingRoute, err := api.getRoute(ctx, subnet)
 	if err != nil {
 		if apiError, ok := err.(*googleapi.Error); ok {
 			if apiError.Code != 404 {
@@ -139,21 +1118,145 @@ func (g *GCEBackend) handleMatchingRoute(subnet string) (bool, error) {
 		return false, fmt.Errorf("error getting googleapi: %v", err)
 	}
 
-	if matchingRoute.NextHopInstance == g.api.gceInstance.SelfLink {
-		log.Info("Exact pre-existing route found")
+	ok, err := api.routeUpToDate(matchingRoute)
+	if err != nil {
+		return false, err
+	}
+	if ok {
+		logger.V(2).Infof("Exact pre-existing route found %s", api.logFields(matchingRoute))
 		return true, nil
 	}
 
-	log.Info("Deleting conflicting route")
-	operation, err := g.api.deleteRoute(subnet)
+	logger.V(1).Infof("Deleting conflicting route %s", api.logFields(matchingRoute))
+	operation, err := api.deleteRoute(ctx, subnet)
 	if err != nil {
+		api.recordDelete(ctx, subnet, err)
 		return false, fmt.Errorf("error deleting conflicting route : %v", err)
 	}
 
-	err = g.api.pollOperationStatus(operation.Name)
-	if err != nil {
-		return false, fmt.Errorf("delete operation failed: %v", err)
+	if operation != nil {
+		err = api.pollOperationStatus(ctx, operation)
+		api.recordDelete(ctx, subnet, err)
+		if err != nil {
+			return false, fmt.Errorf("delete operation failed: %v", err)
+		}
 	}
 
 	return false, nil
 }
+
+// pruneStaleRoutes deletes the routes of subnets which are no longer leased
+func (g *GCEBackend) pruneStaleRoutes(ctx context.Context, ownLease *subnet.Lease) {
+	res, err := g.sm.WatchLeases(ctx, nil)
+	if err != nil {
+		log.Errorf("Error fetching subnet leases, not pruning stale routes: %v", err)
+		return
+	}
+
+	if ctx.Err() != nil {
+		return
+	}
+
+	// only a snapshot tells us the full set of leases
+	if len(res.Events) > 0 {
+		log.Infof("Subnet manager %v does not provide a lease snapshot, not pruning stale routes", g.sm.Name())
+		return
+	}
+
+	activeSubnets := leaseSubnets(ownLease)
+	for i := range res.Snapshot {
+		activeSubnets = append(activeSubnets, leaseSubnets(&res.Snapshot[i])...)
+	}
+
+	for _, api := range g.apis {
+		if err := api.pruneOrphanedRoutes(ctx, activeSubnets); err != nil {
+			log.Errorf("Error pruning stale routes in network %v: %v", api.networkName, err)
+		}
+	}
+}
+
+// repairRoutePeriodically repairs the routes for the subnets of n in every
+// network each interval, so that they follow changes to the instance picked
+// up by the API refresh and are recreated if deleted out of band. A zero
+// interval only repairs them when triggered. The results are recorded for
+// health checks.
+func (g *GCEBackend) repairRoutePeriodically(ctx context.Context, n *network, interval time.Duration) {
+	// the APIs are created and closed together, the first one stands for all
+	primary := n.apis[0]
+	for {
+		var tick <-chan time.Time
+		if interval > 0 {
+			tick = primary.clock.After(interval)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-primary.stopRefresh:
+			return
+		case <-n.Stopped():
+			log.Info("Stopped reconciling routes")
+			return
+		case <-tick:
+		case <-n.Triggered():
+			log.Info("Reconciling routes on demand")
+		}
+
+		var lastErr error
+		for _, api := range n.apis {
+			if api.readOnly {
+				if err := n.verifyRoutes(ctx, api); err != nil {
+					lastErr = err
+				}
+				continue
+			}
+			repair := api.repairRoute
+			if api.aliasIP {
+				repair = api.repairAliasRange
+			}
+			for _, subnet := range n.subnets {
+				state, _, err := repair(ctx, subnet)
+				n.recordRouteStatus(api, subnet, state, err)
+				if err != nil {
+					log.Errorf("Error repairing route for subnet %v in network %v: %v", subnet, api.networkName, err)
+					lastErr = err
+				}
+			}
+		}
+		n.RecordReconcile(lastErr)
+	}
+}
+
+// verifyRoutes records the state of the routes for the subnets of n in the
+// network of api, without repairing them, in read-only mode. It returns the
+// last error.
+func (n *network) verifyRoutes(ctx context.Context, api *gceAPI) error {
+	var lastErr error
+	missing := 0
+	for _, subnet := range n.subnets {
+		state, err := api.checkRoute(ctx, subnet)
+		n.recordRouteStatus(api, subnet, state, err)
+		if state == backend.RouteAbsent || state == backend.RouteDrifted {
+			missing++
+		}
+		if err != nil {
+			log.Errorf("Error verifying route for subnet %v in network %v in read-only mode, not repairing it: %v", subnet, api.networkName, err)
+			lastErr = err
+		}
+	}
+	missingRoutes.WithLabelValues(api.networkName).Set(float64(missing))
+	return lastErr
+}
+
+// recordRouteStatus records the state of the route for subnet in the network
+// of api as of now
+func (n *network) recordRouteStatus(api *gceAPI, subnet string, state backend.RouteState, err error) {
+	n.RecordRouteStatus(backend.RouteStatus{
+		Name:        api.routeName(subnet),
+		Network:     api.networkName,
+		Destination: subnet,
+		State:       state,
+		LastError:   err,
+		LastChecked: api.clock.Now(),
+	})
+}
@@ -0,0 +1,1024 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package gce
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/api/compute/v1"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+func TestBackendConfigValidate(t *testing.T) {
+	for _, tc := range []struct {
+		priority int64
+		valid    bool
+	}{
+		{0, true},
+		{defaultRoutePriority, true},
+		{maxRoutePriority, true},
+		{-1, false},
+		{maxRoutePriority + 1, false},
+	} {
+		cfg := backendConfig{RoutePriority: tc.priority}
+		err := cfg.validate()
+		if tc.valid && err != nil {
+			t.Errorf("priority %d: unexpected error: %v", tc.priority, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("priority %d: expected an error", tc.priority)
+		}
+	}
+}
+
+func TestBackendConfigValidateRoutePriorities(t *testing.T) {
+	for _, tc := range []struct {
+		priorities map[string]int64
+		valid      bool
+	}{
+		{map[string]int64{"10.0.0.0/8": 0, "10.1.0.0/16": maxRoutePriority, "fd00::/8": 500}, true},
+		{map[string]int64{"10.0.0.0": 500}, false},
+		{map[string]int64{"not-a-range": 500}, false},
+		{map[string]int64{"10.0.0.0/8": -1}, false},
+		{map[string]int64{"10.0.0.0/8": maxRoutePriority + 1}, false},
+		// the same range written differently
+		{map[string]int64{"10.0.0.0/8": 500, "10.1.0.0/8": 600}, false},
+	} {
+		cfg := backendConfig{RoutePriority: defaultRoutePriority, RoutePriorities: tc.priorities}
+		err := cfg.validate()
+		if tc.valid && err != nil {
+			t.Errorf("%v: unexpected error: %v", tc.priorities, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("%v: expected an error", tc.priorities)
+		}
+	}
+}
+
+func TestBackendConfigValidateRouteNextHops(t *testing.T) {
+	for _, tc := range []struct {
+		hops  map[string]string
+		valid bool
+	}{
+		{map[string]string{
+			"10.1.0.0/16": "projects/p/global/gateways/default-internet-gateway",
+			"10.2.0.0/16": "https://www.googleapis.com/compute/v1/projects/p/regions/r/vpnTunnels/onprem",
+		}, true},
+		{map[string]string{"10.1.0.0": "projects/p/global/gateways/g"}, false},
+		{map[string]string{"10.1.0.0/16": ""}, false},
+		{map[string]string{"10.1.0.0/16": "projects/p/zones/z/instances/i"}, false},
+		{map[string]string{"10.1.0.0/16": "projects/p/regions/r/vpnTunnels/"}, false},
+		// the same range written differently
+		{map[string]string{"10.1.0.0/16": "projects/p/global/gateways/g", "10.1.1.0/16": "projects/p/global/gateways/h"}, false},
+	} {
+		cfg := backendConfig{RoutePriority: defaultRoutePriority, RouteNextHops: tc.hops}
+		err := cfg.validate()
+		if tc.valid && err != nil {
+			t.Errorf("%v: unexpected error: %v", tc.hops, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("%v: expected an error", tc.hops)
+		}
+	}
+}
+
+func TestBackendConfigValidateDescription(t *testing.T) {
+	cfg := backendConfig{RouteDescription: defaultRouteDescription}
+	if err := cfg.validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	cfg.RouteDescription = "Created by {{.Instance"
+	if err := cfg.validate(); err == nil {
+		t.Error("expected an error for an invalid template")
+	}
+}
+
+func TestBackendConfigValidateRouteNamePrefix(t *testing.T) {
+	for _, tc := range []struct {
+		prefix string
+		valid  bool
+	}{
+		{"", true},
+		{defaultRouteNamePrefix, true},
+		{"cluster-a-", true},
+		{"Cluster-", false},
+		{"1cluster-", false},
+		{"cluster.a-", false},
+		{"a-very-long-cluster-prefix-", false},
+	} {
+		cfg := backendConfig{RouteNamePrefix: tc.prefix}
+		err := cfg.validate()
+		if tc.valid && err != nil {
+			t.Errorf("prefix %q: unexpected error: %v", tc.prefix, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("prefix %q: expected an error", tc.prefix)
+		}
+	}
+}
+
+func TestBackendConfigValidateOperationPollMode(t *testing.T) {
+	for _, mode := range []string{"", operationPollModeGet, operationPollModeWait} {
+		cfg := backendConfig{OperationPollMode: mode}
+		if err := cfg.validate(); err != nil {
+			t.Errorf("mode %q: unexpected error: %v", mode, err)
+		}
+	}
+	cfg := backendConfig{OperationPollMode: "poll"}
+	if err := cfg.validate(); err == nil {
+		t.Error("expected an error for an unknown mode")
+	}
+}
+
+func TestBackendConfigValidateRetryBudget(t *testing.T) {
+	for _, tc := range []struct {
+		budget int
+		refill float64
+		valid  bool
+	}{
+		{0, 0, true},
+		{20, 0.5, true},
+		{-1, 0, false},
+		{20, 0, false},
+		{20, -1, false},
+	} {
+		cfg := backendConfig{RetryBudget: tc.budget, RetryBudgetRefillRate: tc.refill}
+		err := cfg.validate()
+		if tc.valid && err != nil {
+			t.Errorf("budget %d refilled at %v: unexpected error: %v", tc.budget, tc.refill, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("budget %d refilled at %v: expected an error", tc.budget, tc.refill)
+		}
+	}
+}
+
+func TestBackendConfigValidateAdoptRoutes(t *testing.T) {
+	for _, tc := range []struct {
+		cfg   backendConfig
+		valid bool
+	}{
+		{backendConfig{}, true},
+		{backendConfig{AdoptRoutes: adoptRoutesKeep}, true},
+		{backendConfig{AdoptRoutes: adoptRoutesRecreate}, true},
+		{backendConfig{AdoptRoutes: adoptRoutesKeep, ReadOnly: true}, true},
+		{backendConfig{AdoptRoutes: "rename"}, false},
+		{backendConfig{AdoptRoutes: adoptRoutesRecreate, ReadOnly: true}, false},
+		{backendConfig{AdoptRoutes: adoptRoutesKeep, RoutingMode: routingModeAliasIP}, false},
+	} {
+		err := tc.cfg.validate()
+		if tc.valid && err != nil {
+			t.Errorf("%+v: unexpected error: %v", tc.cfg, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("%+v: expected an error", tc.cfg)
+		}
+	}
+}
+
+func TestBackendConfigValidateRecreateOutdatedRoutes(t *testing.T) {
+	for _, tc := range []struct {
+		cfg   backendConfig
+		valid bool
+	}{
+		{backendConfig{RecreateOutdatedRoutes: true}, true},
+		{backendConfig{RecreateOutdatedRoutes: true, ReadOnly: true}, false},
+		{backendConfig{RecreateOutdatedRoutes: true, RoutingMode: routingModeAliasIP}, false},
+	} {
+		err := tc.cfg.validate()
+		if tc.valid && err != nil {
+			t.Errorf("%+v: unexpected error: %v", tc.cfg, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("%+v: expected an error", tc.cfg)
+		}
+	}
+}
+
+func TestBackendConfigValidateNextHopIP(t *testing.T) {
+	for _, tc := range []struct {
+		cfg   backendConfig
+		valid bool
+	}{
+		{backendConfig{NextHopIP: "10.128.0.2"}, true},
+		{backendConfig{MatchNextHopInterfaceIP: true}, true},
+		{backendConfig{NextHopIP: "node"}, false},
+		{backendConfig{NextHopIP: "fd00::2"}, false},
+		{backendConfig{NextHopIP: "10.128.0.2", MatchNextHopInterfaceIP: true}, false},
+		{backendConfig{NextHopIP: "10.128.0.2", NextHopInterface: 1}, false},
+		{backendConfig{MatchNextHopInterfaceIP: true, MatchNextHopInterfaceNetwork: true}, false},
+		{backendConfig{NextHopIP: "10.128.0.2", Networks: []string{"default", "storage"}}, false},
+	} {
+		err := tc.cfg.validate()
+		if tc.valid && err != nil {
+			t.Errorf("%+v: unexpected error: %v", tc.cfg, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("%+v: expected an error", tc.cfg)
+		}
+	}
+}
+
+func TestBackendConfigValidateIdentity(t *testing.T) {
+	for _, tc := range []struct {
+		cfg   backendConfig
+		valid bool
+	}{
+		{backendConfig{Project: "test-project", Zone: "us-central1-a", InstanceName: "node-1"}, true},
+		{backendConfig{Project: "example.com:test-project"}, true},
+		{backendConfig{Project: "Test-Project"}, false},
+		{backendConfig{Project: "prj"}, false},
+		{backendConfig{Zone: "us-central1-a/"}, false},
+		{backendConfig{InstanceName: "node_1"}, false},
+		{backendConfig{InstanceName: strings.Repeat("n", maxRouteNameLength+1)}, false},
+	} {
+		err := tc.cfg.validate()
+		if tc.valid && err != nil {
+			t.Errorf("%+v: unexpected error: %v", tc.cfg, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("%+v: expected an error", tc.cfg)
+		}
+	}
+}
+
+func TestBackendConfigValidateMaxPruneFraction(t *testing.T) {
+	for _, tc := range []struct {
+		cfg   backendConfig
+		valid bool
+	}{
+		{backendConfig{MaxPruneFraction: 0}, true},
+		{backendConfig{MaxPruneFraction: 0.25, ForcePrune: true}, true},
+		{backendConfig{MaxPruneFraction: 1}, true},
+		{backendConfig{MaxPruneFraction: -0.5}, false},
+		{backendConfig{MaxPruneFraction: 1.5}, false},
+	} {
+		err := tc.cfg.validate()
+		if tc.valid && err != nil {
+			t.Errorf("%+v: unexpected error: %v", tc.cfg, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("%+v: expected an error", tc.cfg)
+		}
+	}
+}
+
+func TestBackendConfigValidateNextHopResolution(t *testing.T) {
+	for _, tc := range []struct {
+		cfg   backendConfig
+		valid bool
+	}{
+		{backendConfig{}, true},
+		{backendConfig{NextHopResolution: nextHopResolutionInstance, ForceNextHopInstance: true}, true},
+		{backendConfig{NextHopResolution: nextHopResolutionIP}, true},
+		{backendConfig{NextHopResolution: nextHopResolutionInstanceGroup}, true},
+		{backendConfig{NextHopResolution: "mig"}, false},
+		{backendConfig{NextHopResolution: nextHopResolutionIP, ForceNextHopInstance: true}, false},
+		{backendConfig{NextHopResolution: nextHopResolutionInstanceGroup, NextHopIlb: "ilb"}, false},
+	} {
+		err := tc.cfg.validate()
+		if tc.valid && err != nil {
+			t.Errorf("%+v: unexpected error: %v", tc.cfg, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("%+v: expected an error", tc.cfg)
+		}
+	}
+}
+
+func TestBackendConfigValidateRoutingMode(t *testing.T) {
+	for _, tc := range []struct {
+		cfg   backendConfig
+		valid bool
+	}{
+		{backendConfig{}, true},
+		{backendConfig{RoutingMode: routingModeRoutes}, true},
+		{backendConfig{RoutingMode: routingModeAliasIP}, true},
+		{backendConfig{RoutingMode: routingModeAliasIP, AliasIPRangeName: "pods"}, true},
+		{backendConfig{RoutingMode: routingModeAliasIP, Networks: []string{"default"}}, true},
+		{backendConfig{RoutingMode: "alias"}, false},
+		{backendConfig{AliasIPRangeName: "pods"}, false},
+		{backendConfig{RoutingMode: routingModeAliasIP, NextHopIlb: "ilb"}, false},
+		{backendConfig{RoutingMode: routingModeAliasIP, ForceNextHopInstance: true}, false},
+		{backendConfig{RoutingMode: routingModeAliasIP, RouteNextHops: map[string]string{"10.1.0.0/16": "projects/p/global/gateways/g"}}, false},
+		{backendConfig{RoutingMode: routingModeAliasIP, Networks: []string{"default", "storage-1"}}, false},
+	} {
+		err := tc.cfg.validate()
+		if tc.valid && err != nil {
+			t.Errorf("%+v: unexpected error: %v", tc.cfg, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("%+v: expected an error", tc.cfg)
+		}
+	}
+}
+
+func TestBackendConfigValidateNetworks(t *testing.T) {
+	for _, tc := range []struct {
+		networks []string
+		valid    bool
+	}{
+		{nil, true},
+		{[]string{"default"}, true},
+		{[]string{"default", "storage-1"}, true},
+		{[]string{"default", "default"}, false},
+		{[]string{"Default"}, false},
+		{[]string{""}, false},
+	} {
+		cfg := backendConfig{Networks: tc.networks}
+		err := cfg.validate()
+		if tc.valid && err != nil {
+			t.Errorf("networks %q: unexpected error: %v", tc.networks, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("networks %q: expected an error", tc.networks)
+		}
+	}
+}
+
+func TestQualifiedRouteNamePrefix(t *testing.T) {
+	if p := qualifiedRouteNamePrefix(defaultRouteNamePrefix, "storage"); p != "flannel-storage-" {
+		t.Errorf("unexpected prefix %q", p)
+	}
+
+	long := strings.Repeat("n", 40)
+	p := qualifiedRouteNamePrefix(defaultRouteNamePrefix, long)
+	if len(p) > maxQualifiedRouteNamePrefixLength || !strings.HasPrefix(p, defaultRouteNamePrefix) {
+		t.Errorf("unexpected prefix %q for a long network name", p)
+	}
+	if p == qualifiedRouteNamePrefix(defaultRouteNamePrefix, long+"2") {
+		t.Errorf("expected long network names to get different prefixes")
+	}
+
+	// the hashed name of an IPv6 route keeps the whole prefix
+	name := formatRouteName(p, "fd00:1234:5678:9abc:def0:1234:5678:0/112")
+	if len(name) > maxRouteNameLength || !strings.HasPrefix(name, p) {
+		t.Errorf("unexpected route name %q", name)
+	}
+}
+
+func TestEnsureAPIMultipleNetworks(t *testing.T) {
+	for _, tc := range []struct {
+		networks []string
+		routes   []string
+	}{
+		// a single network keeps the unqualified names
+		{[]string{"storage"}, []string{"flannel-10-0-1-0-24"}},
+		{[]string{"default", "storage"}, []string{"flannel-default-10-0-1-0-24", "flannel-storage-10-0-1-0-24"}},
+	} {
+		fake := newFakeCompute()
+		for _, name := range []string{"default", "storage"} {
+			fake.networks[name] = &compute.Network{Name: name, SelfLink: "projects/test-project/global/networks/" + name}
+		}
+		fake.instances["node"] = &compute.Instance{
+			Name:     "node",
+			SelfLink: "projects/test-project/zones/z/instances/node",
+			NetworkInterfaces: []*compute.NetworkInterface{
+				{Network: "projects/test-project/global/networks/default"},
+				{Network: "projects/test-project/global/networks/storage"},
+			},
+		}
+		srv := httptest.NewServer(fake)
+		cs, err := compute.New(srv.Client())
+		if err != nil {
+			t.Fatal(err)
+		}
+		cs.BasePath = srv.URL + "/"
+
+		g := &GCEBackend{computeService: cs, httpClient: srv.Client(), metadata: newFakeMetadata(), clock: clockwork.NewRealClock()}
+		if err := g.ensureAPI(context.Background(), &backendConfig{Networks: tc.networks}); err != nil {
+			t.Fatal(err)
+		}
+		if len(g.apis) != len(tc.networks) {
+			t.Fatalf("%v: expected %d APIs, got %d", tc.networks, len(tc.networks), len(g.apis))
+		}
+		for _, api := range g.apis {
+			if err := g.ensureRoute(context.Background(), api, "10.0.1.0/24"); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for i, name := range tc.routes {
+			route := fake.routes[name]
+			if route == nil {
+				t.Errorf("%v: expected route %v, got %v", tc.networks, name, fake.inserted)
+				continue
+			}
+			if network := "projects/test-project/global/networks/" + tc.networks[i]; route.Network != network {
+				t.Errorf("%v: expected route %v in network %v, got %v", tc.networks, name, network, route.Network)
+			}
+		}
+		if len(fake.routes) != len(tc.routes) {
+			t.Errorf("%v: unexpected routes %v", tc.networks, fake.inserted)
+		}
+		srv.Close()
+	}
+}
+
+func TestEnsureAPIMatchNextHopInterfaceIP(t *testing.T) {
+	network := "projects/test-project/global/networks/default"
+	fake := newFakeCompute()
+	fake.networks["default"] = &compute.Network{Name: "default", SelfLink: network}
+	fake.instances["node"] = &compute.Instance{
+		Name:     "node",
+		SelfLink: "projects/test-project/zones/z/instances/node",
+		NetworkInterfaces: []*compute.NetworkInterface{
+			{Network: "projects/test-project/global/networks/storage", NetworkIP: "10.200.0.2"},
+			{Network: network, NetworkIP: "10.128.0.3"},
+		},
+	}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	cs, err := compute.New(srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs.BasePath = srv.URL + "/"
+
+	// the interface is found by the IP of the interface flannel uses
+	g := &GCEBackend{
+		computeService: cs,
+		httpClient:     srv.Client(),
+		metadata:       newFakeMetadata(),
+		clock:          clockwork.NewRealClock(),
+		extIface:       &backend.ExternalInterface{IfaceAddr: net.ParseIP("10.128.0.3")},
+	}
+	if err := g.ensureAPI(context.Background(), &backendConfig{MatchNextHopInterfaceIP: true}); err != nil {
+		t.Fatal(err)
+	}
+	api := g.apis[0]
+	gn, gi, _ := api.resources()
+	nic, err := api.nextHopInterface(gn, gi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nic.NetworkIP != "10.128.0.3" {
+		t.Errorf("expected the interface with IP 10.128.0.3, got %v", nic.NetworkIP)
+	}
+}
+
+func TestEnsureAPIInstanceNetwork(t *testing.T) {
+	fake := newFakeCompute()
+	fake.networks["shared"] = &compute.Network{Name: "shared", SelfLink: "projects/test-project/global/networks/shared"}
+	fake.instances["node"] = &compute.Instance{
+		Name:              "node",
+		SelfLink:          "projects/test-project/zones/z/instances/node",
+		NetworkInterfaces: []*compute.NetworkInterface{{Network: "projects/test-project/global/networks/default"}},
+	}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	cs, err := compute.New(srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs.BasePath = srv.URL + "/"
+
+	// the instance isn't attached to the configured network
+	g := &GCEBackend{computeService: cs, httpClient: srv.Client(), metadata: newFakeMetadata(), clock: clockwork.NewRealClock()}
+	err = g.ensureAPI(context.Background(), &backendConfig{Networks: []string{"shared"}})
+	if err == nil || !strings.Contains(err.Error(), "no network interface in network projects/test-project/global/networks/shared") {
+		t.Errorf("expected an error about the network of the instance, got %v", err)
+	}
+	if len(g.apis) != 0 {
+		t.Errorf("expected no API, got %d", len(g.apis))
+	}
+}
+
+func TestPlanRoutes(t *testing.T) {
+	fake := newFakeCompute()
+	fake.networks["default"] = &compute.Network{Name: "default", SelfLink: "projects/test-project/global/networks/default"}
+	fake.instances["node"] = &compute.Instance{Name: "node", SelfLink: "projects/test-project/zones/z/instances/node", NetworkInterfaces: []*compute.NetworkInterface{{Network: "projects/test-project/global/networks/default"}}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	cs, err := compute.New(srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs.BasePath = srv.URL + "/"
+
+	g := &GCEBackend{computeService: cs, httpClient: srv.Client(), metadata: newFakeMetadata(), clock: clockwork.NewRealClock()}
+	config := &subnet.Config{Backend: json.RawMessage(`{"VerifyPermissions": true}`)}
+	lease := &subnet.Lease{Subnet: ip.IP4Net{IP: ip.MustParseIP4("10.0.1.0"), PrefixLen: 24}}
+	routes, err := g.PlanRoutes(context.Background(), config, lease)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []backend.PlannedRoute{{
+		Name:        "flannel-10-0-1-0-24",
+		Network:     "projects/test-project/global/networks/default",
+		Destination: "10.0.1.0/24",
+		NextHop:     "projects/test-project/zones/z/instances/node",
+	}}
+	if !reflect.DeepEqual(routes, expected) {
+		t.Errorf("expected %+v, got %+v", expected, routes)
+	}
+	if len(fake.inserted) > 0 || len(fake.deleted) > 0 || len(fake.routes) > 0 {
+		t.Errorf("expected no route changes, inserted %v and deleted %v", fake.inserted, fake.deleted)
+	}
+}
+
+func TestEnsureAPIRetry(t *testing.T) {
+	fake := newFakeCompute()
+	fake.networks["default"] = &compute.Network{Name: "default", SelfLink: "projects/test-project/global/networks/default"}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	cs, err := compute.New(srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs.BasePath = srv.URL + "/"
+
+	md := newFakeMetadata()
+	g := &GCEBackend{computeService: cs, httpClient: srv.Client(), metadata: md, clock: clockwork.NewRealClock()}
+	cfg := &backendConfig{}
+
+	// the instance doesn't exist yet
+	if err := g.ensureAPI(context.Background(), cfg); err == nil {
+		t.Fatal("expected an error")
+	}
+	requests := md.requests
+
+	fake.instances["node"] = &compute.Instance{Name: "node", SelfLink: "projects/test-project/zones/z/instances/node", NetworkInterfaces: []*compute.NetworkInterface{{Network: "projects/test-project/global/networks/default"}}}
+	if err := g.ensureAPI(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if g.computeService != cs {
+		t.Error("expected the compute service to be reused")
+	}
+	if md.requests != requests {
+		t.Errorf("expected the identity to be reused, got %d more metadata requests", md.requests-requests)
+	}
+	if gi := g.apis[0].gceInstance; gi.SelfLink != "projects/test-project/zones/z/instances/node" {
+		t.Errorf("unexpected instance %+v", gi)
+	}
+}
+
+func TestNetworkCheckRoutes(t *testing.T) {
+	gceNetwork := "projects/test-project/global/networks/default"
+	fake := newFakeCompute(
+		&compute.Route{Name: "flannel-10-0-1-0-24", DestRange: "10.0.1.0/24", Network: gceNetwork, NextHopIp: "10.128.0.2"},
+		&compute.Route{Name: "flannel-10-0-2-0-24", DestRange: "10.0.2.0/24", Network: gceNetwork, NextHopIp: "10.128.0.9"},
+	)
+	api, done := newTestAPI(t, fake)
+	defer done()
+
+	api.useIPNextHop = true
+	api.gceInstance.NetworkInterfaces = []*compute.NetworkInterface{{NetworkIP: "10.128.0.2"}}
+
+	for _, tc := range []struct {
+		subnet string
+		ok     bool
+	}{
+		{"10.0.1.0/24", true},
+		// points at another instance
+		{"10.0.2.0/24", false},
+		// missing
+		{"10.0.3.0/24", false},
+	} {
+		n := &network{apis: []*gceAPI{api}, subnets: []string{tc.subnet}}
+		if err := n.CheckRoutes(context.Background()); (err == nil) != tc.ok {
+			t.Errorf("%v: expected ok=%v, got %v", tc.subnet, tc.ok, err)
+		}
+	}
+}
+
+type fakeRecorder struct {
+	reasons []string
+}
+
+func (r *fakeRecorder) Eventf(eventType, reason, messageFmt string, args ...interface{}) {
+	r.reasons = append(r.reasons, reason)
+}
+
+func TestRouteEvents(t *testing.T) {
+	gceNetwork := "projects/test-project/global/networks/default"
+	fake := newFakeCompute(
+		&compute.Route{Name: "flannel-10-0-2-0-24", DestRange: "10.0.2.0/24", Network: gceNetwork, NextHopIp: "10.128.0.9"},
+	)
+	api, done := newTestAPI(t, fake)
+	defer done()
+
+	api.useIPNextHop = true
+	api.gceInstance.NetworkInterfaces = []*compute.NetworkInterface{{NetworkIP: "10.128.0.2"}}
+	recorder := &fakeRecorder{}
+	api.recorder = recorder
+
+	g := &GCEBackend{apis: []*gceAPI{api}}
+	if err := g.ensureRoute(context.Background(), api, "10.0.1.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	// the route points at another instance, so it is replaced
+	if err := g.ensureRoute(context.Background(), api, "10.0.2.0/24"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{backend.EventRouteCreated, backend.EventRouteDeleted, backend.EventRouteCreated}
+	if !reflect.DeepEqual(recorder.reasons, expected) {
+		t.Errorf("expected events %v, got %v", expected, recorder.reasons)
+	}
+}
+
+func TestRepairRoutePeriodicallyTrigger(t *testing.T) {
+	fake := newFakeCompute()
+	api, done := newTestAPI(t, fake)
+	defer done()
+
+	api.useIPNextHop = true
+	api.gceInstance.NetworkInterfaces = []*compute.NetworkInterface{{NetworkIP: "10.128.0.2"}}
+	api.stopRefresh = make(chan struct{})
+
+	g := &GCEBackend{apis: []*gceAPI{api}}
+	n := &network{apis: []*gceAPI{api}, subnets: []string{"10.0.1.0/24"}}
+
+	stopped := make(chan struct{})
+	go func() {
+		// periodic reconciles are disabled, only the trigger repairs
+		g.repairRoutePeriodically(context.Background(), n, 0)
+		close(stopped)
+	}()
+
+	n.TriggerReconcile()
+	// wait for the triggered repair to insert the route
+	for i := 0; ; i++ {
+		fake.mu.Lock()
+		route := fake.routes[formatRouteName(defaultRouteNamePrefix, "10.0.1.0/24")]
+		fake.mu.Unlock()
+		if route != nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal("expected the triggered reconcile to recreate the route")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	api.Close()
+	<-stopped
+	if failures, err := n.ReconcileFailures(); failures != 0 {
+		t.Errorf("expected the reconcile to succeed, got %v", err)
+	}
+	statuses := n.RouteStatuses()
+	if len(statuses) != 1 || statuses[0].State != backend.RoutePresent || statuses[0].LastSuccess.IsZero() {
+		t.Errorf("expected the route to be reported present, got %+v", statuses)
+	}
+}
+
+func TestRouteStatusesFailure(t *testing.T) {
+	api, done := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusForbidden, "forbidden")
+	}))
+	defer done()
+	api.stopRefresh = make(chan struct{})
+
+	g := &GCEBackend{apis: []*gceAPI{api}}
+	n := &network{apis: []*gceAPI{api}, subnets: []string{"10.0.1.0/24"}}
+	n.recordRouteStatus(api, "10.0.1.0/24", backend.RoutePresent, nil)
+	succeeded := n.RouteStatuses()[0].LastSuccess
+
+	stopped := make(chan struct{})
+	go func() {
+		g.repairRoutePeriodically(context.Background(), n, 0)
+		close(stopped)
+	}()
+
+	n.TriggerReconcile()
+	for i := 0; ; i++ {
+		if failures, _ := n.ReconcileFailures(); failures > 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("expected the triggered reconcile to fail")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	api.Close()
+	<-stopped
+
+	s := n.RouteStatuses()[0]
+	if s.Name != "flannel-10-0-1-0-24" || s.State != backend.RouteUnknown || s.LastError == nil {
+		t.Errorf("expected the route to be reported unknown with an error, got %+v", s)
+	}
+	if !s.LastSuccess.Equal(succeeded) || s.LastChecked.Before(succeeded) {
+		t.Errorf("expected the last success to be kept, got %+v", s)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		mode    string
+		grace   time.Duration
+		expires time.Duration
+		wait    time.Duration
+		deleted bool
+	}{
+		{name: "retain", mode: "", deleted: false},
+		{name: "clean", mode: shutdownModeClean, deleted: true},
+		{name: "grace", mode: shutdownModeRetain, grace: time.Minute, wait: time.Minute, deleted: true},
+		{name: "grace capped by the lease", mode: shutdownModeRetain, grace: time.Hour, expires: 10 * time.Second, wait: 10 * time.Second, deleted: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := newFakeCompute(&compute.Route{Name: "flannel-10-0-1-0-24", DestRange: "10.0.1.0/24", NextHopIp: "10.128.0.2"})
+			api, done := newTestAPI(t, fake)
+			defer done()
+			api.useIPNextHop = true
+			api.gceInstance.NetworkInterfaces = []*compute.NetworkInterface{{NetworkIP: "10.128.0.2"}}
+
+			fc := clockwork.NewFakeClock()
+			api.clock = fc
+			lease := &subnet.Lease{Subnet: ip.IP4Net{IP: ip.MustParseIP4("10.0.1.0"), PrefixLen: 24}}
+			if tc.expires > 0 {
+				lease.Expiration = fc.Now().Add(tc.expires)
+			}
+			n := &network{
+				SimpleNetwork:   backend.SimpleNetwork{SubnetLease: lease},
+				apis:            []*gceAPI{api},
+				subnets:         []string{"10.0.1.0/24"},
+				shutdownMode:    tc.mode,
+				shutdownGrace:   tc.grace,
+				shutdownTimeout: time.Minute,
+			}
+
+			stopped := make(chan struct{})
+			go func() {
+				n.shutdown()
+				close(stopped)
+			}()
+			if tc.wait > 0 {
+				fc.BlockUntil(1)
+				fake.mu.Lock()
+				kept := fake.routes["flannel-10-0-1-0-24"] != nil
+				fake.mu.Unlock()
+				if !kept {
+					t.Fatal("expected the route to be kept during the grace period")
+				}
+				fc.Advance(tc.wait)
+			}
+			<-stopped
+
+			if _, ok := fake.routes["flannel-10-0-1-0-24"]; ok == tc.deleted {
+				t.Errorf("expected deleted=%v, got routes %v", tc.deleted, fake.routes)
+			}
+		})
+	}
+}
+
+func TestShutdownCleanup(t *testing.T) {
+	fake := newFakeCompute(
+		&compute.Route{Name: "flannel-10-0-1-0-24", DestRange: "10.0.1.0/24", NextHopIp: "10.128.0.2"},
+		&compute.Route{Name: "flannel-10-0-2-0-24", DestRange: "10.0.2.0/24", NextHopIp: "10.128.0.9"},
+	)
+	api, done := newTestAPI(t, fake)
+	defer done()
+	api.useIPNextHop = true
+	api.gceInstance.NetworkInterfaces = []*compute.NetworkInterface{{NetworkIP: "10.128.0.2"}}
+
+	n := &network{
+		SimpleNetwork:   backend.SimpleNetwork{SubnetLease: &subnet.Lease{Subnet: ip.IP4Net{IP: ip.MustParseIP4("10.0.1.0"), PrefixLen: 24}}},
+		apis:            []*gceAPI{api},
+		subnets:         []string{"10.0.1.0/24", "10.0.2.0/24", "10.0.3.0/24"},
+		shutdownMode:    shutdownModeClean,
+		shutdownTimeout: time.Minute,
+	}
+	n.shutdown()
+
+	// the route which was leased to another node since is left alone
+	if strings.Join(fake.deleted, ",") != "flannel-10-0-1-0-24" {
+		t.Errorf("expected only the route pointing here to be deleted, got %v", fake.deleted)
+	}
+}
+
+func TestShutdownCleanupDeadline(t *testing.T) {
+	fake := newFakeCompute(
+		&compute.Route{Name: "flannel-10-0-1-0-24", DestRange: "10.0.1.0/24", NextHopIp: "10.128.0.2"},
+		&compute.Route{Name: "flannel-10-0-2-0-24", DestRange: "10.0.2.0/24", NextHopIp: "10.128.0.2"},
+	)
+	unblock := make(chan struct{})
+	defer close(unblock)
+	api, done := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "DELETE" {
+			// the delete hangs past the deadline
+			select {
+			case <-r.Context().Done():
+			case <-unblock:
+			}
+			return
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	defer done()
+	api.useIPNextHop = true
+	api.gceInstance.NetworkInterfaces = []*compute.NetworkInterface{{NetworkIP: "10.128.0.2"}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	stopped := make(chan []string)
+	go func() {
+		stopped <- api.cleanupRoutes(ctx, []string{"10.0.1.0/24", "10.0.2.0/24"})
+	}()
+
+	select {
+	case left := <-stopped:
+		if strings.Join(left, ",") != "10.0.1.0/24,10.0.2.0/24" {
+			t.Errorf("expected both routes to be left, got %v", left)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the cleanup to be abandoned at the deadline")
+	}
+}
+
+func TestShutdownAfterStopReconciling(t *testing.T) {
+	fake := newFakeCompute(&compute.Route{Name: "flannel-10-0-1-0-24", DestRange: "10.0.1.0/24"})
+	api, done := newTestAPI(t, fake)
+	defer done()
+
+	n := &network{
+		SimpleNetwork: backend.SimpleNetwork{SubnetLease: &subnet.Lease{Subnet: ip.IP4Net{IP: ip.MustParseIP4("10.0.1.0"), PrefixLen: 24}}},
+		apis:          []*gceAPI{api},
+		subnets:       []string{"10.0.1.0/24"},
+		shutdownMode:  shutdownModeClean,
+	}
+	g := &GCEBackend{}
+	stopped := make(chan struct{})
+	go func() {
+		g.repairRoutePeriodically(context.Background(), n, time.Hour)
+		close(stopped)
+	}()
+
+	n.StopReconciling()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("expected the reconcile loop to stop")
+	}
+
+	// the routes are left to whoever took over the node
+	n.shutdown()
+	if len(fake.deleted) != 0 {
+		t.Errorf("expected no route to be deleted, got %v", fake.deleted)
+	}
+}
+
+func TestBackendConfigValidateShutdown(t *testing.T) {
+	for _, tc := range []struct {
+		cfg   backendConfig
+		valid bool
+	}{
+		{backendConfig{}, true},
+		{backendConfig{ShutdownMode: shutdownModeClean}, true},
+		{backendConfig{ShutdownMode: shutdownModeRetain, ShutdownGracePeriod: 30}, true},
+		{backendConfig{ShutdownMode: "drain"}, false},
+		{backendConfig{ShutdownGracePeriod: -1}, false},
+		{backendConfig{ShutdownMode: shutdownModeClean, ShutdownGracePeriod: 30}, false},
+		{backendConfig{ShutdownMode: shutdownModeClean, ShutdownTimeout: 20}, true},
+		{backendConfig{ShutdownTimeout: -1}, false},
+	} {
+		err := tc.cfg.validate()
+		if tc.valid && err != nil {
+			t.Errorf("%+v: unexpected error: %v", tc.cfg, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("%+v: expected an error", tc.cfg)
+		}
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	api, done := newTestAPI(t, newFakeCompute())
+	defer done()
+
+	cfg, err := parseBackendConfig(&subnet.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &network{apis: []*gceAPI{api}, cfg: cfg}
+
+	err = n.Reconfigure(context.Background(), &subnet.Config{Backend: json.RawMessage(`{"RoutePriority": 900, "Tags": ["pods"]}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if priority, tags, _ := api.routeSettings("10.0.1.0/24"); priority != 900 || !reflect.DeepEqual(tags, []string{"pods"}) {
+		t.Errorf("expected priority 900 and tags [pods], got %v and %v", priority, tags)
+	}
+	select {
+	case <-n.Triggered():
+	default:
+		t.Error("expected a reconcile to be triggered")
+	}
+
+	// the changes which can be applied are, the others are reported
+	err = n.Reconfigure(context.Background(), &subnet.Config{Backend: json.RawMessage(`{"RoutePriority": 800, "Tags": ["pods"], "PruneStaleRoutes": false}`)})
+	if rerr, ok := err.(*backend.RestartRequiredError); !ok || !reflect.DeepEqual(rerr.Keys, []string{"PruneStaleRoutes"}) {
+		t.Errorf("expected a restart to be required for PruneStaleRoutes, got %v", err)
+	}
+	if priority, _, _ := api.routeSettings("10.0.1.0/24"); priority != 800 {
+		t.Errorf("expected priority 800, got %v", priority)
+	}
+	if !n.cfg.PruneStaleRoutes {
+		t.Error("expected PruneStaleRoutes to keep its running value")
+	}
+}
+
+func TestReadOnlyVerifyRoutes(t *testing.T) {
+	gceNetwork := "projects/test-project/global/networks/default"
+	fake := newFakeCompute(
+		&compute.Route{Name: "flannel-10-0-1-0-24", DestRange: "10.0.1.0/24", Network: gceNetwork, NextHopIp: "10.128.0.2"},
+		&compute.Route{Name: "flannel-10-0-2-0-24", DestRange: "10.0.2.0/24", Network: gceNetwork, NextHopIp: "10.128.0.9"},
+	)
+	api, done := newTestAPI(t, fake)
+	defer done()
+
+	api.readOnly = true
+	api.networkName = "read-only-test"
+	api.useIPNextHop = true
+	api.gceInstance.NetworkInterfaces = []*compute.NetworkInterface{{NetworkIP: "10.128.0.2"}}
+
+	n := &network{apis: []*gceAPI{api}, subnets: []string{"10.0.1.0/24", "10.0.2.0/24", "10.0.3.0/24"}}
+	if err := n.verifyRoutes(context.Background(), api); err == nil {
+		t.Error("expected an error for the missing and drifted routes")
+	}
+
+	want := map[string]backend.RouteState{
+		"10.0.1.0/24": backend.RoutePresent,
+		"10.0.2.0/24": backend.RouteDrifted,
+		"10.0.3.0/24": backend.RouteAbsent,
+	}
+	for _, s := range n.RouteStatuses() {
+		if s.State != want[s.Destination] {
+			t.Errorf("%v: expected state %v, got %v", s.Destination, want[s.Destination], s.State)
+		}
+	}
+	if got := testutil.ToFloat64(missingRoutes.WithLabelValues("read-only-test")); got != 2 {
+		t.Errorf("expected 2 missing routes, got %v", got)
+	}
+	if len(fake.inserted) != 0 || len(fake.deleted) != 0 {
+		t.Errorf("expected no route to be changed, inserted %v, deleted %v", fake.inserted, fake.deleted)
+	}
+}
+
+func TestReadOnlyRefusesWrites(t *testing.T) {
+	fake := newFakeCompute(&compute.Route{Name: "flannel-10-0-1-0-24", DestRange: "10.0.1.0/24"})
+	api, done := newTestAPI(t, fake)
+	defer done()
+	api.readOnly = true
+
+	ctx := context.Background()
+	if _, err := api.insertRoute(ctx, "10.0.2.0/24"); err == nil {
+		t.Error("expected inserting a route to fail in read-only mode")
+	}
+	if _, err := api.deleteRoute(ctx, "10.0.1.0/24"); err == nil {
+		t.Error("expected deleting a route to fail in read-only mode")
+	}
+	if len(fake.inserted) != 0 || len(fake.deleted) != 0 {
+		t.Errorf("expected no route to be changed, inserted %v, deleted %v", fake.inserted, fake.deleted)
+	}
+}
+
+func TestBackendConfigValidateReadOnly(t *testing.T) {
+	for _, tc := range []struct {
+		cfg   backendConfig
+		valid bool
+	}{
+		{backendConfig{ReadOnly: true}, true},
+		{backendConfig{ReadOnly: true, ShutdownMode: shutdownModeRetain}, true},
+		{backendConfig{ReadOnly: true, ManageFirewall: true}, false},
+		{backendConfig{ReadOnly: true, ShutdownMode: shutdownModeClean}, false},
+		{backendConfig{ReadOnly: true, ShutdownGracePeriod: 30}, false},
+	} {
+		err := tc.cfg.validate()
+		if tc.valid && err != nil {
+			t.Errorf("%+v: unexpected error: %v", tc.cfg, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("%+v: expected an error", tc.cfg)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package gce
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// replacingActions are the actions of a managed instance group which replace
+// or remove the instance, during which routes go to its IP
+var replacingActions = map[string]bool{
+	"ABANDONING": true,
+	"DELETING":   true,
+	"RECREATING": true,
+}
+
+var instanceGroupLinkRegexp = regexp.MustCompile(`(^|/)projects/([^/]+)/(zones|regions)/([^/]+)/instanceGroupManagers/([^/]+)$`)
+
+// instanceGroup is the managed instance group of the instance, in a zone or,
+// if regional, a region
+type instanceGroup struct {
+	project  string
+	location string
+	regional bool
+	name     string
+}
+
+// parseInstanceGroup parses the link of an instance group manager, as found in
+// the created-by metadata of its instances
+func parseInstanceGroup(link string) (*instanceGroup, error) {
+	m := instanceGroupLinkRegexp.FindStringSubmatch(link)
+	if m == nil {
+		return nil, fmt.Errorf("invalid instance group manager %q", link)
+	}
+	return &instanceGroup{project: m[2], location: m[4], regional: m[3] == "regions", name: m[5]}, nil
+}
+
+func (g *instanceGroup) String() string {
+	collection := "zones"
+	if g.regional {
+		collection = "regions"
+	}
+	return path.Join("projects", g.project, collection, g.location, "instanceGroupManagers", g.name)
+}
+
+// getManagedInstance returns the instance called name as managed by the
+// instance group
+func (api *gceAPI) getManagedInstance(ctx context.Context, name string) (*compute.ManagedInstance, error) {
+	g := api.instanceGroup
+	var instances []*compute.ManagedInstance
+	start := time.Now()
+	if g.regional {
+		res, err := api.computeService.RegionInstanceGroupManagers.ListManagedInstances(g.project, g.location, g.name).Context(ctx).Do()
+		observeAPICall("listManagedInstances", start, err)
+		if err != nil {
+			return nil, err
+		}
+		instances = res.ManagedInstances
+	} else {
+		res, err := api.computeService.InstanceGroupManagers.ListManagedInstances(g.project, g.location, g.name).Context(ctx).Do()
+		observeAPICall("listManagedInstances", start, err)
+		if err != nil {
+			return nil, err
+		}
+		instances = res.ManagedInstances
+	}
+
+	for _, mi := range instances {
+		if path.Base(mi.Instance) == name {
+			return mi, nil
+		}
+	}
+	return nil, fmt.Errorf("instance %v isn't managed by instance group %v", name, g)
+}
+
+// resolveManagedInstance sets the link of gi to that of the instance the
+// managed instance group reports for it, and returns true if the group is
+// replacing or removing it, so that routes should go to its IP
+func (api *gceAPI) resolveManagedInstance(ctx context.Context, gi *compute.Instance) (bool, error) {
+	if api.instanceGroup == nil {
+		return false, nil
+	}
+	mi, err := api.getManagedInstance(ctx, gi.Name)
+	if err != nil {
+		return false, fmt.Errorf("error resolving instance through its instance group: %v", err)
+	}
+	gi.SelfLink = mi.Instance
+	return replacingActions[mi.CurrentAction], nil
+}
@@ -0,0 +1,154 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package gce
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jonboulle/clockwork"
+	"google.golang.org/api/compute/v1"
+)
+
+func TestParseInstanceGroup(t *testing.T) {
+	for _, tc := range []struct {
+		link     string
+		expected *instanceGroup
+	}{
+		{"projects/123/zones/z/instanceGroupManagers/pool", &instanceGroup{project: "123", location: "z", name: "pool"}},
+		{"projects/123/regions/r/instanceGroupManagers/pool", &instanceGroup{project: "123", location: "r", regional: true, name: "pool"}},
+		{"https://www.googleapis.com/compute/v1/projects/p/zones/z/instanceGroupManagers/pool", &instanceGroup{project: "p", location: "z", name: "pool"}},
+		{"projects/123/zones/z/instances/node", nil},
+		{"projects/123/zones/z/instanceGroupManagers/", nil},
+		{"", nil},
+	} {
+		g, err := parseInstanceGroup(tc.link)
+		if tc.expected == nil {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %+v", tc.link, g)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tc.link, err)
+			continue
+		}
+		if *g != *tc.expected {
+			t.Errorf("%q: expected %+v, got %+v", tc.link, tc.expected, g)
+		}
+	}
+}
+
+func TestNextHopResolution(t *testing.T) {
+	instanceLink := "projects/test-project/zones/z/instances/node"
+	// the group reports the instance by another link than its own, and
+	// SkipInstanceLookup derives its link unless it is looked up
+	managedLink := "https://compute.googleapis.com/compute/v1/" + instanceLink
+	for _, tc := range []struct {
+		name       string
+		resolution string
+		regional   bool
+		action     string
+		hop        routeNextHop
+	}{
+		{"instance", nextHopResolutionInstance, false, "NONE", routeNextHop{instance: selfLinkBase + instanceLink}},
+		{"ip", nextHopResolutionIP, false, "NONE", routeNextHop{ip: "10.128.0.2"}},
+		{"zonal group", nextHopResolutionInstanceGroup, false, "NONE", routeNextHop{instance: managedLink}},
+		{"regional group", nextHopResolutionInstanceGroup, true, "REFRESHING", routeNextHop{instance: managedLink}},
+		{"recreating", nextHopResolutionInstanceGroup, false, "RECREATING", routeNextHop{ip: "10.128.0.2"}},
+	} {
+		fake := newFakeCompute()
+		fake.networks["default"] = &compute.Network{Name: "default", SelfLink: "projects/test-project/global/networks/default"}
+		fake.instances["node"] = &compute.Instance{
+			Name:              "node",
+			SelfLink:          instanceLink,
+			NetworkInterfaces: []*compute.NetworkInterface{{NetworkIP: "10.128.0.2"}},
+		}
+		md := &fakeMetadata{createdBy: "projects/123/zones/z/instanceGroupManagers/pool"}
+		key := "zones/z/pool"
+		if tc.regional {
+			md.createdBy = "projects/123/regions/r/instanceGroupManagers/pool"
+			key = "regions/r/pool"
+		}
+		fake.managedInstances[key] = []*compute.ManagedInstance{
+			{Instance: "https://compute.googleapis.com/compute/v1/projects/test-project/zones/z/instances/other", CurrentAction: "NONE"},
+			{Instance: managedLink, CurrentAction: tc.action},
+		}
+		srv := httptest.NewServer(fake)
+		cs, err := compute.New(srv.Client())
+		if err != nil {
+			t.Fatal(err)
+		}
+		cs.BasePath = srv.URL + "/"
+
+		id := gceIdentity{
+			networkProject:  "test-project",
+			networkName:     "default",
+			instanceProject: "test-project",
+			instanceZone:    "z",
+			instanceName:    "node",
+		}
+		cfg := &backendConfig{RoutePriority: defaultRoutePriority, NextHopResolution: tc.resolution, SkipInstanceLookup: true}
+		api, err := newAPIWithService(context.Background(), cs, srv.Client(), md, clockwork.NewRealClock(), id, cfg)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		r, err := api.planRoute("10.0.1.0/24")
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if r.nextHop != tc.hop {
+			t.Errorf("%s: expected next hop %+v, got %+v", tc.name, tc.hop, r.nextHop)
+		}
+
+		// the group is checked again on refresh
+		if tc.resolution == nextHopResolutionInstanceGroup {
+			fake.managedInstances[key][1].CurrentAction = "NONE"
+			if err := api.refresh(context.Background()); err != nil {
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+			if r, err := api.planRoute("10.0.1.0/24"); err != nil || r.nextHop != (routeNextHop{instance: managedLink}) {
+				t.Errorf("%s: expected the route to go to the instance once replaced, got %+v, %v", tc.name, r, err)
+			}
+
+			fake.managedInstances[key] = fake.managedInstances[key][:1]
+			if err := api.refresh(context.Background()); err == nil {
+				t.Errorf("%s: expected an error for an instance the group doesn't manage", tc.name)
+			}
+		}
+		srv.Close()
+	}
+}
+
+func TestNextHopResolutionWithoutInstanceGroup(t *testing.T) {
+	fake := newFakeCompute()
+	fake.networks["default"] = &compute.Network{Name: "default", SelfLink: "projects/test-project/global/networks/default"}
+	fake.instances["node"] = &compute.Instance{Name: "node", SelfLink: "projects/test-project/zones/z/instances/node"}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	cs, err := compute.New(srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs.BasePath = srv.URL + "/"
+
+	id := gceIdentity{networkProject: "test-project", networkName: "default", instanceProject: "test-project", instanceZone: "z", instanceName: "node"}
+	cfg := &backendConfig{NextHopResolution: nextHopResolutionInstanceGroup}
+	if _, err := newAPIWithService(context.Background(), cs, srv.Client(), &fakeMetadata{}, clockwork.NewRealClock(), id, cfg); err == nil {
+		t.Error("expected an error for an instance created by no instance group")
+	}
+}
@@ -16,30 +16,62 @@
 package gce
 
 import (
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"path"
 	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/jonboulle/clockwork"
 )
 
-func networkFromMetadata() (string, error) {
-	network, err := metadataGet("/instance/network-interfaces/0/network")
+// metadataClient reads the identity of the instance flannel runs on
+type metadataClient interface {
+	// network is the name of the network of the first network interface
+	network() (string, error)
+	// project is the ID of the project of the instance
+	project() (string, error)
+	instanceName() (string, error)
+	instanceZone() (string, error)
+	// instanceIPv6 is the first IPv6 address of the first network interface
+	instanceIPv6() (string, error)
+	// instanceGroupManager is the link of the managed instance group which
+	// created the instance
+	instanceGroupManager() (string, error)
+}
+
+// metadataServer is the metadataClient of the GCE metadata server at endpoint.
+// Retries wait on clock.
+type metadataServer struct {
+	endpoint string
+	clock    clockwork.Clock
+}
+
+// newMetadataServer returns the client of the metadata server of the instance
+func newMetadataServer() *metadataServer {
+	return &metadataServer{endpoint: metadataEndpoint, clock: clockwork.NewRealClock()}
+}
+
+func (m *metadataServer) network() (string, error) {
+	network, err := m.get("/instance/network-interfaces/0/network")
 	if err != nil {
 		return "", err
 	}
 	return path.Base(network), nil
 }
 
-func projectFromMetadata() (string, error) {
-	projectName, err := metadataGet("/project/project-id")
+func (m *metadataServer) project() (string, error) {
+	projectName, err := m.get("/project/project-id")
 	if err != nil {
 		return "", err
 	}
 	return path.Base(projectName), nil
 }
 
-func instanceZoneFromMetadata() (string, error) {
-	zone, err := metadataGet("/instance/zone")
+func (m *metadataServer) instanceZone() (string, error) {
+	zone, err := m.get("/instance/zone")
 
 	if err != nil {
 		return "", err
@@ -47,8 +79,8 @@ func instanceZoneFromMetadata() (string, error) {
 	return path.Base(zone), nil
 }
 
-func instanceNameFromMetadata() (string, error) {
-	hostname, err := metadataGet("/instance/hostname")
+func (m *metadataServer) instanceName() (string, error) {
+	hostname, err := m.get("/instance/hostname")
 	if err != nil {
 		return "", err
 	}
@@ -56,21 +88,60 @@ func instanceNameFromMetadata() (string, error) {
 	return strings.SplitN(hostname, ".", 2)[0], nil
 }
 
-func metadataGet(path string) (string, error) {
-	req, err := http.NewRequest("GET", metadataEndpoint+path, nil)
+func (m *metadataServer) instanceIPv6() (string, error) {
+	ipv6s, err := m.get("/instance/network-interfaces/0/ipv6s")
 	if err != nil {
 		return "", err
 	}
+	// one address is returned per line
+	return strings.TrimSpace(strings.SplitN(ipv6s, "\n", 2)[0]), nil
+}
+
+func (m *metadataServer) instanceGroupManager() (string, error) {
+	return m.get("/instance/attributes/created-by")
+}
+
+const (
+	// metadataRetries is the number of attempts made for each metadata lookup
+	metadataRetries = 5
+	// metadataRetryInterval is the wait before the first retry, doubled on
+	// each subsequent retry
+	metadataRetryInterval = 500 * time.Millisecond
+)
+
+// get reads path from the metadata server, retrying on transient failures
+func (m *metadataServer) get(path string) (string, error) {
+	interval := metadataRetryInterval
+	for i := 1; ; i++ {
+		data, retriable, err := m.getOnce(path)
+		if err == nil || !retriable || i == metadataRetries {
+			return data, err
+		}
+
+		log.Warningf("Error fetching metadata %v (attempt %d of %d), retrying in %v: %v", path, i, metadataRetries, interval, err)
+		m.clock.Sleep(interval)
+		interval *= 2
+	}
+}
+
+func (m *metadataServer) getOnce(path string) (data string, retriable bool, err error) {
+	req, err := http.NewRequest("GET", m.endpoint+path, nil)
+	if err != nil {
+		return "", false, err
+	}
 	req.Header.Add("Metadata-Flavor", "Google")
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", err
+		return "", true, err
 	}
 	defer resp.Body.Close()
-	data, err := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return "", resp.StatusCode >= 500, fmt.Errorf("unexpected status fetching metadata %v: %v", path, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return "", err
+		return "", true, err
 	}
-	return string(data), nil
+	return string(body), false, nil
 }
@@ -0,0 +1,128 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package gce
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jonboulle/clockwork"
+)
+
+func withMetadataServer(t *testing.T, handler http.HandlerFunc) func() {
+	srv := httptest.NewServer(handler)
+	endpoint := metadataEndpoint
+	metadataEndpoint = srv.URL
+	return func() {
+		metadataEndpoint = endpoint
+		srv.Close()
+	}
+}
+
+// fakeMetadata is a metadataClient returning fixed values. Empty values are
+// reported as not found.
+type fakeMetadata struct {
+	networkName string
+	projectID   string
+	name        string
+	zone        string
+	ipv6        string
+	createdBy   string
+	// requests counts the lookups
+	requests int
+}
+
+// newFakeMetadata returns the metadata of instance node in zone z of
+// test-project, attached to the default network
+func newFakeMetadata() *fakeMetadata {
+	return &fakeMetadata{networkName: "default", projectID: "test-project", name: "node", zone: "z"}
+}
+
+func (m *fakeMetadata) lookup(key, value string) (string, error) {
+	m.requests++
+	if value == "" {
+		return "", fmt.Errorf("no %v in metadata", key)
+	}
+	return value, nil
+}
+
+func (m *fakeMetadata) network() (string, error)      { return m.lookup("network", m.networkName) }
+func (m *fakeMetadata) project() (string, error)      { return m.lookup("project", m.projectID) }
+func (m *fakeMetadata) instanceName() (string, error) { return m.lookup("instance name", m.name) }
+func (m *fakeMetadata) instanceZone() (string, error) { return m.lookup("instance zone", m.zone) }
+func (m *fakeMetadata) instanceIPv6() (string, error) { return m.lookup("IPv6 address", m.ipv6) }
+func (m *fakeMetadata) instanceGroupManager() (string, error) {
+	return m.lookup("instance group manager", m.createdBy)
+}
+
+func TestMetadataGetRetries(t *testing.T) {
+	requests := 0
+	defer withMetadataServer(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			t.Errorf("missing Metadata-Flavor header")
+		}
+		fmt.Fprint(w, "projects/123/zones/us-central1-b")
+	})()
+
+	fc := clockwork.NewFakeClock()
+	md := newMetadataServer()
+	md.clock = fc
+	type result struct {
+		zone string
+		err  error
+	}
+	done := make(chan result)
+	go func() {
+		zone, err := md.instanceZone()
+		done <- result{zone, err}
+	}()
+
+	// the retry waits for the clock
+	fc.BlockUntil(1)
+	fc.Advance(metadataRetryInterval)
+	res := <-done
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if res.zone != "us-central1-b" {
+		t.Errorf("expected zone us-central1-b, got %v", res.zone)
+	}
+	if requests != 2 {
+		t.Errorf("expected 2 requests, got %d", requests)
+	}
+}
+
+func TestMetadataGetNotFound(t *testing.T) {
+	requests := 0
+	defer withMetadataServer(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusNotFound)
+	})()
+
+	if _, err := newMetadataServer().instanceIPv6(); err == nil {
+		t.Error("expected an error")
+	}
+	if requests != 1 {
+		t.Errorf("expected 404 not to be retried, got %d requests", requests)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package gce
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/api/googleapi"
+)
+
+var (
+	apiCalls = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "flannel",
+			Subsystem: "gce",
+			Name:      "api_calls_total",
+			Help:      "Number of compute API calls made by the GCE backend, by operation and result.",
+		},
+		[]string{"operation", "result"},
+	)
+
+	apiCallDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "flannel",
+			Subsystem: "gce",
+			Name:      "api_call_duration_seconds",
+			Help:      "Duration of compute API calls made by the GCE backend, by operation.",
+			Buckets:   prometheus.ExponentialBuckets(0.05, 2, 12),
+		},
+		[]string{"operation"},
+	)
+
+	circuitBreakerOpen = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "flannel",
+			Subsystem: "gce",
+			Name:      "circuit_breaker_open",
+			Help:      "1 while route writes are paused after failing in a row, 0 otherwise.",
+		},
+	)
+
+	retryBudgetExhausted = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "flannel",
+			Subsystem: "gce",
+			Name:      "retry_budget_exhausted_total",
+			Help:      "Number of retries and operation polls given up because the retry budget was exhausted.",
+		},
+	)
+
+	flannelRoutes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "flannel",
+			Subsystem: "gce",
+			Name:      "routes",
+			Help:      "Number of flannel routes in the network as of the last route quota check.",
+		},
+		[]string{"network"},
+	)
+
+	routeQuotaUsage = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "flannel",
+			Subsystem: "gce",
+			Name:      "route_quota_usage_ratio",
+			Help:      "Fraction of RouteQuota used by the flannel routes in the network as of the last route quota check.",
+		},
+		[]string{"network"},
+	)
+
+	missingRoutes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "flannel",
+			Subsystem: "gce",
+			Name:      "missing_routes",
+			Help:      "Number of routes of the lease which are absent or don't point at this instance, as of the last check in read-only mode.",
+		},
+		[]string{"network"},
+	)
+
+	registerMetricsOnce sync.Once
+)
+
+// registerMetrics registers the GCE metrics with the default registry. It is
+// called when the API is created so that it only happens once, and only when
+// the GCE backend is in use.
+func registerMetrics() {
+	registerMetricsOnce.Do(func() {
+		prometheus.MustRegister(apiCalls, apiCallDuration, circuitBreakerOpen, retryBudgetExhausted, flannelRoutes, routeQuotaUsage, missingRoutes)
+	})
+}
+
+// observeAPICall records the result and duration of a call which started at start
+func observeAPICall(operation string, start time.Time, err error) {
+	apiCalls.WithLabelValues(operation, resultLabel(err)).Inc()
+	apiCallDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+func resultLabel(err error) string {
+	switch e := err.(type) {
+	case nil:
+		return "success"
+	case *RateLimitError:
+		return "rate_limited"
+	case *googleapi.Error:
+		if e.Code == http.StatusNotFound {
+			return "not_found"
+		}
+		if isRateLimited(e) {
+			return "rate_limited"
+		}
+	}
+	return "error"
+}
@@ -0,0 +1,53 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package gce
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/api/googleapi"
+)
+
+func TestResultLabel(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{nil, "success"},
+		{&googleapi.Error{Code: http.StatusNotFound}, "not_found"},
+		{&googleapi.Error{Code: http.StatusTooManyRequests}, "rate_limited"},
+		{&RateLimitError{Err: &googleapi.Error{Code: http.StatusTooManyRequests}}, "rate_limited"},
+		{&googleapi.Error{Code: http.StatusInternalServerError}, "error"},
+		{errors.New("boom"), "error"},
+	}
+	for _, tt := range tests {
+		if got := resultLabel(tt.err); got != tt.want {
+			t.Errorf("resultLabel(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestObserveAPICall(t *testing.T) {
+	before := testutil.ToFloat64(apiCalls.WithLabelValues("getRoute", "not_found"))
+	observeAPICall("getRoute", time.Now(), &googleapi.Error{Code: http.StatusNotFound})
+	if got := testutil.ToFloat64(apiCalls.WithLabelValues("getRoute", "not_found")); got != before+1 {
+		t.Errorf("expected counter to be %v, got %v", before+1, got)
+	}
+}
@@ -0,0 +1,368 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package gce
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"google.golang.org/api/compute/v1"
+)
+
+// operationStep is the response to one request for the state of an
+// operation: an API error if code is set, else the operation in status,
+// failed with opError if set
+type operationStep struct {
+	status  string
+	code    int
+	opError string
+}
+
+var (
+	opPending = operationStep{status: "PENDING"}
+	opRunning = operationStep{status: "RUNNING"}
+	opDone    = operationStep{status: "DONE"}
+)
+
+// operationReplay is an operations API which answers the gets and waits of
+// operations with its steps, one per request, repeating the last one once
+// they run out. Waits take waitFor on clock before they answer, as the API
+// holds them until the operation changes.
+type operationReplay struct {
+	clock   clockwork.FakeClock
+	start   time.Time
+	waitFor time.Duration
+	// waitUnavailable fails waits as if the API had no wait method
+	waitUnavailable bool
+
+	mu       sync.Mutex
+	steps    []operationStep
+	requests []operationRequest
+}
+
+// operationRequest is a request the replay answered, with the time since the
+// replay started at which it arrived
+type operationRequest struct {
+	method string
+	path   string
+	at     time.Duration
+}
+
+func newOperationReplay(clock clockwork.FakeClock, steps ...operationStep) *operationReplay {
+	return &operationReplay{clock: clock, start: clock.Now(), steps: steps}
+}
+
+func (o *operationReplay) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.requests = append(o.requests, operationRequest{method: r.Method, path: r.URL.Path, at: o.clock.Now().Sub(o.start)})
+	if !strings.Contains(r.URL.Path, "/operations/") {
+		writeError(w, http.StatusNotFound, "notFound")
+		return
+	}
+	name := r.URL.Path[strings.LastIndex(r.URL.Path, "/operations/")+len("/operations/"):]
+	if strings.HasSuffix(name, "/wait") {
+		if o.waitUnavailable {
+			writeError(w, http.StatusNotFound, "notFound")
+			return
+		}
+		name = strings.TrimSuffix(name, "/wait")
+		o.clock.Advance(o.waitFor)
+	}
+
+	step := o.steps[0]
+	if len(o.steps) > 1 {
+		o.steps = o.steps[1:]
+	}
+	if step.code != 0 {
+		writeError(w, step.code, http.StatusText(step.code))
+		return
+	}
+	op := &compute.Operation{Name: name, Status: step.status}
+	if step.opError != "" {
+		op.Error = &compute.OperationError{Errors: []*compute.OperationErrorErrors{{Code: step.opError}}}
+	}
+	writeObject(w, op)
+}
+
+// times returns when each request arrived since the replay started
+func (o *operationReplay) times() []time.Duration {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var times []time.Duration
+	for _, r := range o.requests {
+		times = append(times, r.at)
+	}
+	return times
+}
+
+// paths returns the method and path of each request
+func (o *operationReplay) paths() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var paths []string
+	for _, r := range o.requests {
+		paths = append(paths, r.method+" "+r.path)
+	}
+	return paths
+}
+
+// newReplayAPI returns a gceAPI on a fake clock whose operations are answered
+// by a replay of steps, and polled following policy
+func newReplayAPI(t *testing.T, policy backoffPolicy, steps ...operationStep) (*gceAPI, *operationReplay, func()) {
+	fc := clockwork.NewFakeClock()
+	replay := newOperationReplay(fc, steps...)
+	api, done := newTestAPI(t, replay)
+	api.clock = fc
+	api.pollBackoff = policy
+	return api, replay, done
+}
+
+// replayPoll polls op in the background, advancing the clock by each of sleeps
+// once the poll sleeps, and returns its result
+func replayPoll(api *gceAPI, op *compute.Operation, sleeps ...time.Duration) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- api.pollOperationStatus(context.Background(), op)
+	}()
+	fc := api.clock.(clockwork.FakeClock)
+	for _, d := range sleeps {
+		fc.BlockUntil(1)
+		fc.Advance(d)
+	}
+	return <-errCh
+}
+
+func sameDurations(a, b []time.Duration) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// replayPolicy polls after 1s, 2s, 4s, then every 5s for 30s
+var replayPolicy = backoffPolicy{
+	initialInterval: time.Second,
+	maxInterval:     5 * time.Second,
+	multiplier:      2,
+	deadline:        30 * time.Second,
+}
+
+func TestReplayOperationLifecycle(t *testing.T) {
+	api, replay, done := newReplayAPI(t, replayPolicy, opPending, opPending, opRunning, opRunning, opRunning, opDone)
+	defer done()
+
+	err := replayPoll(api, &compute.Operation{Name: "op"}, time.Second, 2*time.Second, 4*time.Second, 5*time.Second, 5*time.Second)
+	if err != nil {
+		t.Fatalf("pollOperationStatus failed: %v", err)
+	}
+	expected := []time.Duration{0, time.Second, 3 * time.Second, 7 * time.Second, 12 * time.Second, 17 * time.Second}
+	if times := replay.times(); !sameDurations(times, expected) {
+		t.Errorf("expected polls at %v, got %v", expected, times)
+	}
+	for _, path := range replay.paths() {
+		if path != "GET /test-project/global/operations/op" {
+			t.Errorf("expected only gets of the global operation, got %v", replay.paths())
+			break
+		}
+	}
+}
+
+func TestReplayOperationScopes(t *testing.T) {
+	for _, tc := range []struct {
+		selfLink string
+		path     string
+	}{
+		{"projects/host/global/operations/op", "GET /host/global/operations/op"},
+		{"projects/host/regions/r/operations/op", "GET /host/regions/r/operations/op"},
+		{"projects/p/zones/z/operations/op", "GET /p/zones/z/operations/op"},
+	} {
+		api, replay, done := newReplayAPI(t, replayPolicy, opRunning, opDone)
+		if err := replayPoll(api, &compute.Operation{Name: "op", SelfLink: tc.selfLink}, time.Second); err != nil {
+			t.Errorf("%v: pollOperationStatus failed: %v", tc.selfLink, err)
+		}
+		if paths := replay.paths(); len(paths) != 2 || paths[0] != tc.path || paths[1] != tc.path {
+			t.Errorf("%v: expected two polls of %v, got %v", tc.selfLink, tc.path, paths)
+		}
+		done()
+	}
+}
+
+func TestReplayOperationDeadline(t *testing.T) {
+	api, replay, done := newReplayAPI(t, replayPolicy, opPending, opRunning)
+	defer done()
+
+	// the poll after 32s would be past the deadline
+	err := replayPoll(api, &compute.Operation{Name: "op"}, time.Second, 2*time.Second, 4*time.Second, 5*time.Second, 5*time.Second, 5*time.Second, 5*time.Second)
+	if err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	expected := []time.Duration{0, time.Second, 3 * time.Second, 7 * time.Second, 12 * time.Second, 17 * time.Second, 22 * time.Second, 27 * time.Second}
+	if times := replay.times(); !sameDurations(times, expected) {
+		t.Errorf("expected polls at %v, got %v", expected, times)
+	}
+}
+
+func TestReplayOperationErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		steps []operationStep
+		// check returns true if err is the expected one
+		check func(err error) bool
+		polls int
+	}{
+		{
+			"operation failed",
+			[]operationStep{opPending, opRunning, {status: "DONE", opError: "QUOTA_EXCEEDED"}},
+			func(err error) bool { return err != nil && strings.Contains(err.Error(), "error running operation") },
+			3,
+		},
+		{
+			// polling isn't retried, the caller retries the operation
+			"server error",
+			[]operationStep{opRunning, {code: http.StatusServiceUnavailable}, opDone},
+			func(err error) bool {
+				return err != nil && strings.Contains(err.Error(), "error fetching operation status")
+			},
+			2,
+		},
+		{
+			"rate limited",
+			[]operationStep{opRunning, {code: http.StatusTooManyRequests}, opDone},
+			func(err error) bool { _, ok := err.(*RateLimitError); return ok },
+			2,
+		},
+	} {
+		api, replay, done := newReplayAPI(t, replayPolicy, tc.steps...)
+		sleeps := []time.Duration{time.Second, 2 * time.Second}[:tc.polls-1]
+		if err := replayPoll(api, &compute.Operation{Name: "op"}, sleeps...); !tc.check(err) {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+		}
+		if polls := len(replay.times()); polls != tc.polls {
+			t.Errorf("%s: expected %d polls, got %d", tc.name, tc.polls, polls)
+		}
+		done()
+	}
+}
+
+func TestReplayOperationCancel(t *testing.T) {
+	api, replay, done := newReplayAPI(t, replayPolicy, opPending, opRunning)
+	defer done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- api.pollOperationStatus(ctx, &compute.Operation{Name: "op"})
+	}()
+	fc := api.clock.(clockwork.FakeClock)
+	fc.BlockUntil(1)
+	fc.Advance(time.Second)
+	fc.BlockUntil(1)
+	cancel()
+
+	if err := <-errCh; err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+	if polls := len(replay.times()); polls != 2 {
+		t.Errorf("expected no poll after the cancel, got %d polls", polls)
+	}
+}
+
+func TestReplayOperationWait(t *testing.T) {
+	api, replay, done := newReplayAPI(t, replayPolicy, opPending, opRunning, opDone)
+	defer done()
+
+	// each wait is held by the server for 10s, asked again right away
+	api.waitForOperations = true
+	replay.waitFor = 10 * time.Second
+	if err := replayPoll(api, &compute.Operation{Name: "op"}); err != nil {
+		t.Fatalf("pollOperationStatus failed: %v", err)
+	}
+	expected := []time.Duration{0, 10 * time.Second, 20 * time.Second}
+	if times := replay.times(); !sameDurations(times, expected) {
+		t.Errorf("expected waits at %v, got %v", expected, times)
+	}
+	for _, path := range replay.paths() {
+		if path != "POST /test-project/global/operations/op/wait" {
+			t.Errorf("expected only waits, got %v", replay.paths())
+			break
+		}
+	}
+}
+
+func TestReplayOperationWaitDeadline(t *testing.T) {
+	api, replay, done := newReplayAPI(t, replayPolicy, opRunning)
+	defer done()
+
+	api.waitForOperations = true
+	replay.waitFor = 10 * time.Second
+	err := replayPoll(api, &compute.Operation{Name: "op"})
+	if err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	// the deadline is checked after each wait returns
+	if waits := len(replay.times()); waits != 3 {
+		t.Errorf("expected 3 waits within the deadline, got %d", waits)
+	}
+}
+
+func TestReplayOperationWaitErrors(t *testing.T) {
+	api, replay, done := newReplayAPI(t, replayPolicy, opRunning, operationStep{code: http.StatusServiceUnavailable}, opDone)
+	defer done()
+
+	api.waitForOperations = true
+	err := replayPoll(api, &compute.Operation{Name: "op"})
+	if err == nil || !strings.Contains(err.Error(), "error fetching operation status") {
+		t.Fatalf("expected the error of the wait, got %v", err)
+	}
+	if waits := len(replay.times()); waits != 2 {
+		t.Errorf("expected 2 waits, got %d", waits)
+	}
+}
+
+func TestReplayOperationWaitFallback(t *testing.T) {
+	api, replay, done := newReplayAPI(t, replayPolicy, opRunning, opDone)
+	defer done()
+
+	// without the wait method, the operation is polled with the backoff
+	api.waitForOperations = true
+	replay.waitUnavailable = true
+	if err := replayPoll(api, &compute.Operation{Name: "op"}, time.Second); err != nil {
+		t.Fatalf("pollOperationStatus failed: %v", err)
+	}
+	expected := []string{
+		"POST /test-project/global/operations/op/wait",
+		"GET /test-project/global/operations/op",
+		"GET /test-project/global/operations/op",
+	}
+	if paths := replay.paths(); strings.Join(paths, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected %v, got %v", expected, paths)
+	}
+	if times := replay.times(); !sameDurations(times, []time.Duration{0, 0, time.Second}) {
+		t.Errorf("expected the polls to follow the backoff, got %v", times)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package gce
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRunWorkers(t *testing.T) {
+	var running, maxRunning int32
+	err := runWorkers(context.Background(), 20, 3, func(ctx context.Context, i int) error {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		if i%5 == 0 {
+			return fmt.Errorf("item %d failed", i)
+		}
+		return nil
+	})
+
+	if maxRunning > 3 {
+		t.Errorf("expected at most 3 items at once, got %d", maxRunning)
+	}
+	errs, ok := err.(multiError)
+	if !ok || len(errs) != 4 {
+		t.Fatalf("expected 4 aggregated errors, got %v", err)
+	}
+	for i, err := range errs {
+		if want := fmt.Sprintf("item %d failed", 5*i); err.Error() != want {
+			t.Errorf("expected error %d to be %q, got %q", i, want, err)
+		}
+	}
+
+	if err := runWorkers(context.Background(), 0, 3, nil); err != nil {
+		t.Errorf("expected no error without items, got %v", err)
+	}
+}
+
+func TestRunWorkersCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var mu sync.Mutex
+	var started []int
+	err := runWorkers(ctx, 10, 2, func(ctx context.Context, i int) error {
+		mu.Lock()
+		started = append(started, i)
+		mu.Unlock()
+		// the first item cancels the batch, the items which haven't
+		// started by then don't run
+		if i == 0 {
+			cancel()
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	if len(started) > 2 {
+		t.Errorf("expected at most the first 2 items to start, got %v", started)
+	}
+	errs, ok := err.(multiError)
+	if !ok || len(errs) != 10 {
+		t.Fatalf("expected 10 aggregated errors, got %v", err)
+	}
+	for _, err := range errs {
+		if !strings.Contains(err.Error(), context.Canceled.Error()) {
+			t.Errorf("expected the items to be canceled, got %v", err)
+		}
+	}
+}
+
+func TestWriteConcurrency(t *testing.T) {
+	if n := writeConcurrency(&backendConfig{}); n != defaultWriteConcurrency {
+		t.Errorf("expected the default of %d, got %d", defaultWriteConcurrency, n)
+	}
+	if n := writeConcurrency(&backendConfig{WriteConcurrency: 20}); n != 20 {
+		t.Errorf("expected 20, got %d", n)
+	}
+	if err := (&backendConfig{WriteConcurrency: -1}).validate(); err == nil {
+		t.Error("expected an error for a negative WriteConcurrency")
+	}
+}
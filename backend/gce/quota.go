@@ -0,0 +1,61 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package gce
+
+import (
+	"context"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+// checkRouteQuota counts the flannel routes in the network, records how much
+// of quota they use and logs a warning once it reaches threshold
+func (api *gceAPI) checkRouteQuota(ctx context.Context, quota int, threshold float64) (int, error) {
+	routes, err := api.listFlannelRoutes(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	usage := float64(len(routes)) / float64(quota)
+	flannelRoutes.WithLabelValues(api.networkName).Set(float64(len(routes)))
+	routeQuotaUsage.WithLabelValues(api.networkName).Set(usage)
+	if usage >= threshold {
+		log.Warningf("Network %v holds %d flannel routes, %.0f%% of the route quota of %d: request a quota increase "+
+			"or switch to RoutingMode %q before route inserts fail", api.networkName, len(routes), usage*100, quota, routingModeAliasIP)
+	} else {
+		logger.V(1).Infof("Network %v holds %d flannel routes, %.0f%% of the route quota of %d", api.networkName, len(routes), usage*100, quota)
+	}
+	return len(routes), nil
+}
+
+// checkRouteQuotaPeriodically checks the route quota right away and then
+// each interval, until ctx is done or the API is closed
+func (api *gceAPI) checkRouteQuotaPeriodically(ctx context.Context, interval time.Duration, quota int, threshold float64) {
+	for {
+		if _, err := api.checkRouteQuota(ctx, quota, threshold); err != nil && ctx.Err() == nil {
+			log.Errorf("Error checking the route quota of network %v, will retry in %v: %v", api.networkName, interval, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-api.stopRefresh:
+			return
+		case <-api.clock.After(interval):
+		}
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+// +build !windows
+
+package gce
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/api/compute/v1"
+)
+
+func TestCheckRouteQuota(t *testing.T) {
+	fake := newFakeCompute(
+		&compute.Route{Name: "flannel-10-0-1-0-24", DestRange: "10.0.1.0/24"},
+		&compute.Route{Name: "flannel-10-0-2-0-24", DestRange: "10.0.2.0/24"},
+		&compute.Route{Name: "flannel-10-0-3-0-24", DestRange: "10.0.3.0/24"},
+		&compute.Route{Name: "default-route", DestRange: "0.0.0.0/0"},
+	)
+	api, done := newTestAPI(t, fake)
+	defer done()
+	api.networkName = "quota-test"
+
+	count, err := api.checkRouteQuota(context.Background(), 4, 0.8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("expected 3 flannel routes, got %d", count)
+	}
+	if got := testutil.ToFloat64(flannelRoutes.WithLabelValues("quota-test")); got != 3 {
+		t.Errorf("expected the routes gauge to be 3, got %v", got)
+	}
+	if got := testutil.ToFloat64(routeQuotaUsage.WithLabelValues("quota-test")); got != 0.75 {
+		t.Errorf("expected the usage gauge to be 0.75, got %v", got)
+	}
+}
+
+func TestCheckRouteQuotaPeriodically(t *testing.T) {
+	fake := newFakeCompute(&compute.Route{Name: "flannel-10-0-1-0-24", DestRange: "10.0.1.0/24"})
+	api, done := newTestAPI(t, fake)
+	defer done()
+	fc := clockwork.NewFakeClock()
+	api.clock = fc
+	api.stopRefresh = make(chan struct{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		api.checkRouteQuotaPeriodically(ctx, time.Minute, 10, 0.8)
+		close(stopped)
+	}()
+
+	// checked right away, then once a minute
+	fc.BlockUntil(1)
+	fc.Advance(time.Minute)
+	fc.BlockUntil(1)
+	fake.mu.Lock()
+	listed := fake.listed
+	fake.mu.Unlock()
+	if listed != 2 {
+		t.Errorf("expected the routes to be listed twice, got %d", listed)
+	}
+
+	cancel()
+	<-stopped
+}
+
+func TestBackendConfigValidateRouteQuota(t *testing.T) {
+	for _, tc := range []struct {
+		cfg   backendConfig
+		valid bool
+	}{
+		{backendConfig{}, true},
+		{backendConfig{RouteQuota: 250, RouteQuotaWarnThreshold: 0.8}, true},
+		{backendConfig{RouteQuota: 250, RouteQuotaWarnThreshold: 1}, true},
+		{backendConfig{RouteQuota: -1}, false},
+		{backendConfig{RouteQuota: 250}, false},
+		{backendConfig{RouteQuota: 250, RouteQuotaWarnThreshold: 1.5}, false},
+		{backendConfig{RouteQuotaCheckInterval: -1}, false},
+	} {
+		err := tc.cfg.validate()
+		if tc.valid && err != nil {
+			t.Errorf("%+v: unexpected error: %v", tc.cfg, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("%+v: expected an error", tc.cfg)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package gce
+
+import (
+	"encoding/json"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// routeNextHop is where a route sends traffic, either an IP, an instance,
+// the forwarding rule of an internal load balancer, a gateway or a VPN tunnel
+type routeNextHop struct {
+	ip        string
+	instance  string
+	ilb       string
+	gateway   string
+	vpnTunnel string
+}
+
+func (h routeNextHop) String() string {
+	switch {
+	case h.ip != "":
+		return h.ip
+	case h.ilb != "":
+		return h.ilb
+	case h.gateway != "":
+		return h.gateway
+	case h.vpnTunnel != "":
+		return h.vpnTunnel
+	}
+	return h.instance
+}
+
+// matches returns true if actual, as read from the API, is the next hop h.
+// Instances may be referenced by full or partial links.
+func (h routeNextHop) matches(actual routeNextHop) bool {
+	switch {
+	case h.ilb != "":
+		// the vendored compute client doesn't read nextHopIlb, so
+		// routes via a load balancer appear to have no next hop
+		return actual.ip == "" && actual.instance == "" && actual.gateway == "" && actual.vpnTunnel == ""
+	case h.gateway != "":
+		return actual.ip == "" && actual.instance == "" && sameLink(actual.gateway, h.gateway)
+	case h.vpnTunnel != "":
+		return actual.ip == "" && actual.instance == "" && sameLink(actual.vpnTunnel, h.vpnTunnel)
+	case h.instance != "":
+		return actual.ip == "" && actual.gateway == "" && actual.vpnTunnel == "" && sameLink(actual.instance, h.instance)
+	default:
+		return actual.ip == h.ip && actual.instance == "" && actual.gateway == "" && actual.vpnTunnel == ""
+	}
+}
+
+// route describes a route independently of the compute API, so that deciding
+// which routes flannel wants doesn't depend on the API types
+type route struct {
+	name        string
+	destRange   string
+	network     string
+	nextHop     routeNextHop
+	priority    int64
+	tags        []string
+	description string
+	// owner is the flannel which created the route, nil for routes
+	// created before it was recorded in the description
+	owner *routeOwner
+}
+
+// routeSchemaVersion is the schema of the routes flannel creates. Bump it when
+// they gain fields which routes created by an older flannel should be
+// recreated to get, see RecreateOutdatedRoutes.
+const routeSchemaVersion = 1
+
+// routeOwner identifies the flannel which created a route. Routes don't have
+// labels, so it is recorded in their description, see encodeRouteDescription.
+// Schema is the routeSchemaVersion of that flannel, 0 before it was recorded.
+type routeOwner struct {
+	Cluster string `json:"cluster"`
+	Node    string `json:"node"`
+	Version string `json:"version"`
+	Schema  int    `json:"schema,omitempty"`
+}
+
+// ownedRouteDescription is the description of routes with an owner
+type ownedRouteDescription struct {
+	Flannel     *routeOwner `json:"flannel"`
+	Description string      `json:"description,omitempty"`
+}
+
+// encodeRouteDescription returns the description of a route created by owner,
+// as JSON holding owner and text. Without an owner, it is text.
+func encodeRouteDescription(owner *routeOwner, text string) string {
+	if owner == nil {
+		return text
+	}
+	data, err := json.Marshal(ownedRouteDescription{Flannel: owner, Description: text})
+	if err != nil {
+		return text
+	}
+	return string(data)
+}
+
+// decodeRouteDescription returns the owner and text of a route's description.
+// The owner is nil if the description doesn't record one, e.g. because the
+// route was created by an older version of flannel, and text is all of it.
+func decodeRouteDescription(description string) (*routeOwner, string) {
+	var owned ownedRouteDescription
+	if err := json.Unmarshal([]byte(description), &owned); err != nil || owned.Flannel == nil {
+		return nil, description
+	}
+	return owned.Flannel, owned.Description
+}
+
+// routeOutdated returns true if route was created with an older schema than
+// routeSchemaVersion, or before the owner was recorded
+func routeOutdated(route *compute.Route) bool {
+	owner, _ := decodeRouteDescription(route.Description)
+	return owner == nil || owner.Schema < routeSchemaVersion
+}
+
+// toCompute returns the compute API representation of r
+func (r *route) toCompute() *compute.Route {
+	cr := &compute.Route{
+		Name:            r.name,
+		DestRange:       r.destRange,
+		Network:         r.network,
+		NextHopIp:       r.nextHop.ip,
+		NextHopInstance: r.nextHop.instance,
+		Priority:        r.priority,
+		Description:     encodeRouteDescription(r.owner, r.description),
+		Tags:            []string{},
+
+		NextHopGateway:   r.nextHop.gateway,
+		NextHopVpnTunnel: r.nextHop.vpnTunnel,
+	}
+	if len(r.tags) > 0 {
+		cr.Tags = r.tags
+	}
+	return cr
+}
+
+// routeFromCompute returns the route described by cr
+func routeFromCompute(cr *compute.Route) *route {
+	owner, description := decodeRouteDescription(cr.Description)
+	hop := routeNextHop{
+		ip:        cr.NextHopIp,
+		instance:  cr.NextHopInstance,
+		gateway:   cr.NextHopGateway,
+		vpnTunnel: cr.NextHopVpnTunnel,
+	}
+	return &route{
+		name:        cr.Name,
+		destRange:   cr.DestRange,
+		network:     cr.Network,
+		nextHop:     hop,
+		priority:    cr.Priority,
+		tags:        cr.Tags,
+		description: description,
+		owner:       owner,
+	}
+}
+
+// sameTarget returns true if other, as read from the API, sends the same range
+// to the same next hop as r
+func (r *route) sameTarget(other *route) bool {
+	return r.destRange == other.destRange && r.nextHop.matches(other.nextHop)
+}
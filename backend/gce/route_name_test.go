@@ -0,0 +1,123 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+// +build !windows
+
+package gce
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+// randomCIDR is a valid, canonical CIDR for property tests. IPv6 addresses
+// are mostly zeros, so that they are spelled with "::" in different places.
+type randomCIDR string
+
+func (randomCIDR) Generate(r *rand.Rand, size int) reflect.Value {
+	var ipn net.IPNet
+	if r.Intn(2) == 0 {
+		ipn.IP = make(net.IP, net.IPv4len)
+		r.Read(ipn.IP)
+		ipn.Mask = net.CIDRMask(r.Intn(33), 32)
+	} else {
+		ipn.IP = make(net.IP, net.IPv6len)
+		for i := 0; i < net.IPv6len; i += 2 {
+			if r.Intn(3) == 0 {
+				ipn.IP[i], ipn.IP[i+1] = byte(r.Intn(256)), byte(r.Intn(256))
+			}
+		}
+		ipn.Mask = net.CIDRMask(r.Intn(129), 128)
+	}
+	ipn.IP = ipn.IP.Mask(ipn.Mask)
+	return reflect.ValueOf(randomCIDR(ipn.String()))
+}
+
+// routeNameReplacements are the replacements route names are checked with:
+// the defaults, and the documented example for IPv6 subnets
+var routeNameReplacements = []map[string]string{nil, {"::": "-z-"}}
+
+func TestRouteNameValid(t *testing.T) {
+	for _, replacements := range routeNameReplacements {
+		replacer := newRouteNameReplacer(replacements)
+		for _, prefix := range []string{defaultRouteNamePrefix, "a", strings.Repeat("p", maxRouteNamePrefixLength)} {
+			valid := func(subnet randomCIDR) bool {
+				name := formatRouteNameWith(replacer, prefix, string(subnet))
+				return len(name) <= maxRouteNameLength && routeNameRegexp.MatchString(name) && strings.HasPrefix(name, prefix)
+			}
+			if err := quick.Check(valid, &quick.Config{MaxCount: 5000}); err != nil {
+				t.Errorf("replacements %v, prefix %q: %v", replacements, prefix, err)
+			}
+		}
+	}
+}
+
+// expandedCIDR spells the CIDR subnet with all eight uppercase groups, IPv4
+// ranges as IPv4-mapped ones
+func expandedCIDR(subnet string) string {
+	ip, ipn, _ := net.ParseCIDR(subnet)
+	ones, bits := ipn.Mask.Size()
+	if bits == 32 {
+		ones += 96
+	}
+	ip = ip.To16()
+	groups := make([]string, 0, 8)
+	for i := 0; i < net.IPv6len; i += 2 {
+		groups = append(groups, fmt.Sprintf("%04X", int(ip[i])<<8|int(ip[i+1])))
+	}
+	return fmt.Sprintf("%s/%d", strings.Join(groups, ":"), ones)
+}
+
+func TestRouteNameCanonical(t *testing.T) {
+	for _, replacements := range routeNameReplacements {
+		replacer := newRouteNameReplacer(replacements)
+		same := func(subnet randomCIDR) bool {
+			expanded := expandedCIDR(string(subnet))
+			return formatRouteNameWith(replacer, defaultRouteNamePrefix, string(subnet)) == formatRouteNameWith(replacer, defaultRouteNamePrefix, expanded)
+		}
+		if err := quick.Check(same, &quick.Config{MaxCount: 5000}); err != nil {
+			t.Errorf("replacements %v: %v", replacements, err)
+		}
+	}
+}
+
+func TestRouteNameUnique(t *testing.T) {
+	for _, replacements := range routeNameReplacements {
+		replacer := newRouteNameReplacer(replacements)
+		distinct := func(a, b randomCIDR) bool {
+			return a == b || formatRouteNameWith(replacer, defaultRouteNamePrefix, string(a)) != formatRouteNameWith(replacer, defaultRouteNamePrefix, string(b))
+		}
+		if err := quick.Check(distinct, &quick.Config{MaxCount: 5000}); err != nil {
+			t.Errorf("replacements %v: %v", replacements, err)
+		}
+
+		// pairs of random subnets rarely share a name even if names
+		// collide, so also look for collisions across many subnets
+		subnets := make(map[string]string)
+		r := rand.New(rand.NewSource(1))
+		for i := 0; i < 50000; i++ {
+			subnet := string(randomCIDR("").Generate(r, 0).Interface().(randomCIDR))
+			name := formatRouteNameWith(replacer, defaultRouteNamePrefix, subnet)
+			if other, ok := subnets[name]; ok && other != subnet {
+				t.Errorf("replacements %v: subnets %v and %v are both named %v", replacements, subnet, other, name)
+			}
+			subnets[name] = subnet
+		}
+	}
+}
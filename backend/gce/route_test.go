@@ -0,0 +1,161 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package gce
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/flannel/version"
+	"google.golang.org/api/compute/v1"
+)
+
+func TestRouteToCompute(t *testing.T) {
+	r := &route{
+		name:        "flannel-10-0-1-0-24",
+		destRange:   "10.0.1.0/24",
+		network:     "projects/p/global/networks/default",
+		nextHop:     routeNextHop{ip: "10.128.0.2"},
+		priority:    100,
+		tags:        []string{"a"},
+		description: "d",
+	}
+	if back := routeFromCompute(r.toCompute()); !reflect.DeepEqual(back, r) {
+		t.Errorf("expected %+v, got %+v", r, back)
+	}
+
+	// the API needs an empty list rather than no tags
+	r.tags = nil
+	if tags := r.toCompute().Tags; tags == nil || len(tags) != 0 {
+		t.Errorf("expected empty tags, got %#v", tags)
+	}
+}
+
+func TestRouteDescription(t *testing.T) {
+	owner := &routeOwner{Cluster: "prod", Node: "node", Version: "v1"}
+	for _, text := range []string{"Created by flannel on node", ""} {
+		decodedOwner, decoded := decodeRouteDescription(encodeRouteDescription(owner, text))
+		if decodedOwner == nil || *decodedOwner != *owner || decoded != text {
+			t.Errorf("%q: expected %+v and the text back, got %+v and %q", text, owner, decodedOwner, decoded)
+		}
+	}
+
+	// descriptions of routes created by older versions, or by hand
+	for _, text := range []string{"Created by flannel on node", `{"cluster": "prod"}`, "{", ""} {
+		if decodedOwner, decoded := decodeRouteDescription(text); decodedOwner != nil || decoded != text {
+			t.Errorf("%q: expected no owner and the whole text, got %+v and %q", text, decodedOwner, decoded)
+		}
+		if encoded := encodeRouteDescription(nil, text); encoded != text {
+			t.Errorf("%q: expected the text without an owner, got %q", text, encoded)
+		}
+	}
+}
+
+func TestRouteOutdated(t *testing.T) {
+	for _, tc := range []struct {
+		description string
+		outdated    bool
+	}{
+		{"Created by flannel on node", true},
+		{encodeRouteDescription(&routeOwner{Cluster: "prod", Version: "v1"}, ""), true},
+		{encodeRouteDescription(&routeOwner{Cluster: "prod", Schema: routeSchemaVersion}, ""), false},
+		{encodeRouteDescription(&routeOwner{Cluster: "prod", Schema: routeSchemaVersion + 1}, ""), false},
+	} {
+		if outdated := routeOutdated(&compute.Route{Description: tc.description}); outdated != tc.outdated {
+			t.Errorf("%q: expected outdated=%v, got %v", tc.description, tc.outdated, outdated)
+		}
+	}
+}
+
+func TestPlanRoute(t *testing.T) {
+	api, done := newTestAPI(t, newFakeCompute())
+	defer done()
+
+	api.routePriority = 500
+	m, err := api.planRoute("10.0.1.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &route{
+		name:      "flannel-10-0-1-0-24",
+		destRange: "10.0.1.0/24",
+		network:   "projects/test-project/global/networks/default",
+		nextHop:   routeNextHop{instance: "projects/test-project/zones/z/instances/node"},
+		priority:  500,
+		owner:     &routeOwner{Version: version.Version, Schema: routeSchemaVersion},
+	}
+	if !reflect.DeepEqual(m, expected) {
+		t.Errorf("expected %+v, got %+v", expected, m)
+	}
+	if !m.sameTarget(&route{destRange: "10.0.1.0/24", nextHop: expected.nextHop}) {
+		t.Error("expected routes with the same range and next hop to have the same target")
+	}
+}
+
+func TestPlanRouteNextHopRanges(t *testing.T) {
+	fake := newFakeCompute()
+	api, done := newTestAPI(t, fake)
+	defer done()
+
+	gateway := "projects/test-project/global/gateways/default-internet-gateway"
+	tunnel := "projects/test-project/regions/r/vpnTunnels/onprem"
+	var err error
+	api.nextHopRanges, err = parseRouteNextHops(map[string]string{
+		"10.1.0.0/16": gateway,
+		"10.1.2.0/24": tunnel,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance := routeNextHop{instance: "projects/test-project/zones/z/instances/node"}
+	for _, tc := range []struct {
+		subnet string
+		hop    routeNextHop
+	}{
+		{"10.1.1.0/24", routeNextHop{gateway: gateway}},
+		// the most specific range containing the subnet wins
+		{"10.1.2.0/24", routeNextHop{vpnTunnel: tunnel}},
+		{"10.1.2.128/25", routeNextHop{vpnTunnel: tunnel}},
+		// subnets in none of the ranges keep going to the instance
+		{"10.2.0.0/24", instance},
+		{"10.0.0.0/8", instance},
+	} {
+		r, err := api.planRoute(tc.subnet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.nextHop != tc.hop {
+			t.Errorf("%v: expected next hop %+v, got %+v", tc.subnet, tc.hop, r.nextHop)
+		}
+		if back := routeFromCompute(r.toCompute()); !tc.hop.matches(back.nextHop) {
+			t.Errorf("%v: expected the next hop to match once read back, got %+v", tc.subnet, back.nextHop)
+		}
+		if tc.hop != instance && instance.matches(tc.hop) {
+			t.Errorf("%v: expected the instance not to match %+v", tc.subnet, tc.hop)
+		}
+	}
+
+	if _, err := api.insertRoute(context.Background(), "10.1.2.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	if route := fake.routes["flannel-10-1-2-0-24"]; route == nil || route.NextHopVpnTunnel != tunnel || route.NextHopInstance != "" {
+		t.Errorf("expected the route to go to the VPN tunnel, got %+v", route)
+	}
+	if operation, err := api.insertRoute(context.Background(), "10.1.2.0/24"); err != nil || operation != nil {
+		t.Errorf("expected the existing route to match, got %v, %v", operation, err)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package gce
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"google.golang.org/api/googleapi"
+)
+
+// verifyRouteName never matches a route created by flannel, route names
+// don't end with a "k"
+const verifyRouteName = defaultRouteNamePrefix + "permission-check"
+
+// Verify checks that the credentials allow managing routes in the network
+// project, so that misconfigured IAM fails at startup rather than on the first
+// route change. Reads are checked by listing routes and getting a nonexistent
+// one. If write is set, deleting a nonexistent route checks that routes can be
+// deleted. There is no way to check insert without creating a route.
+func (api *gceAPI) Verify(ctx context.Context, write bool) error {
+	if _, err := api.computeService.Routes.List(api.networkProject).MaxResults(1).Context(ctx).Do(); err != nil {
+		return api.permissionError("compute.routes.list", err)
+	}
+
+	_, err := api.computeService.Routes.Get(api.networkProject, verifyRouteName).Context(ctx).Do()
+	if !isNotFound(err) {
+		return api.permissionError("compute.routes.get", err)
+	}
+
+	if write {
+		_, err := api.computeService.Routes.Delete(api.networkProject, verifyRouteName).Context(ctx).Do()
+		if !isNotFound(err) {
+			return api.permissionError("compute.routes.delete", err)
+		}
+	}
+	return nil
+}
+
+func (api *gceAPI) permissionError(permission string, err error) error {
+	if err == nil {
+		return fmt.Errorf("error verifying permission %s in project %s: route %v unexpectedly exists",
+			permission, api.networkProject, verifyRouteName)
+	}
+	if apiError, ok := err.(*googleapi.Error); ok && apiError.Code == http.StatusForbidden && !isRateLimited(apiError) {
+		return fmt.Errorf("missing permission %s in project %s: %v", permission, api.networkProject, err)
+	}
+	return fmt.Errorf("error verifying permission %s in project %s: %v", permission, api.networkProject, err)
+}
+
+func isNotFound(err error) bool {
+	apiError, ok := err.(*googleapi.Error)
+	return ok && apiError.Code == http.StatusNotFound
+}
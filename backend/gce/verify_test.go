@@ -0,0 +1,62 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package gce
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	fake := newFakeCompute()
+	api, done := newTestAPI(t, fake)
+	defer done()
+
+	if err := api.Verify(context.Background(), true); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(fake.deleted) != 0 {
+		t.Errorf("expected no routes to be deleted, got %v", fake.deleted)
+	}
+}
+
+func TestVerifyMissingPermission(t *testing.T) {
+	for _, tc := range []struct {
+		method     string
+		write      bool
+		permission string
+	}{
+		{"GET", false, "compute.routes.list"},
+		{"DELETE", true, "compute.routes.delete"},
+	} {
+		fake := newFakeCompute()
+		api, done := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == tc.method {
+				writeError(w, http.StatusForbidden, "forbidden")
+				return
+			}
+			fake.ServeHTTP(w, r)
+		}))
+
+		err := api.Verify(context.Background(), tc.write)
+		done()
+		if err == nil || !strings.Contains(err.Error(), "missing permission "+tc.permission) {
+			t.Errorf("expected missing %v, got %v", tc.permission, err)
+		}
+	}
+}
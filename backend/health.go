@@ -0,0 +1,205 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// HealthReporter is implemented by networks which can tell whether the routes
+// for their lease are in place, so that probes reflect more than the process
+// being up.
+type HealthReporter interface {
+	// CheckRoutes returns an error unless the routes for the lease exist
+	CheckRoutes(ctx context.Context) error
+	// ReconcileFailures returns the number of consecutive failed route
+	// reconciles and the error of the last one
+	ReconcileFailures() (int, error)
+}
+
+// ReconcileHealth counts consecutive failed route reconciles. Networks
+// embed it to implement ReconcileFailures.
+type ReconcileHealth struct {
+	mu       sync.Mutex
+	failures int
+	lastErr  error
+}
+
+// RecordReconcile records the result of a reconcile, a success resets the
+// count of failures
+func (h *ReconcileHealth) RecordReconcile(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err == nil {
+		h.failures = 0
+		h.lastErr = nil
+		return
+	}
+	h.failures++
+	h.lastErr = err
+}
+
+func (h *ReconcileHealth) ReconcileFailures() (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.failures, h.lastErr
+}
+
+// RouteState is what the last check of a route found
+type RouteState string
+
+const (
+	// RoutePresent routes exist and point at this node
+	RoutePresent RouteState = "present"
+	// RouteAbsent routes don't exist
+	RouteAbsent RouteState = "absent"
+	// RouteDrifted routes exist but point elsewhere or differ from the
+	// config
+	RouteDrifted RouteState = "drifted"
+	// RouteUnknown routes couldn't be checked
+	RouteUnknown RouteState = "unknown"
+)
+
+// RouteStatus is the last known status of a route a network manages
+type RouteStatus struct {
+	Name        string
+	Network     string
+	Destination string
+	State       RouteState
+	// LastError is the error of the last check or repair, nil once it
+	// succeeded
+	LastError error
+	// LastChecked is when the route was last checked, LastSuccess when it
+	// was last found or made present
+	LastChecked time.Time
+	LastSuccess time.Time
+}
+
+// RouteStatusReporter is implemented by networks which keep the status of
+// each route they manage from their reconciles
+type RouteStatusReporter interface {
+	// RouteStatuses returns the status of each route as of the last
+	// reconcile, without checking the routes again
+	RouteStatuses() []RouteStatus
+}
+
+// RouteStatusCache keeps the status of routes as reconciles record them.
+// Networks embed it to implement RouteStatuses.
+type RouteStatusCache struct {
+	mu       sync.Mutex
+	statuses map[string]RouteStatus
+}
+
+// RecordRouteStatus records status, keeping the time of the last success if
+// status isn't one
+func (c *RouteStatusCache) RecordRouteStatus(status RouteStatus) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.statuses == nil {
+		c.statuses = make(map[string]RouteStatus)
+	}
+	key := status.Network + " " + status.Destination
+	if status.LastError == nil && status.State == RoutePresent {
+		status.LastSuccess = status.LastChecked
+	} else {
+		status.LastSuccess = c.statuses[key].LastSuccess
+	}
+	c.statuses[key] = status
+}
+
+// RouteStatuses returns the recorded statuses ordered by network and
+// destination
+func (c *RouteStatusCache) RouteStatuses() []RouteStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	statuses := make([]RouteStatus, 0, len(c.statuses))
+	for _, s := range c.statuses {
+		statuses = append(statuses, s)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Network != statuses[j].Network {
+			return statuses[i].Network < statuses[j].Network
+		}
+		return statuses[i].Destination < statuses[j].Destination
+	})
+	return statuses
+}
+
+// Reconciler is implemented by networks which reconcile their routes, so that
+// a reconcile can be triggered on demand
+type Reconciler interface {
+	// TriggerReconcile asks for a reconcile to run as soon as possible
+	// without waiting for it. Triggers while one is pending are merged.
+	TriggerReconcile()
+}
+
+// ReconcileStopper is implemented by networks whose reconciles can be stopped
+// for good while flannel keeps running, e.g. once another flannel took over
+// the routes of the node
+type ReconcileStopper interface {
+	StopReconciling()
+}
+
+// ReconcileTrigger implements Reconciler and ReconcileStopper for networks
+// which embed it. Their reconcile loop receives from Triggered, and returns
+// once Stopped is closed.
+type ReconcileTrigger struct {
+	once     sync.Once
+	c        chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func (t *ReconcileTrigger) ch() chan struct{} {
+	t.once.Do(func() {
+		t.c = make(chan struct{}, 1)
+		t.stop = make(chan struct{})
+	})
+	return t.c
+}
+
+func (t *ReconcileTrigger) TriggerReconcile() {
+	select {
+	case t.ch() <- struct{}{}:
+	default:
+		// one is already pending
+	}
+}
+
+// Triggered receives once for each pending trigger
+func (t *ReconcileTrigger) Triggered() <-chan struct{} {
+	return t.ch()
+}
+
+func (t *ReconcileTrigger) StopReconciling() {
+	t.ch()
+	t.stopOnce.Do(func() {
+		close(t.stop)
+	})
+}
+
+// Stopped is closed once reconciling was stopped
+func (t *ReconcileTrigger) Stopped() <-chan struct{} {
+	t.ch()
+	return t.stop
+}
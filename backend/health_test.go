@@ -0,0 +1,91 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReconcileHealth(t *testing.T) {
+	var h ReconcileHealth
+
+	h.RecordReconcile(errors.New("first"))
+	h.RecordReconcile(errors.New("second"))
+	if n, err := h.ReconcileFailures(); n != 2 || err == nil || err.Error() != "second" {
+		t.Errorf("expected 2 failures with the last error, got %d, %v", n, err)
+	}
+
+	h.RecordReconcile(nil)
+	if n, err := h.ReconcileFailures(); n != 0 || err != nil {
+		t.Errorf("expected a success to reset the failures, got %d, %v", n, err)
+	}
+}
+
+func TestRouteStatusCache(t *testing.T) {
+	var c RouteStatusCache
+
+	t1 := time.Unix(100, 0)
+	t2 := time.Unix(200, 0)
+	c.RecordRouteStatus(RouteStatus{Name: "b", Network: "default", Destination: "10.0.2.0/24", State: RoutePresent, LastChecked: t1})
+	c.RecordRouteStatus(RouteStatus{Name: "a", Network: "default", Destination: "10.0.1.0/24", State: RoutePresent, LastChecked: t1})
+	c.RecordRouteStatus(RouteStatus{Name: "b", Network: "default", Destination: "10.0.2.0/24", State: RouteDrifted, LastError: errors.New("failed"), LastChecked: t2})
+
+	statuses := c.RouteStatuses()
+	if len(statuses) != 2 || statuses[0].Name != "a" || statuses[1].Name != "b" {
+		t.Fatalf("expected the statuses of a and b in order, got %+v", statuses)
+	}
+	if s := statuses[0]; s.State != RoutePresent || !s.LastSuccess.Equal(t1) {
+		t.Errorf("expected a to be present since %v, got %+v", t1, s)
+	}
+	if s := statuses[1]; s.State != RouteDrifted || s.LastError == nil || !s.LastSuccess.Equal(t1) || !s.LastChecked.Equal(t2) {
+		t.Errorf("expected b to have drifted after succeeding at %v, got %+v", t1, s)
+	}
+}
+
+func TestReconcileTrigger(t *testing.T) {
+	var rt ReconcileTrigger
+
+	rt.TriggerReconcile()
+	rt.TriggerReconcile()
+	select {
+	case <-rt.Triggered():
+	default:
+		t.Fatal("expected a pending trigger")
+	}
+	select {
+	case <-rt.Triggered():
+		t.Fatal("expected triggers to be merged")
+	default:
+	}
+}
+
+func TestReconcileTriggerStop(t *testing.T) {
+	var rt ReconcileTrigger
+
+	select {
+	case <-rt.Stopped():
+		t.Fatal("expected reconciling not to be stopped")
+	default:
+	}
+	rt.StopReconciling()
+	rt.StopReconciling()
+	select {
+	case <-rt.Stopped():
+	default:
+		t.Fatal("expected reconciling to be stopped")
+	}
+}
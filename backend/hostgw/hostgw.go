@@ -50,14 +50,23 @@ func New(sm subnet.Manager, extIface *backend.ExternalInterface) (backend.Backen
 	return be, nil
 }
 
+func (be *HostgwBackend) Capabilities() backend.Capabilities {
+	return backend.Capabilities{}
+}
+
 func (be *HostgwBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
+	mtu, err := backend.DetectMTU(config, be.extIface, "host-gw", 0)
+	if err != nil {
+		return nil, err
+	}
+
 	n := &backend.RouteNetwork{
 		SimpleNetwork: backend.SimpleNetwork{
 			ExtIface: be.extIface,
 		},
 		SM:          be.sm,
 		BackendType: "host-gw",
-		Mtu:         be.extIface.Iface.MTU,
+		Mtu:         mtu,
 		LinkIndex:   be.extIface.Iface.Index,
 	}
 	n.GetRoute = func(lease *subnet.Lease) *netlink.Route {
@@ -40,6 +40,29 @@ func init() {
 	backend.Register(backendType, New)
 }
 
+// network deletes the tunnel device and the routes through it on shutdown, so
+// that a node which stops running flannel doesn't keep routing to its peers.
+type network struct {
+	*backend.RouteNetwork
+}
+
+func (n *network) Run(ctx context.Context) {
+	n.RouteNetwork.Run(ctx)
+
+	// routes through the tunnel are removed along with it, but direct routes via
+	// the external interface have to be deleted explicitly
+	n.DeleteRoutes()
+	link, err := netlink.LinkByName(tunnelName)
+	if err != nil {
+		log.Errorf("failed to find %v on shutdown: %v", tunnelName, err)
+		return
+	}
+	log.Infof("Deleting %v", tunnelName)
+	if err := netlink.LinkDel(link); err != nil {
+		log.Errorf("failed to delete %v: %v", tunnelName, err)
+	}
+}
+
 type IPIPBackend struct {
 	sm       subnet.Manager
 	extIface *backend.ExternalInterface
@@ -53,6 +76,10 @@ func New(sm subnet.Manager, extIface *backend.ExternalInterface) (backend.Backen
 	return be, nil
 }
 
+func (be *IPIPBackend) Capabilities() backend.Capabilities {
+	return backend.Capabilities{}
+}
+
 func (be *IPIPBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
 	cfg := struct {
 		DirectRouting bool
@@ -89,7 +116,14 @@ func (be *IPIPBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup,
 		return nil, fmt.Errorf("failed to acquire lease: %v", err)
 	}
 
-	link, err := be.configureIPIPDevice(n.SubnetLease)
+	// Due to the extra 20 byte IP header that the tunnel will add to each packet,
+	// MTU size for both the workload and tunnel interfaces should be 20 bytes less than the selected iface (specified with the --iface option).
+	mtu, err := backend.DetectMTU(config, be.extIface, backendType, 20)
+	if err != nil {
+		return nil, err
+	}
+
+	link, err := be.configureIPIPDevice(n.SubnetLease, mtu)
 
 	if err != nil {
 		return nil, err
@@ -121,10 +155,10 @@ func (be *IPIPBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup,
 		return &route
 	}
 
-	return n, nil
+	return &network{RouteNetwork: n}, nil
 }
 
-func (be *IPIPBackend) configureIPIPDevice(lease *subnet.Lease) (*netlink.Iptun, error) {
+func (be *IPIPBackend) configureIPIPDevice(lease *subnet.Lease, expectMTU int) (*netlink.Iptun, error) {
 	// When modprobe ipip module, a tunl0 ipip device is created automatically per network namespace by ipip kernel module.
 	// It is the namespace default IPIP device with attributes local=any and remote=any.
 	// When receiving IPIP protocol packets, kernel will forward them to tunl0 as a fallback device
@@ -134,9 +168,9 @@ func (be *IPIPBackend) configureIPIPDevice(lease *subnet.Lease) (*netlink.Iptun,
 	// So we have two options of creating ipip device, either rename tunl0 to flannel.ipip or create an new ipip device
 	// and set local attribute of flannel.ipip to distinguish these two devices.
 	// Considering tunl0 might be used by users, so choose the later option.
-	link := &netlink.Iptun{LinkAttrs: netlink.LinkAttrs{Name: tunnelName}, Local: be.extIface.IfaceAddr}
+	tunnel := &netlink.Iptun{LinkAttrs: netlink.LinkAttrs{Name: tunnelName}, Local: be.extIface.IfaceAddr}
 
-	if err := netlink.LinkAdd(link); err != nil {
+	if err := netlink.LinkAdd(tunnel); err != nil {
 		if err != syscall.EEXIST {
 			return nil, err
 		}
@@ -154,7 +188,7 @@ func (be *IPIPBackend) configureIPIPDevice(lease *subnet.Lease) (*netlink.Iptun,
 		}
 		ipip, ok := existing.(*netlink.Iptun)
 		if !ok {
-			return nil, fmt.Errorf("%s isn't an iptun device (%#v), please remove device and try again", tunnelName, link)
+			return nil, fmt.Errorf("%s isn't an iptun device (%#v), please remove device and try again", tunnelName, existing)
 		}
 
 		// local attribute may change if a user changes iface configuration, we need to recreate the device to ensure
@@ -168,21 +202,25 @@ func (be *IPIPBackend) configureIPIPDevice(lease *subnet.Lease) (*netlink.Iptun,
 				return nil, fmt.Errorf("failed to delete interface: %v", err)
 			}
 
-			if err = netlink.LinkAdd(link); err != nil {
+			if err = netlink.LinkAdd(tunnel); err != nil {
 				return nil, fmt.Errorf("failed to create ipip interface: %v", err)
 			}
 		}
 	}
 
-	// Due to the extra 20 byte IP header that the tunnel will add to each packet,
-	// MTU size for both the workload and tunnel interfaces should be 20 bytes less than the selected iface (specified with the --iface option).
-	expectMTU := be.extIface.Iface.MTU - 20
-	if expectMTU <= 0 {
-		return nil, fmt.Errorf("MTU %d of iface %s is too small for ipip mode to work", be.extIface.Iface.MTU, be.extIface.Iface.Name)
+	// Read the device back so that the MTU and index used below are those of the device
+	// in the kernel, whether it was just created or left over from a previous run.
+	existing, err := netlink.LinkByName(tunnelName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find %v: %v", tunnelName, err)
+	}
+	link, ok := existing.(*netlink.Iptun)
+	if !ok {
+		return nil, fmt.Errorf("%s isn't an iptun device (%#v), please remove device and try again", tunnelName, existing)
 	}
 
 	oldMTU := link.Attrs().MTU
-	if oldMTU > expectMTU || oldMTU == 0 {
+	if oldMTU != expectMTU {
 		log.Infof("current MTU of %s is %d, setting it to %d", tunnelName, oldMTU, expectMTU)
 		err := netlink.LinkSetMTU(link, expectMTU)
 
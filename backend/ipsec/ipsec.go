@@ -69,6 +69,10 @@ func New(sm subnet.Manager, extIface *backend.ExternalInterface) (
 	return be, nil
 }
 
+func (be *IPSECBackend) Capabilities() backend.Capabilities {
+	return backend.Capabilities{}
+}
+
 func (be *IPSECBackend) RegisterNetwork(
 	ctx context.Context, wg *sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
 
@@ -95,6 +99,15 @@ func (be *IPSECBackend) RegisterNetwork(
 
 	log.Infof("IPSec config: UDPEncap=%v ESPProposal=%s", cfg.UDPEncap, cfg.ESPProposal)
 
+	overhead := ipsecOverhead
+	if cfg.UDPEncap {
+		overhead += udpEncapOverhead
+	}
+	mtu, err := backend.DetectMTU(config, be.extIface, "ipsec", overhead)
+	if err != nil {
+		return nil, err
+	}
+
 	attrs := subnet.LeaseAttrs{
 		PublicIP:    ip.FromIP(be.extIface.ExtAddr),
 		BackendType: "ipsec",
@@ -117,5 +130,5 @@ func (be *IPSECBackend) RegisterNetwork(
 		return nil, fmt.Errorf("error creating CharonIKEDaemon struct: %v", err)
 	}
 
-	return newNetwork(be.sm, be.extIface, cfg.UDPEncap, cfg.PSK, ikeDaemon, l)
+	return newNetwork(be.sm, be.extIface, cfg.UDPEncap, cfg.PSK, ikeDaemon, l, mtu)
 }
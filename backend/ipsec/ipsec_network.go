@@ -52,11 +52,12 @@ type network struct {
 	UDPEncap bool
 	sm       subnet.Manager
 	iked     *CharonIKEDaemon
+	mtu      int
 }
 
 func newNetwork(sm subnet.Manager, extIface *backend.ExternalInterface,
 	UDPEncap bool, password string, ikeDaemon *CharonIKEDaemon,
-	l *subnet.Lease) (*network, error) {
+	l *subnet.Lease, mtu int) (*network, error) {
 	n := &network{
 		SimpleNetwork: backend.SimpleNetwork{
 			SubnetLease: l,
@@ -66,6 +67,7 @@ func newNetwork(sm subnet.Manager, extIface *backend.ExternalInterface,
 		iked:     ikeDaemon,
 		password: password,
 		UDPEncap: UDPEncap,
+		mtu:      mtu,
 	}
 
 	return n, nil
@@ -160,12 +162,7 @@ func (n *network) handleSubnetEvents(batch []subnet.Event) {
 }
 
 func (n *network) MTU() int {
-	mtu := n.ExtIface.Iface.MTU - ipsecOverhead
-	if n.UDPEncap {
-		mtu -= udpEncapOverhead
-	}
-
-	return mtu
+	return n.mtu
 }
 
 func (n *network) AddIPSECPolicies(remoteLease *subnet.Lease, reqID int) error {
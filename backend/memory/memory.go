@@ -0,0 +1,237 @@
+// Copyright 2024 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package memory implements the "test" backend, which installs no route but
+// records in memory the routes a routing backend would install for the leases
+// of the other nodes, so that the lease watch and its handling can be tested
+// end to end without a cloud API or the kernel.
+package memory
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+const (
+	backendType = "test"
+	defaultMTU  = 1500
+)
+
+func init() {
+	backend.Register(backendType, New)
+}
+
+type MemoryBackend struct {
+	sm       subnet.Manager
+	extIface *backend.ExternalInterface
+}
+
+func New(sm subnet.Manager, extIface *backend.ExternalInterface) (backend.Backend, error) {
+	be := MemoryBackend{
+		sm:       sm,
+		extIface: extIface,
+	}
+	return &be, nil
+}
+
+func (be *MemoryBackend) Capabilities() backend.Capabilities {
+	return backend.Capabilities{}
+}
+
+func (be *MemoryBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
+	attrs := subnet.LeaseAttrs{
+		PublicIP:    ip.FromIP(be.extIface.ExtAddr),
+		BackendType: backendType,
+	}
+
+	mtu := defaultMTU
+	if config.MTU > 0 {
+		mtu = config.MTU
+	} else if be.extIface.Iface != nil {
+		mtu = be.extIface.Iface.MTU
+	}
+
+	l, err := be.sm.AcquireLease(ctx, &attrs)
+	switch err {
+	case nil:
+		return &Network{
+			SimpleNetwork: backend.SimpleNetwork{
+				SubnetLease: l,
+				ExtIface:    be.extIface,
+			},
+			sm:      be.sm,
+			mtu:     mtu,
+			routes:  make(map[string]Route),
+			changed: make(chan struct{}),
+		}, nil
+
+	case context.Canceled, context.DeadlineExceeded:
+		return nil, err
+
+	default:
+		return nil, fmt.Errorf("failed to acquire lease: %v", err)
+	}
+}
+
+// Route is a route the test backend installed in memory: to the subnet of a
+// lease via its public IP
+type Route struct {
+	Subnet  ip.IP4Net
+	NextHop ip.IP4
+}
+
+func (r Route) String() string {
+	return fmt.Sprintf("%v via %v", r.Subnet, r.NextHop)
+}
+
+type Network struct {
+	backend.SimpleNetwork
+	sm  subnet.Manager
+	mtu int
+
+	mux     sync.Mutex
+	routes  map[string]Route
+	inserts int
+	deletes int
+	// changed is closed and replaced each time the routes change
+	changed chan struct{}
+}
+
+func (n *Network) MTU() int {
+	return n.mtu
+}
+
+func (n *Network) Run(ctx context.Context) {
+	wg := sync.WaitGroup{}
+
+	log.Info("Watching for new subnet leases")
+	evts := make(chan []subnet.Event)
+	wg.Add(1)
+	go func() {
+		subnet.WatchLeases(ctx, n.sm, n.SubnetLease, evts)
+		wg.Done()
+	}()
+
+	defer wg.Wait()
+
+	for {
+		select {
+		case evtBatch := <-evts:
+			n.handleSubnetEvents(evtBatch)
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (n *Network) handleSubnetEvents(batch []subnet.Event) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	changed := false
+	for _, evt := range batch {
+		if evt.Lease.Attrs.BackendType != backendType {
+			log.Warningf("Ignoring non-%v subnet: type=%v", backendType, evt.Lease.Attrs.BackendType)
+			continue
+		}
+
+		route := Route{Subnet: evt.Lease.Subnet, NextHop: evt.Lease.Attrs.PublicIP}
+		key := route.Subnet.String()
+		switch evt.Type {
+		case subnet.EventAdded:
+			if existing, ok := n.routes[key]; ok && existing == route {
+				continue
+			}
+			log.Infof("Inserting route %v", route)
+			n.routes[key] = route
+			n.inserts++
+			changed = true
+
+		case subnet.EventRemoved:
+			if _, ok := n.routes[key]; !ok {
+				continue
+			}
+			log.Infof("Deleting route to %v", route.Subnet)
+			delete(n.routes, key)
+			n.deletes++
+			changed = true
+
+		default:
+			log.Error("Internal error: unknown event type: ", int(evt.Type))
+		}
+	}
+
+	if changed {
+		close(n.changed)
+		n.changed = make(chan struct{})
+	}
+}
+
+// Routes returns the routes the network installed, ordered by subnet
+func (n *Network) Routes() []Route {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	return n.routesLocked()
+}
+
+func (n *Network) routesLocked() []Route {
+	routes := make([]Route, 0, len(n.routes))
+	for _, r := range n.routes {
+		routes = append(routes, r)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].Subnet.IP < routes[j].Subnet.IP ||
+			routes[i].Subnet.IP == routes[j].Subnet.IP && routes[i].Subnet.PrefixLen < routes[j].Subnet.PrefixLen
+	})
+	return routes
+}
+
+// Counts returns how many times the network inserted and deleted a route,
+// the equivalent of the route inserts and deletes of the gce backend. A route
+// whose next hop changed is inserted again without being deleted first.
+func (n *Network) Counts() (inserts, deletes int) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	return n.inserts, n.deletes
+}
+
+// WaitForRoutes blocks until the routes of the network satisfy cond, and
+// returns them, or returns the error of ctx once it is done
+func (n *Network) WaitForRoutes(ctx context.Context, cond func([]Route) bool) ([]Route, error) {
+	for {
+		n.mux.Lock()
+		routes := n.routesLocked()
+		changed := n.changed
+		n.mux.Unlock()
+
+		if cond(routes) {
+			return routes, nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return routes, ctx.Err()
+		}
+	}
+}
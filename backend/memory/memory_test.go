@@ -0,0 +1,168 @@
+// Copyright 2024 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// fakeManager leases 10.5.1.0/24 and returns the watch results sent to it
+type fakeManager struct {
+	results chan subnet.LeaseWatchResult
+}
+
+func (m *fakeManager) GetNetworkConfig(ctx context.Context) (*subnet.Config, error) {
+	return &subnet.Config{}, nil
+}
+
+func (m *fakeManager) AcquireLease(ctx context.Context, attrs *subnet.LeaseAttrs) (*subnet.Lease, error) {
+	return &subnet.Lease{Subnet: mustParseSubnet("10.5.1.0/24"), Attrs: *attrs}, nil
+}
+
+func (m *fakeManager) RenewLease(ctx context.Context, lease *subnet.Lease) error {
+	return nil
+}
+
+func (m *fakeManager) WatchLease(ctx context.Context, sn ip.IP4Net, cursor interface{}) (subnet.LeaseWatchResult, error) {
+	<-ctx.Done()
+	return subnet.LeaseWatchResult{}, ctx.Err()
+}
+
+func (m *fakeManager) WatchLeases(ctx context.Context, cursor interface{}) (subnet.LeaseWatchResult, error) {
+	select {
+	case res := <-m.results:
+		return res, nil
+	case <-ctx.Done():
+		return subnet.LeaseWatchResult{}, ctx.Err()
+	}
+}
+
+func (m *fakeManager) Name() string {
+	return "fake"
+}
+
+func mustParseSubnet(s string) ip.IP4Net {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return ip.FromIPNet(n)
+}
+
+func testLease(sn, publicIP string) subnet.Lease {
+	return subnet.Lease{
+		Subnet: mustParseSubnet(sn),
+		Attrs: subnet.LeaseAttrs{
+			PublicIP:    ip.MustParseIP4(publicIP),
+			BackendType: backendType,
+		},
+	}
+}
+
+func testRoute(sn, nextHop string) Route {
+	return Route{Subnet: mustParseSubnet(sn), NextHop: ip.MustParseIP4(nextHop)}
+}
+
+func TestRegistered(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bm := backend.NewManager(ctx, &fakeManager{}, &backend.ExternalInterface{})
+	be, err := bm.GetBackend("test")
+	if err != nil {
+		t.Fatalf("GetBackend() failed: %v", err)
+	}
+	if _, ok := be.(*MemoryBackend); !ok {
+		t.Fatalf("GetBackend() returned a %T, want a *MemoryBackend", be)
+	}
+}
+
+func TestRun(t *testing.T) {
+	sm := &fakeManager{results: make(chan subnet.LeaseWatchResult)}
+	be, _ := New(sm, &backend.ExternalInterface{ExtAddr: net.ParseIP("10.0.0.1")})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	bn, err := be.RegisterNetwork(ctx, &wg, &subnet.Config{})
+	if err != nil {
+		t.Fatalf("RegisterNetwork() failed: %v", err)
+	}
+	if bn.MTU() != defaultMTU {
+		t.Errorf("MTU() = %d, want %d", bn.MTU(), defaultMTU)
+	}
+	n := bn.(*Network)
+
+	wg.Add(1)
+	go func() {
+		n.Run(ctx)
+		wg.Done()
+	}()
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	other := testLease("10.5.3.0/24", "10.0.0.3")
+	udp := testLease("10.5.4.0/24", "10.0.0.4")
+	udp.Attrs.BackendType = "udp"
+	sm.results <- subnet.LeaseWatchResult{Snapshot: []subnet.Lease{
+		*n.Lease(),
+		testLease("10.5.2.0/24", "10.0.0.2"),
+		other,
+		udp,
+	}}
+
+	want := []Route{testRoute("10.5.2.0/24", "10.0.0.2"), testRoute("10.5.3.0/24", "10.0.0.3")}
+	waitForRoutes(t, n, want)
+
+	// The next hop of 10.5.3.0/24 changes, 10.5.2.0/24 goes away and
+	// 10.5.5.0/24 shows up
+	moved := testLease("10.5.3.0/24", "10.0.0.33")
+	sm.results <- subnet.LeaseWatchResult{Events: []subnet.Event{
+		{Type: subnet.EventRemoved, Lease: testLease("10.5.2.0/24", "10.0.0.2")},
+		{Type: subnet.EventAdded, Lease: moved},
+		{Type: subnet.EventAdded, Lease: testLease("10.5.5.0/24", "10.0.0.5")},
+	}}
+
+	want = []Route{testRoute("10.5.3.0/24", "10.0.0.33"), testRoute("10.5.5.0/24", "10.0.0.5")}
+	waitForRoutes(t, n, want)
+
+	if inserts, deletes := n.Counts(); inserts != 4 || deletes != 1 {
+		t.Errorf("Counts() = %d, %d, want 4 inserts and 1 delete", inserts, deletes)
+	}
+}
+
+func waitForRoutes(t *testing.T, n *Network, want []Route) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	routes, err := n.WaitForRoutes(ctx, func(routes []Route) bool {
+		return reflect.DeepEqual(routes, want)
+	})
+	if err != nil {
+		t.Fatalf("Routes are %v, want %v", routes, want)
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"fmt"
+	"net"
+
+	log "github.com/golang/glog"
+
+	"github.com/coreos/flannel/subnet"
+)
+
+// DetectMTU returns the MTU of the flannel network for a backend that adds
+// overhead bytes to packets sent out of the external interface. The MTU of the
+// external interface is read again, rather than taken from when flannel
+// started, so that changes such as enabling jumbo frames are picked up. An MTU
+// set in the network config overrides detection.
+func DetectMTU(config *subnet.Config, extIface *ExternalInterface, backendType string, overhead int) (int, error) {
+	if config.MTU > 0 {
+		log.Infof("Using MTU %d from the network config for the %s backend", config.MTU, backendType)
+		return config.MTU, nil
+	}
+
+	ifaceMTU := extIface.Iface.MTU
+	if iface, err := net.InterfaceByIndex(extIface.Iface.Index); err != nil {
+		log.Warningf("Failed to read the MTU of %s, using %d: %v", extIface.Iface.Name, ifaceMTU, err)
+	} else if iface.MTU > 0 {
+		ifaceMTU = iface.MTU
+	}
+
+	mtu := ifaceMTU - overhead
+	if mtu <= 0 {
+		return 0, fmt.Errorf("MTU %d of iface %s is too small for the %s backend to work", ifaceMTU, extIface.Iface.Name, backendType)
+	}
+
+	log.Infof("Using MTU %d for the %s backend: MTU %d of %s minus %d bytes of overhead", mtu, backendType, ifaceMTU, extIface.Iface.Name, overhead)
+	return mtu, nil
+}
@@ -0,0 +1,51 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"net"
+	"testing"
+
+	"github.com/coreos/flannel/subnet"
+)
+
+func TestDetectMTU(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skipf("no loopback interface: %v", err)
+	}
+	// the cached MTU is stale, the current one should be read
+	extIface := &ExternalInterface{Iface: &net.Interface{Index: lo.Index, Name: lo.Name, MTU: 1500}}
+
+	mtu, err := DetectMTU(&subnet.Config{}, extIface, "test", 50)
+	if err != nil {
+		t.Fatalf("DetectMTU failed: %v", err)
+	}
+	if mtu != lo.MTU-50 {
+		t.Errorf("expected MTU %d, got %d", lo.MTU-50, mtu)
+	}
+
+	mtu, err = DetectMTU(&subnet.Config{MTU: 1400}, extIface, "test", 50)
+	if err != nil {
+		t.Fatalf("DetectMTU failed: %v", err)
+	}
+	if mtu != 1400 {
+		t.Errorf("expected the configured MTU 1400, got %d", mtu)
+	}
+
+	if _, err := DetectMTU(&subnet.Config{}, extIface, "test", lo.MTU); err == nil {
+		t.Error("expected an error for an MTU that is too small")
+	}
+}
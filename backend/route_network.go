@@ -79,6 +79,7 @@ func (n *RouteNetwork) Run(ctx context.Context) {
 }
 
 func (n *RouteNetwork) handleSubnetEvents(batch []subnet.Event) {
+	recorder := subnet.RecorderFor(n.SM)
 	for _, evt := range batch {
 		switch evt.Type {
 		case subnet.EventAdded:
@@ -102,6 +103,7 @@ func (n *RouteNetwork) handleSubnetEvents(batch []subnet.Event) {
 				log.Warningf("Replacing existing route to %v via %v dev index %d with %v via %v dev index %d.", evt.Lease.Subnet, routeList[0].Gw, routeList[0].LinkIndex, evt.Lease.Subnet, evt.Lease.Attrs.PublicIP, route.LinkIndex)
 				if err := netlink.RouteDel(&routeList[0]); err != nil {
 					log.Errorf("Error deleting route to %v: %v", evt.Lease.Subnet, err)
+					recorder.Eventf(subnet.EventTypeWarning, EventRouteDeleteFailed, "Failed to delete route to %v via %v: %v", evt.Lease.Subnet, routeList[0].Gw, err)
 					continue
 				}
 				n.removeFromRouteList(routeList[0])
@@ -112,7 +114,10 @@ func (n *RouteNetwork) handleSubnetEvents(batch []subnet.Event) {
 				log.Infof("Route to %v via %v dev index %d already exists, skipping.", evt.Lease.Subnet, evt.Lease.Attrs.PublicIP, routeList[0].LinkIndex)
 			} else if err := netlink.RouteAdd(route); err != nil {
 				log.Errorf("Error adding route to %v via %v dev index %d: %v", evt.Lease.Subnet, evt.Lease.Attrs.PublicIP, route.LinkIndex, err)
+				recorder.Eventf(subnet.EventTypeWarning, EventRouteCreateFailed, "Failed to create route to %v via %v: %v", evt.Lease.Subnet, evt.Lease.Attrs.PublicIP, err)
 				continue
+			} else {
+				recorder.Eventf(subnet.EventTypeNormal, EventRouteCreated, "Created route to %v via %v", evt.Lease.Subnet, evt.Lease.Attrs.PublicIP)
 			}
 
 		case subnet.EventRemoved:
@@ -129,8 +134,10 @@ func (n *RouteNetwork) handleSubnetEvents(batch []subnet.Event) {
 
 			if err := netlink.RouteDel(route); err != nil {
 				log.Errorf("Error deleting route to %v: %v", evt.Lease.Subnet, err)
+				recorder.Eventf(subnet.EventTypeWarning, EventRouteDeleteFailed, "Failed to delete route to %v via %v: %v", evt.Lease.Subnet, evt.Lease.Attrs.PublicIP, err)
 				continue
 			}
+			recorder.Eventf(subnet.EventTypeNormal, EventRouteDeleted, "Deleted route to %v via %v", evt.Lease.Subnet, evt.Lease.Attrs.PublicIP)
 
 		default:
 			log.Error("Internal error: unknown event type: ", int(evt.Type))
@@ -156,6 +163,18 @@ func (n *RouteNetwork) removeFromRouteList(route netlink.Route) {
 	}
 }
 
+// DeleteRoutes deletes the routes added by the network. It must only be called
+// once Run has returned.
+func (n *RouteNetwork) DeleteRoutes() {
+	log.Infof("Deleting %d routes", len(n.routes))
+	for _, route := range n.routes {
+		if err := netlink.RouteDel(&route); err != nil {
+			log.Errorf("Error deleting route to %v: %v", route.Dst, err)
+		}
+	}
+	n.routes = nil
+}
+
 func (n *RouteNetwork) routeCheck(ctx context.Context) {
 	for {
 		select {
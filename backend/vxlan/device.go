@@ -112,11 +112,18 @@ func ensureLink(vxlan *netlink.Vxlan) (*netlink.Vxlan, error) {
 	return vxlan, nil
 }
 
-func (dev *vxlanDevice) Configure(ipn ip.IP4Net) error {
+func (dev *vxlanDevice) Configure(ipn ip.IP4Net, mtu int) error {
 	if err := ip.EnsureV4AddressOnLink(ipn, dev.link); err != nil {
 		return fmt.Errorf("failed to ensure address of interface %s: %s", dev.link.Attrs().Name, err)
 	}
 
+	if dev.link.MTU != mtu {
+		if err := netlink.LinkSetMTU(dev.link, mtu); err != nil {
+			return fmt.Errorf("failed to set %v MTU to %d: %v", dev.link.Attrs().Name, mtu, err)
+		}
+		dev.link.MTU = mtu
+	}
+
 	if err := netlink.LinkSetUp(dev.link); err != nil {
 		return fmt.Errorf("failed to set interface %s to UP state: %s", dev.link.Attrs().Name, err)
 	}
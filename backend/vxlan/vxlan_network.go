@@ -35,13 +35,14 @@ type network struct {
 	backend.SimpleNetwork
 	dev       *vxlanDevice
 	subnetMgr subnet.Manager
+	mtu       int
 }
 
 const (
 	encapOverhead = 50
 )
 
-func newNetwork(subnetMgr subnet.Manager, extIface *backend.ExternalInterface, dev *vxlanDevice, _ ip.IP4Net, lease *subnet.Lease) (*network, error) {
+func newNetwork(subnetMgr subnet.Manager, extIface *backend.ExternalInterface, dev *vxlanDevice, _ ip.IP4Net, lease *subnet.Lease, mtu int) (*network, error) {
 	nw := &network{
 		SimpleNetwork: backend.SimpleNetwork{
 			SubnetLease: lease,
@@ -49,6 +50,7 @@ func newNetwork(subnetMgr subnet.Manager, extIface *backend.ExternalInterface, d
 		},
 		subnetMgr: subnetMgr,
 		dev:       dev,
+		mtu:       mtu,
 	}
 
 	return nw, nil
@@ -80,7 +82,7 @@ func (nw *network) Run(ctx context.Context) {
 }
 
 func (nw *network) MTU() int {
-	return nw.ExtIface.Iface.MTU - encapOverhead
+	return nw.mtu
 }
 
 type vxlanLeaseAttrs struct {
@@ -0,0 +1,176 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package wireguard
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	log "github.com/golang/glog"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/crypto/curve25519"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+type wgDeviceAttrs struct {
+	name           string
+	listenPort     int
+	privateKeyFile string
+	// keepalive is the persistent keepalive interval of peers in seconds,
+	// zero disables it
+	keepalive int
+}
+
+type wgDevice struct {
+	link      netlink.Link
+	attrs     wgDeviceAttrs
+	publicKey string
+}
+
+func newWGDevice(attrs *wgDeviceAttrs) (*wgDevice, error) {
+	publicKey, err := ensureKey(attrs.privateKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up wireguard key: %v", err)
+	}
+
+	link, err := ensureLink(attrs.name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := runWG("set", attrs.name, "private-key", attrs.privateKeyFile, "listen-port", strconv.Itoa(attrs.listenPort)); err != nil {
+		return nil, fmt.Errorf("failed to configure %v: %v", attrs.name, err)
+	}
+
+	return &wgDevice{
+		link:      link,
+		attrs:     *attrs,
+		publicKey: publicKey,
+	}, nil
+}
+
+func ensureLink(name string) (netlink.Link, error) {
+	link := &netlink.GenericLink{LinkAttrs: netlink.LinkAttrs{Name: name}, LinkType: "wireguard"}
+
+	if err := netlink.LinkAdd(link); err != nil {
+		if err != syscall.EEXIST {
+			return nil, fmt.Errorf("failed to create wireguard interface %v (is the wireguard kernel module available?): %v", name, err)
+		}
+
+		// If there's an existing device but it's not a wireguard device then get the user to fix it (flannel
+		// shouldn't delete a user's device)
+		existing, err := netlink.LinkByName(name)
+		if err != nil {
+			return nil, err
+		}
+		if existing.Type() != "wireguard" {
+			return nil, fmt.Errorf("%v isn't a wireguard device, please remove device and try again", name)
+		}
+		return existing, nil
+	}
+
+	// fetch the link to get its index
+	return netlink.LinkByName(name)
+}
+
+// Configure sets the address and MTU of the device and brings it up
+func (dev *wgDevice) Configure(ipn ip.IP4Net, mtu int) error {
+	if err := ip.EnsureV4AddressOnLink(ipn, dev.link); err != nil {
+		return fmt.Errorf("failed to ensure address of interface %s: %s", dev.attrs.name, err)
+	}
+
+	if err := netlink.LinkSetMTU(dev.link, mtu); err != nil {
+		return fmt.Errorf("failed to set %v MTU to %d: %v", dev.attrs.name, mtu, err)
+	}
+
+	if err := netlink.LinkSetUp(dev.link); err != nil {
+		return fmt.Errorf("failed to set interface %s to UP state: %s", dev.attrs.name, err)
+	}
+
+	return nil
+}
+
+// AddPeer adds or updates the peer with publicKey
+func (dev *wgDevice) AddPeer(publicKey, endpoint string, allowedIPs string) error {
+	args := []string{"set", dev.attrs.name, "peer", publicKey, "endpoint", endpoint, "allowed-ips", allowedIPs}
+	if dev.attrs.keepalive > 0 {
+		args = append(args, "persistent-keepalive", strconv.Itoa(dev.attrs.keepalive))
+	}
+	return runWG(args...)
+}
+
+// RemovePeer removes the peer with publicKey
+func (dev *wgDevice) RemovePeer(publicKey string) error {
+	return runWG("set", dev.attrs.name, "peer", publicKey, "remove")
+}
+
+func runWG(args ...string) error {
+	log.V(2).Infof("running wg %v", strings.Join(args, " "))
+	out, err := exec.Command("wg", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("wg %v failed: %v: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// ensureKey returns the public key of the private key in path, generating and
+// saving a new private key if there is none
+func ensureKey(path string) (string, error) {
+	var privateKey [32]byte
+
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case err == nil:
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(key) != len(privateKey) {
+			return "", fmt.Errorf("invalid private key in %v", path)
+		}
+		copy(privateKey[:], key)
+
+	case os.IsNotExist(err):
+		log.Infof("Generating a new wireguard private key in %v", path)
+		if _, err := rand.Read(privateKey[:]); err != nil {
+			return "", err
+		}
+		// clamp the key as required for curve25519
+		privateKey[0] &= 248
+		privateKey[31] = (privateKey[31] & 127) | 64
+
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return "", err
+		}
+		encoded := base64.StdEncoding.EncodeToString(privateKey[:]) + "\n"
+		if err := ioutil.WriteFile(path, []byte(encoded), 0600); err != nil {
+			return "", err
+		}
+
+	default:
+		return "", err
+	}
+
+	var publicKey [32]byte
+	curve25519.ScalarBaseMult(&publicKey, &privateKey)
+	return base64.StdEncoding.EncodeToString(publicKey[:]), nil
+}
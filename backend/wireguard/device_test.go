@@ -0,0 +1,70 @@
+// Copyright 2024 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package wireguard
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnsureKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flannel-wg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "run", "wgkey")
+
+	publicKey, err := ensureKey(path)
+	if err != nil {
+		t.Fatalf("ensureKey failed: %v", err)
+	}
+	if key, err := base64.StdEncoding.DecodeString(publicKey); err != nil || len(key) != 32 {
+		t.Errorf("expected a 32 byte public key, got %q", publicKey)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("expected the private key to be only readable by its owner, got mode %v", fi.Mode().Perm())
+	}
+
+	// the saved key is reused
+	reloaded, err := ensureKey(path)
+	if err != nil {
+		t.Fatalf("ensureKey failed: %v", err)
+	}
+	if reloaded != publicKey {
+		t.Errorf("expected the public key %s of the saved private key, got %s", publicKey, reloaded)
+	}
+
+	for _, data := range []string{
+		"not a key\n",
+		base64.StdEncoding.EncodeToString(make([]byte, 16)) + "\n",
+		"",
+	} {
+		if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ensureKey(path); err == nil {
+			t.Errorf("%q: expected an error for an invalid private key", data)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package wireguard
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// The wireguard backend encrypts traffic between hosts with WireGuard.
+// Each host creates a wireguard device and publishes its public key and
+// listen port in its subnet lease. As remote hosts are discovered, they are
+// added as peers of the device, with their subnet as allowed IPs and their
+// public IP as endpoint, and a route to their subnet is added via the device.
+//
+// The private key is kept in a file so that peers don't need to be updated
+// when flannel restarts. Peers are configured with the wg tool from
+// wireguard-tools, which must be installed on the host.
+
+const (
+	backendType = "wireguard"
+
+	defaultDeviceName     = "flannel-wg"
+	defaultListenPort     = 51820
+	defaultPrivateKeyFile = "/run/flannel/wgkey"
+)
+
+func init() {
+	backend.Register(backendType, New)
+}
+
+type WireguardBackend struct {
+	sm       subnet.Manager
+	extIface *backend.ExternalInterface
+}
+
+func New(sm subnet.Manager, extIface *backend.ExternalInterface) (backend.Backend, error) {
+	be := &WireguardBackend{
+		sm:       sm,
+		extIface: extIface,
+	}
+	return be, nil
+}
+
+func (be *WireguardBackend) Capabilities() backend.Capabilities {
+	return backend.Capabilities{}
+}
+
+type wireguardLeaseAttrs struct {
+	PublicKey  string
+	ListenPort int
+}
+
+func newSubnetAttrs(publicIP net.IP, publicKey string, listenPort int) (*subnet.LeaseAttrs, error) {
+	data, err := json.Marshal(&wireguardLeaseAttrs{PublicKey: publicKey, ListenPort: listenPort})
+	if err != nil {
+		return nil, err
+	}
+
+	return &subnet.LeaseAttrs{
+		PublicIP:    ip.FromIP(publicIP),
+		BackendType: backendType,
+		BackendData: json.RawMessage(data),
+	}, nil
+}
+
+func (be *WireguardBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
+	cfg := struct {
+		DeviceName                  string
+		ListenPort                  int
+		PrivateKeyFile              string
+		PersistentKeepaliveInterval int
+	}{
+		DeviceName:     defaultDeviceName,
+		ListenPort:     defaultListenPort,
+		PrivateKeyFile: defaultPrivateKeyFile,
+	}
+
+	if len(config.Backend) > 0 {
+		if err := json.Unmarshal(config.Backend, &cfg); err != nil {
+			return nil, fmt.Errorf("error decoding wireguard backend config: %v", err)
+		}
+	}
+	log.Infof("Wireguard config: DeviceName=%s ListenPort=%d PrivateKeyFile=%s PersistentKeepaliveInterval=%d",
+		cfg.DeviceName, cfg.ListenPort, cfg.PrivateKeyFile, cfg.PersistentKeepaliveInterval)
+
+	if cfg.ListenPort <= 0 || cfg.ListenPort > 65535 {
+		return nil, fmt.Errorf("invalid ListenPort %d: must be between 1 and 65535", cfg.ListenPort)
+	}
+	if cfg.PersistentKeepaliveInterval < 0 {
+		return nil, fmt.Errorf("invalid PersistentKeepaliveInterval %d: must not be negative", cfg.PersistentKeepaliveInterval)
+	}
+
+	mtu, err := backend.DetectMTU(config, be.extIface, backendType, encapOverhead)
+	if err != nil {
+		return nil, err
+	}
+
+	dev, err := newWGDevice(&wgDeviceAttrs{
+		name:           cfg.DeviceName,
+		listenPort:     cfg.ListenPort,
+		privateKeyFile: cfg.PrivateKeyFile,
+		keepalive:      cfg.PersistentKeepaliveInterval,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	subnetAttrs, err := newSubnetAttrs(be.extIface.ExtAddr, dev.publicKey, cfg.ListenPort)
+	if err != nil {
+		return nil, err
+	}
+
+	lease, err := be.sm.AcquireLease(ctx, subnetAttrs)
+	switch err {
+	case nil:
+	case context.Canceled, context.DeadlineExceeded:
+		return nil, err
+	default:
+		return nil, fmt.Errorf("failed to acquire lease: %v", err)
+	}
+
+	// Ensure that the device has a /32 address so that no broadcast routes are created.
+	// This IP is just used as a source address for host to workload traffic (so
+	// the return path for the traffic has an address on the flannel network to use as the destination)
+	if err := dev.Configure(ip.IP4Net{IP: lease.Subnet.IP, PrefixLen: 32}, mtu); err != nil {
+		return nil, fmt.Errorf("failed to configure interface %s: %s", cfg.DeviceName, err)
+	}
+
+	return newNetwork(be.sm, be.extIface, dev, lease, mtu), nil
+}
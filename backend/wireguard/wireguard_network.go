@@ -0,0 +1,153 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package wireguard
+
+import (
+	"encoding/json"
+	"net"
+	"strconv"
+	"sync"
+
+	log "github.com/golang/glog"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+const (
+	// encapOverhead is the outer IPv6 header, UDP header and wireguard
+	// header and authentication tag
+	encapOverhead = 80
+)
+
+type network struct {
+	backend.SimpleNetwork
+	dev       *wgDevice
+	subnetMgr subnet.Manager
+	mtu       int
+	// peers are the public keys of the peers by subnet, so that the peer
+	// of a subnet whose node has a new key, e.g. when it rebooted, is
+	// replaced rather than left behind
+	peers map[ip.IP4Net]string
+}
+
+func newNetwork(subnetMgr subnet.Manager, extIface *backend.ExternalInterface, dev *wgDevice, lease *subnet.Lease, mtu int) *network {
+	return &network{
+		SimpleNetwork: backend.SimpleNetwork{
+			SubnetLease: lease,
+			ExtIface:    extIface,
+		},
+		subnetMgr: subnetMgr,
+		dev:       dev,
+		mtu:       mtu,
+		peers:     make(map[ip.IP4Net]string),
+	}
+}
+
+func (nw *network) Run(ctx context.Context) {
+	wg := sync.WaitGroup{}
+
+	log.V(0).Info("watching for new subnet leases")
+	events := make(chan []subnet.Event)
+	wg.Add(1)
+	go func() {
+		subnet.WatchLeases(ctx, nw.subnetMgr, nw.SubnetLease, events)
+		log.V(1).Info("WatchLeases exited")
+		wg.Done()
+	}()
+
+	defer wg.Wait()
+
+	for {
+		select {
+		case evtBatch := <-events:
+			nw.handleSubnetEvents(evtBatch)
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (nw *network) MTU() int {
+	return nw.mtu
+}
+
+func (nw *network) handleSubnetEvents(batch []subnet.Event) {
+	for _, event := range batch {
+		sn := event.Lease.Subnet
+		attrs := event.Lease.Attrs
+		if attrs.BackendType != backendType {
+			log.Warningf("ignoring non-wireguard subnet(%s): type=%v", sn, attrs.BackendType)
+			continue
+		}
+
+		var wgAttrs wireguardLeaseAttrs
+		if err := json.Unmarshal(attrs.BackendData, &wgAttrs); err != nil {
+			log.Error("error decoding subnet lease JSON: ", err)
+			continue
+		}
+
+		route := netlink.Route{
+			LinkIndex: nw.dev.link.Attrs().Index,
+			Scope:     netlink.SCOPE_LINK,
+			Dst:       sn.ToIPNet(),
+		}
+
+		switch event.Type {
+		case subnet.EventAdded:
+			endpoint := net.JoinHostPort(attrs.PublicIP.String(), strconv.Itoa(wgAttrs.ListenPort))
+			log.V(2).Infof("adding subnet: %s PublicIP: %s PublicKey: %s", sn, attrs.PublicIP, wgAttrs.PublicKey)
+			if err := nw.dev.AddPeer(wgAttrs.PublicKey, endpoint, sn.String()); err != nil {
+				log.Errorf("failed to add peer for subnet %s: %v", sn, err)
+				continue
+			}
+			if prev, ok := nw.peers[sn]; ok && prev != wgAttrs.PublicKey {
+				log.V(2).Infof("removing previous peer of subnet: %s PublicKey: %s", sn, prev)
+				if err := nw.dev.RemovePeer(prev); err != nil {
+					log.Errorf("failed to remove previous peer for subnet %s: %v", sn, err)
+				}
+			}
+			nw.peers[sn] = wgAttrs.PublicKey
+
+			if err := netlink.RouteReplace(&route); err != nil {
+				log.Errorf("failed to add route to %s via %s: %v", sn, nw.dev.attrs.name, err)
+			}
+
+		case subnet.EventRemoved:
+			log.V(2).Infof("removing subnet: %s PublicIP: %s PublicKey: %s", sn, attrs.PublicIP, wgAttrs.PublicKey)
+			if err := netlink.RouteDel(&route); err != nil {
+				log.Errorf("failed to delete route to %s via %s: %v", sn, nw.dev.attrs.name, err)
+			}
+
+			// the peer added for the subnet, whose key may differ
+			publicKey := wgAttrs.PublicKey
+			if prev, ok := nw.peers[sn]; ok {
+				publicKey = prev
+			}
+			delete(nw.peers, sn)
+			if err := nw.dev.RemovePeer(publicKey); err != nil {
+				log.Errorf("failed to remove peer for subnet %s: %v", sn, err)
+			}
+
+		default:
+			log.Error("internal error: unknown event type: ", int(event.Type))
+		}
+	}
+}
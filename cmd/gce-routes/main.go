@@ -0,0 +1,119 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+// gce-routes ensures the GCE routes for a list of subnets and next hops, read
+// from outside flannel's leases, e.g. from an orchestrator, are the only ones
+// with its route name prefix in the network. It prints which routes it
+// created, deleted or left unchanged. With -delete-instance, it deletes the
+// routes with its route name prefix which point at an instance instead.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/backend/gce"
+)
+
+var (
+	routesFile    = flag.String("routes", "-", "file listing a subnet and its next hop, an IP address or an instance link, per line, - for stdin")
+	backendConfig = flag.String("backend-config", "{}", "GCE backend config as in the flannel network config, e.g. to set the RouteNamePrefix or the network in Networks")
+	dryRun        = flag.Bool("dry-run", false, "print the changes without making them, same as DryRun in the backend config")
+	allowEmpty    = flag.Bool("allow-empty", false, "delete all the routes with the route name prefix when no routes are read, which is refused otherwise")
+
+	deleteInstance = flag.String("delete-instance", "", "delete the routes to this instance link or IP address, whatever their subnet, instead of reconciling the routes")
+)
+
+func main() {
+	flag.Set("logtostderr", "true")
+	flag.Parse()
+
+	config, err := withDryRun(json.RawMessage(*backendConfig), *dryRun)
+	if err != nil {
+		log.Exitf("Error parsing backend config: %v", err)
+	}
+
+	if *deleteInstance != "" {
+		deleted, err := gce.DeleteInstanceRoutes(context.Background(), config, *deleteInstance)
+		printSummary(os.Stdout, &gce.ExternalRoutesSummary{Deleted: deleted})
+		if err != nil {
+			log.Exitf("Error deleting the routes of %s: %v", *deleteInstance, err)
+		}
+		return
+	}
+
+	routes, err := readRoutes(*routesFile)
+	if err != nil {
+		log.Exitf("Error reading routes: %v", err)
+	}
+
+	summary, err := gce.ReconcileExternalRoutes(context.Background(), config, routes, *allowEmpty)
+	if summary != nil {
+		printSummary(os.Stdout, summary)
+	}
+	if err != nil {
+		log.Exitf("Error reconciling routes: %v", err)
+	}
+}
+
+func readRoutes(name string) ([]gce.ExternalRoute, error) {
+	if name == "-" {
+		return gce.ReadExternalRoutes(os.Stdin)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return gce.ReadExternalRoutes(f)
+}
+
+// withDryRun returns config with DryRun set if dryRun is
+func withDryRun(config json.RawMessage, dryRun bool) (json.RawMessage, error) {
+	var keys map[string]interface{}
+	if err := json.Unmarshal(config, &keys); err != nil {
+		return nil, err
+	}
+	if !dryRun {
+		return config, nil
+	}
+	keys["DryRun"] = true
+	return json.Marshal(keys)
+}
+
+func printSummary(w io.Writer, summary *gce.ExternalRoutesSummary) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, change := range []struct {
+		name    string
+		subnets []string
+	}{
+		{"created", summary.Created},
+		{"deleted", summary.Deleted},
+		{"unchanged", summary.Unchanged},
+	} {
+		for _, sn := range change.subnets {
+			fmt.Fprintf(tw, "%s\t%s\n", change.name, sn)
+		}
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "%d created, %d deleted, %d unchanged\n", len(summary.Created), len(summary.Deleted), len(summary.Unchanged))
+}
@@ -22,10 +22,10 @@ require (
 	github.com/go-openapi/jsonreference v0.0.0-20160704190145-13c6e3589ad9 // indirect
 	github.com/go-openapi/spec v0.0.0-20160808142527-6aced65f8501 // indirect
 	github.com/go-openapi/swag v0.0.0-20160704191624-1d0bd113de87 // indirect
-	github.com/gogo/protobuf v0.0.0-20160824171236-909568be09de // indirect
 	github.com/golang/glog v0.0.0-20141105023935-44145f04b68c
-	github.com/google/gofuzz v0.0.0-20161122191042-44d81051d367 // indirect
 	github.com/gravitational/trace v1.1.11
+	github.com/grpc-ecosystem/go-grpc-prometheus v0.0.0-20160910222444-6b7015e65d36 // indirect
+	github.com/grpc-ecosystem/grpc-gateway v1.1.0 // indirect
 	github.com/howeyc/gopass v0.0.0-20160826175423-3ca23474a7c7 // indirect
 	github.com/imdario/mergo v0.0.0-20141206190957-6633656539c1 // indirect
 	github.com/jmespath/go-jmespath v0.0.0-20160803190731-bd40a432e4c7 // indirect
@@ -34,6 +34,7 @@ require (
 	github.com/juju/ratelimit v0.0.0-20151125201925-77ed1c8a0121 // indirect
 	github.com/mailru/easyjson v0.0.0-20160728113105-d5b7844b561a // indirect
 	github.com/niemeyer/pretty v0.0.0-20200227124842-a10e7caefd8e // indirect
+	github.com/prometheus/client_golang v1.1.0
 	github.com/rakelkar/gonetsh v0.0.0-20190930180311-e5c5ffe4bdf0
 	github.com/smartystreets/goconvey v1.6.4 // indirect
 	github.com/spf13/pflag v0.0.0-20151013200643-08b1a584251b // indirect
@@ -42,15 +43,29 @@ require (
 	github.com/ugorji/go v0.0.0-20170107133203-ded73eae5db7 // indirect
 	github.com/vishvananda/netlink v0.0.0-20181108222139-023a6dafdcdf
 	github.com/vishvananda/netns v0.0.0-20180720170159-13995c7128cc
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 	golang.org/x/net v0.0.0-20200707034311-ab3426394381
 	golang.org/x/oauth2 v0.0.0-20170629032740-5432cc9688e6
+	golang.org/x/time v0.0.0-20191024005414-555d28b269f0
 	google.golang.org/api v0.0.0-20170627180304-e6586c9293b9
 	google.golang.org/appengine v0.0.0-20160823001527-4f7eeb5305a4 // indirect
+	google.golang.org/grpc v1.0.4 // indirect
 	gopkg.in/check.v1 v1.0.0-20200227125254-8fa46927fb4f // indirect
 	gopkg.in/inf.v0 v0.9.0 // indirect
 	gopkg.in/yaml.v1 v1.0.0-20140924161607-9f9df34309c0 // indirect
-	gopkg.in/yaml.v2 v2.0.0-20170712054546-1be3d31502d6 // indirect
 	k8s.io/apimachinery v0.0.0-20170513172009-9603df80256c
 	k8s.io/client-go v3.0.1-0.20170829130306-a95edf803628+incompatible
 	k8s.io/utils v0.0.0-20171219162953-0ab3217ce272 // indirect
 )
+
+// client_golang's requirements would upgrade these modules under the kube
+// client and apimachinery, which are only known to work with the versions
+// they were vendored with
+replace (
+	github.com/davecgh/go-spew => github.com/davecgh/go-spew v1.1.0
+	github.com/gogo/protobuf => github.com/gogo/protobuf v0.0.0-20160824171236-909568be09de
+	github.com/golang/protobuf => github.com/golang/protobuf v1.3.1
+	github.com/google/gofuzz => github.com/google/gofuzz v0.0.0-20161122191042-44d81051d367
+	github.com/sirupsen/logrus => github.com/sirupsen/logrus v1.0.6
+	gopkg.in/yaml.v2 => gopkg.in/yaml.v2 v2.0.0-20170712054546-1be3d31502d6
+)
@@ -18,6 +18,7 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
@@ -30,10 +31,12 @@ import (
 
 	"github.com/coreos/pkg/flagutil"
 	log "github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/net/context"
 
 	"github.com/coreos/flannel/network"
 	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/logging"
 	"github.com/coreos/flannel/subnet"
 	"github.com/coreos/flannel/subnet/etcdv2"
 	"github.com/coreos/flannel/subnet/kube"
@@ -50,12 +53,15 @@ import (
 	_ "github.com/coreos/flannel/backend/alivpc"
 	_ "github.com/coreos/flannel/backend/alloc"
 	_ "github.com/coreos/flannel/backend/awsvpc"
+	_ "github.com/coreos/flannel/backend/directrouting"
 	_ "github.com/coreos/flannel/backend/extension"
 	_ "github.com/coreos/flannel/backend/gce"
 	_ "github.com/coreos/flannel/backend/hostgw"
 	_ "github.com/coreos/flannel/backend/ipip"
 	_ "github.com/coreos/flannel/backend/ipsec"
+	_ "github.com/coreos/flannel/backend/memory"
 	_ "github.com/coreos/flannel/backend/vxlan"
+	_ "github.com/coreos/flannel/backend/wireguard"
 	"github.com/coreos/go-systemd/daemon"
 )
 
@@ -78,11 +84,15 @@ type CmdLineOpts struct {
 	etcdCAFile             string
 	etcdUsername           string
 	etcdPassword           string
+	etcdAPIVersion         int
+	nodeID                 string
 	help                   bool
 	version                bool
 	kubeSubnetMgr          bool
 	kubeApiUrl             string
 	kubeConfigFile         string
+	kubeNetConfConfigMap   string
+	fileSubnetMgr          string
 	iface                  flagSlice
 	ifaceRegex             flagSlice
 	ipMasq                 bool
@@ -90,6 +100,9 @@ type CmdLineOpts struct {
 	subnetDir              string
 	publicIP               string
 	subnetLeaseRenewMargin int
+	subnetLeaseTTL         int
+	subnetLeaseRenewFrac   float64
+	subnetLen              int
 	kubeAPIServer          string
 	kubeNode               string
 	kubeCert               string
@@ -97,9 +110,14 @@ type CmdLineOpts struct {
 	kubeCA                 string
 	healthzIP              string
 	healthzPort            int
+	healthzFailures        int
+	renewFailures          int
 	charonExecutablePath   string
 	charonViciUri          string
 	iptablesResyncSeconds  int
+	printRoutePlan         bool
+	nodeLock               bool
+	logLevels              logging.LevelsFlag
 }
 
 var (
@@ -107,8 +125,98 @@ var (
 	errInterrupted = errors.New("interrupted")
 	errCanceled    = errors.New("canceled")
 	flannelFlags   = flag.NewFlagSet("flannel", flag.ExitOnError)
+	health         healthState
 )
 
+// healthState is what the healthz server reports on
+type healthState struct {
+	mu      sync.Mutex
+	network backend.Network
+	// routesReady is set once the routes of the network have been
+	// confirmed, later failures show up in the reconcile failures
+	routesReady bool
+}
+
+func (h *healthState) setNetwork(bn backend.Network) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.network = bn
+}
+
+// healthy returns an error if the network has failed to reconcile its
+// routes threshold times in a row
+func (h *healthState) healthy(threshold int) error {
+	h.mu.Lock()
+	bn := h.network
+	h.mu.Unlock()
+
+	return reconcileFailures(bn, threshold)
+}
+
+// reconcileFailures returns an error if bn has failed to reconcile its routes
+// threshold times in a row
+func reconcileFailures(bn backend.Network, threshold int) error {
+	hr, ok := bn.(backend.HealthReporter)
+	if !ok || threshold <= 0 {
+		return nil
+	}
+	if n, err := hr.ReconcileFailures(); n >= threshold {
+		return fmt.Errorf("route reconcile failed %d times in a row: %v", n, err)
+	}
+	return nil
+}
+
+// ready returns an error until the lease has been acquired and the routes
+// of the network have been confirmed. Networks which keep the status of their
+// routes are ready while the last reconcile found all of them present.
+// The routes are checked without holding h.mu, so that slow cloud APIs don't
+// hold up /healthz.
+func (h *healthState) ready(ctx context.Context) error {
+	h.mu.Lock()
+	bn, routesReady := h.network, h.routesReady
+	h.mu.Unlock()
+
+	if bn == nil {
+		return errors.New("subnet lease not acquired")
+	}
+	if sr, ok := bn.(backend.RouteStatusReporter); ok {
+		if statuses := sr.RouteStatuses(); len(statuses) > 0 {
+			return routeStatusesReady(statuses)
+		}
+	}
+	if hr, ok := bn.(backend.HealthReporter); ok && !routesReady {
+		if err := hr.CheckRoutes(ctx); err != nil {
+			return fmt.Errorf("routes not ready: %v", err)
+		}
+		h.mu.Lock()
+		// the routes confirmed are those of bn, not of a network set since
+		if h.network == bn {
+			h.routesReady = true
+		}
+		h.mu.Unlock()
+	}
+	return nil
+}
+
+// routeStatusesReady returns an error listing the routes which aren't present
+func routeStatusesReady(statuses []backend.RouteStatus) error {
+	var notReady []string
+	for _, s := range statuses {
+		if s.State == backend.RoutePresent {
+			continue
+		}
+		msg := fmt.Sprintf("route %v for %v in network %v is %v", s.Name, s.Destination, s.Network, s.State)
+		if s.LastError != nil {
+			msg += fmt.Sprintf(": %v", s.LastError)
+		}
+		notReady = append(notReady, msg)
+	}
+	if len(notReady) > 0 {
+		return fmt.Errorf("routes not ready: %v", strings.Join(notReady, "; "))
+	}
+	return nil
+}
+
 func init() {
 	flannelFlags.StringVar(&opts.etcdEndpoints, "etcd-endpoints", "http://127.0.0.1:4001,http://127.0.0.1:2379", "a comma-delimited list of etcd endpoints")
 	flannelFlags.StringVar(&opts.etcdPrefix, "etcd-prefix", "/coreos.com/network", "etcd prefix")
@@ -117,24 +225,36 @@ func init() {
 	flannelFlags.StringVar(&opts.etcdCAFile, "etcd-cafile", "", "SSL Certificate Authority file used to secure etcd communication")
 	flannelFlags.StringVar(&opts.etcdUsername, "etcd-username", "", "username for BasicAuth to etcd")
 	flannelFlags.StringVar(&opts.etcdPassword, "etcd-password", "", "password for BasicAuth to etcd")
+	flannelFlags.IntVar(&opts.etcdAPIVersion, "etcd-api-version", 2, "etcd API version to use for the subnet store, 2 or 3")
+	flannelFlags.StringVar(&opts.nodeID, "node-id", "", "stable identity of this node, used to hand its subnet lease off across restarts. Defaults to the contents of /etc/machine-id")
 	flannelFlags.Var(&opts.iface, "iface", "interface to use (IP or name) for inter-host communication. Can be specified multiple times to check each option in order. Returns the first match found.")
 	flannelFlags.Var(&opts.ifaceRegex, "iface-regex", "regex expression to match the first interface to use (IP or name) for inter-host communication. Can be specified multiple times to check each regex in order. Returns the first match found. Regexes are checked after specific interfaces specified by the iface option have already been checked.")
 	flannelFlags.StringVar(&opts.subnetFile, "subnet-file", "/run/flannel/subnet.env", "filename where env variables (subnet, MTU, ... ) will be written to")
 	flannelFlags.StringVar(&opts.publicIP, "public-ip", "", "IP accessible by other nodes for inter-host communication")
-	flannelFlags.IntVar(&opts.subnetLeaseRenewMargin, "subnet-lease-renew-margin", 60, "subnet lease renewal margin, in minutes, ranging from 1 to 1439")
+	flannelFlags.IntVar(&opts.subnetLeaseRenewMargin, "subnet-lease-renew-margin", 60, "subnet lease renewal margin, in minutes, at most half the subnet lease TTL")
+	flannelFlags.IntVar(&opts.subnetLeaseTTL, "subnet-lease-ttl", 24*60, "subnet lease TTL, in minutes")
+	flannelFlags.Float64Var(&opts.subnetLeaseRenewFrac, "subnet-lease-renew-fraction", 0, "fraction of the subnet lease TTL before expiry at which the lease is renewed, at most 0.5. Overrides subnet-lease-renew-margin when set")
+	flannelFlags.IntVar(&opts.subnetLen, "subnet-len", 0, "length of the subnet to lease to this node, within the SubnetLenMin and SubnetLenMax of the network config. Defaults to its SubnetLen")
 	flannelFlags.BoolVar(&opts.ipMasq, "ip-masq", false, "setup IP masquerade rule for traffic destined outside of overlay network")
 	flannelFlags.BoolVar(&opts.kubeSubnetMgr, "kube-subnet-mgr", false, "contact the Kubernetes API for subnet assignment instead of etcd.")
 	flannelFlags.StringVar(&opts.kubeApiUrl, "kube-api-url", "", "Kubernetes API server URL. Does not need to be specified if flannel is running in a pod.")
 	flannelFlags.StringVar(&opts.kubeConfigFile, "kubeconfig-file", "", "kubeconfig file location. Does not need to be specified if flannel is running in a pod.")
+	flannelFlags.StringVar(&opts.kubeNetConfConfigMap, "kube-net-conf-configmap", "", "ConfigMap, as namespace/name or a name in the namespace of the pod, whose net-conf.json is watched to apply network config changes without a restart")
+	flannelFlags.StringVar(&opts.fileSubnetMgr, "file-subnet-mgr", "", "path of a JSON file, shared by the nodes, holding the network config and the subnet leases instead of etcd")
 	flannelFlags.BoolVar(&opts.version, "version", false, "print version and exit")
+	flannelFlags.BoolVar(&opts.nodeLock, "node-lock", false, "hold a lock on the node ID in etcd, so that a second flannel for the same node waits for the first to stop instead of fighting over its routes")
+	flannelFlags.BoolVar(&opts.printRoutePlan, "print-route-plan", false, "print the routes the backend would ensure for the existing lease of this node and exit, without changing anything")
 	flannelFlags.StringVar(&opts.healthzIP, "healthz-ip", "0.0.0.0", "the IP address for healthz server to listen")
 	flannelFlags.IntVar(&opts.healthzPort, "healthz-port", 0, "the port for healthz server to listen(0 to disable)")
+	flannelFlags.IntVar(&opts.healthzFailures, "healthz-failure-threshold", 3, "number of consecutive failed route reconciles after which /healthz reports unhealthy (0 to disable)")
+	flannelFlags.IntVar(&opts.renewFailures, "subnet-lease-renew-failure-threshold", 0, "number of consecutive failed route reconciles after which the subnet lease is no longer renewed, so that it expires and peers stop routing to this node (0 to disable)")
 	flannelFlags.IntVar(&opts.iptablesResyncSeconds, "iptables-resync", 5, "resync period for iptables rules, in seconds")
 	flannelFlags.StringVar(&opts.kubeAPIServer, "kube-apiserver", "", "Kubernetes API server address in host:port format")
 	flannelFlags.StringVar(&opts.kubeNode, "kube-node", "", "Kubernetes node name flannel is running on")
 	flannelFlags.StringVar(&opts.kubeCert, "kube-cert", "", "Kubernetes API server certificate file used for client auth")
 	flannelFlags.StringVar(&opts.kubeKey, "kube-key", "", "Kubernetes API server private key file used for client auth")
 	flannelFlags.StringVar(&opts.kubeCA, "kube-ca", "", "Kubernetes API server CA file used for client auth")
+	flannelFlags.Var(&opts.logLevels, "log-levels", "comma separated list of subsystem=level overriding -v for the subsystem, e.g. gce=2, of "+strings.Join(logging.Subsystems(), ", "))
 
 	// glog will log to tmp files by default. override so all entries
 	// can flow into journald (if running under systemd)
@@ -147,9 +267,6 @@ func init() {
 
 	// Define the usage function
 	flannelFlags.Usage = usage
-
-	// now parse command line args
-	flannelFlags.Parse(os.Args[1:])
 }
 
 func copyFlag(name string) {
@@ -164,26 +281,42 @@ func usage() {
 
 func newSubnetManager() (subnet.Manager, error) {
 	if opts.kubeSubnetMgr {
-		return kube.NewSubnetManager(opts.kubeApiUrl, opts.kubeConfigFile)
-	}
-
-	cfg := &etcdv2.EtcdConfig{
-		Endpoints: strings.Split(opts.etcdEndpoints, ","),
-		Keyfile:   opts.etcdKeyfile,
-		Certfile:  opts.etcdCertfile,
-		CAFile:    opts.etcdCAFile,
-		Prefix:    opts.etcdPrefix,
-		Username:  opts.etcdUsername,
-		Password:  opts.etcdPassword,
+		return kube.NewSubnetManager(opts.kubeApiUrl, opts.kubeConfigFile, subnetLeaseTTL(), opts.kubeNetConfConfigMap)
 	}
 
 	// Attempt to renew the lease for the subnet specified in the subnetFile
 	prevSubnet := ReadSubnetFromSubnetFile(opts.subnetFile)
 
-	return etcdv2.NewLocalManager(cfg, prevSubnet)
+	if opts.fileSubnetMgr != "" {
+		cfg := &etcdv2.FileConfig{
+			Path:      opts.fileSubnetMgr,
+			LeaseTTL:  subnetLeaseTTL(),
+			SubnetLen: uint(opts.subnetLen),
+		}
+		return etcdv2.NewFileManager(cfg, prevSubnet, ReadNodeID(opts.nodeID))
+	}
+
+	cfg := &etcdv2.EtcdConfig{
+		Endpoints:  strings.Split(opts.etcdEndpoints, ","),
+		Keyfile:    opts.etcdKeyfile,
+		Certfile:   opts.etcdCertfile,
+		CAFile:     opts.etcdCAFile,
+		Prefix:     opts.etcdPrefix,
+		Username:   opts.etcdUsername,
+		Password:   opts.etcdPassword,
+		APIVersion: opts.etcdAPIVersion,
+		LeaseTTL:   subnetLeaseTTL(),
+		SubnetLen:  uint(opts.subnetLen),
+	}
+
+	return etcdv2.NewLocalManager(cfg, prevSubnet, ReadNodeID(opts.nodeID))
 }
 
 func main() {
+	// parse the command line args here rather than in init, which would
+	// also parse those of the tests
+	flannelFlags.Parse(os.Args[1:])
+
 	if opts.version {
 		fmt.Fprintln(os.Stderr, version.Version)
 		os.Exit(0)
@@ -192,8 +325,42 @@ func main() {
 	flagutil.SetFlagsFromEnv(flannelFlags, "FLANNELD")
 
 	// Validate flags
-	if opts.subnetLeaseRenewMargin >= 24*60 || opts.subnetLeaseRenewMargin <= 0 {
-		log.Error("Invalid subnet-lease-renew-margin option, out of acceptable range")
+	if opts.subnetLeaseRenewFrac < 0 || opts.subnetLeaseRenewFrac >= 1 {
+		log.Error("Invalid subnet-lease-renew-fraction option, out of acceptable range")
+		os.Exit(1)
+	}
+	if err := subnet.ValidateLeaseTiming(subnetLeaseTTL(), subnetLeaseRenewLeadTime()); err != nil {
+		log.Errorf("Invalid subnet-lease-ttl, subnet-lease-renew-margin or subnet-lease-renew-fraction option: %v", err)
+		os.Exit(1)
+	}
+	if opts.renewFailures < 0 {
+		log.Error("Invalid subnet-lease-renew-failure-threshold option, out of acceptable range")
+		os.Exit(1)
+	}
+	if opts.subnetLen < 0 || opts.subnetLen > 30 {
+		log.Error("Invalid subnet-len option, out of acceptable range")
+		os.Exit(1)
+	}
+	if opts.subnetLen != 0 && opts.kubeSubnetMgr {
+		// the pod CIDRs of nodes are allocated by Kubernetes
+		log.Error("The subnet-len option is not supported with kube-subnet-mgr")
+		os.Exit(1)
+	}
+	if opts.renewFailures != 0 && opts.kubeSubnetMgr {
+		// the pod CIDRs of nodes aren't leased
+		log.Error("The subnet-lease-renew-failure-threshold option is not supported with kube-subnet-mgr")
+		os.Exit(1)
+	}
+	if opts.nodeLock && opts.kubeSubnetMgr {
+		log.Error("The node-lock option is not supported with kube-subnet-mgr")
+		os.Exit(1)
+	}
+	if opts.fileSubnetMgr != "" && opts.kubeSubnetMgr {
+		log.Error("The file-subnet-mgr and kube-subnet-mgr options are mutually exclusive")
+		os.Exit(1)
+	}
+	if opts.kubeNetConfConfigMap != "" && !opts.kubeSubnetMgr {
+		log.Error("The kube-net-conf-configmap option requires kube-subnet-mgr")
 		os.Exit(1)
 	}
 
@@ -267,7 +434,7 @@ func main() {
 		wg.Done()
 	}()
 
-	if opts.healthzPort > 0 {
+	if opts.healthzPort > 0 && !opts.printRoutePlan {
 		// It's not super easy to shutdown the HTTP server so don't attempt to stop it cleanly
 		go mustRunHealthz()
 	}
@@ -288,6 +455,55 @@ func main() {
 		wg.Wait()
 		os.Exit(1)
 	}
+	needs, err := backend.ConfigCapabilities(config)
+	if err != nil {
+		log.Errorf("Error parsing network config: %s", err)
+		cancel()
+		wg.Wait()
+		os.Exit(1)
+	}
+	// stopping the lease renewals relies on the reconcile failures
+	needs.RouteReconcile = opts.renewFailures > 0
+	if err := backend.CheckCapabilities(be, config.BackendType, needs); err != nil {
+		log.Errorf("Unsupported network config: %s", err)
+		cancel()
+		wg.Wait()
+		os.Exit(1)
+	}
+
+	if opts.printRoutePlan {
+		if err := printRoutePlan(ctx, os.Stdout, sm, be, config, extIface); err != nil {
+			log.Errorf("Error printing route plan: %s", err)
+			cancel()
+			wg.Wait()
+			os.Exit(1)
+		}
+		cancel()
+		wg.Wait()
+		os.Exit(0)
+	}
+
+	// A second flannel for this node waits here until the first stops
+	var lockLost <-chan struct{}
+	if opts.nodeLock {
+		locker, ok := sm.(subnet.NodeLocker)
+		if !ok {
+			log.Errorf("The %s subnet manager can't lock the node", sm.Name())
+			cancel()
+			wg.Wait()
+			os.Exit(1)
+		}
+		lockLost, err = locker.LockNode(ctx, &wg)
+		if err == context.Canceled {
+			wg.Wait()
+			os.Exit(0)
+		} else if err != nil {
+			log.Errorf("Error locking the node: %s", err)
+			cancel()
+			wg.Wait()
+			os.Exit(1)
+		}
+	}
 
 	bn, err := be.RegisterNetwork(ctx, &wg, config)
 	if err != nil {
@@ -296,9 +512,15 @@ func main() {
 		wg.Wait()
 		os.Exit(1)
 	}
+	health.setNetwork(bn)
 
+	var secondaryNetworks []string
+	for _, n := range config.SecondaryNetworks {
+		secondaryNetworks = append(secondaryNetworks, n.String())
+	}
 	err = network.Config{
 		Network:                config.Network.String(),
+		SecondaryNetworks:      secondaryNetworks,
 		Lease:                  bn.Lease().Subnet.String(),
 		Masquerade:             opts.ipMasq,
 		IPTablesresyncInterval: time.Duration(opts.iptablesResyncSeconds) * time.Second,
@@ -310,7 +532,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	if err := WriteSubnetFile(opts.subnetFile, config.Network, opts.ipMasq, bn); err != nil {
+	if err := WriteSubnetFile(opts.subnetFile, config, opts.ipMasq, bn); err != nil {
 		// Continue, even though it failed.
 		log.Warningf("Failed to write subnet file: %s", err)
 	} else {
@@ -324,6 +546,38 @@ func main() {
 		go resetNodeCondition(ctx)
 	}
 
+	// Networks which reconcile their routes do so immediately on SIGHUP
+	if r, ok := bn.(backend.Reconciler); ok {
+		wg.Add(1)
+		go func() {
+			reconcileOnSignal(ctx, r)
+			wg.Done()
+		}()
+	}
+
+	if lockLost != nil {
+		wg.Add(1)
+		go func() {
+			stopReconcilingOnLockLoss(ctx, lockLost, bn)
+			wg.Done()
+		}()
+	}
+
+	// Subnet managers which notice network config changes report them, so
+	// that the network applies what it can without a restart
+	if cw, ok := sm.(subnet.ConfigWatcher); ok {
+		configs := make(chan *subnet.Config)
+		wg.Add(2)
+		go func() {
+			cw.WatchNetworkConfig(ctx, configs)
+			wg.Done()
+		}()
+		go func() {
+			followNetworkConfig(ctx, configs, bn, config)
+			wg.Done()
+		}()
+	}
+
 	log.Infof("Finished starting backend.")
 	log.Info("Running backend.")
 	wg.Add(1)
@@ -365,6 +619,36 @@ func shutdownHandler(ctx context.Context, sigs chan os.Signal, cancel context.Ca
 	signal.Stop(sigs)
 }
 
+// reconcileOnSignal triggers a reconcile of the routes of r on each SIGHUP
+func reconcileOnSignal(ctx context.Context, r backend.Reconciler) {
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	defer signal.Stop(hups)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hups:
+			log.Info("Received SIGHUP, triggering a route reconcile")
+			r.TriggerReconcile()
+		}
+	}
+}
+
+// stopReconcilingOnLockLoss stops the route reconciles of bn once the node
+// lock is lost, since another flannel may manage the routes by then
+func stopReconcilingOnLockLoss(ctx context.Context, lost <-chan struct{}, bn backend.Network) {
+	select {
+	case <-ctx.Done():
+	case <-lost:
+		log.Error("Lost the lock on this node, another flannel may be managing its routes, no longer reconciling them")
+		if s, ok := bn.(backend.ReconcileStopper); ok {
+			s.StopReconciling()
+		}
+	}
+}
+
 func getConfig(ctx context.Context, sm subnet.Manager) (*subnet.Config, error) {
 	// Retry every second until it succeeds
 	for {
@@ -386,6 +670,17 @@ func getConfig(ctx context.Context, sm subnet.Manager) (*subnet.Config, error) {
 	}
 }
 
+// subnetLeaseTTL returns how long subnet leases last
+func subnetLeaseTTL() time.Duration {
+	return time.Duration(opts.subnetLeaseTTL) * time.Minute
+}
+
+// subnetLeaseRenewLeadTime returns how long before expiry the subnet lease is
+// renewed
+func subnetLeaseRenewLeadTime() time.Duration {
+	return subnet.LeaseRenewLeadTime(subnetLeaseTTL(), time.Duration(opts.subnetLeaseRenewMargin)*time.Minute, opts.subnetLeaseRenewFrac)
+}
+
 func MonitorLease(ctx context.Context, sm subnet.Manager, bn backend.Network, wg *sync.WaitGroup) error {
 	// Use the subnet manager to start watching leases.
 	evts := make(chan subnet.Event)
@@ -396,12 +691,21 @@ func MonitorLease(ctx context.Context, sm subnet.Manager, bn backend.Network, wg
 		wg.Done()
 	}()
 
-	renewMargin := time.Duration(opts.subnetLeaseRenewMargin) * time.Minute
+	renewMargin := subnetLeaseRenewLeadTime()
 	dur := bn.Lease().Expiration.Sub(time.Now()) - renewMargin
 
 	for {
 		select {
 		case <-time.After(dur):
+			// routes to this node which can't be installed black hole
+			// the traffic of peers, let the lease expire instead so
+			// that they stop routing to it
+			if err := reconcileFailures(bn, opts.renewFailures); err != nil {
+				log.Errorf("Not renewing lease, expiring %v (checking again in 1 min): %v", bn.Lease().Expiration, err)
+				dur = time.Minute
+				continue
+			}
+
 			err := sm.RenewLease(ctx, bn.Lease())
 			if err != nil {
 				log.Error("Error renewing lease (trying again in 1 min): ", err)
@@ -543,7 +847,7 @@ func LookupExtIface(ifname string, ifregex string) (*backend.ExternalInterface,
 	}, nil
 }
 
-func WriteSubnetFile(path string, nw ip.IP4Net, ipMasq bool, bn backend.Network) error {
+func WriteSubnetFile(path string, config *subnet.Config, ipMasq bool, bn backend.Network) error {
 	dir, name := filepath.Split(path)
 	os.MkdirAll(dir, 0755)
 
@@ -558,8 +862,14 @@ func WriteSubnetFile(path string, nw ip.IP4Net, ipMasq bool, bn backend.Network)
 	sn := bn.Lease().Subnet
 	sn.IP += 1
 
-	fmt.Fprintf(f, "FLANNEL_NETWORK=%s\n", nw)
+	fmt.Fprintf(f, "FLANNEL_NETWORK=%s\n", config.Network)
 	fmt.Fprintf(f, "FLANNEL_SUBNET=%s\n", sn)
+	if sn6 := bn.Lease().IPv6Subnet; config.EnableIPv6() && !sn6.Empty() {
+		// like for IPv4, write out the first usable IP
+		sn6.IP = sn6.IP.Add(ip.IP6Size(128))
+		fmt.Fprintf(f, "FLANNEL_IPV6_NETWORK=%s\n", config.IPv6Network)
+		fmt.Fprintf(f, "FLANNEL_IPV6_SUBNET=%s\n", sn6)
+	}
 	fmt.Fprintf(f, "FLANNEL_MTU=%d\n", bn.MTU())
 	_, err = fmt.Fprintf(f, "FLANNEL_IPMASQ=%v\n", ipMasq)
 	f.Close()
@@ -573,14 +883,34 @@ func WriteSubnetFile(path string, nw ip.IP4Net, ipMasq bool, bn backend.Network)
 	//TODO - is this safe? What if it's not on the same FS?
 }
 
+// readyzTimeout bounds the route check of a readiness probe
+const readyzTimeout = 5 * time.Second
+
 func mustRunHealthz() {
 	address := net.JoinHostPort(opts.healthzIP, strconv.Itoa(opts.healthzPort))
 	log.Infof("Start healthz server on %s", address)
 
 	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if err := health.healthy(opts.healthzFailures); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(err.Error()))
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("flanneld is running"))
 	})
+	http.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), readyzTimeout)
+		defer cancel()
+		if err := health.ready(ctx); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("flanneld is ready"))
+	})
+	http.Handle("/metrics", promhttp.Handler())
 
 	if err := http.ListenAndServe(address, nil); err != nil {
 		log.Errorf("Start healthz server error. %v", err)
@@ -603,3 +933,18 @@ func ReadSubnetFromSubnetFile(path string) ip.IP4Net {
 	}
 	return prevSubnet
 }
+
+// ReadNodeID returns nodeID if set, otherwise the machine ID of the host.
+// An empty result disables lease handoff.
+func ReadNodeID(nodeID string) string {
+	if nodeID != "" {
+		return nodeID
+	}
+
+	machineID, err := ioutil.ReadFile("/etc/machine-id")
+	if err != nil {
+		log.Warningf("Couldn't read machine ID, lease handoff across restarts is disabled: %v", err)
+		return ""
+	}
+	return strings.TrimSpace(string(machineID))
+}
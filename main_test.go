@@ -0,0 +1,80 @@
+// Copyright 2024 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/subnet"
+)
+
+// blockingNetwork is a network whose route checks block until release is
+// closed
+type blockingNetwork struct {
+	checking chan struct{}
+	release  chan struct{}
+}
+
+func (n *blockingNetwork) Lease() *subnet.Lease    { return &subnet.Lease{} }
+func (n *blockingNetwork) MTU() int                { return 1500 }
+func (n *blockingNetwork) Run(ctx context.Context) {}
+
+func (n *blockingNetwork) CheckRoutes(ctx context.Context) error {
+	close(n.checking)
+	<-n.release
+	return nil
+}
+
+func (n *blockingNetwork) ReconcileFailures() (int, error) {
+	return 0, nil
+}
+
+func TestHealthyWhileReadyChecksRoutes(t *testing.T) {
+	var h healthState
+	bn := &blockingNetwork{checking: make(chan struct{}), release: make(chan struct{})}
+	h.setNetwork(bn)
+
+	ready := make(chan error, 1)
+	go func() {
+		ready <- h.ready(context.Background())
+	}()
+	<-bn.checking
+
+	healthy := make(chan error, 1)
+	go func() {
+		healthy <- h.healthy(3)
+	}()
+	select {
+	case err := <-healthy:
+		if err != nil {
+			t.Errorf("expected healthy, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the health check not to wait for the route check")
+	}
+
+	close(bn.release)
+	if err := <-ready; err != nil {
+		t.Fatalf("expected ready, got %v", err)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.routesReady {
+		t.Error("expected the confirmed routes to be recorded")
+	}
+}
@@ -68,7 +68,10 @@ type chain struct {
 
 type Config struct {
 	Network string
-	Lease   string
+	// SecondaryNetworks are further networks of the overlay, treated like
+	// Network
+	SecondaryNetworks []string
+	Lease             string
 	// Setup ipMasq if configured
 	Masquerade bool
 	// IPTablesresyncInterval indicated how frequently to resync iptables
@@ -88,29 +91,40 @@ const (
 func (c Config) generateRules(ipt IPTables, masq bool) []IPTablesRule {
 	rules := make([]IPTablesRule, 0)
 
+	// traffic from the secondary networks never gets past the rules for
+	// internal overlay traffic, so the rules for traffic from outside the
+	// overlay only need to exclude Network
+	networks := append([]string{c.Network}, c.SecondaryNetworks...)
+
 	if masq {
 		supportsRandomFully := ipt.HasRandomFully()
 
 		// This rule makes sure we don't NAT traffic within overlay network (e.g. coming out of docker0)
-		rules = append(rules,
-			IPTablesRule{flannelMasqChain.table, flannelMasqChain.name,
-				[]string{"-s", c.Network, "-d", c.Network, "-j", "RETURN"},
-				"flannel: internal overlay traffic"},
-		)
+		for _, src := range networks {
+			for _, dst := range networks {
+				rules = append(rules,
+					IPTablesRule{flannelMasqChain.table, flannelMasqChain.name,
+						[]string{"-s", src, "-d", dst, "-j", "RETURN"},
+						"flannel: internal overlay traffic"},
+				)
+			}
+		}
 
 		// NAT if it's not multicast traffic
-		if supportsRandomFully {
-			rules = append(rules,
-				IPTablesRule{flannelMasqChain.table, flannelMasqChain.name,
-					[]string{"-s", c.Network, "!", "-d", "224.0.0.0/4", "-j", "MASQUERADE", "--random-fully"},
-					"flannel: nat outbound traffic"},
-			)
-		} else {
-			rules = append(rules,
-				IPTablesRule{flannelMasqChain.table, flannelMasqChain.name,
-					[]string{"-s", c.Network, "!", "-d", "224.0.0.0/4", "-j", "MASQUERADE"},
-					"flannel: nat outbound traffic"},
-			)
+		for _, n := range networks {
+			if supportsRandomFully {
+				rules = append(rules,
+					IPTablesRule{flannelMasqChain.table, flannelMasqChain.name,
+						[]string{"-s", n, "!", "-d", "224.0.0.0/4", "-j", "MASQUERADE", "--random-fully"},
+						"flannel: nat outbound traffic"},
+				)
+			} else {
+				rules = append(rules,
+					IPTablesRule{flannelMasqChain.table, flannelMasqChain.name,
+						[]string{"-s", n, "!", "-d", "224.0.0.0/4", "-j", "MASQUERADE"},
+						"flannel: nat outbound traffic"},
+				)
+			}
 		}
 
 		// Prevent performing Masquerade on external traffic which arrives from a Node that owns the container/pod IP address
@@ -121,30 +135,34 @@ func (c Config) generateRules(ipt IPTables, masq bool) []IPTablesRule {
 		)
 
 		// Masquerade anything headed towards flannel from the host
-		if supportsRandomFully {
-			rules = append(rules,
-				IPTablesRule{flannelMasqChain.table, flannelMasqChain.name,
-					[]string{"!", "-s", c.Network, "-d", c.Network, "-j", "MASQUERADE", "--random-fully"},
-					"flannel: snat to overlay"},
-			)
-		} else {
-			rules = append(rules,
-				IPTablesRule{flannelMasqChain.table, flannelMasqChain.name,
-					[]string{"!", "-s", c.Network, "-d", c.Network, "-j", "MASQUERADE"},
-					"flannel: snat to overlay"},
-			)
+		for _, n := range networks {
+			if supportsRandomFully {
+				rules = append(rules,
+					IPTablesRule{flannelMasqChain.table, flannelMasqChain.name,
+						[]string{"!", "-s", c.Network, "-d", n, "-j", "MASQUERADE", "--random-fully"},
+						"flannel: snat to overlay"},
+				)
+			} else {
+				rules = append(rules,
+					IPTablesRule{flannelMasqChain.table, flannelMasqChain.name,
+						[]string{"!", "-s", c.Network, "-d", n, "-j", "MASQUERADE"},
+						"flannel: snat to overlay"},
+				)
+			}
 		}
 
 	}
 
-	rules = append(rules,
-		IPTablesRule{flannelForwardChain.table, flannelForwardChain.name,
-			[]string{"-s", c.Network, "-j", "ACCEPT"},
-			"flannel: allow forwarding of overlay traffic"},
-		IPTablesRule{flannelForwardChain.table, flannelForwardChain.name,
-			[]string{"-d", c.Network, "-j", "ACCEPT"},
-			"flannel: allow forwarding of overlay traffic"},
-	)
+	for _, n := range networks {
+		rules = append(rules,
+			IPTablesRule{flannelForwardChain.table, flannelForwardChain.name,
+				[]string{"-s", n, "-j", "ACCEPT"},
+				"flannel: allow forwarding of overlay traffic"},
+			IPTablesRule{flannelForwardChain.table, flannelForwardChain.name,
+				[]string{"-d", n, "-j", "ACCEPT"},
+				"flannel: allow forwarding of overlay traffic"},
+		)
+	}
 
 	rules = append(rules, c.generateJoinRules(masq)...)
 
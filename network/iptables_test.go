@@ -18,6 +18,7 @@ package network
 import (
 	"net"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/coreos/flannel/pkg/ip"
@@ -119,3 +120,31 @@ func TestEnsureRules(t *testing.T) {
 		t.Errorf("iptables masqRules after ensureIPTables are incorrected. Expected: %#v, Actual: %#v", ipt_recreate.rules, ipt_correct.rules)
 	}
 }
+
+func TestGenerateRulesSecondaryNetworks(t *testing.T) {
+	c := Config{Network: "10.0.0.0/16", SecondaryNetworks: []string{"10.5.0.0/16"}, Lease: "10.0.1.0/24"}
+	var specs []string
+	for _, r := range c.generateRules(&MockIPTables{}, true) {
+		specs = append(specs, r.chain+" "+strings.Join(r.rulespec, " "))
+	}
+	expected := []string{
+		"FLANNEL-MASQ -s 10.0.0.0/16 -d 10.0.0.0/16 -j RETURN",
+		"FLANNEL-MASQ -s 10.0.0.0/16 -d 10.5.0.0/16 -j RETURN",
+		"FLANNEL-MASQ -s 10.5.0.0/16 -d 10.0.0.0/16 -j RETURN",
+		"FLANNEL-MASQ -s 10.5.0.0/16 -d 10.5.0.0/16 -j RETURN",
+		"FLANNEL-MASQ -s 10.0.0.0/16 ! -d 224.0.0.0/4 -j MASQUERADE --random-fully",
+		"FLANNEL-MASQ -s 10.5.0.0/16 ! -d 224.0.0.0/4 -j MASQUERADE --random-fully",
+		"FLANNEL-MASQ ! -s 10.0.0.0/16 -d 10.0.1.0/24 -j RETURN",
+		"FLANNEL-MASQ ! -s 10.0.0.0/16 -d 10.0.0.0/16 -j MASQUERADE --random-fully",
+		"FLANNEL-MASQ ! -s 10.0.0.0/16 -d 10.5.0.0/16 -j MASQUERADE --random-fully",
+		"FLANNEL-FORWARD -s 10.0.0.0/16 -j ACCEPT",
+		"FLANNEL-FORWARD -d 10.0.0.0/16 -j ACCEPT",
+		"FLANNEL-FORWARD -s 10.5.0.0/16 -j ACCEPT",
+		"FLANNEL-FORWARD -d 10.5.0.0/16 -j ACCEPT",
+		"POSTROUTING -j FLANNEL-MASQ",
+		"FORWARD -j FLANNEL-FORWARD",
+	}
+	if !reflect.DeepEqual(specs, expected) {
+		t.Errorf("expected rules\n%v\ngot\n%v", strings.Join(expected, "\n"), strings.Join(specs, "\n"))
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// IP6 is an IPv6 address stored as two 64 bit halves so that, like IP4, it
+// can be compared and used as a map key
+type IP6 struct {
+	hi, lo uint64
+}
+
+func FromIP6(ip net.IP) IP6 {
+	ip = ip.To16()
+	return IP6{binary.BigEndian.Uint64(ip[:8]), binary.BigEndian.Uint64(ip[8:])}
+}
+
+func ParseIP6(s string) (IP6, error) {
+	ip := net.ParseIP(s)
+	if ip == nil || ip.To4() != nil {
+		return IP6{}, errors.New("Invalid IPv6 address format")
+	}
+	return FromIP6(ip), nil
+}
+
+func MustParseIP6(s string) IP6 {
+	ip, err := ParseIP6(s)
+	if err != nil {
+		panic(err)
+	}
+	return ip
+}
+
+func (ip IP6) ToIP() net.IP {
+	b := make(net.IP, net.IPv6len)
+	binary.BigEndian.PutUint64(b[:8], ip.hi)
+	binary.BigEndian.PutUint64(b[8:], ip.lo)
+	return b
+}
+
+func (ip IP6) String() string {
+	return ip.ToIP().String()
+}
+
+// Cmp returns -1, 0 or 1 if ip is less than, equal to or greater than other
+func (ip IP6) Cmp(other IP6) int {
+	switch {
+	case ip.hi < other.hi || (ip.hi == other.hi && ip.lo < other.lo):
+		return -1
+	case ip == other:
+		return 0
+	default:
+		return 1
+	}
+}
+
+func (ip IP6) Add(other IP6) IP6 {
+	lo := ip.lo + other.lo
+	hi := ip.hi + other.hi
+	if lo < ip.lo {
+		hi++
+	}
+	return IP6{hi, lo}
+}
+
+func (ip IP6) Sub(other IP6) IP6 {
+	lo := ip.lo - other.lo
+	hi := ip.hi - other.hi
+	if lo > ip.lo {
+		hi--
+	}
+	return IP6{hi, lo}
+}
+
+func (ip IP6) And(other IP6) IP6 {
+	return IP6{ip.hi & other.hi, ip.lo & other.lo}
+}
+
+func (ip IP6) IsZero() bool {
+	return ip == IP6{}
+}
+
+// IP6Size returns the number of addresses in a network of prefixLen
+func IP6Size(prefixLen uint) IP6 {
+	if prefixLen <= 64 {
+		return IP6{1 << (64 - prefixLen), 0}
+	}
+	return IP6{0, 1 << (128 - prefixLen)}
+}
+
+// json.Marshaler impl
+func (ip IP6) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`"%s"`, ip)), nil
+}
+
+// json.Unmarshaler impl
+func (ip *IP6) UnmarshalJSON(j []byte) error {
+	j = bytes.Trim(j, "\"")
+	if val, err := ParseIP6(string(j)); err != nil {
+		return err
+	} else {
+		*ip = val
+		return nil
+	}
+}
+
+// similar to net.IPNet but has uint based representation
+type IP6Net struct {
+	IP        IP6
+	PrefixLen uint
+}
+
+func (n IP6Net) String() string {
+	return fmt.Sprintf("%s/%d", n.IP.String(), n.PrefixLen)
+}
+
+func (n IP6Net) Network() IP6Net {
+	return IP6Net{
+		n.IP.And(n.Mask()),
+		n.PrefixLen,
+	}
+}
+
+func (n IP6Net) Next() IP6Net {
+	return IP6Net{
+		n.IP.Add(IP6Size(n.PrefixLen)),
+		n.PrefixLen,
+	}
+}
+
+func FromIP6Net(n *net.IPNet) IP6Net {
+	prefixLen, _ := n.Mask.Size()
+	return IP6Net{
+		FromIP6(n.IP),
+		uint(prefixLen),
+	}
+}
+
+func (n IP6Net) ToIPNet() *net.IPNet {
+	return &net.IPNet{
+		IP:   n.IP.ToIP(),
+		Mask: net.CIDRMask(int(n.PrefixLen), 128),
+	}
+}
+
+func (n IP6Net) Overlaps(other IP6Net) bool {
+	var mask IP6
+	if n.PrefixLen < other.PrefixLen {
+		mask = n.Mask()
+	} else {
+		mask = other.Mask()
+	}
+	return n.IP.And(mask) == other.IP.And(mask)
+}
+
+func (n IP6Net) Equal(other IP6Net) bool {
+	return n.IP == other.IP && n.PrefixLen == other.PrefixLen
+}
+
+func (n IP6Net) Mask() IP6 {
+	var ones uint64 = 0xFFFFFFFFFFFFFFFF
+	switch {
+	case n.PrefixLen == 0:
+		return IP6{}
+	case n.PrefixLen <= 64:
+		return IP6{ones << (64 - n.PrefixLen), 0}
+	default:
+		return IP6{ones, ones << (128 - n.PrefixLen)}
+	}
+}
+
+func (n IP6Net) Contains(ip IP6) bool {
+	return n.IP.And(n.Mask()) == ip.And(n.Mask())
+}
+
+func (n IP6Net) Empty() bool {
+	return n.IP.IsZero() && n.PrefixLen == uint(0)
+}
+
+// json.Marshaler impl
+func (n IP6Net) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`"%s"`, n)), nil
+}
+
+// json.Unmarshaler impl
+func (n *IP6Net) UnmarshalJSON(j []byte) error {
+	j = bytes.Trim(j, "\"")
+	if _, val, err := net.ParseCIDR(string(j)); err != nil {
+		return err
+	} else if val.IP.To4() != nil {
+		return fmt.Errorf("%s is not an IPv6 network", j)
+	} else {
+		*n = FromIP6Net(val)
+		return nil
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func mkIP6Net(s string, plen uint) IP6Net {
+	return IP6Net{MustParseIP6(s), plen}
+}
+
+func TestIP6(t *testing.T) {
+	ip, err := ParseIP6("fc00::1:2")
+	if err != nil {
+		t.Fatal("ParseIP6 failed with: ", err)
+	}
+
+	if ip.String() != "fc00::1:2" {
+		t.Error("String failed")
+	}
+
+	if _, err := ParseIP6("1.2.3.4"); err == nil {
+		t.Error("ParseIP6 accepted an IPv4 address")
+	}
+
+	if ip.Add(MustParseIP6("::ffff:ffff:ffff:ffff")) != MustParseIP6("fc00:0:0:1::1:1") {
+		t.Error("Add failed to carry")
+	}
+
+	if MustParseIP6("fc00:0:0:1::").Sub(MustParseIP6("::1")) != MustParseIP6("fc00::ffff:ffff:ffff:ffff") {
+		t.Error("Sub failed to borrow")
+	}
+
+	if ip.Cmp(MustParseIP6("fc00::1:3")) != -1 || ip.Cmp(ip) != 0 || ip.Cmp(MustParseIP6("fb00::")) != 1 {
+		t.Error("Cmp failed")
+	}
+
+	j, err := json.Marshal(ip)
+	if err != nil {
+		t.Error("Marshal of IP6 failed: ", err)
+	} else if string(j) != `"fc00::1:2"` {
+		t.Error("Marshal of IP6 failed with unexpected value: ", j)
+	}
+}
+
+func TestIP6Net(t *testing.T) {
+	n1 := mkIP6Net("fc00:0:0:1::", 64)
+
+	if n1.ToIPNet().String() != "fc00:0:0:1::/64" {
+		t.Error("ToIPNet failed")
+	}
+
+	if n1.Next() != mkIP6Net("fc00:0:0:2::", 64) {
+		t.Errorf("Next failed: %s", n1.Next())
+	}
+
+	if mkIP6Net("fc00::1:0", 112).Next() != mkIP6Net("fc00::2:0", 112) {
+		t.Error("Next failed for a prefix longer than 64")
+	}
+
+	if !n1.Overlaps(mkIP6Net("fc00::", 48)) {
+		t.Errorf("%s does not overlap fc00::/48", n1)
+	}
+
+	if n1.Overlaps(mkIP6Net("fc00:0:0:2::", 64)) {
+		t.Errorf("%s overlaps fc00:0:0:2::/64", n1)
+	}
+
+	if !n1.Contains(MustParseIP6("fc00:0:0:1::5")) || n1.Contains(MustParseIP6("fc00:0:0:2::")) {
+		t.Error("Contains failed")
+	}
+
+	if mkIP6Net("fc00::1:2", 64).Network() != mkIP6Net("fc00::", 64) {
+		t.Error("Network failed")
+	}
+
+	j, err := json.Marshal(n1)
+	if err != nil {
+		t.Error("Marshal of IP6Net failed: ", err)
+	} else if string(j) != `"fc00:0:0:1::/64"` {
+		t.Error("Marshal of IP6Net failed with unexpected value: ", j)
+	}
+
+	var n2 IP6Net
+	if err := json.Unmarshal(j, &n2); err != nil || !n2.Equal(n1) {
+		t.Errorf("Unmarshal of IP6Net failed: %v %v", n2, err)
+	}
+
+	if err := json.Unmarshal([]byte(`"10.0.0.0/8"`), &n2); err == nil {
+		t.Error("Unmarshal of IP6Net accepted an IPv4 network")
+	}
+}
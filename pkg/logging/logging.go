@@ -0,0 +1,160 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package logging scopes the verbosity of glog to the subsystems of flannel,
+// so that the verbose logs of one, e.g. the gce backend, can be turned up
+// without those of all others. Subsystems without a level of their own log
+// at the level of -v, as with glog.V.
+package logging
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/golang/glog"
+)
+
+// Logger gates the verbose logs of a subsystem on its level
+type Logger struct {
+	name string
+
+	mu sync.RWMutex
+	// level is the level of the subsystem if set is true, otherwise that
+	// of -v applies
+	level log.Level
+	set   bool
+}
+
+var (
+	mu      sync.Mutex
+	loggers = make(map[string]*Logger)
+)
+
+// New returns the logger of the subsystem name, the same for every caller
+func New(name string) *Logger {
+	mu.Lock()
+	defer mu.Unlock()
+	l, ok := loggers[name]
+	if !ok {
+		l = &Logger{name: name}
+		loggers[name] = l
+	}
+	return l
+}
+
+// V returns whether logs at level are enabled for the subsystem, like
+// glog.V, e.g. logger.V(2).Infof(...). Its Info methods report the file and
+// line of their caller. -vmodule doesn't apply to subsystem loggers.
+func (l *Logger) V(level log.Level) log.Verbose {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.set {
+		return log.Verbose(level <= l.level)
+	}
+	return log.Verbose(level <= globalLevel())
+}
+
+// globalLevel returns the level set with -v
+func globalLevel() log.Level {
+	f := flag.Lookup("v")
+	if f == nil {
+		return 0
+	}
+	level, _ := f.Value.(flag.Getter).Get().(log.Level)
+	return level
+}
+
+// Subsystems returns the names of the subsystems with a logger, sorted
+func Subsystems() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	var names []string
+	for name := range loggers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetLevels sets the levels of subsystems from spec, a comma separated list
+// of name=level, e.g. "gce=2,subnet=1". Subsystems which aren't listed log at
+// the level of -v again. Nothing is changed if spec is invalid.
+func SetLevels(spec string) error {
+	levels, err := parseLevels(spec)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for name := range levels {
+		if _, ok := loggers[name]; !ok {
+			return fmt.Errorf("unknown subsystem %q", name)
+		}
+	}
+	for name, l := range loggers {
+		level, ok := levels[name]
+		l.mu.Lock()
+		l.level, l.set = level, ok
+		l.mu.Unlock()
+	}
+	return nil
+}
+
+func parseLevels(spec string) (map[string]log.Level, error) {
+	levels := make(map[string]log.Level)
+	for _, s := range strings.Split(spec, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		parts := strings.SplitN(s, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid subsystem level %q: must be name=level", s)
+		}
+		level, err := strconv.ParseInt(parts[1], 10, 32)
+		if err != nil || level < 0 {
+			return nil, fmt.Errorf("invalid level %q of subsystem %q: must be a non-negative integer", parts[1], parts[0])
+		}
+		if _, ok := levels[parts[0]]; ok {
+			return nil, fmt.Errorf("duplicate level of subsystem %q", parts[0])
+		}
+		levels[parts[0]] = log.Level(level)
+	}
+	return levels, nil
+}
+
+// LevelsFlag is a flag.Value which sets the levels of subsystems with
+// SetLevels, e.g. -log-levels=gce=2
+type LevelsFlag struct {
+	spec string
+}
+
+func (f *LevelsFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.spec
+}
+
+func (f *LevelsFlag) Set(spec string) error {
+	if err := SetLevels(spec); err != nil {
+		return err
+	}
+	f.spec = spec
+	return nil
+}
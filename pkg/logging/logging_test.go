@@ -0,0 +1,110 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"flag"
+	"testing"
+
+	log "github.com/golang/glog"
+)
+
+// setGlobalLevel sets -v to level and returns a func restoring it
+func setGlobalLevel(t *testing.T, level string) func() {
+	old := flag.Lookup("v").Value.String()
+	if err := flag.Set("v", level); err != nil {
+		t.Fatal(err)
+	}
+	return func() { flag.Set("v", old) }
+}
+
+func TestLoggerLevels(t *testing.T) {
+	defer setGlobalLevel(t, "1")()
+	gce, subnet := New("test-gce"), New("test-subnet")
+	defer SetLevels("")
+
+	if New("test-gce") != gce {
+		t.Error("expected the same logger for a subsystem")
+	}
+	if !gce.V(1) || gce.V(2) {
+		t.Error("expected subsystems to follow -v without a level")
+	}
+
+	if err := SetLevels("test-gce=3"); err != nil {
+		t.Fatal(err)
+	}
+	if !gce.V(3) || gce.V(4) {
+		t.Error("expected test-gce to log at level 3")
+	}
+	if !subnet.V(1) || subnet.V(2) {
+		t.Error("expected test-subnet to still follow -v")
+	}
+
+	if err := SetLevels("test-gce=0, test-subnet=2"); err != nil {
+		t.Fatal(err)
+	}
+	if !gce.V(0) || gce.V(1) {
+		t.Error("expected test-gce to log at level 0 only, below -v")
+	}
+	if !subnet.V(2) {
+		t.Error("expected test-subnet to log at level 2")
+	}
+
+	if err := SetLevels(""); err != nil {
+		t.Fatal(err)
+	}
+	if !gce.V(1) || gce.V(2) {
+		t.Error("expected test-gce to follow -v again")
+	}
+}
+
+func TestSetLevelsInvalid(t *testing.T) {
+	gce := New("test-gce")
+	if err := SetLevels("test-gce=2"); err != nil {
+		t.Fatal(err)
+	}
+	defer SetLevels("")
+
+	for _, spec := range []string{
+		"test-gce",
+		"=2",
+		"test-gce=-1",
+		"test-gce=high",
+		"test-gce=1,test-gce=2",
+		"unknown=2",
+	} {
+		if err := SetLevels(spec); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+	if gce.V(3) || !gce.V(2) {
+		t.Error("expected invalid levels to leave the level unchanged")
+	}
+}
+
+func TestLevelsFlag(t *testing.T) {
+	gce := New("test-gce")
+	defer SetLevels("")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	var levels LevelsFlag
+	fs.Var(&levels, "log-levels", "")
+	if err := fs.Parse([]string{"-log-levels=test-gce=5"}); err != nil {
+		t.Fatal(err)
+	}
+	if levels.String() != "test-gce=5" || !gce.V(log.Level(5)) {
+		t.Errorf("expected test-gce to log at level 5, got %q", levels.String())
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/subnet"
+)
+
+// followNetworkConfig applies the network configs received from configs to
+// bn, which was registered with running, until ctx is done
+func followNetworkConfig(ctx context.Context, configs <-chan *subnet.Config, bn backend.Network, running *subnet.Config) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case config := <-configs:
+			applyNetworkConfig(ctx, bn, running, config)
+		}
+	}
+}
+
+// applyNetworkConfig applies the changes of config from running which bn can
+// apply while running, and logs those which need a restart. Only backend
+// config changes can be applied, by networks which are Reconfigurers.
+func applyNetworkConfig(ctx context.Context, bn backend.Network, running, config *subnet.Config) {
+	if config.BackendType != running.BackendType {
+		log.Warningf("Backend type changed from %s to %s, restart flannel to switch backends", running.BackendType, config.BackendType)
+		return
+	}
+	if keys := networkConfigChanges(running, config); len(keys) > 0 {
+		log.Warningf("Network config changed: %v", &backend.RestartRequiredError{Keys: keys})
+	}
+
+	r, ok := bn.(backend.Reconfigurer)
+	if !ok {
+		if !sameJSON(running.Backend, config.Backend) {
+			log.Warningf("Backend config changed, but the %s backend can't apply changes while running, restart flannel to apply them", config.BackendType)
+		}
+		return
+	}
+	switch err := r.Reconfigure(ctx, config); err.(type) {
+	case nil:
+	case *backend.RestartRequiredError:
+		log.Warningf("Backend config changed: %v", err)
+	default:
+		log.Errorf("Error applying the backend config: %v", err)
+	}
+}
+
+// networkConfigChanges returns the keys of the network config outside the
+// backend config which differ between a and b
+func networkConfigChanges(a, b *subnet.Config) []string {
+	var keys []string
+	va, vb := reflect.ValueOf(*a), reflect.ValueOf(*b)
+	for i := 0; i < va.NumField(); i++ {
+		name := va.Type().Field(i).Name
+		if name == "Backend" || name == "BackendType" {
+			continue
+		}
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			keys = append(keys, name)
+		}
+	}
+	return keys
+}
+
+// sameJSON returns true if a and b encode the same value, whatever their
+// formatting
+func sameJSON(a, b json.RawMessage) bool {
+	var va, vb interface{}
+	if len(a) > 0 && json.Unmarshal(a, &va) != nil {
+		return false
+	}
+	if len(b) > 0 && json.Unmarshal(b, &vb) != nil {
+		return false
+	}
+	return reflect.DeepEqual(va, vb)
+}
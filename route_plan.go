@@ -0,0 +1,81 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// printRoutePlan writes the routes be would ensure for the lease of this node
+// to w, without acquiring a lease or changing any route
+func printRoutePlan(ctx context.Context, w io.Writer, sm subnet.Manager, be backend.Backend, config *subnet.Config, extIface *backend.ExternalInterface) error {
+	planner, ok := be.(backend.RoutePlanner)
+	if !ok {
+		return fmt.Errorf("backend %v can't print its route plan", config.BackendType)
+	}
+
+	lease, err := findLocalLease(ctx, sm, ReadNodeID(opts.nodeID), ReadSubnetFromSubnetFile(opts.subnetFile), ip.FromIP(extIface.ExtAddr))
+	if err != nil {
+		return err
+	}
+
+	routes, err := planner.PlanRoutes(ctx, config, lease)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tNETWORK\tDESTINATION\tNEXT HOP")
+	for _, r := range routes {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.Name, r.Network, r.Destination, r.NextHop)
+	}
+	return tw.Flush()
+}
+
+// findLocalLease returns the existing lease of this node, found by its node
+// ID, the subnet in the subnet file or its public IP, in that order. Nothing
+// is acquired or renewed, so only subnet managers which list all leases
+// are supported.
+func findLocalLease(ctx context.Context, sm subnet.Manager, nodeID string, prevSubnet ip.IP4Net, publicIP ip.IP4) (*subnet.Lease, error) {
+	res, err := sm.WatchLeases(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error listing leases: %v", err)
+	}
+	if len(res.Events) > 0 {
+		return nil, fmt.Errorf("subnet manager %v does not list leases, can't find the lease of this node", sm.Name())
+	}
+
+	matches := []func(l *subnet.Lease) bool{
+		func(l *subnet.Lease) bool { return nodeID != "" && l.Attrs.NodeID == nodeID },
+		func(l *subnet.Lease) bool { return !prevSubnet.Empty() && l.Subnet.Equal(prevSubnet) },
+		func(l *subnet.Lease) bool { return l.Attrs.PublicIP == publicIP },
+	}
+	for _, match := range matches {
+		for i := range res.Snapshot {
+			if match(&res.Snapshot[i]) {
+				return &res.Snapshot[i], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no lease found for this node (node ID %q, public IP %v), it would acquire a new one", nodeID, publicIP)
+}
@@ -29,6 +29,100 @@ type Config struct {
 	SubnetLen   uint
 	BackendType string          `json:"-"`
 	Backend     json.RawMessage `json:",omitempty"`
+
+	// SubnetLenMin and SubnetLenMax bound the subnet lengths nodes may
+	// request instead of SubnetLen. Both default to SubnetLen.
+	SubnetLenMin uint `json:",omitempty"`
+	SubnetLenMax uint `json:",omitempty"`
+
+	// MTU overrides the MTU that backends detect from the external interface
+	MTU int `json:",omitempty"`
+
+	// SecondaryNetworks are further IPv4 networks subnets are allocated
+	// from, in order, once Network and the ones before are exhausted
+	SecondaryNetworks []ip.IP4Net `json:",omitempty"`
+
+	// IPv6Network is optional, when set each lease is also assigned an
+	// IPv6 subnet of IPv6SubnetLen out of it
+	IPv6Network   ip.IP6Net
+	IPv6SubnetMin ip.IP6
+	IPv6SubnetMax ip.IP6
+	IPv6SubnetLen uint
+}
+
+// SubnetLenRange returns the shortest and longest subnet lengths nodes may
+// lease
+func (c *Config) SubnetLenRange() (uint, uint) {
+	min, max := c.SubnetLenMin, c.SubnetLenMax
+	if min == 0 {
+		min = c.SubnetLen
+	}
+	if max == 0 {
+		max = c.SubnetLen
+	}
+	return min, max
+}
+
+// SubnetRangeEnd returns the last address subnets may cover, the end of the
+// SubnetLen subnet at SubnetMax
+func (c *Config) SubnetRangeEnd() ip.IP4 {
+	return c.SubnetMax + ip.IP4(1<<(32-c.SubnetLen)) - 1
+}
+
+// SubnetPool is a range of a network subnets are allocated from, those
+// between SubnetMin and the end of the SubnetLen subnet at SubnetMax
+type SubnetPool struct {
+	Network   ip.IP4Net
+	SubnetMin ip.IP4
+	SubnetMax ip.IP4
+}
+
+// Networks returns Network followed by the SecondaryNetworks
+func (c *Config) Networks() []ip.IP4Net {
+	return append([]ip.IP4Net{c.Network}, c.SecondaryNetworks...)
+}
+
+// SubnetPools returns the pools subnets are allocated from, in order: that of
+// Network between SubnetMin and SubnetMax, then the SecondaryNetworks, each
+// without its first subnet like Network
+func (c *Config) SubnetPools() []SubnetPool {
+	pools := []SubnetPool{{Network: c.Network, SubnetMin: c.SubnetMin, SubnetMax: c.SubnetMax}}
+	subnetSize := ip.IP4(1 << (32 - c.SubnetLen))
+	for _, n := range c.SecondaryNetworks {
+		pools = append(pools, SubnetPool{Network: n, SubnetMin: n.IP + subnetSize, SubnetMax: n.Next().IP - subnetSize})
+	}
+	return pools
+}
+
+// PoolOf returns the pool whose range covers sn
+func (c *Config) PoolOf(sn ip.IP4Net) (SubnetPool, bool) {
+	for _, p := range c.SubnetPools() {
+		if p.Covers(c.SubnetLen, sn) {
+			return p, true
+		}
+	}
+	return SubnetPool{}, false
+}
+
+// RangeEnd returns the last address subnets of the pool may cover, the end of
+// the subnetLen subnet at SubnetMax
+func (p SubnetPool) RangeEnd(subnetLen uint) ip.IP4 {
+	return p.SubnetMax + ip.IP4(1<<(32-subnetLen)) - 1
+}
+
+// Covers reports whether sn lies within the range of the pool, for subnets of
+// subnetLen. Subnets longer than subnetLen may start past SubnetMax, all must
+// end within the subnetLen subnet at SubnetMax.
+func (p SubnetPool) Covers(subnetLen uint, sn ip.IP4Net) bool {
+	if sn.IP < p.SubnetMin {
+		return false
+	}
+	return uint64(sn.IP)+uint64(1)<<(32-sn.PrefixLen)-1 <= uint64(p.RangeEnd(subnetLen))
+}
+
+// EnableIPv6 reports whether leases are assigned an IPv6 subnet
+func (c *Config) EnableIPv6() bool {
+	return !c.IPv6Network.Empty()
 }
 
 func parseBackendType(be json.RawMessage) (string, error) {
@@ -108,6 +202,24 @@ func ParseConfig(s string) (*Config, error) {
 		return nil, fmt.Errorf("SubnetMax is not on a SubnetLen boundary: %v", cfg.SubnetMax)
 	}
 
+	if err := parseSubnetLenRange(cfg); err != nil {
+		return nil, err
+	}
+
+	if err := checkSecondaryNetworks(cfg); err != nil {
+		return nil, err
+	}
+
+	if cfg.MTU < 0 {
+		return nil, fmt.Errorf("MTU must not be negative: %d", cfg.MTU)
+	}
+
+	if cfg.EnableIPv6() {
+		if err := parseIPv6Config(cfg); err != nil {
+			return nil, err
+		}
+	}
+
 	bt, err := parseBackendType(cfg.Backend)
 	if err != nil {
 		return nil, err
@@ -116,3 +228,90 @@ func ParseConfig(s string) (*Config, error) {
 
 	return cfg, nil
 }
+
+// parseSubnetLenRange defaults SubnetLenMin and SubnetLenMax to SubnetLen and
+// checks that they surround it
+func parseSubnetLenRange(cfg *Config) error {
+	cfg.SubnetLenMin, cfg.SubnetLenMax = cfg.SubnetLenRange()
+
+	if cfg.SubnetLenMin > cfg.SubnetLen {
+		return fmt.Errorf("SubnetLenMin must not be longer than SubnetLen: /%d", cfg.SubnetLenMin)
+	}
+	if cfg.SubnetLenMax < cfg.SubnetLen {
+		return fmt.Errorf("SubnetLenMax must not be shorter than SubnetLen: /%d", cfg.SubnetLenMax)
+	}
+	if cfg.SubnetLenMax > 30 {
+		return errors.New("SubnetLenMax must be less than /31")
+	}
+	if cfg.SubnetLenMin < cfg.Network.PrefixLen+2 {
+		return errors.New("Network must be able to accommodate at least four subnets of SubnetLenMin")
+	}
+	return nil
+}
+
+// checkSecondaryNetworks checks that the SecondaryNetworks overlap neither
+// Network nor each other, and can accommodate subnets like Network
+func checkSecondaryNetworks(cfg *Config) error {
+	networks := cfg.Networks()
+	for i, n := range cfg.SecondaryNetworks {
+		if cfg.SubnetLenMin < n.PrefixLen+2 {
+			return fmt.Errorf("SecondaryNetworks %v must be able to accommodate at least four subnets of SubnetLenMin", n)
+		}
+		for _, other := range networks[:i+1] {
+			if n.Overlaps(other) {
+				return fmt.Errorf("SecondaryNetworks %v overlaps %v", n, other)
+			}
+		}
+	}
+	return nil
+}
+
+func parseIPv6Config(cfg *Config) error {
+	if cfg.IPv6SubnetLen > 0 {
+		// SubnetLen needs to allow for a tunnel and bridge device on each host.
+		if cfg.IPv6SubnetLen > 126 {
+			return errors.New("IPv6SubnetLen must be less than /127")
+		}
+
+		// the first subnet isn't used, so the network needs to accommodate at least four.
+		if cfg.IPv6SubnetLen < cfg.IPv6Network.PrefixLen+2 {
+			return errors.New("IPv6Network must be able to accommodate at least four subnets")
+		}
+	} else {
+		// Default to giving each host a /64, otherwise split the network into four.
+		if cfg.IPv6Network.PrefixLen > 124 {
+			return errors.New("IPv6Network is too small. Minimum useful network prefix is /124")
+		} else if cfg.IPv6Network.PrefixLen <= 62 {
+			cfg.IPv6SubnetLen = 64
+		} else {
+			cfg.IPv6SubnetLen = cfg.IPv6Network.PrefixLen + 2
+		}
+	}
+
+	subnetSize := ip.IP6Size(cfg.IPv6SubnetLen)
+
+	if cfg.IPv6SubnetMin.IsZero() {
+		// skip over the first subnet, like for IPv4
+		cfg.IPv6SubnetMin = cfg.IPv6Network.IP.Add(subnetSize)
+	} else if !cfg.IPv6Network.Contains(cfg.IPv6SubnetMin) {
+		return errors.New("IPv6SubnetMin is not in the range of the IPv6Network")
+	}
+
+	if cfg.IPv6SubnetMax.IsZero() {
+		cfg.IPv6SubnetMax = cfg.IPv6Network.Next().IP.Sub(subnetSize)
+	} else if !cfg.IPv6Network.Contains(cfg.IPv6SubnetMax) {
+		return errors.New("IPv6SubnetMax is not in the range of the IPv6Network")
+	}
+
+	// The IPv6SubnetMin and IPv6SubnetMax need to be aligned to a IPv6SubnetLen boundary
+	mask := ip.IP6Net{PrefixLen: cfg.IPv6SubnetLen}.Mask()
+	if cfg.IPv6SubnetMin != cfg.IPv6SubnetMin.And(mask) {
+		return fmt.Errorf("IPv6SubnetMin is not on a IPv6SubnetLen boundary: %v", cfg.IPv6SubnetMin)
+	}
+
+	if cfg.IPv6SubnetMax != cfg.IPv6SubnetMax.And(mask) {
+		return fmt.Errorf("IPv6SubnetMax is not on a IPv6SubnetLen boundary: %v", cfg.IPv6SubnetMax)
+	}
+
+	return nil
+}
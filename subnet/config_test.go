@@ -15,7 +15,10 @@
 package subnet
 
 import (
+	"strings"
 	"testing"
+
+	"github.com/coreos/flannel/pkg/ip"
 )
 
 func TestConfigDefaults(t *testing.T) {
@@ -69,3 +72,145 @@ func TestConfigOverrides(t *testing.T) {
 		t.Errorf("SubnetLen mismatch: expected 28, got %d", cfg.SubnetLen)
 	}
 }
+
+func TestConfigIPv6Defaults(t *testing.T) {
+	s := `{ "Network": "10.3.0.0/16", "IPv6Network": "fc00::/48" }`
+
+	cfg, err := ParseConfig(s)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %s", err)
+	}
+
+	if !cfg.EnableIPv6() {
+		t.Error("expected IPv6 to be enabled")
+	}
+
+	if cfg.IPv6SubnetMin.String() != "fc00:0:0:1::" {
+		t.Errorf("IPv6SubnetMin mismatch, expected fc00:0:0:1::, got %s", cfg.IPv6SubnetMin)
+	}
+
+	if cfg.IPv6SubnetMax.String() != "fc00:0:0:ffff::" {
+		t.Errorf("IPv6SubnetMax mismatch, expected fc00:0:0:ffff::, got %s", cfg.IPv6SubnetMax)
+	}
+
+	if cfg.IPv6SubnetLen != 64 {
+		t.Errorf("IPv6SubnetLen mismatch: expected 64, got %d", cfg.IPv6SubnetLen)
+	}
+}
+
+func TestConfigIPv6Disabled(t *testing.T) {
+	cfg, err := ParseConfig(`{ "Network": "10.3.0.0/16" }`)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %s", err)
+	}
+
+	if cfg.EnableIPv6() || cfg.IPv6SubnetLen != 0 {
+		t.Errorf("expected IPv6 to be disabled, got %+v", cfg)
+	}
+}
+
+func TestConfigIPv6Invalid(t *testing.T) {
+	for _, s := range []string{
+		`{ "Network": "10.3.0.0/16", "IPv6Network": "10.4.0.0/16" }`,
+		`{ "Network": "10.3.0.0/16", "IPv6Network": "fc00::/126" }`,
+		`{ "Network": "10.3.0.0/16", "IPv6Network": "fc00::/64", "IPv6SubnetLen": 63 }`,
+		`{ "Network": "10.3.0.0/16", "IPv6Network": "fc00::/48", "IPv6SubnetMin": "fd00::" }`,
+		`{ "Network": "10.3.0.0/16", "IPv6Network": "fc00::/48", "IPv6SubnetMin": "fc00::1" }`,
+	} {
+		if _, err := ParseConfig(s); err == nil {
+			t.Errorf("expected %s to be invalid", s)
+		}
+	}
+}
+
+func TestConfigMTU(t *testing.T) {
+	cfg, err := ParseConfig(`{ "Network": "10.3.0.0/16", "MTU": 1400 }`)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %s", err)
+	}
+	if cfg.MTU != 1400 {
+		t.Errorf("MTU mismatch: expected 1400, got %d", cfg.MTU)
+	}
+
+	if _, err := ParseConfig(`{ "Network": "10.3.0.0/16", "MTU": -1 }`); err == nil {
+		t.Error("expected a negative MTU to be invalid")
+	}
+}
+
+func TestConfigSubnetLenRange(t *testing.T) {
+	cfg, err := ParseConfig(`{ "Network": "10.3.0.0/16", "SubnetLen": 24, "SubnetLenMin": 22, "SubnetLenMax": 26 }`)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %s", err)
+	}
+	if min, max := cfg.SubnetLenRange(); min != 22 || max != 26 {
+		t.Errorf("SubnetLenRange mismatch: expected 22, 26, got %d, %d", min, max)
+	}
+	if cfg.SubnetRangeEnd().String() != "10.3.255.255" {
+		t.Errorf("SubnetRangeEnd mismatch: expected 10.3.255.255, got %s", cfg.SubnetRangeEnd())
+	}
+
+	cfg, err = ParseConfig(`{ "Network": "10.3.0.0/16" }`)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %s", err)
+	}
+	if cfg.SubnetLenMin != 24 || cfg.SubnetLenMax != 24 {
+		t.Errorf("expected the subnet length range to default to SubnetLen, got %d, %d", cfg.SubnetLenMin, cfg.SubnetLenMax)
+	}
+
+	for _, s := range []string{
+		`{ "Network": "10.3.0.0/16", "SubnetLen": 24, "SubnetLenMin": 25 }`,
+		`{ "Network": "10.3.0.0/16", "SubnetLen": 24, "SubnetLenMax": 23 }`,
+		`{ "Network": "10.3.0.0/16", "SubnetLen": 24, "SubnetLenMax": 31 }`,
+		`{ "Network": "10.3.0.0/16", "SubnetLen": 24, "SubnetLenMin": 17 }`,
+	} {
+		if _, err := ParseConfig(s); err == nil {
+			t.Errorf("ParseConfig(%s): expected an error", s)
+		}
+	}
+}
+
+func TestConfigSecondaryNetworks(t *testing.T) {
+	cfg, err := ParseConfig(`{ "Network": "10.3.0.0/16", "SecondaryNetworks": ["10.5.0.0/16", "10.7.0.0/20"] }`)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %s", err)
+	}
+	var networks []string
+	for _, n := range cfg.Networks() {
+		networks = append(networks, n.String())
+	}
+	if strings.Join(networks, ",") != "10.3.0.0/16,10.5.0.0/16,10.7.0.0/20" {
+		t.Errorf("Networks mismatch: got %v", networks)
+	}
+
+	// the pools of the secondary networks skip their first subnet
+	pools := cfg.SubnetPools()
+	var ranges []string
+	for _, p := range pools {
+		ranges = append(ranges, p.SubnetMin.String()+"-"+p.SubnetMax.String())
+	}
+	if strings.Join(ranges, ",") != "10.3.1.0-10.3.255.0,10.5.1.0-10.5.255.0,10.7.1.0-10.7.15.0" {
+		t.Errorf("SubnetPools mismatch: got %v", ranges)
+	}
+
+	sn := ip.IP4Net{IP: ip.MustParseIP4("10.7.3.0"), PrefixLen: 24}
+	if p, ok := cfg.PoolOf(sn); !ok || p.Network != pools[2].Network {
+		t.Errorf("PoolOf(%v): expected %v, got %v, %v", sn, pools[2].Network, p.Network, ok)
+	}
+	for _, s := range []string{"10.7.0.0", "10.7.16.0", "10.4.1.0"} {
+		sn := ip.IP4Net{IP: ip.MustParseIP4(s), PrefixLen: 24}
+		if p, ok := cfg.PoolOf(sn); ok {
+			t.Errorf("PoolOf(%v): expected no pool, got %v", sn, p.Network)
+		}
+	}
+
+	for _, s := range []string{
+		`{ "Network": "10.3.0.0/16", "SecondaryNetworks": ["10.3.128.0/17"] }`,
+		`{ "Network": "10.3.0.0/16", "SecondaryNetworks": ["10.5.0.0/16", "10.5.0.0/20"] }`,
+		`{ "Network": "10.3.0.0/16", "SecondaryNetworks": ["10.5.0.0/23"] }`,
+		`{ "Network": "10.3.0.0/16", "SecondaryNetworks": ["not-a-network"] }`,
+	} {
+		if _, err := ParseConfig(s); err == nil {
+			t.Errorf("ParseConfig(%s): expected an error", s)
+		}
+	}
+}
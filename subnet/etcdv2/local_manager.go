@@ -22,6 +22,7 @@ import (
 
 	etcd "github.com/coreos/etcd/client"
 	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/logging"
 	. "github.com/coreos/flannel/subnet"
 	log "github.com/golang/glog"
 	"golang.org/x/net/context"
@@ -29,12 +30,25 @@ import (
 
 const (
 	raceRetries = 10
-	subnetTTL   = 24 * time.Hour
+	subnetTTL   = DefaultLeaseTTL
 )
 
+// allocatorLogger gates the verbose logs of subnet allocation on the level of
+// the allocator subsystem
+var allocatorLogger = logging.New("allocator")
+
 type LocalManager struct {
 	registry       Registry
 	previousSubnet ip.IP4Net
+	nodeID         string
+	// leaseTTL is how long acquired and renewed leases last
+	leaseTTL time.Duration
+	// subnetLen is the requested length of the subnet of this node, 0
+	// means the SubnetLen of the network config
+	subnetLen uint
+	// lockTTL is how long the node lock lasts unless refreshed
+	lockTTL time.Duration
+	metrics leaseMetrics
 }
 
 type watchCursor struct {
@@ -69,18 +83,36 @@ func (c watchCursor) String() string {
 	return strconv.FormatUint(c.index, 10)
 }
 
-func NewLocalManager(config *EtcdConfig, prevSubnet ip.IP4Net) (Manager, error) {
-	r, err := newEtcdSubnetRegistry(config, nil)
+func NewLocalManager(config *EtcdConfig, prevSubnet ip.IP4Net, nodeID string) (Manager, error) {
+	var r Registry
+	var err error
+	switch config.APIVersion {
+	case 0, 2:
+		r, err = newEtcdSubnetRegistry(config, nil)
+	case 3:
+		r, err = newEtcdV3SubnetRegistry(config)
+	default:
+		return nil, fmt.Errorf("unsupported etcd API version %d, must be 2 or 3", config.APIVersion)
+	}
 	if err != nil {
 		return nil, err
 	}
-	return newLocalManager(r, prevSubnet), nil
+	registerMetrics()
+	m := newLocalManager(r, prevSubnet, nodeID)
+	if config.LeaseTTL > 0 {
+		m.leaseTTL = config.LeaseTTL
+	}
+	m.subnetLen = config.SubnetLen
+	return m, nil
 }
 
-func newLocalManager(r Registry, prevSubnet ip.IP4Net) Manager {
+func newLocalManager(r Registry, prevSubnet ip.IP4Net, nodeID string) *LocalManager {
 	return &LocalManager{
 		registry:       r,
 		previousSubnet: prevSubnet,
+		nodeID:         nodeID,
+		leaseTTL:       subnetTTL,
+		lockTTL:        nodeLockTTL,
 	}
 }
 
@@ -90,7 +122,13 @@ func (m *LocalManager) GetNetworkConfig(ctx context.Context) (*Config, error) {
 		return nil, err
 	}
 
-	return ParseConfig(cfg)
+	config, err := ParseConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	m.metrics.setConfig(config)
+	return config, nil
 }
 
 func (m *LocalManager) AcquireLease(ctx context.Context, attrs *LeaseAttrs) (*Lease, error) {
@@ -99,10 +137,19 @@ func (m *LocalManager) AcquireLease(ctx context.Context, attrs *LeaseAttrs) (*Le
 		return nil, err
 	}
 
+	// Tag the lease with our identity so that a restart can hand it off
+	// to ourselves instead of allocating a new one
+	nodeAttrs := *attrs
+	nodeAttrs.NodeID = m.nodeID
+	attrs = &nodeAttrs
+
 	for i := 0; i < raceRetries; i++ {
 		l, err := m.tryAcquireLease(ctx, config, attrs.PublicIP, attrs)
 		switch err {
 		case nil:
+			m.recordAffinity(ctx, l.Subnet)
+			m.metrics.handleEvent(Event{Type: EventAdded, Lease: *l})
+			setLocalLeaseExpiration(l.Expiration)
 			return l, nil
 		case errTryAgain:
 			continue
@@ -124,6 +171,59 @@ func findLeaseByIP(leases []Lease, pubIP ip.IP4) *Lease {
 	return nil
 }
 
+// findLeaseForHandoff returns the lease for subnet that was last written
+// by the node identified by nodeID, or nil if there is none.
+func findLeaseForHandoff(leases []Lease, subnet ip.IP4Net, nodeID string) *Lease {
+	if nodeID == "" {
+		return nil
+	}
+
+	for _, l := range leases {
+		if subnet.Equal(l.Subnet) && l.Attrs.NodeID == nodeID {
+			return &l
+		}
+	}
+
+	return nil
+}
+
+// isLeaseHeldByOtherNode reports whether l carries a node identity that is
+// not nodeID. Leases without an identity belong to no node in particular.
+func isLeaseHeldByOtherNode(l *Lease, nodeID string) bool {
+	return nodeID != "" && l.Attrs.NodeID != "" && l.Attrs.NodeID != nodeID
+}
+
+// findOverlappingLease returns a lease whose subnet overlaps, but is not,
+// subnet, or nil if there is none
+func findOverlappingLease(leases []Lease, subnet ip.IP4Net) *Lease {
+	for _, l := range leases {
+		if !subnet.Equal(l.Subnet) && subnet.Overlaps(l.Subnet) {
+			return &l
+		}
+	}
+
+	return nil
+}
+
+// checkLeaseOverlap returns an error if sn or sn6 overlap the subnets of any
+// lease other than the one for sn. Such leases are left by subnet managers
+// with overlapping network configs, and routes to both would conflict.
+func checkLeaseOverlap(leases []Lease, sn ip.IP4Net, sn6 ip.IP6Net) error {
+	if l := findOverlappingLease(leases, sn); l != nil {
+		return fmt.Errorf("subnet %v overlaps subnet %v leased to %v, the network configs of the subnet managers may overlap", sn, l.Subnet, l.Attrs.PublicIP)
+	}
+
+	if sn6.Empty() {
+		return nil
+	}
+	for _, l := range leases {
+		if !sn.Equal(l.Subnet) && !l.IPv6Subnet.Empty() && sn6.Overlaps(l.IPv6Subnet) {
+			return fmt.Errorf("IPv6 subnet %v overlaps IPv6 subnet %v leased to %v, the network configs of the subnet managers may overlap", sn6, l.IPv6Subnet, l.Attrs.PublicIP)
+		}
+	}
+	return nil
+}
+
 func findLeaseBySubnet(leases []Lease, subnet ip.IP4Net) *Lease {
 	for _, l := range leases {
 		if subnet.Equal(l.Subnet) {
@@ -134,28 +234,96 @@ func findLeaseBySubnet(leases []Lease, subnet ip.IP4Net) *Lease {
 	return nil
 }
 
+// nodeSubnetLen returns the length of the subnet to lease to this node
+func (m *LocalManager) nodeSubnetLen(config *Config) (uint, error) {
+	if m.subnetLen == 0 {
+		return config.SubnetLen, nil
+	}
+
+	min, max := config.SubnetLenRange()
+	if m.subnetLen < min || m.subnetLen > max {
+		return 0, fmt.Errorf("requested subnet length /%d is outside the range /%d to /%d of the network config", m.subnetLen, min, max)
+	}
+	return m.subnetLen, nil
+}
+
 func (m *LocalManager) tryAcquireLease(ctx context.Context, config *Config, extIaddr ip.IP4, attrs *LeaseAttrs) (*Lease, error) {
+	subnetLen, err := m.nodeSubnetLen(config)
+	if err != nil {
+		return nil, err
+	}
+	// leases of another length than requested are treated as incompatible,
+	// so that changing it moves the node to a subnet of the new length
+	isCompat := func(sn ip.IP4Net) bool {
+		return isSubnetConfigCompat(config, sn) && sn.PrefixLen == subnetLen
+	}
+
 	leases, _, err := m.registry.getSubnets(ctx)
 	if err != nil {
 		return nil, err
 	}
+	m.metrics.setLeases(leases)
+
+	// Try to take over the lease we held before a restart. The lease must
+	// still be for the subnet we last wrote to the subnet file and carry our
+	// node identity; it is renewed in place, conditional on it not having
+	// changed since we read it, so the backend sees no remove/add churn.
+	if l := findLeaseForHandoff(leases, m.previousSubnet, m.nodeID); l != nil && isCompat(l.Subnet) {
+		log.Infof("Found lease (%v) held by this node (%v), handing it off", l.Subnet, m.nodeID)
+
+		ttl := time.Duration(0)
+		if !l.Expiration.IsZero() {
+			// Not a reservation
+			ttl = m.leaseTTL
+		}
+		sn6, err := m.ipv6SubnetFor(config, l, leases)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkLeaseOverlap(leases, l.Subnet, sn6); err != nil {
+			return nil, err
+		}
+		setLeasePool(config, l.Subnet, attrs)
+		exp, err := m.registry.updateSubnet(ctx, l.Subnet, sn6, attrs, ttl, l.Asof)
+		switch {
+		case err == nil:
+			l.IPv6Subnet = sn6
+			l.Attrs = *attrs
+			l.Expiration = exp
+			return l, nil
+		case isErrEtcdTestFailed(err):
+			// The lease changed under us, start over with a fresh view
+			return nil, errTryAgain
+		default:
+			return nil, err
+		}
+	}
 
 	// Try to reuse a subnet if there's one that matches our IP
 	if l := findLeaseByIP(leases, extIaddr); l != nil {
 		// Make sure the existing subnet is still within the configured network
-		if isSubnetConfigCompat(config, l.Subnet) {
+		if isCompat(l.Subnet) {
 			log.Infof("Found lease (%v) for current IP (%v), reusing", l.Subnet, extIaddr)
 
 			ttl := time.Duration(0)
 			if !l.Expiration.IsZero() {
 				// Not a reservation
-				ttl = subnetTTL
+				ttl = m.leaseTTL
+			}
+			sn6, err := m.ipv6SubnetFor(config, l, leases)
+			if err != nil {
+				return nil, err
+			}
+			if err := checkLeaseOverlap(leases, l.Subnet, sn6); err != nil {
+				return nil, err
 			}
-			exp, err := m.registry.updateSubnet(ctx, l.Subnet, attrs, ttl, 0)
+			setLeasePool(config, l.Subnet, attrs)
+			exp, err := m.registry.updateSubnet(ctx, l.Subnet, sn6, attrs, ttl, 0)
 			if err != nil {
 				return nil, err
 			}
 
+			l.IPv6Subnet = sn6
 			l.Attrs = *attrs
 			l.Expiration = exp
 			return l, nil
@@ -172,20 +340,30 @@ func (m *LocalManager) tryAcquireLease(ctx context.Context, config *Config, extI
 	if !m.previousSubnet.Empty() {
 		// use previous subnet
 		if l := findLeaseBySubnet(leases, m.previousSubnet); l != nil {
-			// Make sure the existing subnet is still within the configured network
-			if isSubnetConfigCompat(config, l.Subnet) {
+			if isLeaseHeldByOtherNode(l, m.nodeID) {
+				log.Warningf("Found lease (%v) matching previously leased subnet but held by node %v, ignoring", l.Subnet, l.Attrs.NodeID)
+			} else if isCompat(l.Subnet) {
 				log.Infof("Found lease (%v) matching previously leased subnet, reusing", l.Subnet)
 
 				ttl := time.Duration(0)
 				if !l.Expiration.IsZero() {
 					// Not a reservation
-					ttl = subnetTTL
+					ttl = m.leaseTTL
 				}
-				exp, err := m.registry.updateSubnet(ctx, l.Subnet, attrs, ttl, 0)
+				sn6, err := m.ipv6SubnetFor(config, l, leases)
+				if err != nil {
+					return nil, err
+				}
+				if err := checkLeaseOverlap(leases, l.Subnet, sn6); err != nil {
+					return nil, err
+				}
+				setLeasePool(config, l.Subnet, attrs)
+				exp, err := m.registry.updateSubnet(ctx, l.Subnet, sn6, attrs, ttl, 0)
 				if err != nil {
 					return nil, err
 				}
 
+				l.IPv6Subnet = sn6
 				l.Attrs = *attrs
 				l.Expiration = exp
 				return l, nil
@@ -197,29 +375,54 @@ func (m *LocalManager) tryAcquireLease(ctx context.Context, config *Config, extI
 			}
 		} else {
 			// Check if the previous subnet is a part of the network and of the right subnet length
-			if isSubnetConfigCompat(config, m.previousSubnet) {
+			if !isCompat(m.previousSubnet) {
+				log.Errorf("Found previously leased subnet (%v) that is not compatible with the Etcd network config, ignoring", m.previousSubnet)
+			} else if l := findOverlappingLease(leases, m.previousSubnet); l != nil {
+				log.Warningf("Found previously leased subnet (%v) that overlaps the lease (%v) of %v, ignoring", m.previousSubnet, l.Subnet, l.Attrs.PublicIP)
+			} else {
 				log.Infof("Found previously leased subnet (%v), reusing", m.previousSubnet)
 				sn = m.previousSubnet
-			} else {
-				log.Errorf("Found previously leased subnet (%v) that is not compatible with the Etcd network config, ignoring", m.previousSubnet)
 			}
 		}
 	}
 
+	if sn.Empty() {
+		// prefer the subnet this node held last, it is known to peers
+		sn = m.affineSubnet(ctx, config, subnetLen, leases)
+	}
+
 	if sn.Empty() {
 		// no existing match, grab a new one
-		sn, err = m.allocateSubnet(config, leases)
+		sn, err = m.allocateSubnet(config, subnetLen, leases)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var sn6 ip.IP6Net
+	if config.EnableIPv6() {
+		sn6, err = m.allocateIPv6Subnet(config, leases)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	exp, err := m.registry.createSubnet(ctx, sn, attrs, subnetTTL)
+	if err := checkLeaseOverlap(leases, sn, sn6); err != nil {
+		return nil, err
+	}
+
+	setLeasePool(config, sn, attrs)
+	exp, err := m.registry.createSubnet(ctx, sn, sn6, attrs, m.leaseTTL)
 	switch {
 	case err == nil:
-		log.Infof("Allocated lease (%v) to current node (%v) ", sn, extIaddr)
+		if config.EnableIPv6() {
+			log.Infof("Allocated lease (%v, %v) to current node (%v) ", sn, sn6, extIaddr)
+		} else {
+			log.Infof("Allocated lease (%v) to current node (%v) ", sn, extIaddr)
+		}
 		return &Lease{
 			Subnet:     sn,
+			IPv6Subnet: sn6,
 			Attrs:      *attrs,
 			Expiration: exp,
 		}, nil
@@ -230,37 +433,168 @@ func (m *LocalManager) tryAcquireLease(ctx context.Context, config *Config, extI
 	}
 }
 
-func (m *LocalManager) allocateSubnet(config *Config, leases []Lease) (ip.IP4Net, error) {
-	log.Infof("Picking subnet in range %s ... %s", config.SubnetMin, config.SubnetMax)
+// setLeasePool records in attrs the subnet pool of config sn belongs to
+func setLeasePool(config *Config, sn ip.IP4Net, attrs *LeaseAttrs) {
+	attrs.Pool = nil
+	if pool, ok := config.PoolOf(sn); ok {
+		attrs.Pool = &pool.Network
+	}
+}
+
+// affineSubnet returns the subnet last leased to this node if it is free,
+// compatible with config and of subnetLen, and an empty subnet otherwise
+func (m *LocalManager) affineSubnet(ctx context.Context, config *Config, subnetLen uint, leases []Lease) ip.IP4Net {
+	if m.nodeID == "" {
+		return ip.IP4Net{}
+	}
+
+	sn, err := m.registry.getAffinity(ctx, m.nodeID)
+	if err != nil {
+		log.Warningf("Couldn't fetch the subnet last leased to this node (%v): %v", m.nodeID, err)
+		return ip.IP4Net{}
+	}
+	if sn.Empty() {
+		return ip.IP4Net{}
+	}
+
+	if !isSubnetConfigCompat(config, sn) || sn.PrefixLen != subnetLen {
+		log.Infof("Found subnet (%v) last leased to this node but not compatible with current config, ignoring", sn)
+		return ip.IP4Net{}
+	}
+	for _, l := range leases {
+		if sn.Overlaps(l.Subnet) {
+			log.Infof("Found subnet (%v) last leased to this node but it is taken, ignoring", sn)
+			return ip.IP4Net{}
+		}
+	}
+
+	log.Infof("Found subnet (%v) last leased to this node, reusing", sn)
+	return sn
+}
+
+// recordAffinity remembers that sn is leased to this node. Failures only
+// cost the preference on the next acquire, so they are just logged.
+func (m *LocalManager) recordAffinity(ctx context.Context, sn ip.IP4Net) {
+	if m.nodeID == "" {
+		return
+	}
+
+	if err := m.registry.setAffinity(ctx, m.nodeID, sn); err != nil {
+		log.Warningf("Couldn't record subnet (%v) as leased to this node (%v): %v", sn, m.nodeID, err)
+	}
+}
+
+// allocateSubnet picks a free subnet of subnetLen from the first of the
+// subnet pools which has one. Subnets are aligned to their length and lie
+// between SubnetMin and the end of the subnet at SubnetMax of their pool,
+// leases of any length take up the addresses they cover.
+func (m *LocalManager) allocateSubnet(config *Config, subnetLen uint, leases []Lease) (ip.IP4Net, error) {
+	pools := config.SubnetPools()
+	var err error
+	for i, pool := range pools {
+		var sn ip.IP4Net
+		if sn, err = allocatePoolSubnet(config, pool, subnetLen, leases); err == nil {
+			return sn, nil
+		}
+		if i < len(pools)-1 {
+			log.Infof("No free /%d subnet left in pool %s, trying pool %s", subnetLen, pool.Network, pools[i+1].Network)
+		}
+	}
+	if len(pools) > 1 {
+		return ip.IP4Net{}, fmt.Errorf("out of subnets: no free /%d subnet in networks %v", subnetLen, config.Networks())
+	}
+	return ip.IP4Net{}, err
+}
+
+// allocatePoolSubnet picks a free subnet of subnetLen in pool
+func allocatePoolSubnet(config *Config, pool SubnetPool, subnetLen uint, leases []Lease) (ip.IP4Net, error) {
+	log.Infof("Picking /%d subnet in range %s ... %s", subnetLen, pool.SubnetMin, pool.SubnetMax)
 
 	var bag []ip.IP4
-	sn := ip.IP4Net{IP: config.SubnetMin, PrefixLen: config.SubnetLen}
+	size := uint64(1) << (32 - subnetLen)
+	// round SubnetMin up to a subnetLen boundary, in 64 bits so that the
+	// subnets at the top of the address space don't wrap around
+	start := (uint64(pool.SubnetMin) + size - 1) &^ (size - 1)
+	end := uint64(pool.RangeEnd(config.SubnetLen))
 
 OuterLoop:
-	for ; sn.IP <= config.SubnetMax && len(bag) < 100; sn = sn.Next() {
+	for addr := start; addr+size-1 <= end && len(bag) < 100; addr += size {
+		sn := ip.IP4Net{IP: ip.IP4(addr), PrefixLen: subnetLen}
 		for _, l := range leases {
 			if sn.Overlaps(l.Subnet) {
+				allocatorLogger.V(3).Infof("Subnet %v overlaps lease (%v), skipping", sn, l.Subnet)
 				continue OuterLoop
 			}
 		}
 		bag = append(bag, sn.IP)
 	}
 
+	allocatorLogger.V(2).Infof("Picking among %d free /%d subnets in range %s ... %s, %d leases taken", len(bag), subnetLen, pool.SubnetMin, pool.SubnetMax, len(leases))
 	if len(bag) == 0 {
-		return ip.IP4Net{}, errors.New("out of subnets")
+		return ip.IP4Net{}, fmt.Errorf("out of subnets: no free /%d subnet in range %s ... %s", subnetLen, pool.SubnetMin, pool.SubnetMax)
 	} else {
 		i := randInt(0, len(bag))
-		return ip.IP4Net{IP: bag[i], PrefixLen: config.SubnetLen}, nil
+		return ip.IP4Net{IP: bag[i], PrefixLen: subnetLen}, nil
+	}
+}
+
+// ipv6SubnetFor returns the IPv6 subnet to use when reusing lease l: its
+// current one if it is still compatible with the config, otherwise a newly
+// allocated one. It is empty if the network has no IPv6Network.
+func (m *LocalManager) ipv6SubnetFor(config *Config, l *Lease, leases []Lease) (ip.IP6Net, error) {
+	if !config.EnableIPv6() {
+		return ip.IP6Net{}, nil
+	}
+
+	if isIPv6SubnetConfigCompat(config, l.IPv6Subnet) {
+		return l.IPv6Subnet, nil
+	}
+
+	if !l.IPv6Subnet.Empty() {
+		log.Infof("Found IPv6 subnet (%v) for lease (%v) but not compatible with current config, replacing", l.IPv6Subnet, l.Subnet)
+	}
+	return m.allocateIPv6Subnet(config, leases)
+}
+
+func (m *LocalManager) allocateIPv6Subnet(config *Config, leases []Lease) (ip.IP6Net, error) {
+	log.Infof("Picking IPv6 subnet in range %s ... %s", config.IPv6SubnetMin, config.IPv6SubnetMax)
+
+	var bag []ip.IP6
+	sn := ip.IP6Net{IP: config.IPv6SubnetMin, PrefixLen: config.IPv6SubnetLen}
+
+OuterLoop:
+	for ; sn.IP.Cmp(config.IPv6SubnetMax) <= 0 && len(bag) < 100; sn = sn.Next() {
+		for _, l := range leases {
+			if !l.IPv6Subnet.Empty() && sn.Overlaps(l.IPv6Subnet) {
+				continue OuterLoop
+			}
+		}
+		bag = append(bag, sn.IP)
+	}
+
+	if len(bag) == 0 {
+		return ip.IP6Net{}, errors.New("out of IPv6 subnets")
+	} else {
+		i := randInt(0, len(bag))
+		return ip.IP6Net{IP: bag[i], PrefixLen: config.IPv6SubnetLen}, nil
 	}
 }
 
 func (m *LocalManager) RenewLease(ctx context.Context, lease *Lease) error {
-	exp, err := m.registry.updateSubnet(ctx, lease.Subnet, &lease.Attrs, subnetTTL, 0)
+	exp, err := m.registry.updateSubnet(ctx, lease.Subnet, lease.IPv6Subnet, &lease.Attrs, m.leaseTTL, 0)
 	if err != nil {
+		leaseRenewalFailures.Inc()
 		return err
 	}
 
 	lease.Expiration = exp
+	setLocalLeaseExpiration(exp)
+
+	// Renewals are rare enough to also refresh the lease counts, which
+	// otherwise only change for backends watching the leases
+	if leases, _, err := m.registry.getSubnets(ctx); err == nil {
+		m.metrics.setLeases(leases)
+	}
 	return nil
 }
 
@@ -304,12 +638,12 @@ func (m *LocalManager) WatchLease(ctx context.Context, sn ip.IP4Net, cursor inte
 		return LeaseWatchResult{}, err
 	}
 
-	evt, index, err := m.registry.watchSubnet(ctx, nextIndex, sn)
+	evts, index, err := m.registry.watchSubnet(ctx, nextIndex, sn)
 
 	switch {
 	case err == nil:
 		return LeaseWatchResult{
-			Events: []Event{evt},
+			Events: evts,
 			Cursor: watchCursor{index},
 		}, nil
 
@@ -332,12 +666,15 @@ func (m *LocalManager) WatchLeases(ctx context.Context, cursor interface{}) (Lea
 		return LeaseWatchResult{}, err
 	}
 
-	evt, index, err := m.registry.watchSubnets(ctx, nextIndex)
+	evts, index, err := m.registry.watchSubnets(ctx, nextIndex)
 
 	switch {
 	case err == nil:
+		for _, evt := range evts {
+			m.metrics.handleEvent(evt)
+		}
 		return LeaseWatchResult{
-			Events: []Event{evt},
+			Events: evts,
 			Cursor: watchCursor{index},
 		}, nil
 
@@ -364,17 +701,30 @@ func (m *LocalManager) leasesWatchReset(ctx context.Context) (LeaseWatchResult,
 		return wr, fmt.Errorf("failed to retrieve subnet leases: %v", err)
 	}
 
+	m.metrics.setLeases(leases)
+
 	wr.Cursor = watchCursor{index}
 	wr.Snapshot = leases
 	return wr, nil
 }
 
+// isSubnetConfigCompat reports whether sn is within the range of one of the
+// subnet pools of config and of a length nodes may request
 func isSubnetConfigCompat(config *Config, sn ip.IP4Net) bool {
-	if sn.IP < config.SubnetMin || sn.IP > config.SubnetMax {
+	min, max := config.SubnetLenRange()
+	if sn.PrefixLen < min || sn.PrefixLen > max {
 		return false
 	}
+	_, ok := config.PoolOf(sn)
+	return ok
+}
 
-	return sn.PrefixLen == config.SubnetLen
+func isIPv6SubnetConfigCompat(config *Config, sn ip.IP6Net) bool {
+	if sn.IP.Cmp(config.IPv6SubnetMin) < 0 || sn.IP.Cmp(config.IPv6SubnetMax) > 0 {
+		return false
+	}
+
+	return sn.PrefixLen == config.IPv6SubnetLen
 }
 
 func (m *LocalManager) Name() string {
@@ -382,5 +732,8 @@ func (m *LocalManager) Name() string {
 	if m.previousSubnet.Empty() {
 		previousSubnet = "None"
 	}
+	if m.nodeID != "" {
+		return fmt.Sprintf("Etcd Local Manager with Previous Subnet: %s, Node ID: %s", previousSubnet, m.nodeID)
+	}
 	return fmt.Sprintf("Etcd Local Manager with Previous Subnet: %s", previousSubnet)
 }
@@ -0,0 +1,179 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcdv2
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/coreos/flannel/pkg/ip"
+	. "github.com/coreos/flannel/subnet"
+)
+
+var (
+	leasesGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "flannel",
+			Subsystem: "subnet",
+			Name:      "leases",
+			Help:      "Number of subnet leases in the network, including reservations.",
+		},
+	)
+
+	freeSubnetsGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "flannel",
+			Subsystem: "subnet",
+			Name:      "free_subnets",
+			Help:      "Number of subnets between SubnetMin and SubnetMax, and in the SecondaryNetworks, which are not leased.",
+		},
+	)
+
+	localLeaseExpiryGauge = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: "flannel",
+			Subsystem: "subnet",
+			Name:      "local_lease_expiry_seconds",
+			Help:      "Seconds until the lease of this node expires, 0 if there is none or it is a reservation.",
+		},
+		localLeaseExpiry,
+	)
+
+	leaseRenewalFailures = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "flannel",
+			Subsystem: "subnet",
+			Name:      "lease_renewal_failures_total",
+			Help:      "Number of failed attempts to renew the lease of this node.",
+		},
+	)
+
+	registerMetricsOnce sync.Once
+
+	localLeaseMu         sync.Mutex
+	localLeaseExpiration time.Time
+)
+
+// registerMetrics registers the lease metrics with the default registry. It
+// is called when the manager is created so that it only happens once, and only
+// when the etcd subnet manager is in use.
+func registerMetrics() {
+	registerMetricsOnce.Do(func() {
+		prometheus.MustRegister(leasesGauge, freeSubnetsGauge, localLeaseExpiryGauge, leaseRenewalFailures)
+	})
+}
+
+func setLocalLeaseExpiration(exp time.Time) {
+	localLeaseMu.Lock()
+	defer localLeaseMu.Unlock()
+	localLeaseExpiration = exp
+}
+
+func localLeaseExpiry() float64 {
+	localLeaseMu.Lock()
+	defer localLeaseMu.Unlock()
+
+	if localLeaseExpiration.IsZero() {
+		return 0
+	}
+	if ttl := localLeaseExpiration.Sub(clock.Now()); ttl > 0 {
+		return ttl.Seconds()
+	}
+	return 0
+}
+
+// leaseMetrics keeps the set of leased subnets up to date from snapshots and
+// watch events, and sets the lease gauges from it
+type leaseMetrics struct {
+	mu      sync.Mutex
+	config  *Config
+	subnets map[ip.IP4Net]bool
+}
+
+func (lm *leaseMetrics) setConfig(config *Config) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	lm.config = config
+	lm.update()
+}
+
+// setLeases replaces the set of leased subnets with those of leases
+func (lm *leaseMetrics) setLeases(leases []Lease) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	lm.subnets = make(map[ip.IP4Net]bool, len(leases))
+	for _, l := range leases {
+		lm.subnets[l.Subnet] = true
+	}
+	lm.update()
+}
+
+func (lm *leaseMetrics) handleEvent(evt Event) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	if lm.subnets == nil {
+		lm.subnets = make(map[ip.IP4Net]bool)
+	}
+	switch evt.Type {
+	case EventAdded:
+		lm.subnets[evt.Lease.Subnet] = true
+	case EventRemoved:
+		delete(lm.subnets, evt.Lease.Subnet)
+	}
+	lm.update()
+}
+
+// update sets the gauges, lm.mu must be held
+func (lm *leaseMetrics) update() {
+	leasesGauge.Set(float64(len(lm.subnets)))
+	if lm.config != nil {
+		freeSubnetsGauge.Set(float64(lm.freeSubnets()))
+	}
+}
+
+// freeSubnets returns the number of subnets of SubnetLen the allocator could
+// still hand out, lm.mu must be held. Leases of other lengths take up every
+// such subnet they overlap.
+func (lm *leaseMetrics) freeSubnets() int {
+	taken := make(map[ip.IP4]bool)
+	size := uint64(1) << (32 - lm.config.SubnetLen)
+	for sn := range lm.subnets {
+		if !isSubnetConfigCompat(lm.config, sn) {
+			continue
+		}
+		last := uint64(sn.IP) + uint64(1)<<(32-sn.PrefixLen) - 1
+		for addr := uint64(sn.IP) &^ (size - 1); addr <= last; addr += size {
+			taken[ip.IP4(addr)] = true
+		}
+	}
+	return subnetCapacity(lm.config) - len(taken)
+}
+
+// subnetCapacity returns the number of subnets of SubnetLen between
+// SubnetMin and SubnetMax of each subnet pool
+func subnetCapacity(config *Config) int {
+	capacity := 0
+	for _, pool := range config.SubnetPools() {
+		if pool.SubnetMax >= pool.SubnetMin {
+			capacity += int(uint32(pool.SubnetMax-pool.SubnetMin)>>(32-config.SubnetLen)) + 1
+		}
+	}
+	return capacity
+}
@@ -0,0 +1,124 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcdv2
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	. "github.com/coreos/flannel/subnet"
+)
+
+func TestLeaseMetrics(t *testing.T) {
+	config, err := ParseConfig(`{ "Network": "10.3.0.0/16", "SubnetMin": "10.3.1.0", "SubnetMax": "10.3.25.0" }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := subnetCapacity(config); c != 25 {
+		t.Fatalf("expected a capacity of 25 subnets, got %d", c)
+	}
+
+	var lm leaseMetrics
+	lm.setConfig(config)
+	lm.setLeases(newDummyRegistry().network.subnets)
+	if got := testutil.ToFloat64(leasesGauge); got != 5 {
+		t.Errorf("expected 5 leases, got %v", got)
+	}
+	// one of the leases is outside SubnetMin-SubnetMax
+	if got := testutil.ToFloat64(freeSubnetsGauge); got != 21 {
+		t.Errorf("expected 21 free subnets, got %v", got)
+	}
+
+	sn := ip.IP4Net{IP: ip.MustParseIP4("10.3.9.0"), PrefixLen: 24}
+	lm.handleEvent(Event{Type: EventAdded, Lease: Lease{Subnet: sn}})
+	if got := testutil.ToFloat64(freeSubnetsGauge); got != 20 {
+		t.Errorf("expected 20 free subnets after an add, got %v", got)
+	}
+	lm.handleEvent(Event{Type: EventRemoved, Lease: Lease{Subnet: sn}})
+	if got := testutil.ToFloat64(freeSubnetsGauge); got != 21 {
+		t.Errorf("expected 21 free subnets after a remove, got %v", got)
+	}
+
+	// leases of other lengths take up the subnets they overlap
+	config, err = ParseConfig(`{ "Network": "10.3.0.0/16", "SubnetMin": "10.3.1.0", "SubnetMax": "10.3.25.0", "SubnetLenMin": 22, "SubnetLenMax": 26 }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lm.setConfig(config)
+	lm.setLeases([]Lease{
+		{Subnet: ip.IP4Net{IP: ip.MustParseIP4("10.3.4.0"), PrefixLen: 22}},
+		{Subnet: ip.IP4Net{IP: ip.MustParseIP4("10.3.9.0"), PrefixLen: 26}},
+		{Subnet: ip.IP4Net{IP: ip.MustParseIP4("10.3.9.64"), PrefixLen: 26}},
+	})
+	if got := testutil.ToFloat64(freeSubnetsGauge); got != 20 {
+		t.Errorf("expected 20 free subnets with variable length leases, got %v", got)
+	}
+
+	// the secondary networks add to the capacity, without their first subnet
+	config, err = ParseConfig(`{ "Network": "10.3.0.0/16", "SubnetMin": "10.3.1.0", "SubnetMax": "10.3.25.0", "SecondaryNetworks": ["10.5.0.0/22"] }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := subnetCapacity(config); c != 28 {
+		t.Fatalf("expected a capacity of 28 subnets, got %d", c)
+	}
+	lm.setConfig(config)
+	lm.setLeases([]Lease{
+		{Subnet: ip.IP4Net{IP: ip.MustParseIP4("10.3.4.0"), PrefixLen: 24}},
+		{Subnet: ip.IP4Net{IP: ip.MustParseIP4("10.5.1.0"), PrefixLen: 24}},
+	})
+	if got := testutil.ToFloat64(freeSubnetsGauge); got != 26 {
+		t.Errorf("expected 26 free subnets with secondary networks, got %v", got)
+	}
+}
+
+func TestLocalLeaseMetrics(t *testing.T) {
+	fakeClock := clockwork.NewFakeClock()
+	clock = fakeClock
+	defer func() { clock = clockwork.NewRealClock() }()
+
+	msr := newDummyRegistry()
+	sm := NewMockManager(msr)
+
+	attrs := LeaseAttrs{
+		PublicIP: ip.MustParseIP4("1.2.3.4"),
+	}
+	l, err := sm.AcquireLease(context.Background(), &attrs)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if got := localLeaseExpiry(); got != subnetTTL.Seconds() {
+		t.Errorf("expected the local lease to expire in %v, got %vs", subnetTTL, got)
+	}
+
+	fakeClock.Advance(time.Hour)
+	if got := localLeaseExpiry(); got != (subnetTTL - time.Hour).Seconds() {
+		t.Errorf("expected the local lease to expire in %v, got %vs", subnetTTL-time.Hour, got)
+	}
+
+	before := testutil.ToFloat64(leaseRenewalFailures)
+	msr.expireSubnet("_", l.Subnet)
+	if err := sm.RenewLease(context.Background(), l); err == nil {
+		t.Fatal("expected renewing an expired lease to fail")
+	}
+	if got := testutil.ToFloat64(leaseRenewalFailures); got != before+1 {
+		t.Errorf("expected the renewal failure to be counted, got %v", got)
+	}
+}
@@ -68,9 +68,12 @@ type event struct {
 }
 
 type MockSubnetRegistry struct {
-	mux     sync.Mutex
-	network *netwk
-	index   uint64
+	mux        sync.Mutex
+	network    *netwk
+	index      uint64
+	affinities map[string]ip.IP4Net
+	// locks are the holders of the node locks, which don't expire
+	locks map[string]string
 }
 
 func NewMockRegistry(config string, initialSubnets []Lease) *MockSubnetRegistry {
@@ -81,6 +84,8 @@ func NewMockRegistry(config string, initialSubnets []Lease) *MockSubnetRegistry
 			subnets:       initialSubnets,
 			subnetsEvents: make(chan event, 1000),
 			subnetEvents:  make(map[ip.IP4Net]chan event)},
+		affinities: make(map[string]ip.IP4Net),
+		locks:      make(map[string]string),
 	}
 
 	return msr
@@ -116,7 +121,7 @@ func (msr *MockSubnetRegistry) getSubnet(ctx context.Context, sn ip.IP4Net) (*Le
 	return nil, msr.index, fmt.Errorf("subnet %s not found", sn)
 }
 
-func (msr *MockSubnetRegistry) createSubnet(ctx context.Context, sn ip.IP4Net, attrs *LeaseAttrs, ttl time.Duration) (time.Time, error) {
+func (msr *MockSubnetRegistry) createSubnet(ctx context.Context, sn ip.IP4Net, sn6 ip.IP6Net, attrs *LeaseAttrs, ttl time.Duration) (time.Time, error) {
 	msr.mux.Lock()
 	defer msr.mux.Unlock()
 
@@ -137,6 +142,7 @@ func (msr *MockSubnetRegistry) createSubnet(ctx context.Context, sn ip.IP4Net, a
 
 	l := Lease{
 		Subnet:     sn,
+		IPv6Subnet: sn6,
 		Attrs:      *attrs,
 		Expiration: exp,
 		Asof:       msr.index,
@@ -153,7 +159,7 @@ func (msr *MockSubnetRegistry) createSubnet(ctx context.Context, sn ip.IP4Net, a
 	return exp, nil
 }
 
-func (msr *MockSubnetRegistry) updateSubnet(ctx context.Context, sn ip.IP4Net, attrs *LeaseAttrs, ttl time.Duration, asof uint64) (time.Time, error) {
+func (msr *MockSubnetRegistry) updateSubnet(ctx context.Context, sn ip.IP4Net, sn6 ip.IP6Net, attrs *LeaseAttrs, ttl time.Duration, asof uint64) (time.Time, error) {
 	msr.mux.Lock()
 	defer msr.mux.Unlock()
 
@@ -169,6 +175,14 @@ func (msr *MockSubnetRegistry) updateSubnet(ctx context.Context, sn ip.IP4Net, a
 		return time.Time{}, err
 	}
 
+	if asof != 0 && sub.Asof != asof {
+		return time.Time{}, etcd.Error{
+			Code:  etcd.ErrorCodeTestFailed,
+			Index: msr.index,
+		}
+	}
+
+	sub.IPv6Subnet = sn6
 	sub.Attrs = *attrs
 	sub.Asof = msr.index
 	sub.Expiration = exp
@@ -207,14 +221,14 @@ func (msr *MockSubnetRegistry) deleteSubnet(ctx context.Context, sn ip.IP4Net) e
 	return nil
 }
 
-func (msr *MockSubnetRegistry) watchSubnets(ctx context.Context, since uint64) (Event, uint64, error) {
+func (msr *MockSubnetRegistry) watchSubnets(ctx context.Context, since uint64) ([]Event, uint64, error) {
 	for {
 		msr.mux.Lock()
 		index := msr.index
 		msr.mux.Unlock()
 
 		if since < index {
-			return Event{}, 0, etcd.Error{
+			return nil, 0, etcd.Error{
 				Code:    etcd.ErrorCodeEventIndexCleared,
 				Cause:   "out of date",
 				Message: "cursor is out of date",
@@ -224,24 +238,24 @@ func (msr *MockSubnetRegistry) watchSubnets(ctx context.Context, since uint64) (
 
 		select {
 		case <-ctx.Done():
-			return Event{}, 0, ctx.Err()
+			return nil, 0, ctx.Err()
 
 		case e := <-msr.network.subnetsEvents:
 			if e.index > since {
-				return e.evt, e.index, nil
+				return []Event{e.evt}, e.index, nil
 			}
 		}
 	}
 }
 
-func (msr *MockSubnetRegistry) watchSubnet(ctx context.Context, since uint64, sn ip.IP4Net) (Event, uint64, error) {
+func (msr *MockSubnetRegistry) watchSubnet(ctx context.Context, since uint64, sn ip.IP4Net) ([]Event, uint64, error) {
 	for {
 		msr.mux.Lock()
 		index := msr.index
 		msr.mux.Unlock()
 
 		if since < index {
-			return Event{}, msr.index, etcd.Error{
+			return nil, msr.index, etcd.Error{
 				Code:    etcd.ErrorCodeEventIndexCleared,
 				Cause:   "out of date",
 				Message: "cursor is out of date",
@@ -251,11 +265,11 @@ func (msr *MockSubnetRegistry) watchSubnet(ctx context.Context, since uint64, sn
 
 		select {
 		case <-ctx.Done():
-			return Event{}, index, ctx.Err()
+			return nil, index, ctx.Err()
 
 		case e := <-msr.network.subnetEventsChan(sn):
 			if e.index > since {
-				return e.evt, index, nil
+				return []Event{e.evt}, index, nil
 			}
 		}
 	}
@@ -276,6 +290,42 @@ func (msr *MockSubnetRegistry) expireSubnet(network string, sn ip.IP4Net) {
 	}
 }
 
+func (msr *MockSubnetRegistry) getAffinity(ctx context.Context, nodeID string) (ip.IP4Net, error) {
+	msr.mux.Lock()
+	defer msr.mux.Unlock()
+
+	return msr.affinities[nodeID], nil
+}
+
+func (msr *MockSubnetRegistry) setAffinity(ctx context.Context, nodeID string, sn ip.IP4Net) error {
+	msr.mux.Lock()
+	defer msr.mux.Unlock()
+
+	msr.affinities[nodeID] = sn
+	return nil
+}
+
+func (msr *MockSubnetRegistry) lockNode(ctx context.Context, nodeID, holder string, ttl time.Duration) (string, error) {
+	msr.mux.Lock()
+	defer msr.mux.Unlock()
+
+	if owner, ok := msr.locks[nodeID]; ok {
+		return owner, nil
+	}
+	msr.locks[nodeID] = holder
+	return holder, nil
+}
+
+func (msr *MockSubnetRegistry) unlockNode(ctx context.Context, nodeID, holder string) error {
+	msr.mux.Lock()
+	defer msr.mux.Unlock()
+
+	if msr.locks[nodeID] == holder {
+		delete(msr.locks, nodeID)
+	}
+	return nil
+}
+
 func (msr *MockSubnetRegistry) getNetwork(ctx context.Context) (*netwk, error) {
 	return msr.network, nil
 }
@@ -20,9 +20,13 @@ import (
 )
 
 func NewMockManager(registry *MockSubnetRegistry) subnet.Manager {
-	return newLocalManager(registry, ip.IP4Net{})
+	return newLocalManager(registry, ip.IP4Net{}, "")
 }
 
 func NewMockManagerWithSubnet(registry *MockSubnetRegistry, sn ip.IP4Net) subnet.Manager {
-	return newLocalManager(registry, sn)
+	return newLocalManager(registry, sn, "")
+}
+
+func NewMockManagerWithNodeID(registry *MockSubnetRegistry, sn ip.IP4Net, nodeID string) subnet.Manager {
+	return newLocalManager(registry, sn, nodeID)
 }
@@ -0,0 +1,115 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcdv2
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+const (
+	// nodeLockTTL is how long a node lock lasts unless refreshed, it is
+	// refreshed or retried every third of it
+	nodeLockTTL = time.Minute
+	// nodeUnlockTimeout bounds releasing the lock once flannel stops
+	nodeUnlockTimeout = 10 * time.Second
+)
+
+// lockHolder returns an identity for this flannel process, which tells the
+// operator where a lock is held
+func lockHolder() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s/%d/%x", hostname, os.Getpid(), rnd.Int63())
+}
+
+// LockNode locks the node ID of m, see subnet.NodeLocker. While the lock is
+// held by someone else, it is retried until they release it or it expires.
+func (m *LocalManager) LockNode(ctx context.Context, wg *sync.WaitGroup) (<-chan struct{}, error) {
+	if m.nodeID == "" {
+		return nil, errors.New("locking the node requires a node ID")
+	}
+
+	holder := lockHolder()
+	owner := ""
+	for {
+		current, err := m.registry.lockNode(ctx, m.nodeID, holder, m.lockTTL)
+		switch {
+		case err != nil:
+			log.Warningf("Couldn't lock node %v, retrying: %v", m.nodeID, err)
+		case current == holder:
+			log.Infof("Locked node %v as %v", m.nodeID, holder)
+			lost := make(chan struct{})
+			wg.Add(1)
+			go func() {
+				m.holdNodeLock(ctx, holder, lost)
+				wg.Done()
+			}()
+			return lost, nil
+		case current != owner:
+			log.Warningf("Node %v is locked by %v, another flannel seems to be running for this node, waiting for it to stop", m.nodeID, current)
+			owner = current
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-clock.After(m.lockTTL / 3):
+		}
+	}
+}
+
+// holdNodeLock refreshes the lock of holder until ctx is done, then releases
+// it. lost is closed if someone else took the lock, or it couldn't be
+// refreshed before it expired.
+func (m *LocalManager) holdNodeLock(ctx context.Context, holder string, lost chan struct{}) {
+	refreshed := clock.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			uctx, cancel := context.WithTimeout(context.Background(), nodeUnlockTimeout)
+			defer cancel()
+			if err := m.registry.unlockNode(uctx, m.nodeID, holder); err != nil {
+				log.Warningf("Couldn't release the lock on node %v, it expires in %v: %v", m.nodeID, m.lockTTL, err)
+			}
+			return
+		case <-clock.After(m.lockTTL / 3):
+		}
+
+		current, err := m.registry.lockNode(ctx, m.nodeID, holder, m.lockTTL)
+		switch {
+		case err == nil && current == holder:
+			refreshed = clock.Now()
+			continue
+		case ctx.Err() != nil:
+			// released above
+			continue
+		case err == nil:
+			log.Errorf("Lost the lock on node %v to %v", m.nodeID, current)
+		case clock.Now().Sub(refreshed) < m.lockTTL:
+			log.Warningf("Couldn't refresh the lock on node %v, retrying: %v", m.nodeID, err)
+			continue
+		default:
+			log.Errorf("Lost the lock on node %v, it couldn't be refreshed for %v: %v", m.nodeID, m.lockTTL, err)
+		}
+		close(lost)
+		return
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/url"
 	"path"
 	"regexp"
 	"sync"
@@ -40,11 +41,24 @@ type Registry interface {
 	getNetworkConfig(ctx context.Context) (string, error)
 	getSubnets(ctx context.Context) ([]Lease, uint64, error)
 	getSubnet(ctx context.Context, sn ip.IP4Net) (*Lease, uint64, error)
-	createSubnet(ctx context.Context, sn ip.IP4Net, attrs *LeaseAttrs, ttl time.Duration) (time.Time, error)
-	updateSubnet(ctx context.Context, sn ip.IP4Net, attrs *LeaseAttrs, ttl time.Duration, asof uint64) (time.Time, error)
+	createSubnet(ctx context.Context, sn ip.IP4Net, sn6 ip.IP6Net, attrs *LeaseAttrs, ttl time.Duration) (time.Time, error)
+	updateSubnet(ctx context.Context, sn ip.IP4Net, sn6 ip.IP6Net, attrs *LeaseAttrs, ttl time.Duration, asof uint64) (time.Time, error)
 	deleteSubnet(ctx context.Context, sn ip.IP4Net) error
-	watchSubnets(ctx context.Context, since uint64) (Event, uint64, error)
-	watchSubnet(ctx context.Context, since uint64, sn ip.IP4Net) (Event, uint64, error)
+	// watchSubnets and watchSubnet return the changes to the leases, or
+	// to the lease of sn, at the first index after since which has any,
+	// and that index
+	watchSubnets(ctx context.Context, since uint64) ([]Event, uint64, error)
+	watchSubnet(ctx context.Context, since uint64, sn ip.IP4Net) ([]Event, uint64, error)
+	// getAffinity returns the subnet last leased to the node, or an empty
+	// subnet if there is none. Affinities outlive the leases.
+	getAffinity(ctx context.Context, nodeID string) (ip.IP4Net, error)
+	setAffinity(ctx context.Context, nodeID string, sn ip.IP4Net) error
+	// lockNode takes or refreshes the lock on nodeID for holder, which
+	// expires after ttl unless refreshed again. It returns the holder of
+	// the lock, which is someone else if they hold it.
+	lockNode(ctx context.Context, nodeID, holder string, ttl time.Duration) (string, error)
+	// unlockNode releases the lock on nodeID if holder holds it
+	unlockNode(ctx context.Context, nodeID, holder string) error
 }
 
 type EtcdConfig struct {
@@ -55,6 +69,65 @@ type EtcdConfig struct {
 	Prefix    string
 	Username  string
 	Password  string
+	// APIVersion selects the etcd API, 2 or 3. Defaults to 2.
+	APIVersion int
+	// LeaseTTL is how long subnet leases last. Defaults to DefaultLeaseTTL.
+	LeaseTTL time.Duration
+	// SubnetLen is the length of the subnet to lease to this node, within
+	// the SubnetLenMin and SubnetLenMax of the network config. Defaults to
+	// its SubnetLen.
+	SubnetLen uint
+}
+
+// leaseValue is the value stored under a subnet key. The IPv6 subnet is
+// stored alongside the lease attributes so that the key, and so the value
+// for networks without IPv6, is unchanged.
+type leaseValue struct {
+	LeaseAttrs
+	IPv6Subnet *ip.IP6Net `json:",omitempty"`
+}
+
+func encodeLeaseValue(sn6 ip.IP6Net, attrs *LeaseAttrs) (string, error) {
+	lv := leaseValue{LeaseAttrs: *attrs}
+	if !sn6.Empty() {
+		lv.IPv6Subnet = &sn6
+	}
+	value, err := json.Marshal(&lv)
+	return string(value), err
+}
+
+func decodeLeaseValue(value string) (*LeaseAttrs, ip.IP6Net, error) {
+	lv := &leaseValue{}
+	if err := json.Unmarshal([]byte(value), lv); err != nil {
+		return nil, ip.IP6Net{}, err
+	}
+
+	var sn6 ip.IP6Net
+	if lv.IPv6Subnet != nil {
+		sn6 = *lv.IPv6Subnet
+	}
+	return &lv.LeaseAttrs, sn6, nil
+}
+
+// makeAffinityKey returns the key, under the affinity "directory", of the
+// subnet last leased to nodeID
+func makeAffinityKey(nodeID string) string {
+	return url.PathEscape(nodeID)
+}
+
+// makeLockKey returns the key, under the locks "directory", of the lock on
+// nodeID
+func makeLockKey(nodeID string) string {
+	return url.PathEscape(nodeID)
+}
+
+// parseAffinityValue parses the subnet stored under an affinity key
+func parseAffinityValue(value string) (ip.IP4Net, error) {
+	sn := ParseSubnetKey(value)
+	if sn == nil {
+		return ip.IP4Net{}, fmt.Errorf("failed to parse subnet affinity %q", value)
+	}
+	return *sn, nil
 }
 
 type etcdNewFunc func(c *EtcdConfig) (etcd.KeysAPI, error)
@@ -160,9 +233,9 @@ func (esr *etcdSubnetRegistry) getSubnet(ctx context.Context, sn ip.IP4Net) (*Le
 	return l, resp.Index, err
 }
 
-func (esr *etcdSubnetRegistry) createSubnet(ctx context.Context, sn ip.IP4Net, attrs *LeaseAttrs, ttl time.Duration) (time.Time, error) {
+func (esr *etcdSubnetRegistry) createSubnet(ctx context.Context, sn ip.IP4Net, sn6 ip.IP6Net, attrs *LeaseAttrs, ttl time.Duration) (time.Time, error) {
 	key := path.Join(esr.etcdCfg.Prefix, "subnets", MakeSubnetKey(sn))
-	value, err := json.Marshal(attrs)
+	value, err := encodeLeaseValue(sn6, attrs)
 	if err != nil {
 		return time.Time{}, err
 	}
@@ -172,7 +245,7 @@ func (esr *etcdSubnetRegistry) createSubnet(ctx context.Context, sn ip.IP4Net, a
 		TTL:       ttl,
 	}
 
-	resp, err := esr.client().Set(ctx, key, string(value), opts)
+	resp, err := esr.client().Set(ctx, key, value, opts)
 	if err != nil {
 		return time.Time{}, err
 	}
@@ -185,14 +258,14 @@ func (esr *etcdSubnetRegistry) createSubnet(ctx context.Context, sn ip.IP4Net, a
 	return exp, nil
 }
 
-func (esr *etcdSubnetRegistry) updateSubnet(ctx context.Context, sn ip.IP4Net, attrs *LeaseAttrs, ttl time.Duration, asof uint64) (time.Time, error) {
+func (esr *etcdSubnetRegistry) updateSubnet(ctx context.Context, sn ip.IP4Net, sn6 ip.IP6Net, attrs *LeaseAttrs, ttl time.Duration, asof uint64) (time.Time, error) {
 	key := path.Join(esr.etcdCfg.Prefix, "subnets", MakeSubnetKey(sn))
-	value, err := json.Marshal(attrs)
+	value, err := encodeLeaseValue(sn6, attrs)
 	if err != nil {
 		return time.Time{}, err
 	}
 
-	resp, err := esr.client().Set(ctx, key, string(value), &etcd.SetOptions{
+	resp, err := esr.client().Set(ctx, key, value, &etcd.SetOptions{
 		PrevIndex: asof,
 		TTL:       ttl,
 	})
@@ -214,7 +287,55 @@ func (esr *etcdSubnetRegistry) deleteSubnet(ctx context.Context, sn ip.IP4Net) e
 	return err
 }
 
-func (esr *etcdSubnetRegistry) watchSubnets(ctx context.Context, since uint64) (Event, uint64, error) {
+func (esr *etcdSubnetRegistry) getAffinity(ctx context.Context, nodeID string) (ip.IP4Net, error) {
+	key := path.Join(esr.etcdCfg.Prefix, "affinity", makeAffinityKey(nodeID))
+	resp, err := esr.client().Get(ctx, key, &etcd.GetOptions{Quorum: true})
+	if err != nil {
+		if etcdErr, ok := err.(etcd.Error); ok && etcdErr.Code == etcd.ErrorCodeKeyNotFound {
+			return ip.IP4Net{}, nil
+		}
+		return ip.IP4Net{}, err
+	}
+	return parseAffinityValue(resp.Node.Value)
+}
+
+func (esr *etcdSubnetRegistry) setAffinity(ctx context.Context, nodeID string, sn ip.IP4Net) error {
+	key := path.Join(esr.etcdCfg.Prefix, "affinity", makeAffinityKey(nodeID))
+	_, err := esr.client().Set(ctx, key, MakeSubnetKey(sn), nil)
+	return err
+}
+
+func (esr *etcdSubnetRegistry) lockNode(ctx context.Context, nodeID, holder string, ttl time.Duration) (string, error) {
+	key := path.Join(esr.etcdCfg.Prefix, "locks", makeLockKey(nodeID))
+	_, err := esr.client().Set(ctx, key, holder, &etcd.SetOptions{PrevExist: etcd.PrevNoExist, TTL: ttl})
+	if etcdErr, ok := err.(etcd.Error); ok && etcdErr.Code == etcd.ErrorCodeNodeExist {
+		// refresh the lock if it is ours
+		_, err = esr.client().Set(ctx, key, holder, &etcd.SetOptions{PrevValue: holder, TTL: ttl})
+		if etcdErr, ok := err.(etcd.Error); ok && etcdErr.Code == etcd.ErrorCodeTestFailed {
+			resp, err := esr.client().Get(ctx, key, &etcd.GetOptions{Quorum: true})
+			if err != nil {
+				return "", err
+			}
+			return resp.Node.Value, nil
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	return holder, nil
+}
+
+func (esr *etcdSubnetRegistry) unlockNode(ctx context.Context, nodeID, holder string) error {
+	key := path.Join(esr.etcdCfg.Prefix, "locks", makeLockKey(nodeID))
+	_, err := esr.client().Delete(ctx, key, &etcd.DeleteOptions{PrevValue: holder})
+	if etcdErr, ok := err.(etcd.Error); ok && (etcdErr.Code == etcd.ErrorCodeKeyNotFound || etcdErr.Code == etcd.ErrorCodeTestFailed) {
+		// expired, or someone else's by now
+		return nil
+	}
+	return err
+}
+
+func (esr *etcdSubnetRegistry) watchSubnets(ctx context.Context, since uint64) ([]Event, uint64, error) {
 	key := path.Join(esr.etcdCfg.Prefix, "subnets")
 	opts := &etcd.WatcherOptions{
 		AfterIndex: since,
@@ -222,14 +343,14 @@ func (esr *etcdSubnetRegistry) watchSubnets(ctx context.Context, since uint64) (
 	}
 	e, err := esr.client().Watcher(key, opts).Next(ctx)
 	if err != nil {
-		return Event{}, 0, err
+		return nil, 0, err
 	}
 
 	evt, err := parseSubnetWatchResponse(e)
-	return evt, e.Node.ModifiedIndex, err
+	return []Event{evt}, e.Node.ModifiedIndex, err
 }
 
-func (esr *etcdSubnetRegistry) watchSubnet(ctx context.Context, since uint64, sn ip.IP4Net) (Event, uint64, error) {
+func (esr *etcdSubnetRegistry) watchSubnet(ctx context.Context, since uint64, sn ip.IP4Net) ([]Event, uint64, error) {
 	key := path.Join(esr.etcdCfg.Prefix, "subnets", MakeSubnetKey(sn))
 	opts := &etcd.WatcherOptions{
 		AfterIndex: since,
@@ -237,11 +358,11 @@ func (esr *etcdSubnetRegistry) watchSubnet(ctx context.Context, since uint64, sn
 
 	e, err := esr.client().Watcher(key, opts).Next(ctx)
 	if err != nil {
-		return Event{}, 0, err
+		return nil, 0, err
 	}
 
 	evt, err := parseSubnetWatchResponse(e)
-	return evt, e.Node.ModifiedIndex, err
+	return []Event{evt}, e.Node.ModifiedIndex, err
 }
 
 func (esr *etcdSubnetRegistry) client() etcd.KeysAPI {
@@ -275,8 +396,7 @@ func parseSubnetWatchResponse(resp *etcd.Response) (Event, error) {
 		}, nil
 
 	default:
-		attrs := &LeaseAttrs{}
-		err := json.Unmarshal([]byte(resp.Node.Value), attrs)
+		attrs, sn6, err := decodeLeaseValue(resp.Node.Value)
 		if err != nil {
 			return Event{}, err
 		}
@@ -290,6 +410,7 @@ func parseSubnetWatchResponse(resp *etcd.Response) (Event, error) {
 			EventAdded,
 			Lease{
 				Subnet:     *sn,
+				IPv6Subnet: sn6,
 				Attrs:      *attrs,
 				Expiration: exp,
 			},
@@ -304,8 +425,8 @@ func nodeToLease(node *etcd.Node) (*Lease, error) {
 		return nil, fmt.Errorf("failed to parse subnet key %s", node.Key)
 	}
 
-	attrs := &LeaseAttrs{}
-	if err := json.Unmarshal([]byte(node.Value), attrs); err != nil {
+	attrs, sn6, err := decodeLeaseValue(node.Value)
+	if err != nil {
 		return nil, err
 	}
 
@@ -316,6 +437,7 @@ func nodeToLease(node *etcd.Node) (*Lease, error) {
 
 	lease := Lease{
 		Subnet:     *sn,
+		IPv6Subnet: sn6,
 		Attrs:      *attrs,
 		Expiration: exp,
 		Asof:       node.ModifiedIndex,
@@ -0,0 +1,567 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcdv2
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	. "github.com/coreos/flannel/subnet"
+)
+
+const (
+	// the subnet file is checked for changes every defaultFilePollInterval
+	// by watches. inotify doesn't see the writes of other NFS clients, so
+	// the file is polled.
+	defaultFilePollInterval = time.Second
+
+	// fileLockRetryInterval is how often a held lock file is tried again,
+	// and a lock file older than staleFileLockAge is assumed to be left
+	// behind by a writer which died
+	fileLockRetryInterval = 50 * time.Millisecond
+	staleFileLockAge      = 30 * time.Second
+
+	// maxFileEvents bounds the lease changes kept in the file for watches
+	// which fell behind, older watches take a new snapshot
+	maxFileEvents = 1000
+)
+
+// FileConfig configures a subnet manager keeping its leases in a file
+type FileConfig struct {
+	// Path is the JSON file holding the network config and the leases,
+	// shared by the nodes, e.g. on NFS
+	Path string
+	// LeaseTTL is how long subnet leases last. Defaults to 24 hours.
+	LeaseTTL time.Duration
+	// SubnetLen is the length of the subnet to lease to this node, as in
+	// EtcdConfig
+	SubnetLen uint
+}
+
+// NewFileManager returns a subnet manager keeping the network config and the
+// leases in the file at config.Path
+func NewFileManager(config *FileConfig, prevSubnet ip.IP4Net, nodeID string) (Manager, error) {
+	if config.Path == "" {
+		return nil, fmt.Errorf("no subnet file path given")
+	}
+	registerMetrics()
+	m := newLocalManager(newFileSubnetRegistry(config.Path), prevSubnet, nodeID)
+	if config.LeaseTTL > 0 {
+		m.leaseTTL = config.LeaseTTL
+	}
+	m.subnetLen = config.SubnetLen
+	return m, nil
+}
+
+// fileState is the content of the subnet file. Index counts the changes to
+// the leases, each of which is recorded in Events.
+type fileState struct {
+	Config     json.RawMessage       `json:"config,omitempty"`
+	Index      uint64                `json:"index"`
+	Subnets    map[string]*fileLease `json:"subnets,omitempty"`
+	Affinities map[string]string     `json:"affinities,omitempty"`
+	Locks      map[string]*fileLock  `json:"locks,omitempty"`
+	Events     []fileEvent           `json:"events,omitempty"`
+}
+
+// fileLease is a lease in the subnet file, which never expires if Expiration
+// is zero
+type fileLease struct {
+	Value      json.RawMessage `json:"value"`
+	Expiration time.Time       `json:"expiration"`
+	Index      uint64          `json:"index"`
+}
+
+// fileLock is the holder of a node lock in the subnet file
+type fileLock struct {
+	Holder     string    `json:"holder"`
+	Expiration time.Time `json:"expiration"`
+}
+
+// fileEvent is a change to the lease of Subnet, its removal if Lease is nil
+type fileEvent struct {
+	Index  uint64     `json:"index"`
+	Subnet string     `json:"subnet"`
+	Lease  *fileLease `json:"lease,omitempty"`
+}
+
+// fileSubnetRegistry stores the network config and the leases in a JSON file,
+// for small deployments without etcd. Writers read, change and replace the
+// whole file while holding a lock file next to it, and leases are updated
+// with compare-and-swap on their index, as in etcd. Expired leases are removed
+// by the next writer, or by a watch noticing them. Errors are reported as the
+// equivalent etcd errors so that the LocalManager handles all registries
+// alike.
+type fileSubnetRegistry struct {
+	path         string
+	pollInterval time.Duration
+}
+
+func newFileSubnetRegistry(path string) *fileSubnetRegistry {
+	return &fileSubnetRegistry{path: path, pollInterval: defaultFilePollInterval}
+}
+
+// read returns the content of the subnet file, empty if it doesn't exist
+func (fsr *fileSubnetRegistry) read() (*fileState, error) {
+	s := &fileState{}
+	data, err := ioutil.ReadFile(fsr.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("error decoding subnet file %v: %v", fsr.path, err)
+	}
+	return s, nil
+}
+
+// write replaces the subnet file with s, atomically so that readers never see
+// a partial file
+func (fsr *fileSubnetRegistry) write(s *fileState) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(fsr.path), filepath.Base(fsr.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fsr.path)
+}
+
+// lock takes the lock file of the subnet file, waiting while another writer
+// holds it, and returns the function releasing it
+func (fsr *fileSubnetRegistry) lock(ctx context.Context) (func(), error) {
+	path := fsr.path + ".lock"
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if fi, err := os.Stat(path); err == nil && time.Since(fi.ModTime()) > staleFileLockAge {
+			breakStaleLock(path, fi)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(fileLockRetryInterval):
+		}
+	}
+}
+
+// breakStaleLock removes the lock file at path if it is still stale, the file
+// of fi. The stale file can't just be removed: another writer which saw it
+// too may have removed it and taken a fresh lock meanwhile, which would be
+// removed instead. It is moved aside to a name of its own, and put back if it
+// turns out to be another file than fi, or the same inode reused by a fresh
+// lock, which is newer.
+func breakStaleLock(path string, fi os.FileInfo) {
+	aside, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".stale")
+	if err != nil {
+		log.Warningf("Failed to remove stale lock file %v: %v", path, err)
+		return
+	}
+	aside.Close()
+	defer os.Remove(aside.Name())
+
+	if err := os.Rename(path, aside.Name()); err != nil {
+		// already moved by another writer
+		return
+	}
+	if moved, err := os.Stat(aside.Name()); err == nil && (!os.SameFile(fi, moved) || !moved.ModTime().Equal(fi.ModTime())) {
+		if err := os.Link(aside.Name(), path); err != nil {
+			log.Warningf("Failed to restore lock file %v taken by another writer: %v", path, err)
+		}
+		return
+	}
+	log.Warningf("Removed stale lock file %v", path)
+}
+
+// update applies f to the content of the subnet file under its lock, after
+// removing the expired leases and locks, and writes the result unless nothing
+// changed
+func (fsr *fileSubnetRegistry) update(ctx context.Context, f func(s *fileState) (bool, error)) error {
+	unlock, err := fsr.lock(ctx)
+	if err != nil {
+		return fmt.Errorf("error locking subnet file %v: %v", fsr.path, err)
+	}
+	defer unlock()
+
+	s, err := fsr.read()
+	if err != nil {
+		return err
+	}
+	expired := s.expire(clock.Now())
+	changed, err := f(s)
+	if err != nil {
+		if expired {
+			if err := fsr.write(s); err != nil {
+				log.Warningf("Failed to remove expired leases from subnet file %v: %v", fsr.path, err)
+			}
+		}
+		return err
+	}
+	if !changed && !expired {
+		return nil
+	}
+	return fsr.write(s)
+}
+
+// expire removes the leases and locks which expired by now, and returns true
+// if there were any
+func (s *fileState) expire(now time.Time) bool {
+	expired := false
+	for key, l := range s.Subnets {
+		if !l.Expiration.IsZero() && !now.Before(l.Expiration) {
+			s.remove(key)
+			expired = true
+		}
+	}
+	for nodeID, l := range s.Locks {
+		if !now.Before(l.Expiration) {
+			delete(s.Locks, nodeID)
+			expired = true
+		}
+	}
+	return expired
+}
+
+// hasExpired returns true if a lease has expired by now
+func (s *fileState) hasExpired(now time.Time) bool {
+	for _, l := range s.Subnets {
+		if !l.Expiration.IsZero() && !now.Before(l.Expiration) {
+			return true
+		}
+	}
+	return false
+}
+
+// set stores lease l under key and records the change
+func (s *fileState) set(key string, l *fileLease) {
+	s.Index++
+	l.Index = s.Index
+	if s.Subnets == nil {
+		s.Subnets = make(map[string]*fileLease)
+	}
+	s.Subnets[key] = l
+	s.record(fileEvent{Index: s.Index, Subnet: key, Lease: l})
+}
+
+// remove removes the lease under key and records the change
+func (s *fileState) remove(key string) {
+	s.Index++
+	delete(s.Subnets, key)
+	s.record(fileEvent{Index: s.Index, Subnet: key})
+}
+
+func (s *fileState) record(e fileEvent) {
+	s.Events = append(s.Events, e)
+	if len(s.Events) > maxFileEvents {
+		s.Events = s.Events[len(s.Events)-maxFileEvents:]
+	}
+}
+
+// newFileLease returns the lease for sn and sn6 with attrs, expiring after ttl
+// unless it is zero
+func newFileLease(sn6 ip.IP6Net, attrs *LeaseAttrs, ttl time.Duration) (*fileLease, error) {
+	value, err := encodeLeaseValue(sn6, attrs)
+	if err != nil {
+		return nil, err
+	}
+	l := &fileLease{Value: json.RawMessage(value)}
+	if ttl != 0 {
+		l.Expiration = clock.Now().Add(ttl)
+	}
+	return l, nil
+}
+
+// toLease converts the lease l under key to a Lease
+func (l *fileLease) toLease(key string) (*Lease, error) {
+	sn := ParseSubnetKey(key)
+	if sn == nil {
+		return nil, fmt.Errorf("failed to parse subnet key %s", key)
+	}
+	attrs, sn6, err := decodeLeaseValue(string(l.Value))
+	if err != nil {
+		return nil, err
+	}
+	return &Lease{
+		Subnet:     *sn,
+		IPv6Subnet: sn6,
+		Attrs:      *attrs,
+		Expiration: l.Expiration,
+		Asof:       l.Index,
+	}, nil
+}
+
+func (fsr *fileSubnetRegistry) getNetworkConfig(ctx context.Context) (string, error) {
+	s, err := fsr.read()
+	if err != nil {
+		return "", err
+	}
+	if len(s.Config) == 0 {
+		return "", keyNotFound(fsr.path+"#config", int64(s.Index))
+	}
+	return string(s.Config), nil
+}
+
+func (fsr *fileSubnetRegistry) getSubnets(ctx context.Context) ([]Lease, uint64, error) {
+	s, err := fsr.read()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	now := clock.Now()
+	leases := []Lease{}
+	for key, fl := range s.Subnets {
+		if !fl.Expiration.IsZero() && !now.Before(fl.Expiration) {
+			continue
+		}
+		l, err := fl.toLease(key)
+		if err != nil {
+			log.Warningf("Ignoring bad subnet node: %v", err)
+			continue
+		}
+		leases = append(leases, *l)
+	}
+	return leases, s.Index, nil
+}
+
+func (fsr *fileSubnetRegistry) getSubnet(ctx context.Context, sn ip.IP4Net) (*Lease, uint64, error) {
+	s, err := fsr.read()
+	if err != nil {
+		return nil, 0, err
+	}
+	key := MakeSubnetKey(sn)
+	fl, ok := s.Subnets[key]
+	if !ok || (!fl.Expiration.IsZero() && !clock.Now().Before(fl.Expiration)) {
+		return nil, 0, keyNotFound(key, int64(s.Index))
+	}
+	l, err := fl.toLease(key)
+	return l, s.Index, err
+}
+
+func (fsr *fileSubnetRegistry) createSubnet(ctx context.Context, sn ip.IP4Net, sn6 ip.IP6Net, attrs *LeaseAttrs, ttl time.Duration) (time.Time, error) {
+	l, err := newFileLease(sn6, attrs, ttl)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	key := MakeSubnetKey(sn)
+	err = fsr.update(ctx, func(s *fileState) (bool, error) {
+		if _, ok := s.Subnets[key]; ok {
+			return false, etcd.Error{
+				Code:    etcd.ErrorCodeNodeExist,
+				Message: "Key already exists",
+				Cause:   key,
+				Index:   s.Index,
+			}
+		}
+		s.set(key, l)
+		return true, nil
+	})
+	return l.Expiration, err
+}
+
+func (fsr *fileSubnetRegistry) updateSubnet(ctx context.Context, sn ip.IP4Net, sn6 ip.IP6Net, attrs *LeaseAttrs, ttl time.Duration, asof uint64) (time.Time, error) {
+	l, err := newFileLease(sn6, attrs, ttl)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	key := MakeSubnetKey(sn)
+	err = fsr.update(ctx, func(s *fileState) (bool, error) {
+		if asof != 0 {
+			prev, ok := s.Subnets[key]
+			if !ok {
+				return false, keyNotFound(key, int64(s.Index))
+			}
+			if prev.Index != asof {
+				return false, etcd.Error{
+					Code:    etcd.ErrorCodeTestFailed,
+					Message: "Compare failed",
+					Cause:   fmt.Sprintf("[%v != %v]", asof, prev.Index),
+					Index:   s.Index,
+				}
+			}
+		}
+		s.set(key, l)
+		return true, nil
+	})
+	return l.Expiration, err
+}
+
+func (fsr *fileSubnetRegistry) deleteSubnet(ctx context.Context, sn ip.IP4Net) error {
+	key := MakeSubnetKey(sn)
+	return fsr.update(ctx, func(s *fileState) (bool, error) {
+		if _, ok := s.Subnets[key]; !ok {
+			return false, keyNotFound(key, int64(s.Index))
+		}
+		s.remove(key)
+		return true, nil
+	})
+}
+
+func (fsr *fileSubnetRegistry) getAffinity(ctx context.Context, nodeID string) (ip.IP4Net, error) {
+	s, err := fsr.read()
+	if err != nil {
+		return ip.IP4Net{}, err
+	}
+	value, ok := s.Affinities[nodeID]
+	if !ok {
+		return ip.IP4Net{}, nil
+	}
+	return parseAffinityValue(value)
+}
+
+func (fsr *fileSubnetRegistry) setAffinity(ctx context.Context, nodeID string, sn ip.IP4Net) error {
+	return fsr.update(ctx, func(s *fileState) (bool, error) {
+		if s.Affinities == nil {
+			s.Affinities = make(map[string]string)
+		}
+		s.Affinities[nodeID] = MakeSubnetKey(sn)
+		return true, nil
+	})
+}
+
+func (fsr *fileSubnetRegistry) lockNode(ctx context.Context, nodeID, holder string, ttl time.Duration) (string, error) {
+	var owner string
+	err := fsr.update(ctx, func(s *fileState) (bool, error) {
+		if l, ok := s.Locks[nodeID]; ok && l.Holder != holder {
+			owner = l.Holder
+			return false, nil
+		}
+		if s.Locks == nil {
+			s.Locks = make(map[string]*fileLock)
+		}
+		s.Locks[nodeID] = &fileLock{Holder: holder, Expiration: clock.Now().Add(ttl)}
+		owner = holder
+		return true, nil
+	})
+	return owner, err
+}
+
+func (fsr *fileSubnetRegistry) unlockNode(ctx context.Context, nodeID, holder string) error {
+	return fsr.update(ctx, func(s *fileState) (bool, error) {
+		if l, ok := s.Locks[nodeID]; !ok || l.Holder != holder {
+			return false, nil
+		}
+		delete(s.Locks, nodeID)
+		return true, nil
+	})
+}
+
+func (fsr *fileSubnetRegistry) watchSubnets(ctx context.Context, since uint64) ([]Event, uint64, error) {
+	return fsr.watch(ctx, since, "")
+}
+
+func (fsr *fileSubnetRegistry) watchSubnet(ctx context.Context, since uint64, sn ip.IP4Net) ([]Event, uint64, error) {
+	return fsr.watch(ctx, since, MakeSubnetKey(sn))
+}
+
+// watch returns the first change after index since to the lease under key, or
+// to any lease if key is empty, polling the subnet file until there is one.
+// If the change is no longer recorded, an index cleared error is returned for
+// the LocalManager to take a new snapshot.
+func (fsr *fileSubnetRegistry) watch(ctx context.Context, since uint64, key string) ([]Event, uint64, error) {
+	for {
+		s, err := fsr.read()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		switch {
+		case s.hasExpired(clock.Now()):
+			// nobody wrote since the lease expired, remove it so
+			// that it is reported
+			if err := fsr.update(ctx, func(*fileState) (bool, error) { return false, nil }); err != nil {
+				return nil, 0, err
+			}
+			continue
+
+		case since > s.Index || (since < s.Index && (len(s.Events) == 0 || s.Events[0].Index > since+1)):
+			return nil, 0, etcd.Error{
+				Code:    etcd.ErrorCodeEventIndexCleared,
+				Message: "The event in requested index is outdated and cleared",
+				Cause:   fmt.Sprintf("the requested history has been cleared [%v/%v]", s.Index, since+1),
+				Index:   s.Index,
+			}
+		}
+
+		for _, e := range s.Events {
+			if e.Index <= since || (key != "" && e.Subnet != key) {
+				continue
+			}
+			evt, err := e.toEvent()
+			return []Event{evt}, e.Index, err
+		}
+		if key != "" {
+			// the changes to other leases are skipped
+			since = s.Index
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		case <-time.After(fsr.pollInterval):
+		}
+	}
+}
+
+// toEvent converts e to a lease event
+func (e fileEvent) toEvent() (Event, error) {
+	if e.Lease == nil {
+		sn := ParseSubnetKey(e.Subnet)
+		if sn == nil {
+			return Event{}, fmt.Errorf("delete %q: not a subnet, skipping", e.Subnet)
+		}
+		return Event{Type: EventRemoved, Lease: Lease{Subnet: *sn}}, nil
+	}
+
+	l, err := e.Lease.toLease(e.Subnet)
+	if err != nil {
+		return Event{}, err
+	}
+	return Event{Type: EventAdded, Lease: *l}, nil
+}
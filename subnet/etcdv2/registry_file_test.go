@@ -0,0 +1,306 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcdv2
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"github.com/jonboulle/clockwork"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	. "github.com/coreos/flannel/subnet"
+)
+
+// newTestFileRegistry returns a registry on a subnet file holding config in a
+// new directory, and the function removing it
+func newTestFileRegistry(t *testing.T, config string) (*fileSubnetRegistry, func()) {
+	dir, err := ioutil.TempDir("", "flannel-subnets")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	path := filepath.Join(dir, "subnets.json")
+	if config != "" {
+		if err := ioutil.WriteFile(path, []byte(`{"config": `+config+`}`), 0644); err != nil {
+			t.Fatalf("Failed to write subnet file: %v", err)
+		}
+	}
+	fsr := newFileSubnetRegistry(path)
+	fsr.pollInterval = 10 * time.Millisecond
+	return fsr, func() { os.RemoveAll(dir) }
+}
+
+func etcdErrorCode(err error) int {
+	if etcdErr, ok := err.(etcd.Error); ok {
+		return etcdErr.Code
+	}
+	return 0
+}
+
+func TestFileRegistry(t *testing.T) {
+	fsr, done := newTestFileRegistry(t, "")
+	defer done()
+	ctx := context.Background()
+
+	if _, err := fsr.getNetworkConfig(ctx); etcdErrorCode(err) != etcd.ErrorCodeKeyNotFound {
+		t.Errorf("Expected key not found for a missing subnet file, got %v", err)
+	}
+
+	sn := ip.IP4Net{IP: ip.MustParseIP4("10.1.5.0"), PrefixLen: 24}
+	attrs := &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4")}
+	if _, err := fsr.createSubnet(ctx, sn, ip.IP6Net{}, attrs, time.Hour); err != nil {
+		t.Fatalf("createSubnet failed: %v", err)
+	}
+	if _, err := fsr.createSubnet(ctx, sn, ip.IP6Net{}, attrs, time.Hour); etcdErrorCode(err) != etcd.ErrorCodeNodeExist {
+		t.Errorf("Expected node exists creating a subnet twice, got %v", err)
+	}
+
+	// the leases are read back from the file
+	l, index, err := newFileSubnetRegistry(fsr.path).getSubnet(ctx, sn)
+	if err != nil {
+		t.Fatalf("getSubnet failed: %v", err)
+	}
+	if !l.Subnet.Equal(sn) || l.Attrs.PublicIP != attrs.PublicIP || l.Asof != 1 || index != 1 {
+		t.Errorf("Unexpected lease %+v at index %v", l, index)
+	}
+
+	// updates compare and swap on the index of the lease
+	attrs = &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.5")}
+	if _, err := fsr.updateSubnet(ctx, sn, ip.IP6Net{}, attrs, time.Hour, 7); etcdErrorCode(err) != etcd.ErrorCodeTestFailed {
+		t.Errorf("Expected compare failed updating a stale lease, got %v", err)
+	}
+	if _, err := fsr.updateSubnet(ctx, sn, ip.IP6Net{}, attrs, time.Hour, l.Asof); err != nil {
+		t.Fatalf("updateSubnet failed: %v", err)
+	}
+	leases, index, err := fsr.getSubnets(ctx)
+	if err != nil {
+		t.Fatalf("getSubnets failed: %v", err)
+	}
+	if len(leases) != 1 || leases[0].Attrs.PublicIP != attrs.PublicIP || leases[0].Asof != 2 || index != 2 {
+		t.Errorf("Unexpected leases %+v at index %v", leases, index)
+	}
+
+	if err := fsr.deleteSubnet(ctx, sn); err != nil {
+		t.Fatalf("deleteSubnet failed: %v", err)
+	}
+	if _, _, err := fsr.getSubnet(ctx, sn); etcdErrorCode(err) != etcd.ErrorCodeKeyNotFound {
+		t.Errorf("Expected key not found for a deleted subnet, got %v", err)
+	}
+
+	// all changes are watched in order
+	for i, typ := range []EventType{EventAdded, EventAdded, EventRemoved} {
+		evts, index, err := fsr.watchSubnets(ctx, uint64(i))
+		if err != nil {
+			t.Fatalf("watchSubnets failed: %v", err)
+		}
+		if len(evts) != 1 || evts[0].Type != typ || !evts[0].Lease.Subnet.Equal(sn) || index != uint64(i+1) {
+			t.Errorf("Unexpected events %+v at index %v", evts, index)
+		}
+	}
+	if _, err := os.Stat(fsr.path + ".lock"); !os.IsNotExist(err) {
+		t.Errorf("Expected the lock file to be removed, got %v", err)
+	}
+}
+
+// newStaleLock creates the lock file of fsr as left behind by a writer which
+// died, and returns it
+func newStaleLock(t *testing.T, fsr *fileSubnetRegistry) os.FileInfo {
+	path := fsr.path + ".lock"
+	if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+		t.Fatalf("Failed to write lock file: %v", err)
+	}
+	old := time.Now().Add(-2 * staleFileLockAge)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatalf("Failed to age lock file: %v", err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Failed to stat lock file: %v", err)
+	}
+	return fi
+}
+
+func TestFileRegistryStaleLock(t *testing.T) {
+	fsr, done := newTestFileRegistry(t, "")
+	defer done()
+	ctx := context.Background()
+	path := fsr.path + ".lock"
+
+	// each update counts itself in the config, one at a time
+	var holders int32
+	count := func(s *fileState) {
+		if atomic.AddInt32(&holders, 1) > 1 {
+			t.Error("Expected one writer at a time to hold the lock")
+		}
+		defer atomic.AddInt32(&holders, -1)
+		var n int
+		json.Unmarshal(s.Config, &n)
+		time.Sleep(3 * fileLockRetryInterval)
+		s.Config = json.RawMessage(fmt.Sprint(n + 1))
+	}
+
+	// the first writer breaks the stale lock and takes a fresh one, then
+	// another writer which saw the stale lock too breaks it in turn, while
+	// a second update waits for the lock
+	stale := newStaleLock(t, fsr)
+	second := make(chan error)
+	err := fsr.update(ctx, func(s *fileState) (bool, error) {
+		breakStaleLock(path, stale)
+		go func() {
+			second <- fsr.update(ctx, func(s *fileState) (bool, error) {
+				count(s)
+				return true, nil
+			})
+		}()
+		count(s)
+		return true, nil
+	})
+	if err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+	if err := <-second; err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+	if s, err := fsr.read(); err != nil || string(s.Config) != "2" {
+		t.Errorf("Expected both updates to be written, got %s: %v", s.Config, err)
+	}
+	if files, _ := filepath.Glob(path + ".stale*"); len(files) != 0 {
+		t.Errorf("Expected the moved lock files to be removed, got %v", files)
+	}
+
+	breakStaleLock(path, newStaleLock(t, fsr))
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected the stale lock file to be removed, got %v", err)
+	}
+}
+
+func TestFileRegistryExpire(t *testing.T) {
+	fsr, done := newTestFileRegistry(t, "")
+	defer done()
+	ctx := context.Background()
+
+	fakeClock := clockwork.NewFakeClock()
+	clock = fakeClock
+	defer func() { clock = clockwork.NewRealClock() }()
+
+	sn := ip.IP4Net{IP: ip.MustParseIP4("10.1.5.0"), PrefixLen: 24}
+	if _, err := fsr.createSubnet(ctx, sn, ip.IP6Net{}, &LeaseAttrs{}, time.Minute); err != nil {
+		t.Fatalf("createSubnet failed: %v", err)
+	}
+	fakeClock.Advance(time.Minute)
+
+	if _, _, err := fsr.getSubnet(ctx, sn); etcdErrorCode(err) != etcd.ErrorCodeKeyNotFound {
+		t.Errorf("Expected key not found for an expired lease, got %v", err)
+	}
+
+	// the watch removes the expired lease which nobody wrote since
+	evts, index, err := fsr.watchSubnet(ctx, 1, sn)
+	if err != nil {
+		t.Fatalf("watchSubnet failed: %v", err)
+	}
+	if len(evts) != 1 || evts[0].Type != EventRemoved || !evts[0].Lease.Subnet.Equal(sn) || index != 2 {
+		t.Errorf("Unexpected events %+v at index %v", evts, index)
+	}
+
+	// the subnet is free again
+	if _, err := fsr.createSubnet(ctx, sn, ip.IP6Net{}, &LeaseAttrs{}, time.Minute); err != nil {
+		t.Errorf("createSubnet of an expired subnet failed: %v", err)
+	}
+}
+
+func TestFileRegistryWatchCleared(t *testing.T) {
+	fsr, done := newTestFileRegistry(t, "")
+	defer done()
+	ctx := context.Background()
+
+	s := &fileState{Index: 10, Events: []fileEvent{{Index: 9, Subnet: "10.1.5.0-24"}, {Index: 10, Subnet: "10.1.6.0-24"}}}
+	if err := fsr.write(s); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	for _, since := range []uint64{2, 11} {
+		if _, _, err := fsr.watchSubnets(ctx, since); etcdErrorCode(err) != etcd.ErrorCodeEventIndexCleared {
+			t.Errorf("Expected index cleared watching since %v, got %v", since, err)
+		}
+	}
+	if _, index, err := fsr.watchSubnets(ctx, 8); err != nil || index != 9 {
+		t.Errorf("Expected the event at index 9 watching since 8, got %v, %v", index, err)
+	}
+
+	// the watch waits for the next change
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, _, err := fsr.watchSubnets(ctx, 10); err != context.DeadlineExceeded {
+		t.Errorf("Expected the watch to time out, got %v", err)
+	}
+}
+
+func TestFileManagers(t *testing.T) {
+	fsr, done := newTestFileRegistry(t, `{"Network": "10.3.0.0/16", "SubnetMin": "10.3.1.0", "SubnetMax": "10.3.5.0"}`)
+	defer done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// two nodes sharing the subnet file get distinct subnets
+	sm1 := newLocalManager(fsr, ip.IP4Net{}, "node1")
+	l1, err := sm1.AcquireLease(ctx, &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4")})
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+
+	events := make(chan []Event)
+	go WatchLeases(ctx, sm1, l1, events)
+
+	fsr2 := newFileSubnetRegistry(fsr.path)
+	sm2 := newLocalManager(fsr2, ip.IP4Net{}, "node2")
+	l2, err := sm2.AcquireLease(ctx, &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.5")})
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	if l1.Subnet.Equal(l2.Subnet) {
+		t.Fatalf("Expected distinct subnets, both got %v", l1.Subnet)
+	}
+
+	// and the first sees the lease of the second
+	select {
+	case evts := <-events:
+		if len(evts) != 1 || evts[0].Type != EventAdded || !evts[0].Lease.Subnet.Equal(l2.Subnet) {
+			t.Errorf("Unexpected events %+v", evts)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the lease of the second node")
+	}
+
+	data, err := ioutil.ReadFile(fsr.path)
+	if err != nil {
+		t.Fatalf("Failed to read subnet file: %v", err)
+	}
+	s := &fileState{}
+	if err := json.Unmarshal(data, s); err != nil {
+		t.Fatalf("Failed to decode subnet file: %v", err)
+	}
+	if len(s.Subnets) != 2 || s.Affinities["node1"] != MakeSubnetKey(l1.Subnet) {
+		t.Errorf("Unexpected subnet file %s", data)
+	}
+}
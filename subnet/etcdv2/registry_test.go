@@ -56,24 +56,26 @@ func watchSubnets(t *testing.T, r Registry, ctx context.Context, sn ip.IP4Net, n
 
 	numFound := 0
 	for {
-		evt, index, err := r.watchSubnets(ctx, nextIndex)
+		evts, index, err := r.watchSubnets(ctx, nextIndex)
 
 		switch {
 		case err == nil:
 			nextIndex = index
-			for _, exp := range expectedEvents {
-				if evt.Type != exp.etype {
-					continue
+			for _, evt := range evts {
+				for _, exp := range expectedEvents {
+					if evt.Type != exp.etype {
+						continue
+					}
+					if exp.found == true {
+						result <- fmt.Errorf("Subnet event type already found: %v", exp)
+						return
+					}
+					if !evt.Lease.Subnet.Equal(exp.subnet) {
+						result <- fmt.Errorf("Subnet event lease %v mismatch (expected %v)", evt.Lease.Subnet, exp.subnet)
+					}
+					exp.found = true
+					numFound += 1
 				}
-				if exp.found == true {
-					result <- fmt.Errorf("Subnet event type already found: %v", exp)
-					return
-				}
-				if !evt.Lease.Subnet.Equal(exp.subnet) {
-					result <- fmt.Errorf("Subnet event lease %v mismatch (expected %v)", evt.Lease.Subnet, exp.subnet)
-				}
-				exp.found = true
-				numFound += 1
 			}
 			if numFound == len(expectedEvents) {
 				// All done; success
@@ -134,7 +136,7 @@ func TestEtcdRegistry(t *testing.T) {
 	attrs := &LeaseAttrs{
 		PublicIP: ip.MustParseIP4("1.2.3.4"),
 	}
-	exp, err := r.createSubnet(ctx, sn, attrs, 24*time.Hour)
+	exp, err := r.createSubnet(ctx, sn, ip.IP6Net{}, attrs, 24*time.Hour)
 	if err != nil {
 		t.Fatal("Failed to create subnet lease")
 	}
@@ -188,3 +190,76 @@ func TestEtcdRegistry(t *testing.T) {
 
 	// TODO: watchSubnet and watchNetworks
 }
+
+func TestLeaseValueIPv6(t *testing.T) {
+	attrs := &LeaseAttrs{
+		PublicIP: ip.MustParseIP4("1.2.3.4"),
+	}
+	sn6 := ip.IP6Net{IP: ip.MustParseIP6("fc00:0:0:5::"), PrefixLen: 64}
+
+	value, err := encodeLeaseValue(sn6, attrs)
+	if err != nil {
+		t.Fatalf("Failed to encode lease value: %v", err)
+	}
+	if value != `{"PublicIP":"1.2.3.4","IPv6Subnet":"fc00:0:0:5::/64"}` {
+		t.Fatalf("Unexpected lease value %s", value)
+	}
+
+	attrs2, sn62, err := decodeLeaseValue(value)
+	if err != nil {
+		t.Fatalf("Failed to decode lease value: %v", err)
+	}
+	if attrs2.PublicIP != attrs.PublicIP || !sn62.Equal(sn6) {
+		t.Fatalf("Mismatched lease value %v %v (expected %v %v)", attrs2, sn62, attrs, sn6)
+	}
+}
+
+func TestParseAffinityValue(t *testing.T) {
+	sn, err := parseAffinityValue("10.1.5.0-24")
+	if err != nil {
+		t.Fatalf("Failed to parse affinity value: %v", err)
+	}
+	if !sn.Equal(ip.IP4Net{IP: ip.MustParseIP4("10.1.5.0"), PrefixLen: 24}) {
+		t.Fatalf("Unexpected affinity subnet %v", sn)
+	}
+
+	if _, err := parseAffinityValue("garbage"); err == nil {
+		t.Fatal("Unexpected success parsing a bad affinity value")
+	}
+}
+
+func TestEtcdRegistryNodeLock(t *testing.T) {
+	r, _ := newTestEtcdRegistry(t)
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		holder, owner string
+	}{
+		{"a", "a"},
+		{"b", "a"},
+		// the holder refreshes its lock
+		{"a", "a"},
+	} {
+		owner, err := r.lockNode(ctx, "node", tc.holder, time.Minute)
+		if err != nil {
+			t.Fatalf("lockNode failed: %v", err)
+		}
+		if owner != tc.owner {
+			t.Errorf("%v: expected the lock to be held by %v, got %v", tc.holder, tc.owner, owner)
+		}
+	}
+
+	// only the holder releases the lock
+	if err := r.unlockNode(ctx, "node", "b"); err != nil {
+		t.Fatalf("unlockNode failed: %v", err)
+	}
+	if owner, _ := r.lockNode(ctx, "node", "b", time.Minute); owner != "a" {
+		t.Errorf("expected the lock to still be held by a, got %v", owner)
+	}
+	if err := r.unlockNode(ctx, "node", "a"); err != nil {
+		t.Fatalf("unlockNode failed: %v", err)
+	}
+	if owner, _ := r.lockNode(ctx, "node", "b", time.Minute); owner != "b" {
+		t.Errorf("expected b to get the released lock, got %v", owner)
+	}
+}
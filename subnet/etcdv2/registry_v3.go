@@ -0,0 +1,456 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcdv2
+
+import (
+	"fmt"
+	"path"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/coreos/etcd/pkg/transport"
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	. "github.com/coreos/flannel/subnet"
+)
+
+// etcdV3SubnetRegistry stores leases with the etcd v3 API, under the same keys
+// as the v2 registry. Subnet leases are attached to etcd leases so that they
+// expire, and etcd revisions are used as the index. Errors are reported as the
+// equivalent v2 errors so that the LocalManager handles both registries alike.
+type etcdV3SubnetRegistry struct {
+	cli     etcdV3Client
+	etcdCfg *EtcdConfig
+}
+
+// etcdV3Client is the part of the etcd v3 client the registry uses
+type etcdV3Client interface {
+	clientv3.KV
+	clientv3.Lease
+	clientv3.Watcher
+}
+
+func newEtcdV3Client(c *EtcdConfig) (*clientv3.Client, error) {
+	cfg := clientv3.Config{
+		Endpoints:   c.Endpoints,
+		DialTimeout: 5 * time.Second,
+		Username:    c.Username,
+		Password:    c.Password,
+	}
+
+	tlsInfo := transport.TLSInfo{
+		CertFile: c.Certfile,
+		KeyFile:  c.Keyfile,
+		CAFile:   c.CAFile,
+	}
+	if !tlsInfo.Empty() || c.CAFile != "" {
+		tlsCfg, err := tlsInfo.ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+		cfg.TLS = tlsCfg
+	}
+
+	return clientv3.New(cfg)
+}
+
+func newEtcdV3SubnetRegistry(config *EtcdConfig) (Registry, error) {
+	cli, err := newEtcdV3Client(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &etcdV3SubnetRegistry{
+		cli:     cli,
+		etcdCfg: config,
+	}, nil
+}
+
+// leaseTTL returns how long subnet leases are granted for
+func (esr *etcdV3SubnetRegistry) leaseTTL() time.Duration {
+	if esr.etcdCfg.LeaseTTL > 0 {
+		return esr.etcdCfg.LeaseTTL
+	}
+	return subnetTTL
+}
+
+func (esr *etcdV3SubnetRegistry) subnetsKey() string {
+	// the trailing slash keeps prefix matches to the subnets "directory"
+	return path.Join(esr.etcdCfg.Prefix, "subnets") + "/"
+}
+
+func (esr *etcdV3SubnetRegistry) subnetKey(sn ip.IP4Net) string {
+	return esr.subnetsKey() + MakeSubnetKey(sn)
+}
+
+func (esr *etcdV3SubnetRegistry) getNetworkConfig(ctx context.Context) (string, error) {
+	key := path.Join(esr.etcdCfg.Prefix, "config")
+	resp, err := esr.cli.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Kvs) == 0 {
+		return "", keyNotFound(key, resp.Header.Revision)
+	}
+	return string(resp.Kvs[0].Value), nil
+}
+
+func (esr *etcdV3SubnetRegistry) getSubnets(ctx context.Context) ([]Lease, uint64, error) {
+	resp, err := esr.cli.Get(ctx, esr.subnetsKey(), clientv3.WithPrefix())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	leases := []Lease{}
+	for _, kv := range resp.Kvs {
+		l, err := kvToLease(kv, esr.leaseTTL())
+		if err != nil {
+			log.Warningf("Ignoring bad subnet node: %v", err)
+			continue
+		}
+
+		leases = append(leases, *l)
+	}
+
+	return leases, uint64(resp.Header.Revision), nil
+}
+
+func (esr *etcdV3SubnetRegistry) getSubnet(ctx context.Context, sn ip.IP4Net) (*Lease, uint64, error) {
+	key := esr.subnetKey(sn)
+	resp, err := esr.cli.Get(ctx, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, 0, keyNotFound(key, resp.Header.Revision)
+	}
+
+	l, err := kvToLease(resp.Kvs[0], esr.leaseTTL())
+	return l, uint64(resp.Header.Revision), err
+}
+
+// grant returns an etcd lease for ttl, or no lease for a zero ttl
+func (esr *etcdV3SubnetRegistry) grant(ctx context.Context, ttl time.Duration) (clientv3.LeaseID, time.Time, error) {
+	if ttl == 0 {
+		return clientv3.NoLease, time.Time{}, nil
+	}
+
+	resp, err := esr.cli.Grant(ctx, int64(ttl/time.Second))
+	if err != nil {
+		return clientv3.NoLease, time.Time{}, err
+	}
+	return resp.ID, time.Now().Add(time.Duration(resp.TTL) * time.Second), nil
+}
+
+// revoke revokes an etcd lease that is no longer used, an expiring lease is
+// only wasted so failures are just logged
+func (esr *etcdV3SubnetRegistry) revoke(ctx context.Context, id clientv3.LeaseID) {
+	if id == clientv3.NoLease {
+		return
+	}
+	if _, err := esr.cli.Revoke(ctx, id); err != nil {
+		log.Warningf("Failed to revoke etcd lease %x: %v", id, err)
+	}
+}
+
+func (esr *etcdV3SubnetRegistry) createSubnet(ctx context.Context, sn ip.IP4Net, sn6 ip.IP6Net, attrs *LeaseAttrs, ttl time.Duration) (time.Time, error) {
+	key := esr.subnetKey(sn)
+	value, err := encodeLeaseValue(sn6, attrs)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	id, exp, err := esr.grant(ctx, ttl)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	resp, err := esr.cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, value, clientv3.WithLease(id))).
+		Commit()
+	if err != nil {
+		esr.revoke(ctx, id)
+		return time.Time{}, err
+	}
+	if !resp.Succeeded {
+		esr.revoke(ctx, id)
+		return time.Time{}, etcd.Error{
+			Code:    etcd.ErrorCodeNodeExist,
+			Message: "Key already exists",
+			Cause:   key,
+			Index:   uint64(resp.Header.Revision),
+		}
+	}
+
+	return exp, nil
+}
+
+func (esr *etcdV3SubnetRegistry) updateSubnet(ctx context.Context, sn ip.IP4Net, sn6 ip.IP6Net, attrs *LeaseAttrs, ttl time.Duration, asof uint64) (time.Time, error) {
+	key := esr.subnetKey(sn)
+	value, err := encodeLeaseValue(sn6, attrs)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	id, exp, err := esr.grant(ctx, ttl)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var cmps []clientv3.Cmp
+	if asof != 0 {
+		cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(key), "=", int64(asof)))
+	}
+
+	resp, err := esr.cli.Txn(ctx).
+		If(cmps...).
+		Then(clientv3.OpPut(key, value, clientv3.WithLease(id), clientv3.WithPrevKV())).
+		Commit()
+	if err != nil {
+		esr.revoke(ctx, id)
+		return time.Time{}, err
+	}
+	if !resp.Succeeded {
+		esr.revoke(ctx, id)
+		return time.Time{}, etcd.Error{
+			Code:    etcd.ErrorCodeTestFailed,
+			Message: "Compare failed",
+			Cause:   fmt.Sprintf("[%v != %v]", asof, key),
+			Index:   uint64(resp.Header.Revision),
+		}
+	}
+
+	// the key is now attached to the new etcd lease, so the previous one can go
+	if put := resp.Responses[0].GetResponsePut(); put != nil && put.PrevKv != nil {
+		esr.revoke(ctx, clientv3.LeaseID(put.PrevKv.Lease))
+	}
+
+	return exp, nil
+}
+
+func (esr *etcdV3SubnetRegistry) deleteSubnet(ctx context.Context, sn ip.IP4Net) error {
+	key := esr.subnetKey(sn)
+	resp, err := esr.cli.Delete(ctx, key)
+	if err != nil {
+		return err
+	}
+	if resp.Deleted == 0 {
+		return keyNotFound(key, resp.Header.Revision)
+	}
+	return nil
+}
+
+func (esr *etcdV3SubnetRegistry) affinityKey(nodeID string) string {
+	return path.Join(esr.etcdCfg.Prefix, "affinity", makeAffinityKey(nodeID))
+}
+
+func (esr *etcdV3SubnetRegistry) getAffinity(ctx context.Context, nodeID string) (ip.IP4Net, error) {
+	resp, err := esr.cli.Get(ctx, esr.affinityKey(nodeID))
+	if err != nil {
+		return ip.IP4Net{}, err
+	}
+	if len(resp.Kvs) == 0 {
+		return ip.IP4Net{}, nil
+	}
+	return parseAffinityValue(string(resp.Kvs[0].Value))
+}
+
+func (esr *etcdV3SubnetRegistry) setAffinity(ctx context.Context, nodeID string, sn ip.IP4Net) error {
+	_, err := esr.cli.Put(ctx, esr.affinityKey(nodeID), MakeSubnetKey(sn))
+	return err
+}
+
+func (esr *etcdV3SubnetRegistry) lockKey(nodeID string) string {
+	return path.Join(esr.etcdCfg.Prefix, "locks", makeLockKey(nodeID))
+}
+
+func (esr *etcdV3SubnetRegistry) lockNode(ctx context.Context, nodeID, holder string, ttl time.Duration) (string, error) {
+	key := esr.lockKey(nodeID)
+	resp, err := esr.cli.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Kvs) > 0 {
+		kv := resp.Kvs[0]
+		if string(kv.Value) != holder {
+			return string(kv.Value), nil
+		}
+		// our lock expires with its etcd lease
+		if _, err := esr.cli.KeepAliveOnce(ctx, clientv3.LeaseID(kv.Lease)); err != nil {
+			return "", err
+		}
+		return holder, nil
+	}
+
+	id, _, err := esr.grant(ctx, ttl)
+	if err != nil {
+		return "", err
+	}
+	txn, err := esr.cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, holder, clientv3.WithLease(id))).
+		Else(clientv3.OpGet(key)).
+		Commit()
+	if err != nil {
+		esr.revoke(ctx, id)
+		return "", err
+	}
+	if !txn.Succeeded {
+		esr.revoke(ctx, id)
+		// someone else took it in the meantime
+		if get := txn.Responses[0].GetResponseRange(); get != nil && len(get.Kvs) > 0 {
+			return string(get.Kvs[0].Value), nil
+		}
+		return "", keyNotFound(key, txn.Header.Revision)
+	}
+	return holder, nil
+}
+
+func (esr *etcdV3SubnetRegistry) unlockNode(ctx context.Context, nodeID, holder string) error {
+	key := esr.lockKey(nodeID)
+	_, err := esr.cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.Value(key), "=", holder)).
+		Then(clientv3.OpDelete(key)).
+		Commit()
+	return err
+}
+
+func (esr *etcdV3SubnetRegistry) watchSubnets(ctx context.Context, since uint64) ([]Event, uint64, error) {
+	return esr.watch(ctx, since, esr.subnetsKey(), clientv3.WithPrefix())
+}
+
+func (esr *etcdV3SubnetRegistry) watchSubnet(ctx context.Context, since uint64, sn ip.IP4Net) ([]Event, uint64, error) {
+	return esr.watch(ctx, since, esr.subnetKey(sn))
+}
+
+// watch returns the events on key at the first revision after since which has
+// any, all of them as a transaction can change several leases at once. The
+// watch resumes from that revision, so events aren't missed when the
+// connection to etcd is lost or fails over to another member. If the revision
+// has been compacted, an index cleared error is returned for the LocalManager
+// to take a new snapshot.
+func (esr *etcdV3SubnetRegistry) watch(ctx context.Context, since uint64, key string, opts ...clientv3.OpOption) ([]Event, uint64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	opts = append(opts, clientv3.WithRev(int64(since)+1))
+	for resp := range esr.cli.Watch(ctx, key, opts...) {
+		if resp.CompactRevision != 0 {
+			return nil, 0, etcd.Error{
+				Code:    etcd.ErrorCodeEventIndexCleared,
+				Message: "The event in requested index is outdated and cleared",
+				Cause:   fmt.Sprintf("the requested history has been cleared [%v/%v]", resp.CompactRevision, since+1),
+				Index:   uint64(resp.Header.Revision),
+			}
+		}
+		if err := resp.Err(); err != nil {
+			return nil, 0, err
+		}
+		if len(resp.Events) == 0 {
+			continue
+		}
+
+		// the next watch starts after the first revision, so the events
+		// of later revisions in resp are delivered again
+		rev := resp.Events[0].Kv.ModRevision
+		evts := []Event{}
+		for _, e := range resp.Events {
+			if e.Kv.ModRevision != rev {
+				break
+			}
+			evt, err := watchEventToEvent(e, esr.leaseTTL())
+			if err != nil {
+				log.Warningf("Ignoring bad subnet event: %v", err)
+				continue
+			}
+			evts = append(evts, evt)
+		}
+		return evts, uint64(rev), nil
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	return nil, 0, fmt.Errorf("watch of %v closed", key)
+}
+
+// watchEventToEvent converts e to a lease event, see kvToLease for ttl
+func watchEventToEvent(e *clientv3.Event, ttl time.Duration) (Event, error) {
+	switch e.Type {
+	case mvccpb.DELETE:
+		sn := ParseSubnetKey(string(e.Kv.Key))
+		if sn == nil {
+			return Event{}, fmt.Errorf("delete %q: not a subnet, skipping", e.Kv.Key)
+		}
+		return Event{
+			Type:  EventRemoved,
+			Lease: Lease{Subnet: *sn},
+		}, nil
+
+	default:
+		l, err := kvToLease(e.Kv, ttl)
+		if err != nil {
+			return Event{}, err
+		}
+		return Event{
+			Type:  EventAdded,
+			Lease: *l,
+		}, nil
+	}
+}
+
+// kvToLease converts kv to a lease, which expires ttl from now unless it is a
+// reservation
+func kvToLease(kv *mvccpb.KeyValue, ttl time.Duration) (*Lease, error) {
+	sn := ParseSubnetKey(string(kv.Key))
+	if sn == nil {
+		return nil, fmt.Errorf("failed to parse subnet key %s", kv.Key)
+	}
+
+	attrs, sn6, err := decodeLeaseValue(string(kv.Value))
+	if err != nil {
+		return nil, err
+	}
+
+	// etcd only reports the remaining TTL of an etcd lease with an extra
+	// request, so a leased subnet is assumed to expire a full TTL from now.
+	// Reservations have no etcd lease and never expire.
+	exp := time.Time{}
+	if kv.Lease != int64(clientv3.NoLease) {
+		exp = time.Now().Add(ttl)
+	}
+
+	return &Lease{
+		Subnet:     *sn,
+		IPv6Subnet: sn6,
+		Attrs:      *attrs,
+		Expiration: exp,
+		Asof:       uint64(kv.ModRevision),
+	}, nil
+}
+
+func keyNotFound(key string, revision int64) error {
+	return etcd.Error{
+		Code:    etcd.ErrorCodeKeyNotFound,
+		Message: "Key not found",
+		Cause:   key,
+		Index:   uint64(revision),
+	}
+}
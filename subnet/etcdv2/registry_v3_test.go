@@ -0,0 +1,310 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcdv2
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"github.com/coreos/etcd/clientv3"
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	. "github.com/coreos/flannel/subnet"
+)
+
+// fakeEtcdV3 is an etcd v3 client whose transactions succeed or fail as
+// txnSucceeded tells, and whose gets return kvs. Each watch is served the next
+// of watches, then closed as if the connection was lost. It records the
+// revisions the watches start at and the revoked leases.
+type fakeEtcdV3 struct {
+	clientv3.KV
+	clientv3.Lease
+
+	txnSucceeded bool
+	// prevLease is the etcd lease of the key a successful put replaces
+	prevLease clientv3.LeaseID
+	kvs       []*mvccpb.KeyValue
+	revision  int64
+	nextLease clientv3.LeaseID
+	revoked   []clientv3.LeaseID
+	watches   [][]clientv3.WatchResponse
+	watchRevs []int64
+}
+
+func (f *fakeEtcdV3) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	return &clientv3.GetResponse{Header: &pb.ResponseHeader{Revision: f.revision}, Kvs: f.kvs}, nil
+}
+
+func (f *fakeEtcdV3) Txn(ctx context.Context) clientv3.Txn {
+	return &fakeTxn{f: f}
+}
+
+func (f *fakeEtcdV3) Grant(ctx context.Context, ttl int64) (*clientv3.LeaseGrantResponse, error) {
+	f.nextLease++
+	return &clientv3.LeaseGrantResponse{ID: f.nextLease, TTL: ttl}, nil
+}
+
+func (f *fakeEtcdV3) Revoke(ctx context.Context, id clientv3.LeaseID) (*clientv3.LeaseRevokeResponse, error) {
+	f.revoked = append(f.revoked, id)
+	return &clientv3.LeaseRevokeResponse{}, nil
+}
+
+func (f *fakeEtcdV3) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	// the revision of the options isn't exported
+	op := clientv3.OpGet(key, opts...)
+	f.watchRevs = append(f.watchRevs, reflect.ValueOf(op).FieldByName("rev").Int())
+
+	ch := make(chan clientv3.WatchResponse, 10)
+	if len(f.watches) > 0 {
+		for _, resp := range f.watches[0] {
+			ch <- resp
+		}
+		f.watches = f.watches[1:]
+	}
+	close(ch)
+	return ch
+}
+
+func (f *fakeEtcdV3) Close() error {
+	return nil
+}
+
+type fakeTxn struct {
+	f *fakeEtcdV3
+}
+
+func (t *fakeTxn) If(cs ...clientv3.Cmp) clientv3.Txn   { return t }
+func (t *fakeTxn) Then(ops ...clientv3.Op) clientv3.Txn { return t }
+func (t *fakeTxn) Else(ops ...clientv3.Op) clientv3.Txn { return t }
+
+func (t *fakeTxn) Commit() (*clientv3.TxnResponse, error) {
+	resp := &clientv3.TxnResponse{Header: &pb.ResponseHeader{Revision: t.f.revision}, Succeeded: t.f.txnSucceeded}
+	if resp.Succeeded {
+		put := &pb.PutResponse{}
+		if t.f.prevLease != clientv3.NoLease {
+			put.PrevKv = &mvccpb.KeyValue{Lease: int64(t.f.prevLease)}
+		}
+		resp.Responses = []*pb.ResponseOp{{Response: &pb.ResponseOp_ResponsePut{ResponsePut: put}}}
+	}
+	return resp, nil
+}
+
+func newTestEtcdV3Registry(f *fakeEtcdV3) *etcdV3SubnetRegistry {
+	return &etcdV3SubnetRegistry{cli: f, etcdCfg: &EtcdConfig{Prefix: "/coreos.com/network"}}
+}
+
+func subnetEvent(typ mvccpb.Event_EventType, subnet string, rev int64) *clientv3.Event {
+	kv := &mvccpb.KeyValue{Key: []byte("/coreos.com/network/subnets/" + subnet), ModRevision: rev}
+	if typ == mvccpb.PUT {
+		kv.Value = []byte(`{"PublicIP":"1.2.3.4"}`)
+	}
+	return &clientv3.Event{Type: typ, Kv: kv}
+}
+
+func TestKVToLease(t *testing.T) {
+	kv := &mvccpb.KeyValue{
+		Key:         []byte("/coreos.com/network/subnets/10.1.5.0-24"),
+		Value:       []byte(`{"PublicIP":"1.2.3.4","IPv6Subnet":"fc00:0:0:5::/64"}`),
+		ModRevision: 42,
+		Lease:       7,
+	}
+
+	l, err := kvToLease(kv, subnetTTL)
+	if err != nil {
+		t.Fatalf("kvToLease failed: %v", err)
+	}
+	if l.Subnet.String() != "10.1.5.0/24" || l.IPv6Subnet.String() != "fc00:0:0:5::/64" {
+		t.Errorf("Unexpected subnets %v %v", l.Subnet, l.IPv6Subnet)
+	}
+	if l.Attrs.PublicIP != ip.MustParseIP4("1.2.3.4") || l.Asof != 42 {
+		t.Errorf("Unexpected lease %+v", l)
+	}
+	if l.Expiration.IsZero() {
+		t.Error("Expected a leased subnet to expire")
+	}
+
+	// a subnet without an etcd lease is a reservation
+	kv.Lease = int64(clientv3.NoLease)
+	if l, err = kvToLease(kv, subnetTTL); err != nil {
+		t.Fatalf("kvToLease failed: %v", err)
+	}
+	if !l.Expiration.IsZero() {
+		t.Errorf("Expected a reservation not to expire, got %v", l.Expiration)
+	}
+
+	if _, err := kvToLease(&mvccpb.KeyValue{Key: []byte("/coreos.com/network/subnets/bad")}, subnetTTL); err == nil {
+		t.Error("Expected an error for a bad subnet key")
+	}
+}
+
+func TestWatchEventToEvent(t *testing.T) {
+	evt, err := watchEventToEvent(&clientv3.Event{
+		Type: mvccpb.DELETE,
+		Kv:   &mvccpb.KeyValue{Key: []byte("/coreos.com/network/subnets/10.1.5.0-24")},
+	}, subnetTTL)
+	if err != nil {
+		t.Fatalf("watchEventToEvent failed: %v", err)
+	}
+	if evt.Type != EventRemoved || evt.Lease.Subnet.String() != "10.1.5.0/24" {
+		t.Errorf("Unexpected event %+v", evt)
+	}
+
+	evt, err = watchEventToEvent(&clientv3.Event{
+		Type: mvccpb.PUT,
+		Kv: &mvccpb.KeyValue{
+			Key:   []byte("/coreos.com/network/subnets/10.1.6.0-24"),
+			Value: []byte(`{"PublicIP":"1.2.3.5"}`),
+		},
+	}, subnetTTL)
+	if err != nil {
+		t.Fatalf("watchEventToEvent failed: %v", err)
+	}
+	if evt.Type != EventAdded || evt.Lease.Attrs.PublicIP != ip.MustParseIP4("1.2.3.5") {
+		t.Errorf("Unexpected event %+v", evt)
+	}
+}
+
+func TestEtcdV3Watch(t *testing.T) {
+	f := &fakeEtcdV3{watches: [][]clientv3.WatchResponse{
+		// a transaction changed two leases at revision 42
+		{
+			{Created: true},
+			{Events: []*clientv3.Event{
+				subnetEvent(mvccpb.PUT, "10.1.5.0-24", 42),
+				subnetEvent(mvccpb.DELETE, "10.1.6.0-24", 42),
+				subnetEvent(mvccpb.PUT, "10.1.7.0-24", 43),
+			}},
+		},
+		// the connection was lost
+		{},
+		{{Events: []*clientv3.Event{subnetEvent(mvccpb.PUT, "10.1.7.0-24", 43)}}},
+	}}
+	esr := newTestEtcdV3Registry(f)
+	ctx := context.Background()
+
+	evts, index, err := esr.watchSubnets(ctx, 41)
+	if err != nil {
+		t.Fatalf("watchSubnets failed: %v", err)
+	}
+	if len(evts) != 2 || evts[0].Type != EventAdded || evts[0].Lease.Subnet.String() != "10.1.5.0/24" ||
+		evts[1].Type != EventRemoved || evts[1].Lease.Subnet.String() != "10.1.6.0/24" || index != 42 {
+		t.Errorf("Expected both events of revision 42, got %+v at %v", evts, index)
+	}
+
+	if _, _, err := esr.watchSubnets(ctx, index); err == nil {
+		t.Error("Expected an error for a closed watch")
+	}
+	evts, index, err = esr.watchSubnets(ctx, index)
+	if err != nil {
+		t.Fatalf("watchSubnets failed: %v", err)
+	}
+	if len(evts) != 1 || evts[0].Lease.Subnet.String() != "10.1.7.0/24" || index != 43 {
+		t.Errorf("Expected the event of revision 43, got %+v at %v", evts, index)
+	}
+
+	// each watch resumes after the revision of the last events, also
+	// after the connection was lost
+	if expected := []int64{42, 43, 43}; !reflect.DeepEqual(f.watchRevs, expected) {
+		t.Errorf("Expected the watches to start at revisions %v, got %v", expected, f.watchRevs)
+	}
+}
+
+func TestEtcdV3WatchCompacted(t *testing.T) {
+	f := &fakeEtcdV3{
+		watches: [][]clientv3.WatchResponse{{{Header: pb.ResponseHeader{Revision: 60}, CompactRevision: 50}}},
+		kvs: []*mvccpb.KeyValue{{
+			Key:         []byte("/coreos.com/network/subnets/10.1.5.0-24"),
+			Value:       []byte(`{"PublicIP":"1.2.3.4"}`),
+			ModRevision: 55,
+		}},
+		revision: 60,
+	}
+	esr := newTestEtcdV3Registry(f)
+
+	if _, _, err := esr.watchSubnets(context.Background(), 41); etcdErrorCode(err) != etcd.ErrorCodeEventIndexCleared {
+		t.Errorf("Expected index cleared for a compacted revision, got %v", err)
+	}
+
+	// the LocalManager takes a new snapshot instead
+	f.watches = [][]clientv3.WatchResponse{{{Header: pb.ResponseHeader{Revision: 60}, CompactRevision: 50}}}
+	m := newLocalManager(esr, ip.IP4Net{}, "")
+	result, err := m.WatchLeases(context.Background(), watchCursor{41})
+	if err != nil {
+		t.Fatalf("WatchLeases failed: %v", err)
+	}
+	if len(result.Snapshot) != 1 || result.Snapshot[0].Subnet.String() != "10.1.5.0/24" || result.Cursor != (watchCursor{60}) {
+		t.Errorf("Expected a snapshot at revision 60, got %+v", result)
+	}
+}
+
+func TestEtcdV3CreateSubnetExists(t *testing.T) {
+	f := &fakeEtcdV3{revision: 7}
+	esr := newTestEtcdV3Registry(f)
+	sn := ip.IP4Net{IP: ip.MustParseIP4("10.1.5.0"), PrefixLen: 24}
+
+	_, err := esr.createSubnet(context.Background(), sn, ip.IP6Net{}, &LeaseAttrs{}, time.Hour)
+	if etcdErrorCode(err) != etcd.ErrorCodeNodeExist || err.(etcd.Error).Index != 7 {
+		t.Errorf("Expected node exists at index 7 for a taken subnet, got %v", err)
+	}
+	// the lease granted for the subnet isn't used
+	if expected := []clientv3.LeaseID{1}; !reflect.DeepEqual(f.revoked, expected) {
+		t.Errorf("Expected leases %v to be revoked, got %v", expected, f.revoked)
+	}
+}
+
+func TestEtcdV3UpdateSubnet(t *testing.T) {
+	f := &fakeEtcdV3{revision: 7}
+	esr := newTestEtcdV3Registry(f)
+	ctx := context.Background()
+	sn := ip.IP4Net{IP: ip.MustParseIP4("10.1.5.0"), PrefixLen: 24}
+
+	_, err := esr.updateSubnet(ctx, sn, ip.IP6Net{}, &LeaseAttrs{}, time.Hour, 5)
+	if etcdErrorCode(err) != etcd.ErrorCodeTestFailed || err.(etcd.Error).Index != 7 {
+		t.Errorf("Expected compare failed at index 7 updating a stale lease, got %v", err)
+	}
+	if expected := []clientv3.LeaseID{1}; !reflect.DeepEqual(f.revoked, expected) {
+		t.Errorf("Expected the unused lease %v to be revoked, got %v", expected, f.revoked)
+	}
+
+	// the subnet moves to the new etcd lease, the previous one is revoked
+	f.txnSucceeded = true
+	f.prevLease = 1
+	f.revoked = nil
+	exp, err := esr.updateSubnet(ctx, sn, ip.IP6Net{}, &LeaseAttrs{}, time.Hour, 5)
+	if err != nil {
+		t.Fatalf("updateSubnet failed: %v", err)
+	}
+	if exp.IsZero() {
+		t.Error("Expected the lease to expire")
+	}
+	if expected := []clientv3.LeaseID{1}; !reflect.DeepEqual(f.revoked, expected) {
+		t.Errorf("Expected the previous lease %v to be revoked, got %v", expected, f.revoked)
+	}
+
+	// reservations have no etcd lease to revoke
+	f.prevLease = clientv3.NoLease
+	f.revoked = nil
+	if _, err := esr.updateSubnet(ctx, sn, ip.IP6Net{}, &LeaseAttrs{}, 0, 0); err != nil {
+		t.Fatalf("updateSubnet failed: %v", err)
+	}
+	if len(f.revoked) != 0 {
+		t.Errorf("Expected no lease to be revoked, got %v", f.revoked)
+	}
+}
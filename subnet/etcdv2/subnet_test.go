@@ -17,6 +17,7 @@ package etcdv2
 import (
 	"encoding/json"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 
@@ -35,13 +36,13 @@ func newDummyRegistry() *MockSubnetRegistry {
 
 	subnets := []Lease{
 		// leases within SubnetMin-SubnetMax range
-		{ip.IP4Net{ip.MustParseIP4("10.3.1.0"), 24}, attrs, exp, 10},
-		{ip.IP4Net{ip.MustParseIP4("10.3.2.0"), 24}, attrs, exp, 11},
-		{ip.IP4Net{ip.MustParseIP4("10.3.4.0"), 24}, attrs, exp, 12},
-		{ip.IP4Net{ip.MustParseIP4("10.3.5.0"), 24}, attrs, exp, 13},
+		{ip.IP4Net{ip.MustParseIP4("10.3.1.0"), 24}, ip.IP6Net{}, attrs, exp, 10},
+		{ip.IP4Net{ip.MustParseIP4("10.3.2.0"), 24}, ip.IP6Net{}, attrs, exp, 11},
+		{ip.IP4Net{ip.MustParseIP4("10.3.4.0"), 24}, ip.IP6Net{}, attrs, exp, 12},
+		{ip.IP4Net{ip.MustParseIP4("10.3.5.0"), 24}, ip.IP6Net{}, attrs, exp, 13},
 
 		// hand created lease outside the range of subnetMin-SubnetMax for testing removal
-		{ip.IP4Net{ip.MustParseIP4("10.3.31.0"), 24}, attrs, exp, 13},
+		{ip.IP4Net{ip.MustParseIP4("10.3.31.0"), 24}, ip.IP6Net{}, attrs, exp, 13},
 	}
 
 	config := `{ "Network": "10.3.0.0/16", "SubnetMin": "10.3.1.0", "SubnetMax": "10.3.25.0" }`
@@ -133,6 +134,61 @@ func TestConfigChanged(t *testing.T) {
 	}
 }
 
+func TestAcquireLeaseIPv6(t *testing.T) {
+	msr := newDummyRegistry()
+	sm := NewMockManager(msr)
+
+	extIaddr, _ := ip.ParseIP4("1.2.3.4")
+	attrs := LeaseAttrs{
+		PublicIP: extIaddr,
+	}
+
+	// Without an IPv6Network no IPv6 subnet is assigned
+	l, err := sm.AcquireLease(context.Background(), &attrs)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if !l.IPv6Subnet.Empty() {
+		t.Fatalf("AcquireLease assigned an IPv6 subnet without an IPv6Network: %v", l.IPv6Subnet)
+	}
+
+	msr.setConfig(`{ "Network": "10.3.0.0/16", "SubnetMin": "10.3.1.0", "SubnetMax": "10.3.25.0", "IPv6Network": "fc00::/48" }`)
+
+	// The existing lease is reused and assigned an IPv6 subnet
+	l2, err := sm.AcquireLease(context.Background(), &attrs)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if !l.Subnet.Equal(l2.Subnet) {
+		t.Fatalf("AcquireLease did not reuse subnet; expected %v, got %v", l.Subnet, l2.Subnet)
+	}
+	ipv6Network := ip.IP6Net{IP: ip.MustParseIP6("fc00::"), PrefixLen: 48}
+	if l2.IPv6Subnet.PrefixLen != 64 || !ipv6Network.Contains(l2.IPv6Subnet.IP) {
+		t.Fatalf("AcquireLease assigned an invalid IPv6 subnet: %v", l2.IPv6Subnet)
+	}
+
+	// Acquire again, should reuse both subnets
+	l3, err := sm.AcquireLease(context.Background(), &attrs)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if !l3.IPv6Subnet.Equal(l2.IPv6Subnet) {
+		t.Fatalf("AcquireLease did not reuse IPv6 subnet; expected %v, got %v", l2.IPv6Subnet, l3.IPv6Subnet)
+	}
+
+	// A new node gets a different IPv6 subnet
+	attrs2 := LeaseAttrs{
+		PublicIP: ip.MustParseIP4("1.2.3.5"),
+	}
+	l4, err := sm.AcquireLease(context.Background(), &attrs2)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if l4.IPv6Subnet.Empty() || l4.IPv6Subnet.Overlaps(l3.IPv6Subnet) {
+		t.Fatalf("AcquireLease assigned an overlapping IPv6 subnet: %v and %v", l4.IPv6Subnet, l3.IPv6Subnet)
+	}
+}
+
 func newIP4Net(ipaddr string, prefix uint) ip.IP4Net {
 	a, err := ip.ParseIP4(ipaddr)
 	if err != nil {
@@ -190,7 +246,7 @@ func TestWatchLeaseAdded(t *testing.T) {
 	attrs := &LeaseAttrs{
 		PublicIP: ip.MustParseIP4("1.1.1.1"),
 	}
-	_, err := msr.createSubnet(ctx, expected, attrs, 0)
+	_, err := msr.createSubnet(ctx, expected, ip.IP6Net{}, attrs, 0)
 	if err != nil {
 		t.Fatalf("createSubnet filed: %v", err)
 	}
@@ -312,6 +368,9 @@ func TestRenewLease(t *testing.T) {
 			if !sn.Expiration.Equal(expected) {
 				t.Errorf("Failed to renew lease: bad expiration; expected %v, got %v", expected, sn.Expiration)
 			}
+			// the lease records the pool of its subnet
+			pool := ip.IP4Net{IP: ip.MustParseIP4("10.3.0.0"), PrefixLen: 16}
+			attrs.Pool = &pool
 			if !reflect.DeepEqual(sn.Attrs, attrs) {
 				t.Errorf("LeaseAttrs changed: was %#v, now %#v", attrs, sn.Attrs)
 			}
@@ -322,6 +381,172 @@ func TestRenewLease(t *testing.T) {
 	t.Fatal("Failed to find acquired lease")
 }
 
+func TestLeaseTTL(t *testing.T) {
+	msr := newDummyRegistry()
+	sm := newLocalManager(msr, ip.IP4Net{}, "")
+	sm.leaseTTL = time.Hour
+	now := time.Now()
+	clock = clockwork.NewFakeClockAt(now)
+	defer func() { clock = clockwork.NewRealClock() }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	attrs := LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4")}
+	l, err := sm.AcquireLease(ctx, &attrs)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if expected := now.Add(time.Hour); !l.Expiration.Equal(expected) {
+		t.Errorf("expected the lease to expire at %v, got %v", expected, l.Expiration)
+	}
+
+	if err := sm.RenewLease(ctx, l); err != nil {
+		t.Fatal("RenewLease failed: ", err)
+	}
+	if expected := now.Add(time.Hour); !l.Expiration.Equal(expected) {
+		t.Errorf("expected the renewed lease to expire at %v, got %v", expected, l.Expiration)
+	}
+}
+
+func TestAcquireLeaseSubnetLen(t *testing.T) {
+	attrs := LeaseAttrs{
+		PublicIP: ip.MustParseIP4("1.1.1.1"),
+	}
+	config := `{ "Network": "10.3.0.0/16", "SubnetMin": "10.3.1.0", "SubnetMax": "10.3.25.0", "SubnetLenMin": 22, "SubnetLenMax": 26 }`
+	taken := ip.IP4Net{ip.MustParseIP4("10.3.4.0"), 24}
+
+	// /22 subnets are aligned, don't overlap the /24 lease and end within
+	// the range, 10.3.24.0/22 would end past 10.3.25.255
+	free22 := map[string]bool{"10.3.8.0/22": true, "10.3.12.0/22": true, "10.3.16.0/22": true, "10.3.20.0/22": true}
+	for i := 0; i < 10; i++ {
+		msr := NewMockRegistry(config, []Lease{{taken, ip.IP6Net{}, attrs, time.Time{}, 10}})
+		sm := newLocalManager(msr, ip.IP4Net{}, "")
+		sm.subnetLen = 22
+		l, err := sm.AcquireLease(context.Background(), &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4")})
+		if err != nil {
+			t.Fatal("AcquireLease failed: ", err)
+		}
+		if !free22[l.Subnet.String()] {
+			t.Fatalf("AcquireLease handed out %v, expected one of %v", l.Subnet, free22)
+		}
+	}
+
+	msr := NewMockRegistry(config, []Lease{{taken, ip.IP6Net{}, attrs, time.Time{}, 10}})
+	sm := newLocalManager(msr, ip.IP4Net{}, "")
+	sm.subnetLen = 26
+	l, err := sm.AcquireLease(context.Background(), &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4")})
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if l.Subnet.PrefixLen != 26 || l.Subnet.Overlaps(taken) {
+		t.Fatalf("AcquireLease handed out %v, expected a free /26", l.Subnet)
+	}
+
+	// lengths outside SubnetLenMin-SubnetLenMax are rejected
+	sm.subnetLen = 21
+	if _, err := sm.AcquireLease(context.Background(), &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.5")}); err == nil {
+		t.Fatal("AcquireLease accepted a subnet length outside the range")
+	}
+}
+
+func TestAcquireLeaseSubnetLenChanged(t *testing.T) {
+	config := `{ "Network": "10.3.0.0/16", "SubnetMin": "10.3.1.0", "SubnetMax": "10.3.25.0", "SubnetLenMin": 22 }`
+	pubIP := ip.MustParseIP4("1.2.3.4")
+	old := ip.IP4Net{ip.MustParseIP4("10.3.4.0"), 24}
+	msr := NewMockRegistry(config, []Lease{{old, ip.IP6Net{}, LeaseAttrs{PublicIP: pubIP}, time.Time{}, 10}})
+
+	// the lease of this node is of another length than it now requests
+	sm := newLocalManager(msr, ip.IP4Net{}, "")
+	sm.subnetLen = 22
+	l, err := sm.AcquireLease(context.Background(), &LeaseAttrs{PublicIP: pubIP})
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if l.Subnet.PrefixLen != 22 {
+		t.Fatalf("AcquireLease handed out %v, expected a /22", l.Subnet)
+	}
+	if _, _, err := msr.getSubnet(context.Background(), old); err == nil {
+		t.Errorf("expected the %v lease to be deleted", old)
+	}
+}
+
+func TestAcquireLeaseSubnetLenExhausted(t *testing.T) {
+	// no /22 starts within 10.3.1.0-10.3.3.255
+	config := `{ "Network": "10.3.0.0/16", "SubnetMin": "10.3.1.0", "SubnetMax": "10.3.3.0", "SubnetLenMin": 22 }`
+	sm := newLocalManager(NewMockRegistry(config, nil), ip.IP4Net{}, "")
+	sm.subnetLen = 22
+	if _, err := sm.AcquireLease(context.Background(), &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4")}); err == nil {
+		t.Fatal("AcquireLease handed out a /22 which doesn't fit the range")
+	}
+
+	// the /24 subnets still do
+	sm.subnetLen = 0
+	if _, err := sm.AcquireLease(context.Background(), &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4")}); err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+}
+
+func TestAcquireLeaseSecondaryNetworks(t *testing.T) {
+	// two subnets in Network, then three in the secondary network which,
+	// like Network, doesn't hand out its first subnet
+	config := `{ "Network": "10.3.0.0/16", "SubnetMin": "10.3.1.0", "SubnetMax": "10.3.2.0", "SecondaryNetworks": ["10.5.0.0/22"] }`
+	msr := NewMockRegistry(config, nil)
+	primary := ip.IP4Net{ip.MustParseIP4("10.3.0.0"), 16}
+	secondary := ip.IP4Net{ip.MustParseIP4("10.5.0.0"), 22}
+
+	var leases []*Lease
+	for i := 1; i <= 5; i++ {
+		sm := newLocalManager(msr, ip.IP4Net{}, "")
+		l, err := sm.AcquireLease(context.Background(), &LeaseAttrs{PublicIP: ip.IP4(ip.MustParseIP4("1.2.3.0") + ip.IP4(i))})
+		if err != nil {
+			t.Fatal("AcquireLease failed: ", err)
+		}
+		pool := primary
+		if i > 2 {
+			pool = secondary
+		}
+		// the first pool fills up before the next is used
+		if !pool.Contains(l.Subnet.IP) || l.Subnet.IP == pool.IP {
+			t.Fatalf("lease %d: AcquireLease handed out %v, expected a subnet of %v", i, l.Subnet, pool)
+		}
+		if l.Attrs.Pool == nil || *l.Attrs.Pool != pool {
+			t.Errorf("lease %d: expected the lease to record pool %v, got %v", i, pool, l.Attrs.Pool)
+		}
+		if stored, _, err := msr.getSubnet(context.Background(), l.Subnet); err != nil || stored.Attrs.Pool == nil || *stored.Attrs.Pool != pool {
+			t.Errorf("lease %d: expected the stored lease to record pool %v, got %+v, %v", i, pool, stored, err)
+		}
+		leases = append(leases, l)
+	}
+
+	sm := newLocalManager(msr, ip.IP4Net{}, "")
+	if _, err := sm.AcquireLease(context.Background(), &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.9")}); err == nil {
+		t.Fatal("AcquireLease handed out a subnet with all pools exhausted")
+	}
+
+	// a released subnet of the secondary network is handed out again
+	if err := msr.deleteSubnet(context.Background(), leases[2].Subnet); err != nil {
+		t.Fatal(err)
+	}
+	l, err := sm.AcquireLease(context.Background(), &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.9")})
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if l.Subnet != leases[2].Subnet || l.Attrs.Pool == nil || *l.Attrs.Pool != secondary {
+		t.Errorf("expected %v of pool %v to be handed out again, got %v of %v", leases[2].Subnet, secondary, l.Subnet, l.Attrs.Pool)
+	}
+
+	// leases in the secondary network are reused on restart
+	sm = newLocalManager(msr, ip.IP4Net{}, "")
+	l, err = sm.AcquireLease(context.Background(), &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4")})
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if l.Subnet != leases[3].Subnet {
+		t.Errorf("expected the lease %v to be reused, got %v", leases[3].Subnet, l.Subnet)
+	}
+}
+
 func inAllocatableRange(ctx context.Context, sm Manager, ipn ip.IP4Net) bool {
 	cfg, err := sm.GetNetworkConfig(ctx)
 	if err != nil {
@@ -330,3 +555,228 @@ func inAllocatableRange(ctx context.Context, sm Manager, ipn ip.IP4Net) bool {
 
 	return ipn.IP >= cfg.SubnetMin || ipn.IP <= cfg.SubnetMax
 }
+
+func TestLeaseHandoff(t *testing.T) {
+	sn := ip.IP4Net{ip.MustParseIP4("10.3.7.0"), 24}
+	oldAttrs := LeaseAttrs{
+		PublicIP: ip.MustParseIP4("1.1.1.1"),
+		NodeID:   "node-a",
+	}
+	newRegistry := func() *MockSubnetRegistry {
+		config := `{ "Network": "10.3.0.0/16", "SubnetMin": "10.3.1.0", "SubnetMax": "10.3.25.0" }`
+		return NewMockRegistry(config, []Lease{
+			{sn, ip.IP6Net{}, oldAttrs, clock.Now().Add(time.Minute), 10},
+		})
+	}
+
+	// The public IP changed across the restart, so only the node ID ties the lease to us
+	attrs := LeaseAttrs{
+		PublicIP: ip.MustParseIP4("1.2.3.4"),
+	}
+
+	msr := newRegistry()
+	sm := NewMockManagerWithNodeID(msr, sn, "node-a")
+	l, err := sm.AcquireLease(context.Background(), &attrs)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if !l.Subnet.Equal(sn) {
+		t.Fatalf("AcquireLease did not hand off lease; expected %v, got %v", sn, l.Subnet)
+	}
+	if l.Attrs.PublicIP != attrs.PublicIP || l.Attrs.NodeID != "node-a" {
+		t.Fatalf("AcquireLease did not update lease attrs: %v", l.Attrs)
+	}
+	if attrs.NodeID != "" {
+		t.Fatalf("AcquireLease modified the caller's attrs: %v", attrs)
+	}
+	leases, _, _ := msr.getSubnets(context.Background())
+	if len(leases) != 1 {
+		t.Fatalf("Unexpected number of leases %d (expected 1)", len(leases))
+	}
+
+	// Another node presenting the same subnet must not take the lease over
+	msr2 := newRegistry()
+	sm2 := NewMockManagerWithNodeID(msr2, sn, "node-b")
+	l2, err := sm2.AcquireLease(context.Background(), &attrs)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if l2.Subnet.Equal(sn) {
+		t.Fatalf("AcquireLease handed off lease %v held by another node", sn)
+	}
+}
+
+func TestAcquireLeaseAffinity(t *testing.T) {
+	msr := newDummyRegistry()
+	sm := NewMockManagerWithNodeID(msr, ip.IP4Net{}, "node-a")
+
+	attrs := LeaseAttrs{
+		PublicIP: ip.MustParseIP4("1.2.3.4"),
+	}
+	l, err := sm.AcquireLease(context.Background(), &attrs)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if aff, _ := msr.getAffinity(context.Background(), "node-a"); !aff.Equal(l.Subnet) {
+		t.Fatalf("AcquireLease did not record the subnet affinity; expected %v, got %v", l.Subnet, aff)
+	}
+
+	// The lease expired and the node came back with another IP and no subnet file
+	msr.expireSubnet("_", l.Subnet)
+	attrs.PublicIP = ip.MustParseIP4("1.2.3.5")
+	l2, err := sm.AcquireLease(context.Background(), &attrs)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if !l2.Subnet.Equal(l.Subnet) {
+		t.Fatalf("AcquireLease did not prefer the subnet last leased to the node; expected %v, got %v", l.Subnet, l2.Subnet)
+	}
+
+	// Another node took the subnet in the meantime
+	msr.expireSubnet("_", l.Subnet)
+	other := LeaseAttrs{
+		PublicIP: ip.MustParseIP4("1.2.3.6"),
+	}
+	if _, err := msr.createSubnet(context.Background(), l.Subnet, ip.IP6Net{}, &other, 0); err != nil {
+		t.Fatal("createSubnet failed: ", err)
+	}
+	attrs.PublicIP = ip.MustParseIP4("1.2.3.7")
+	l3, err := sm.AcquireLease(context.Background(), &attrs)
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if l3.Subnet.Equal(l.Subnet) {
+		t.Fatalf("AcquireLease reused subnet %v taken by another node", l.Subnet)
+	}
+	if aff, _ := msr.getAffinity(context.Background(), "node-a"); !aff.Equal(l3.Subnet) {
+		t.Fatalf("AcquireLease did not update the subnet affinity; expected %v, got %v", l3.Subnet, aff)
+	}
+}
+
+func TestCheckLeaseOverlap(t *testing.T) {
+	attrs := LeaseAttrs{
+		PublicIP: ip.MustParseIP4("1.1.1.1"),
+	}
+	lease := func(s string) Lease {
+		sn := ip.IP4Net{}
+		if err := sn.UnmarshalJSON([]byte(`"` + s + `"`)); err != nil {
+			t.Fatal(err)
+		}
+		return Lease{Subnet: sn, Attrs: attrs}
+	}
+
+	for _, tc := range []struct {
+		lease    string
+		subnet   string
+		overlaps bool
+	}{
+		// adjacent
+		{"10.3.1.0/24", "10.3.2.0/24", false},
+		{"10.3.2.0/24", "10.3.1.0/24", false},
+		{"10.3.0.0/23", "10.3.2.0/24", false},
+		{"10.3.1.128/25", "10.3.1.0/25", false},
+		// nested
+		{"10.3.0.0/16", "10.3.5.0/24", true},
+		{"10.3.5.0/24", "10.3.0.0/16", true},
+		{"10.3.1.0/24", "10.3.1.128/25", true},
+		{"10.3.0.0/23", "10.3.1.0/24", true},
+		// the lease being reused
+		{"10.3.1.0/24", "10.3.1.0/24", false},
+	} {
+		l := lease(tc.lease)
+		sn := lease(tc.subnet).Subnet
+		err := checkLeaseOverlap([]Lease{l}, sn, ip.IP6Net{})
+		if tc.overlaps && err == nil {
+			t.Errorf("%v with lease %v: expected an overlap error", tc.subnet, tc.lease)
+		}
+		if !tc.overlaps && err != nil {
+			t.Errorf("%v with lease %v: unexpected error: %v", tc.subnet, tc.lease, err)
+		}
+	}
+
+	// IPv6 subnets are checked too
+	l := Lease{
+		Subnet:     lease("10.3.1.0/24").Subnet,
+		IPv6Subnet: ip.IP6Net{IP: ip.MustParseIP6("fc00:0:0:5::"), PrefixLen: 64},
+		Attrs:      attrs,
+	}
+	sn := lease("10.3.2.0/24").Subnet
+	if err := checkLeaseOverlap([]Lease{l}, sn, ip.IP6Net{IP: ip.MustParseIP6("fc00::"), PrefixLen: 48}); err == nil {
+		t.Error("expected an overlap error for nested IPv6 subnets")
+	}
+	if err := checkLeaseOverlap([]Lease{l}, sn, ip.IP6Net{IP: ip.MustParseIP6("fc00:0:0:6::"), PrefixLen: 64}); err != nil {
+		t.Errorf("unexpected error for adjacent IPv6 subnets: %v", err)
+	}
+}
+
+func TestAcquireLeaseOverlap(t *testing.T) {
+	attrs := LeaseAttrs{
+		PublicIP: ip.MustParseIP4("1.1.1.1"),
+	}
+	// a lease left by a manager whose network config overlaps ours
+	config := `{ "Network": "10.3.0.0/16", "SubnetMin": "10.3.1.0", "SubnetMax": "10.3.25.0" }`
+	msr := NewMockRegistry(config, []Lease{
+		{ip.IP4Net{ip.MustParseIP4("10.3.0.0"), 20}, ip.IP6Net{}, attrs, time.Time{}, 10},
+	})
+
+	// the previous subnet overlaps that lease, so a fresh subnet is used
+	prevSubnet := ip.IP4Net{ip.MustParseIP4("10.3.6.0"), 24}
+	sm := NewMockManagerWithSubnet(msr, prevSubnet)
+	l, err := sm.AcquireLease(context.Background(), &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4")})
+	if err != nil {
+		t.Fatal("AcquireLease failed: ", err)
+	}
+	if l.Subnet.Overlaps(ip.IP4Net{ip.MustParseIP4("10.3.0.0"), 20}) {
+		t.Fatalf("AcquireLease handed out %v which overlaps an existing lease", l.Subnet)
+	}
+
+	// reusing a lease which overlaps another one is rejected
+	msr2 := NewMockRegistry(config, []Lease{
+		{ip.IP4Net{ip.MustParseIP4("10.3.0.0"), 20}, ip.IP6Net{}, attrs, time.Time{}, 10},
+		{ip.IP4Net{ip.MustParseIP4("10.3.6.0"), 24}, ip.IP6Net{}, LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4")}, time.Time{}, 11},
+	})
+	sm2 := NewMockManager(msr2)
+	if _, err := sm2.AcquireLease(context.Background(), &LeaseAttrs{PublicIP: ip.MustParseIP4("1.2.3.4")}); err == nil {
+		t.Fatal("AcquireLease reused a lease overlapping another one")
+	}
+}
+
+func TestLockNode(t *testing.T) {
+	msr := newDummyRegistry()
+	sm := newLocalManager(msr, ip.IP4Net{}, "node-a")
+	sm.lockTTL = 30 * time.Millisecond
+	sm2 := newLocalManager(msr, ip.IP4Net{}, "node-a")
+	sm2.lockTTL = 30 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	if _, err := sm.LockNode(ctx, &wg); err != nil {
+		t.Fatal("LockNode failed: ", err)
+	}
+
+	// the second manager waits while the first holds the lock
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	if _, err := sm2.LockNode(ctx2, &wg); err != context.DeadlineExceeded {
+		t.Fatalf("expected LockNode to wait for the lock, got %v", err)
+	}
+	cancel2()
+
+	// and gets it once the first stopped
+	cancel()
+	wg.Wait()
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	lost, err := sm2.LockNode(ctx, &wg)
+	if err != nil {
+		t.Fatal("LockNode failed: ", err)
+	}
+
+	msr.mux.Lock()
+	msr.locks["node-a"] = "someone else"
+	msr.mux.Unlock()
+	select {
+	case <-lost:
+	case <-time.After(time.Second):
+		t.Fatal("expected the lock to be lost")
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/coreos/flannel/subnet"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// netConfKey is the key of the ConfigMap mounted at netConfPath which holds
+// the network config
+const netConfKey = "net-conf.json"
+
+// parseConfigMapName splits a ConfigMap given as namespace/name, or as a name
+// in defaultNamespace
+func parseConfigMapName(s, defaultNamespace string) (string, string, error) {
+	namespace, name := defaultNamespace, s
+	if i := strings.Index(s, "/"); i >= 0 {
+		namespace, name = s[:i], s[i+1:]
+	}
+	if namespace == "" || name == "" || strings.Contains(name, "/") {
+		return "", "", fmt.Errorf("invalid ConfigMap %q: must be namespace/name, or a name when POD_NAMESPACE is set", s)
+	}
+	return namespace, name, nil
+}
+
+// watchConfigMap makes ksm follow the network config in the net-conf.json key
+// of the ConfigMap namespace/name once it runs
+func (ksm *kubeSubnetManager) watchConfigMap(namespace, name string) {
+	selector := fields.OneTermEqualSelector("metadata.name", name).String()
+	_, controller := cache.NewInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				options.FieldSelector = selector
+				return ksm.client.CoreV1().ConfigMaps(namespace).List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				options.FieldSelector = selector
+				return ksm.client.CoreV1().ConfigMaps(namespace).Watch(options)
+			},
+		},
+		&v1.ConfigMap{},
+		resyncPeriod,
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: ksm.handleConfigMap,
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				ksm.handleConfigMap(newObj)
+			},
+		},
+	)
+	ksm.configController = controller
+	ksm.configChanges = make(chan *subnet.Config, 1)
+}
+
+// handleConfigMap updates the network config from the ConfigMap obj if it
+// changed and is valid, and queues it for WatchNetworkConfig
+func (ksm *kubeSubnetManager) handleConfigMap(obj interface{}) {
+	cm := obj.(*v1.ConfigMap)
+	netConf, ok := cm.Data[netConfKey]
+	if !ok {
+		glog.Warningf("ConfigMap %s/%s has no %s key, keeping the network config", cm.Namespace, cm.Name, netConfKey)
+		return
+	}
+
+	ksm.confMu.Lock()
+	defer ksm.confMu.Unlock()
+
+	if netConf == ksm.netConf {
+		return
+	}
+	sc, err := subnet.ParseConfig(netConf)
+	if err != nil {
+		glog.Errorf("Error parsing %s of ConfigMap %s/%s, keeping the network config: %v", netConfKey, cm.Namespace, cm.Name, err)
+		return
+	}
+	glog.Infof("Network config changed in ConfigMap %s/%s", cm.Namespace, cm.Name)
+	ksm.netConf = netConf
+	ksm.subnetConf = sc
+
+	// only the latest config matters to a watcher which didn't take the
+	// previous one yet
+	select {
+	case <-ksm.configChanges:
+	default:
+	}
+	ksm.configChanges <- sc
+}
+
+// WatchNetworkConfig sends the network config to receiver each time it
+// changes in the ConfigMap, see subnet.ConfigWatcher. Without a ConfigMap to
+// watch it only returns once ctx is done.
+func (ksm *kubeSubnetManager) WatchNetworkConfig(ctx context.Context, receiver chan<- *subnet.Config) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sc := <-ksm.configChanges:
+			select {
+			case receiver <- sc:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+
+	"github.com/coreos/flannel/subnet"
+)
+
+func TestParseConfigMapName(t *testing.T) {
+	for _, tc := range []struct {
+		s, defaultNamespace string
+		namespace, name     string
+		fail                bool
+	}{
+		{s: "kube-system/kube-flannel-cfg", namespace: "kube-system", name: "kube-flannel-cfg"},
+		{s: "kube-flannel-cfg", defaultNamespace: "flannel", namespace: "flannel", name: "kube-flannel-cfg"},
+		{s: "kube-flannel-cfg", fail: true},
+		{s: "kube-system/", fail: true},
+		{s: "a/b/c", fail: true},
+	} {
+		namespace, name, err := parseConfigMapName(tc.s, tc.defaultNamespace)
+		if tc.fail {
+			if err == nil {
+				t.Errorf("%q: expected an error", tc.s)
+			}
+			continue
+		}
+		if err != nil || namespace != tc.namespace || name != tc.name {
+			t.Errorf("%q: expected %s/%s, got %s/%s, %v", tc.s, tc.namespace, tc.name, namespace, name, err)
+		}
+	}
+}
+
+func TestHandleConfigMap(t *testing.T) {
+	initial := `{"Network": "10.0.0.0/16", "Backend": {"Type": "gce"}}`
+	sc, err := subnet.ParseConfig(initial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ksm := &kubeSubnetManager{subnetConf: sc, netConf: initial, configChanges: make(chan *subnet.Config, 1)}
+	configMap := func(netConf string) *v1.ConfigMap {
+		return &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "kube-flannel-cfg"},
+			Data:       map[string]string{netConfKey: netConf},
+		}
+	}
+
+	// unchanged and invalid configs are ignored
+	ksm.handleConfigMap(configMap(initial))
+	ksm.handleConfigMap(configMap(`{"Network": "10.0.0.0/16", "Backend": `))
+	ksm.handleConfigMap(&v1.ConfigMap{})
+	select {
+	case sc := <-ksm.configChanges:
+		t.Fatalf("unexpected config change %+v", sc)
+	default:
+	}
+
+	// only the latest change is kept for the watcher
+	ksm.handleConfigMap(configMap(`{"Network": "10.0.0.0/16", "Backend": {"Type": "gce", "RoutePriority": 900}}`))
+	ksm.handleConfigMap(configMap(`{"Network": "10.0.0.0/16", "Backend": {"Type": "gce", "RoutePriority": 800}}`))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	configs := make(chan *subnet.Config)
+	go ksm.WatchNetworkConfig(ctx, configs)
+	sc = <-configs
+	if string(sc.Backend) != `{"Type": "gce", "RoutePriority": 800}` {
+		t.Errorf("expected the latest backend config, got %s", sc.Backend)
+	}
+	if current, _ := ksm.GetNetworkConfig(ctx); current != sc {
+		t.Errorf("expected GetNetworkConfig to return the latest config, got %+v", current)
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/time/rate"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+
+	"github.com/coreos/flannel/pkg/logging"
+)
+
+const (
+	eventSource = "flannel"
+
+	// events are dropped beyond eventBurst at once and one every
+	// eventInterval on average, and an event identical to one recorded
+	// less than eventRepeatInterval ago is dropped, so that retry loops
+	// don't flood the API
+	eventBurst          = 10
+	eventInterval       = 10 * time.Second
+	eventRepeatInterval = 5 * time.Minute
+)
+
+// subnetLogger gates the verbose logs of the subnet manager on the level of
+// the subnet subsystem
+var subnetLogger = logging.New("subnet")
+
+// eventRecorder records events on the node flannel runs on, so that they are
+// shown by kubectl describe node
+type eventRecorder struct {
+	nodeName string
+	// create sends an event to the API
+	create  func(*v1.Event) error
+	limiter *rate.Limiter
+	now     func() time.Time
+
+	// mu guards recorded, when each event was last recorded by its type,
+	// reason and message
+	mu       sync.Mutex
+	recorded map[string]time.Time
+}
+
+func newEventRecorder(c clientset.Interface, nodeName string) *eventRecorder {
+	return &eventRecorder{
+		nodeName: nodeName,
+		create: func(e *v1.Event) error {
+			_, err := c.CoreV1().Events(e.Namespace).Create(e)
+			return err
+		},
+		limiter:  rate.NewLimiter(rate.Every(eventInterval), eventBurst),
+		now:      time.Now,
+		recorded: make(map[string]time.Time),
+	}
+}
+
+// Eventf records an event on the node in the background, unless it is rate
+// limited
+func (r *eventRecorder) Eventf(eventType, reason, messageFmt string, args ...interface{}) {
+	message := fmt.Sprintf(messageFmt, args...)
+	now := r.now()
+	if !r.allow(eventType+"/"+reason+"/"+message, now) {
+		subnetLogger.V(2).Infof("Dropping rate limited event %v: %v", reason, message)
+		return
+	}
+
+	event := r.makeEvent(eventType, reason, message, now)
+	go func() {
+		if err := r.create(event); err != nil {
+			glog.Warningf("Error recording event %v on node %v: %v", reason, r.nodeName, err)
+		}
+	}()
+}
+
+// allow returns true if the event identified by key can be recorded at now
+func (r *eventRecorder) allow(key string, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for k, t := range r.recorded {
+		if now.Sub(t) >= eventRepeatInterval {
+			delete(r.recorded, k)
+		}
+	}
+	if _, ok := r.recorded[key]; ok {
+		return false
+	}
+	if !r.limiter.AllowN(now, 1) {
+		return false
+	}
+	r.recorded[key] = now
+	return true
+}
+
+func (r *eventRecorder) makeEvent(eventType, reason, message string, now time.Time) *v1.Event {
+	t := metav1.NewTime(now)
+	return &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: fmt.Sprintf("%v.%x", r.nodeName, now.UnixNano()),
+			// nodes aren't namespaced, their events go to the
+			// default namespace like the kubelet's
+			Namespace: metav1.NamespaceDefault,
+		},
+		// kubectl describe node finds the events of a node by its
+		// name used as the UID, as the kubelet records them
+		InvolvedObject: v1.ObjectReference{
+			Kind: "Node",
+			Name: r.nodeName,
+			UID:  types.UID(r.nodeName),
+		},
+		Reason:         reason,
+		Message:        message,
+		FirstTimestamp: t,
+		LastTimestamp:  t,
+		Count:          1,
+		Type:           eventType,
+		Source:         v1.EventSource{Component: eventSource, Host: r.nodeName},
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestEventRecorderRateLimit(t *testing.T) {
+	now := time.Now()
+	created := make(chan *v1.Event, 100)
+	r := &eventRecorder{
+		nodeName: "node",
+		create: func(e *v1.Event) error {
+			created <- e
+			return nil
+		},
+		limiter:  rate.NewLimiter(rate.Every(eventInterval), 2),
+		now:      func() time.Time { return now },
+		recorded: make(map[string]time.Time),
+	}
+
+	for i := 0; i < 3; i++ {
+		r.Eventf(v1.EventTypeWarning, "RouteCreateFailed", "Failed to create route to %v", "10.0.1.0/24")
+	}
+	e := <-created
+	if e.InvolvedObject.Kind != "Node" || e.InvolvedObject.Name != "node" || e.Reason != "RouteCreateFailed" {
+		t.Errorf("unexpected event %+v", e)
+	}
+
+	// a different event is within the burst, a third one isn't
+	r.Eventf(v1.EventTypeNormal, "RouteCreated", "Created route to %v", "10.0.1.0/24")
+	<-created
+	r.Eventf(v1.EventTypeNormal, "RouteDeleted", "Deleted route to %v", "10.0.1.0/24")
+
+	// repeats are allowed again after a while
+	now = now.Add(eventRepeatInterval)
+	r.Eventf(v1.EventTypeWarning, "RouteCreateFailed", "Failed to create route to %v", "10.0.1.0/24")
+	if e := <-created; e.Reason != "RouteCreateFailed" {
+		t.Errorf("expected the repeated event after %v, got %v", eventRepeatInterval, e.Reason)
+	}
+
+	select {
+	case e := <-created:
+		t.Errorf("unexpected event %v", e.Reason)
+	default:
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"io/ioutil"
 	"net"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/coreos/flannel/pkg/ip"
@@ -29,11 +30,9 @@ import (
 	"github.com/golang/glog"
 	"golang.org/x/net/context"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/strategicpatch"
 	"k8s.io/apimachinery/pkg/util/wait"
-	"k8s.io/apimachinery/pkg/watch"
 	clientset "k8s.io/client-go/kubernetes"
 	listers "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/pkg/api"
@@ -65,11 +64,30 @@ type kubeSubnetManager struct {
 	nodeName       string
 	nodeStore      listers.NodeLister
 	nodeController cache.Controller
-	subnetConf     *subnet.Config
 	events         chan subnet.Event
+	recorder       *eventRecorder
+	// leaseTTL is how far in the future leases are reported to expire
+	leaseTTL time.Duration
+	// podCIDRs holds the pod CIDRs of the nodes in nodeStore
+	podCIDRs podCIDRStore
+
+	// confMu guards subnetConf and netConf, the network config and the
+	// net-conf.json it was parsed from, which change when the ConfigMap
+	// is watched
+	confMu     sync.RWMutex
+	subnetConf *subnet.Config
+	netConf    string
+	// configController watches the ConfigMap, if configured, and
+	// configChanges holds the latest config it found
+	configController cache.Controller
+	configChanges    chan *subnet.Config
 }
 
-func NewSubnetManager(apiUrl, kubeconfig string) (subnet.Manager, error) {
+// NewSubnetManager returns a subnet manager using the pod CIDRs of nodes as
+// their subnets. Unless configMap is empty, the network config follows the
+// net-conf.json key of that ConfigMap, given as namespace/name or as a name in
+// the namespace of the pod.
+func NewSubnetManager(apiUrl, kubeconfig string, leaseTTL time.Duration, configMap string) (subnet.Manager, error) {
 
 	var cfg *rest.Config
 	var err error
@@ -126,6 +144,18 @@ func NewSubnetManager(apiUrl, kubeconfig string) (subnet.Manager, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error creating network manager: %s", err)
 	}
+	if leaseTTL > 0 {
+		sm.leaseTTL = leaseTTL
+	}
+	sm.netConf = string(netConf)
+	if configMap != "" {
+		namespace, name, err := parseConfigMapName(configMap, os.Getenv("POD_NAMESPACE"))
+		if err != nil {
+			return nil, err
+		}
+		glog.Infof("Watching ConfigMap %s/%s for network config changes", namespace, name)
+		sm.watchConfigMap(namespace, name)
+	}
 	go sm.Run(context.Background())
 
 	glog.Infof("Waiting %s for node controller to sync", nodeControllerSyncTimeout)
@@ -146,14 +176,12 @@ func newKubeSubnetManager(c clientset.Interface, sc *subnet.Config, nodeName str
 	ksm.nodeName = nodeName
 	ksm.subnetConf = sc
 	ksm.events = make(chan subnet.Event, 5000)
+	ksm.recorder = newEventRecorder(c, nodeName)
+	ksm.leaseTTL = subnet.DefaultLeaseTTL
 	indexer, controller := cache.NewIndexerInformer(
 		&cache.ListWatch{
-			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
-				return ksm.client.CoreV1().Nodes().List(options)
-			},
-			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
-				return ksm.client.CoreV1().Nodes().Watch(options)
-			},
+			ListFunc:  ksm.listNodes,
+			WatchFunc: ksm.watchNodes,
 		},
 		&v1.Node{},
 		resyncPeriod,
@@ -179,7 +207,7 @@ func (ksm *kubeSubnetManager) handleAddLeaseEvent(et subnet.EventType, obj inter
 		return
 	}
 
-	l, err := nodeToLease(*n)
+	l, err := ksm.nodeLease(*n)
 	if err != nil {
 		glog.Infof("Error turning node %q to lease: %v", n.ObjectMeta.Name, err)
 		return
@@ -193,13 +221,24 @@ func (ksm *kubeSubnetManager) handleUpdateLeaseEvent(oldObj, newObj interface{})
 	if s, ok := n.Annotations[subnetKubeManagedAnnotation]; !ok || s != "true" {
 		return
 	}
+	// the podCIDRs of dual-stack clusters aren't in the node objects, so an
+	// IPv6 pod CIDR added or changed alone only shows in ksm.podCIDRs
+	podCIDRsChanged := ksm.podCIDRs.takeChanged(n.Name)
 	if o.Annotations[backendDataAnnotation] == n.Annotations[backendDataAnnotation] &&
 		o.Annotations[backendTypeAnnotation] == n.Annotations[backendTypeAnnotation] &&
-		o.Annotations[backendPublicIPAnnotation] == n.Annotations[backendPublicIPAnnotation] {
+		o.Annotations[backendPublicIPAnnotation] == n.Annotations[backendPublicIPAnnotation] &&
+		o.Spec.PodCIDR == n.Spec.PodCIDR && !podCIDRsChanged {
 		return // No change to lease
 	}
 
-	l, err := nodeToLease(*n)
+	// the lease of the old pod CIDR goes away with it
+	if o.Spec.PodCIDR != n.Spec.PodCIDR {
+		if ol, err := nodeToLease(*o); err == nil {
+			ksm.events <- subnet.Event{Type: subnet.EventRemoved, Lease: ol}
+		}
+	}
+
+	l, err := ksm.nodeLease(*n)
 	if err != nil {
 		glog.Infof("Error turning node %q to lease: %v", n.ObjectMeta.Name, err)
 		return
@@ -208,11 +247,13 @@ func (ksm *kubeSubnetManager) handleUpdateLeaseEvent(oldObj, newObj interface{})
 }
 
 func (ksm *kubeSubnetManager) GetNetworkConfig(ctx context.Context) (*subnet.Config, error) {
+	ksm.confMu.RLock()
+	defer ksm.confMu.RUnlock()
 	return ksm.subnetConf, nil
 }
 
 func (ksm *kubeSubnetManager) AcquireLease(ctx context.Context, attrs *subnet.LeaseAttrs) (*subnet.Lease, error) {
-	cachedNode, err := ksm.nodeStore.Get(ksm.nodeName)
+	cachedNode, err := ksm.waitForPodCIDR(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -222,9 +263,6 @@ func (ksm *kubeSubnetManager) AcquireLease(ctx context.Context, attrs *subnet.Le
 	}
 	n := nobj.(*v1.Node)
 
-	if n.Spec.PodCIDR == "" {
-		return nil, fmt.Errorf("node %q pod cidr not assigned", ksm.nodeName)
-	}
 	bd, err := attrs.BackendData.MarshalJSON()
 	if err != nil {
 		return nil, err
@@ -233,6 +271,12 @@ func (ksm *kubeSubnetManager) AcquireLease(ctx context.Context, attrs *subnet.Le
 	if err != nil {
 		return nil, err
 	}
+	var sn6 ip.IP6Net
+	if sc, _ := ksm.GetNetworkConfig(ctx); sc.EnableIPv6() {
+		if sn6, err = ksm.nodeIPv6Subnet(sc, ksm.nodeName); err != nil {
+			return nil, err
+		}
+	}
 	if n.Annotations[backendDataAnnotation] != string(bd) ||
 		n.Annotations[backendTypeAnnotation] != attrs.BackendType ||
 		n.Annotations[backendPublicIPAnnotation] != attrs.PublicIP.String() ||
@@ -274,8 +318,9 @@ func (ksm *kubeSubnetManager) AcquireLease(ctx context.Context, attrs *subnet.Le
 	}
 	return &subnet.Lease{
 		Subnet:     ip.FromIPNet(cidr),
+		IPv6Subnet: sn6,
 		Attrs:      *attrs,
-		Expiration: time.Now().Add(24 * time.Hour),
+		Expiration: time.Now().Add(ksm.leaseTTL),
 	}, nil
 }
 
@@ -292,9 +337,27 @@ func (ksm *kubeSubnetManager) WatchLeases(ctx context.Context, cursor interface{
 
 func (ksm *kubeSubnetManager) Run(ctx context.Context) {
 	glog.Infof("Starting kube subnet manager")
+	if ksm.configController != nil {
+		go ksm.configController.Run(ctx.Done())
+	}
 	ksm.nodeController.Run(ctx.Done())
 }
 
+// nodeLease returns the lease of n, with the IPv6 subnet of the node when the
+// network config has an IPv6Network
+func (ksm *kubeSubnetManager) nodeLease(n v1.Node) (subnet.Lease, error) {
+	l, err := nodeToLease(n)
+	if err != nil {
+		return l, err
+	}
+	if sc, _ := ksm.GetNetworkConfig(context.TODO()); sc != nil && sc.EnableIPv6() {
+		if l.IPv6Subnet, err = ksm.nodeIPv6Subnet(sc, n.Name); err != nil {
+			glog.Warningf("Following node %q without an IPv6 subnet: %v", n.Name, err)
+		}
+	}
+	return l, nil
+}
+
 func nodeToLease(n v1.Node) (l subnet.Lease, err error) {
 	l.Attrs.PublicIP, err = ip.ParseIP4(n.Annotations[backendPublicIPAnnotation])
 	if err != nil {
@@ -322,6 +385,11 @@ func (ksm *kubeSubnetManager) WatchLease(ctx context.Context, sn ip.IP4Net, curs
 	return subnet.LeaseWatchResult{}, ErrUnimplemented
 }
 
+// Eventf records an event on the node, see subnet.EventRecorder
+func (ksm *kubeSubnetManager) Eventf(eventType, reason, messageFmt string, args ...interface{}) {
+	ksm.recorder.Eventf(eventType, reason, messageFmt, args...)
+}
+
 func (ksm *kubeSubnetManager) Name() string {
 	return fmt.Sprintf("Kubernetes Subnet Manager - %s", ksm.nodeName)
 }
@@ -0,0 +1,292 @@
+// Copyright 2024 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/pkg/api/v1"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// podCIDRPollInterval is how often the node is checked while waiting for its
+// pod CIDR to be assigned
+const podCIDRPollInterval = time.Second
+
+// waitForPodCIDR returns the node from the store once it has a pod CIDR, which
+// the controller manager assigns some time after the node registers, or the
+// error of ctx once it is done
+func (ksm *kubeSubnetManager) waitForPodCIDR(ctx context.Context) (*v1.Node, error) {
+	for logged := false; ; logged = true {
+		n, err := ksm.nodeStore.Get(ksm.nodeName)
+		if err != nil {
+			return nil, err
+		}
+		if n.Spec.PodCIDR != "" {
+			return n, nil
+		}
+		if !logged {
+			glog.Infof("Waiting for node %q to be assigned a pod CIDR", ksm.nodeName)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(podCIDRPollInterval):
+		}
+	}
+}
+
+// rawNode is the part of a node object that the pod CIDRs are read from
+type rawNode struct {
+	Metadata struct {
+		Name string `json:"name"`
+	} `json:"metadata"`
+	Spec struct {
+		PodCIDR  string   `json:"podCIDR"`
+		PodCIDRs []string `json:"podCIDRs"`
+	} `json:"spec"`
+}
+
+// podCIDRs returns the podCIDRs of dual-stack clusters, which the vendored API
+// types predate, or else the podCIDR of the node
+func (n *rawNode) podCIDRs() []string {
+	if len(n.Spec.PodCIDRs) > 0 {
+		return n.Spec.PodCIDRs
+	}
+	if n.Spec.PodCIDR != "" {
+		return []string{n.Spec.PodCIDR}
+	}
+	return nil
+}
+
+// nodePodCIDRs returns the pod CIDRs in the spec of the node in raw
+func nodePodCIDRs(raw []byte) ([]string, error) {
+	var node rawNode
+	if err := json.Unmarshal(raw, &node); err != nil {
+		return nil, fmt.Errorf("error decoding node: %v", err)
+	}
+	return node.podCIDRs(), nil
+}
+
+// podCIDRStore holds the pod CIDRs of the nodes by name. The node informer
+// fills it from the raw node objects before they reach its store, as the
+// vendored API types drop the podCIDRs. As the node objects can't tell a
+// change of pod CIDRs only in the podCIDRs either, changed holds the nodes
+// whose pod CIDRs changed since their last event was handled.
+type podCIDRStore struct {
+	mu      sync.Mutex
+	byNode  map[string][]string
+	changed map[string]bool
+}
+
+// replace sets the pod CIDRs of the listed nodes, forgetting all others
+func (s *podCIDRStore) replace(nodes []rawNode) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := s.byNode
+	s.byNode = make(map[string][]string, len(nodes))
+	for i := range nodes {
+		name, cidrs := nodes[i].Metadata.Name, nodes[i].podCIDRs()
+		if prev, ok := old[name]; ok && !sameCIDRs(prev, cidrs) {
+			s.markChanged(name)
+		}
+		s.byNode[name] = cidrs
+	}
+}
+
+// set sets the pod CIDRs of the named node, returning whether they differ
+// from those it had
+func (s *podCIDRStore) set(name string, cidrs []string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.byNode == nil {
+		s.byNode = make(map[string][]string)
+	}
+	prev, ok := s.byNode[name]
+	s.byNode[name] = cidrs
+	if ok && !sameCIDRs(prev, cidrs) {
+		s.markChanged(name)
+		return true
+	}
+	return false
+}
+
+func (s *podCIDRStore) remove(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.byNode, name)
+	delete(s.changed, name)
+}
+
+// takeChanged returns whether the pod CIDRs of the named node changed since
+// it was last called for the node
+func (s *podCIDRStore) takeChanged(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := s.changed[name]
+	delete(s.changed, name)
+	return changed
+}
+
+func (s *podCIDRStore) markChanged(name string) {
+	if s.changed == nil {
+		s.changed = make(map[string]bool)
+	}
+	s.changed[name] = true
+}
+
+func sameCIDRs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *podCIDRStore) get(name string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.byNode[name]
+}
+
+// listNodes lists the nodes like the typed client, also recording their pod
+// CIDRs
+func (ksm *kubeSubnetManager) listNodes(options metav1.ListOptions) (runtime.Object, error) {
+	raw, err := ksm.client.CoreV1().RESTClient().Get().
+		Resource("nodes").
+		VersionedParams(&options, scheme.ParameterCodec).
+		DoRaw()
+	if err != nil {
+		return nil, err
+	}
+	obj, err := runtime.Decode(scheme.Codecs.UniversalDeserializer(), raw)
+	if err != nil {
+		return nil, err
+	}
+	var list struct {
+		Items []rawNode `json:"items"`
+	}
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, fmt.Errorf("error decoding node list: %v", err)
+	}
+	ksm.podCIDRs.replace(list.Items)
+	return obj, nil
+}
+
+// watchNodes watches the nodes like the typed client, also recording the pod
+// CIDRs of the nodes in the events
+func (ksm *kubeSubnetManager) watchNodes(options metav1.ListOptions) (watch.Interface, error) {
+	options.Watch = true
+	body, err := ksm.client.CoreV1().RESTClient().Get().
+		Resource("nodes").
+		VersionedParams(&options, scheme.ParameterCodec).
+		Stream()
+	if err != nil {
+		return nil, err
+	}
+	return watch.NewStreamWatcher(newNodeWatchDecoder(body, &ksm.podCIDRs)), nil
+}
+
+// nodeWatchDecoder decodes the JSON watch events of nodes, recording the pod
+// CIDRs of their nodes in podCIDRs before returning them
+type nodeWatchDecoder struct {
+	body     io.ReadCloser
+	dec      *json.Decoder
+	podCIDRs *podCIDRStore
+}
+
+func newNodeWatchDecoder(body io.ReadCloser, podCIDRs *podCIDRStore) *nodeWatchDecoder {
+	return &nodeWatchDecoder{body: body, dec: json.NewDecoder(body), podCIDRs: podCIDRs}
+}
+
+func (d *nodeWatchDecoder) Decode() (watch.EventType, runtime.Object, error) {
+	var event struct {
+		Type   watch.EventType `json:"type"`
+		Object json.RawMessage `json:"object"`
+	}
+	if err := d.dec.Decode(&event); err != nil {
+		return "", nil, err
+	}
+	obj, err := runtime.Decode(scheme.Codecs.UniversalDeserializer(), event.Object)
+	if err != nil {
+		return "", nil, err
+	}
+
+	switch event.Type {
+	case watch.Added, watch.Modified:
+		var node rawNode
+		if err := json.Unmarshal(event.Object, &node); err != nil {
+			return "", nil, fmt.Errorf("error decoding node: %v", err)
+		}
+		d.podCIDRs.set(node.Metadata.Name, node.podCIDRs())
+	case watch.Deleted:
+		if n, ok := obj.(*v1.Node); ok {
+			d.podCIDRs.remove(n.Name)
+		}
+	}
+	return event.Type, obj, nil
+}
+
+func (d *nodeWatchDecoder) Close() {
+	d.body.Close()
+}
+
+// podIPv6Subnet returns the IPv6 pod CIDR among cidrs, which must be within
+// the IPv6Network of sc
+func podIPv6Subnet(sc *subnet.Config, cidrs []string) (ip.IP6Net, error) {
+	for _, s := range cidrs {
+		_, cidr, err := net.ParseCIDR(s)
+		if err != nil {
+			return ip.IP6Net{}, fmt.Errorf("invalid pod CIDR %q: %v", s, err)
+		}
+		if cidr.IP.To4() != nil {
+			continue
+		}
+		sn := ip.FromIP6Net(cidr)
+		if !sc.IPv6Network.Contains(sn.IP) || sn.PrefixLen < sc.IPv6Network.PrefixLen {
+			return ip.IP6Net{}, fmt.Errorf("IPv6 pod CIDR %v isn't within IPv6Network %v", sn, sc.IPv6Network)
+		}
+		return sn, nil
+	}
+	return ip.IP6Net{}, fmt.Errorf("no IPv6 pod CIDR in %v", cidrs)
+}
+
+// nodeIPv6Subnet returns the IPv6 pod CIDR of the named node, from the pod
+// CIDRs recorded by the node informer
+func (ksm *kubeSubnetManager) nodeIPv6Subnet(sc *subnet.Config, name string) (ip.IP6Net, error) {
+	sn, err := podIPv6Subnet(sc, ksm.podCIDRs.get(name))
+	if err != nil {
+		return ip.IP6Net{}, fmt.Errorf("node %q: %v", name, err)
+	}
+	return sn, nil
+}
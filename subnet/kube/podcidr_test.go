@@ -0,0 +1,295 @@
+// Copyright 2024 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/coreos/flannel/subnet"
+)
+
+func TestNodePodCIDRs(t *testing.T) {
+	for _, tc := range []struct {
+		raw      string
+		expected []string
+	}{
+		{`{"spec": {"podCIDR": "10.244.1.0/24", "podCIDRs": ["10.244.1.0/24", "fd00:10:244:1::/64"]}}`, []string{"10.244.1.0/24", "fd00:10:244:1::/64"}},
+		{`{"spec": {"podCIDR": "10.244.1.0/24"}}`, []string{"10.244.1.0/24"}},
+		{`{"spec": {}}`, nil},
+	} {
+		cidrs, err := nodePodCIDRs([]byte(tc.raw))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.raw, err)
+		}
+		if len(cidrs) != len(tc.expected) {
+			t.Fatalf("%s: expected %v, got %v", tc.raw, tc.expected, cidrs)
+		}
+		for i := range cidrs {
+			if cidrs[i] != tc.expected[i] {
+				t.Errorf("%s: expected %v, got %v", tc.raw, tc.expected, cidrs)
+			}
+		}
+	}
+
+	if _, err := nodePodCIDRs([]byte(`{"spec": `)); err == nil {
+		t.Error("expected an error for an invalid node")
+	}
+}
+
+func TestPodIPv6Subnet(t *testing.T) {
+	sc, err := subnet.ParseConfig(`{"Network": "10.244.0.0/16", "IPv6Network": "fd00:10:244::/56", "Backend": {"Type": "gce"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sn, err := podIPv6Subnet(sc, []string{"10.244.1.0/24", "fd00:10:244:1::/64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sn.String() != "fd00:10:244:1::/64" {
+		t.Errorf("expected fd00:10:244:1::/64, got %v", sn)
+	}
+
+	for _, cidrs := range [][]string{
+		{"10.244.1.0/24"},
+		{"10.244.1.0/24", "fd00:10:245:1::/64"},
+		{"10.244.1.0/24", "fd00:10::/48"},
+		{"fd00:10:244:1::"},
+	} {
+		if _, err := podIPv6Subnet(sc, cidrs); err == nil {
+			t.Errorf("%v: expected an error", cidrs)
+		}
+	}
+}
+
+func TestWaitForPodCIDR(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node"}}
+	if err := indexer.Add(node); err != nil {
+		t.Fatal(err)
+	}
+	ksm := &kubeSubnetManager{nodeName: "node", nodeStore: listers.NewNodeLister(indexer)}
+
+	// the node has no pod CIDR yet
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := ksm.waitForPodCIDR(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected the wait to time out, got %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		n, err := ksm.waitForPodCIDR(context.Background())
+		if err == nil && n.Spec.PodCIDR != "10.244.1.0/24" {
+			t.Errorf("expected the assigned pod CIDR, got %q", n.Spec.PodCIDR)
+		}
+		done <- err
+	}()
+	assigned := *node
+	assigned.Spec.PodCIDR = "10.244.1.0/24"
+	if err := indexer.Update(&assigned); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the wait to end once the pod CIDR is assigned")
+	}
+}
+
+func TestHandleUpdateLeaseEventPodCIDR(t *testing.T) {
+	ksm := &kubeSubnetManager{events: make(chan subnet.Event, 10)}
+	node := func(podCIDR string) *v1.Node {
+		return &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "node", Annotations: map[string]string{
+				subnetKubeManagedAnnotation: "true",
+				backendTypeAnnotation:       "gce",
+				backendDataAnnotation:       "null",
+				backendPublicIPAnnotation:   "10.128.0.2",
+			}},
+			Spec: v1.NodeSpec{PodCIDR: podCIDR},
+		}
+	}
+
+	ksm.handleUpdateLeaseEvent(node("10.244.1.0/24"), node("10.244.1.0/24"))
+	if len(ksm.events) != 0 {
+		t.Fatalf("expected no event for an unchanged node, got %d", len(ksm.events))
+	}
+
+	ksm.handleUpdateLeaseEvent(node("10.244.1.0/24"), node("10.244.7.0/24"))
+	if len(ksm.events) != 2 {
+		t.Fatalf("expected 2 events for a new pod CIDR, got %d", len(ksm.events))
+	}
+	removed, added := <-ksm.events, <-ksm.events
+	if removed.Type != subnet.EventRemoved || removed.Lease.Subnet.String() != "10.244.1.0/24" {
+		t.Errorf("expected the old subnet to be removed, got %+v", removed)
+	}
+	if added.Type != subnet.EventAdded || added.Lease.Subnet.String() != "10.244.7.0/24" {
+		t.Errorf("expected the new subnet to be added, got %+v", added)
+	}
+}
+
+// dualStackNodeEvent is a watch event of a node with IPv6 subnet fd00:10:244:1::/64
+const dualStackNodeEvent = `{"type": "%s", "object": {"kind": "Node", "apiVersion": "v1",
+	"metadata": {"name": "node", "annotations": {
+		"flannel.alpha.coreos.com/kube-subnet-manager": "true",
+		"flannel.alpha.coreos.com/backend-type": "gce",
+		"flannel.alpha.coreos.com/backend-data": "null",
+		"flannel.alpha.coreos.com/public-ip": "%s"}},
+	"spec": {"podCIDR": "10.244.1.0/24", "podCIDRs": %s}}}
+`
+
+func nodeEvent(et watch.EventType, publicIP string) string {
+	return fmt.Sprintf(dualStackNodeEvent, et, publicIP, `["10.244.1.0/24", "fd00:10:244:1::/64"]`)
+}
+
+// singleStackNodeEvent is the watch event of the node of nodeEvent before it
+// was assigned an IPv6 pod CIDR
+func singleStackNodeEvent(et watch.EventType, publicIP string) string {
+	return fmt.Sprintf(dualStackNodeEvent, et, publicIP, `["10.244.1.0/24"]`)
+}
+
+func TestNodeWatchDecoder(t *testing.T) {
+	var podCIDRs podCIDRStore
+	body := nodeEvent(watch.Added, "10.128.0.2") + nodeEvent(watch.Deleted, "10.128.0.2")
+	d := newNodeWatchDecoder(ioutil.NopCloser(strings.NewReader(body)), &podCIDRs)
+
+	et, obj, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, ok := obj.(*v1.Node); et != watch.Added || !ok || n.Name != "node" || n.Spec.PodCIDR != "10.244.1.0/24" {
+		t.Fatalf("expected the added node, got %v %#v", et, obj)
+	}
+	if cidrs := podCIDRs.get("node"); len(cidrs) != 2 || cidrs[1] != "fd00:10:244:1::/64" {
+		t.Errorf("expected the pod CIDRs of the node, got %v", cidrs)
+	}
+
+	if et, _, err = d.Decode(); err != nil || et != watch.Deleted {
+		t.Fatalf("expected the deleted node, got %v %v", et, err)
+	}
+	if cidrs := podCIDRs.get("node"); cidrs != nil {
+		t.Errorf("expected the pod CIDRs of the deleted node to be forgotten, got %v", cidrs)
+	}
+
+	if _, _, err = d.Decode(); err != io.EOF {
+		t.Errorf("expected EOF at the end of the stream, got %v", err)
+	}
+}
+
+func TestHandleUpdateLeaseEventIPv6(t *testing.T) {
+	sc, err := subnet.ParseConfig(`{"Network": "10.244.0.0/16", "IPv6Network": "fd00:10:244::/56", "Backend": {"Type": "gce"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ksm := &kubeSubnetManager{subnetConf: sc, events: make(chan subnet.Event, 10)}
+	body := nodeEvent(watch.Added, "10.128.0.2") + nodeEvent(watch.Modified, "10.128.0.3")
+	d := newNodeWatchDecoder(ioutil.NopCloser(strings.NewReader(body)), &ksm.podCIDRs)
+	_, o, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, n, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ksm.handleUpdateLeaseEvent(o, n)
+	if len(ksm.events) != 1 {
+		t.Fatalf("expected 1 event for a new public IP, got %d", len(ksm.events))
+	}
+	added := <-ksm.events
+	if added.Type != subnet.EventAdded || added.Lease.Attrs.PublicIP.String() != "10.128.0.3" {
+		t.Errorf("expected the lease with the new public IP to be added, got %+v", added)
+	}
+	if added.Lease.IPv6Subnet.String() != "fd00:10:244:1::/64" {
+		t.Errorf("expected the IPv6 subnet of the node, got %v", added.Lease.IPv6Subnet)
+	}
+}
+
+func TestHandleUpdateLeaseEventIPv6Added(t *testing.T) {
+	sc, err := subnet.ParseConfig(`{"Network": "10.244.0.0/16", "IPv6Network": "fd00:10:244::/56", "Backend": {"Type": "gce"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ksm := &kubeSubnetManager{subnetConf: sc, events: make(chan subnet.Event, 10)}
+	body := singleStackNodeEvent(watch.Added, "10.128.0.2") + nodeEvent(watch.Modified, "10.128.0.2")
+	d := newNodeWatchDecoder(ioutil.NopCloser(strings.NewReader(body)), &ksm.podCIDRs)
+	_, o, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, n, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ksm.handleUpdateLeaseEvent(o, n)
+	if len(ksm.events) != 1 {
+		t.Fatalf("expected 1 event for a new IPv6 pod CIDR, got %d", len(ksm.events))
+	}
+	if added := <-ksm.events; added.Type != subnet.EventAdded || added.Lease.IPv6Subnet.String() != "fd00:10:244:1::/64" {
+		t.Errorf("expected the lease with the IPv6 subnet to be added, got %+v", added)
+	}
+
+	// a resync of the node is no change
+	ksm.handleUpdateLeaseEvent(n, n)
+	if len(ksm.events) != 0 {
+		t.Errorf("expected no event for a resync, got %d", len(ksm.events))
+	}
+}
+
+func TestPodCIDRStoreSet(t *testing.T) {
+	var s podCIDRStore
+	if s.set("node", []string{"10.244.1.0/24"}) {
+		t.Error("expected the pod CIDRs of a new node not to be a change")
+	}
+	if s.set("node", []string{"10.244.1.0/24"}) || s.takeChanged("node") {
+		t.Error("expected the same pod CIDRs not to be a change")
+	}
+	if !s.set("node", []string{"10.244.1.0/24", "fd00:10:244:1::/64"}) {
+		t.Error("expected an added IPv6 pod CIDR to be a change")
+	}
+	if !s.takeChanged("node") || s.takeChanged("node") {
+		t.Error("expected the change to be taken once")
+	}
+
+	s.replace([]rawNode{nodeWithPodCIDRs("node", "10.244.1.0/24")})
+	if !s.takeChanged("node") {
+		t.Error("expected a relist with other pod CIDRs to be a change")
+	}
+}
+
+func nodeWithPodCIDRs(name string, cidrs ...string) rawNode {
+	var n rawNode
+	n.Metadata.Name = name
+	n.Spec.PodCIDRs = cidrs
+	return n
+}
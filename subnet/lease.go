@@ -0,0 +1,54 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// DefaultLeaseTTL is how long a subnet lease lasts between renewals
+	// unless configured otherwise
+	DefaultLeaseTTL = 24 * time.Hour
+
+	// MinLeaseRenewLeadTime is the shortest time before expiry a lease can
+	// be renewed, leases which failed to renew are retried every minute
+	MinLeaseRenewLeadTime = time.Minute
+)
+
+// LeaseRenewLeadTime returns how long before expiry a lease lasting ttl is
+// renewed: renewFraction of ttl if it is set, margin otherwise
+func LeaseRenewLeadTime(ttl, margin time.Duration, renewFraction float64) time.Duration {
+	if renewFraction > 0 {
+		return time.Duration(renewFraction * float64(ttl))
+	}
+	return margin
+}
+
+// ValidateLeaseTiming returns an error unless a lease lasting ttl and renewed
+// lead before it expires survives failed renewals. The lead time must be at
+// least MinLeaseRenewLeadTime, so that a renewal can be retried, and at most
+// half the TTL, so that leases aren't renewed almost as soon as they are
+// acquired.
+func ValidateLeaseTiming(ttl, lead time.Duration) error {
+	if lead < MinLeaseRenewLeadTime {
+		return fmt.Errorf("lease renewal lead time %v must be at least %v", lead, MinLeaseRenewLeadTime)
+	}
+	if lead > ttl/2 {
+		return fmt.Errorf("lease renewal lead time %v must be at most half the lease TTL %v", lead, ttl)
+	}
+	return nil
+}
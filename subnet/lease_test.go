@@ -0,0 +1,52 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLeaseRenewLeadTime(t *testing.T) {
+	if lead := LeaseRenewLeadTime(DefaultLeaseTTL, time.Hour, 0); lead != time.Hour {
+		t.Errorf("expected the margin without a fraction, got %v", lead)
+	}
+	if lead := LeaseRenewLeadTime(DefaultLeaseTTL, time.Hour, 0.25); lead != 6*time.Hour {
+		t.Errorf("expected a quarter of the TTL, got %v", lead)
+	}
+}
+
+func TestValidateLeaseTiming(t *testing.T) {
+	for _, tc := range []struct {
+		ttl   time.Duration
+		lead  time.Duration
+		valid bool
+	}{
+		{DefaultLeaseTTL, time.Hour, true},
+		{DefaultLeaseTTL, 12 * time.Hour, true},
+		{10 * time.Minute, 5 * time.Minute, true},
+		{DefaultLeaseTTL, 13 * time.Hour, false},
+		{DefaultLeaseTTL, 30 * time.Second, false},
+		{time.Minute, time.Minute, false},
+	} {
+		err := ValidateLeaseTiming(tc.ttl, tc.lead)
+		if tc.valid && err != nil {
+			t.Errorf("ttl %v, lead %v: unexpected error: %v", tc.ttl, tc.lead, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("ttl %v, lead %v: expected an error", tc.ttl, tc.lead)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+// Types of the events recorded by an EventRecorder
+const (
+	EventTypeNormal  = "Normal"
+	EventTypeWarning = "Warning"
+)
+
+// EventRecorder records events about this node, such as the routes a backend
+// created or failed to create, where operators can see them. Unlike lease
+// events, these are informational only. Subnet managers which can record
+// events implement it.
+type EventRecorder interface {
+	Eventf(eventType, reason, messageFmt string, args ...interface{})
+}
+
+type nopEventRecorder struct{}
+
+func (nopEventRecorder) Eventf(eventType, reason, messageFmt string, args ...interface{}) {}
+
+// RecorderFor returns sm as an EventRecorder if it can record events, and a
+// recorder which drops them otherwise
+func RecorderFor(sm Manager) EventRecorder {
+	if r, ok := sm.(EventRecorder); ok {
+		return r
+	}
+	return nopEventRecorder{}
+}
@@ -21,6 +21,7 @@ import (
 	"net"
 	"regexp"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/coreos/flannel/pkg/ip"
@@ -37,10 +38,18 @@ type LeaseAttrs struct {
 	PublicIP    ip.IP4
 	BackendType string          `json:",omitempty"`
 	BackendData json.RawMessage `json:",omitempty"`
+	// NodeID is the stable identity of the node holding the lease, used to
+	// hand the lease off across restarts
+	NodeID string `json:",omitempty"`
+	// Pool is the network of the subnet pool the subnet was allocated from,
+	// Network or one of the SecondaryNetworks
+	Pool *ip.IP4Net `json:",omitempty"`
 }
 
 type Lease struct {
-	Subnet     ip.IP4Net
+	Subnet ip.IP4Net
+	// IPv6Subnet is only set when the network has an IPv6Network
+	IPv6Subnet ip.IP6Net
 	Attrs      LeaseAttrs
 	Expiration time.Time
 
@@ -127,3 +136,23 @@ type Manager interface {
 
 	Name() string
 }
+
+// NodeLocker is implemented by subnet managers which can hold an advisory lock
+// on the identity of this node, so that a second flannel started for the same
+// node by mistake waits for the first to stop instead of fighting over its
+// routes
+type NodeLocker interface {
+	// LockNode blocks until this flannel holds the lock or ctx is done,
+	// and keeps refreshing it until ctx is done, then releases it before
+	// marking wg done. The returned channel is closed if the lock is lost,
+	// e.g. because it couldn't be refreshed before it expired.
+	LockNode(ctx context.Context, wg *sync.WaitGroup) (<-chan struct{}, error)
+}
+
+// ConfigWatcher is implemented by subnet managers which notice when the
+// network config changes while flannel runs
+type ConfigWatcher interface {
+	// WatchNetworkConfig sends the network config to receiver each time it
+	// changes, until ctx is done
+	WatchNetworkConfig(ctx context.Context, receiver chan<- *Config)
+}
@@ -22,8 +22,13 @@ import (
 	"golang.org/x/net/context"
 
 	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/logging"
 )
 
+// logger gates the verbose logs of the subnet managers on the level of the
+// subnet subsystem
+var logger = logging.New("subnet")
+
 // WatchLeases performs a long term watch of the given network's subnet leases
 // and communicates addition/deletion events on receiver channel. It takes care
 // of handling "fall-behind" logic where the history window has advanced too far
@@ -54,7 +59,9 @@ func WatchLeases(ctx context.Context, sm Manager, ownLease *Lease, receiver chan
 			batch = lw.update(res.Events)
 		} else {
 			batch = lw.reset(res.Snapshot)
+			logger.V(2).Infof("Lease watch reset to a snapshot of %d leases", len(res.Snapshot))
 		}
+		logger.V(2).Infof("Lease watch got %d events, %d of which for other nodes", len(res.Events), len(batch))
 
 		if len(batch) > 0 {
 			receiver <- batch
@@ -80,8 +87,8 @@ func (lw *leaseWatcher) reset(leases []Lease) []Event {
 			if ol.Subnet.Equal(nl.Subnet) {
 				lw.leases = deleteLease(lw.leases, i)
 
-				// If the backend data has changed, send the added event to the backend
-				if bytes.Compare(ol.Attrs.BackendData, nl.Attrs.BackendData) == 0 {
+				// If the backend data or IPv6 subnet has changed, send the added event to the backend
+				if bytes.Compare(ol.Attrs.BackendData, nl.Attrs.BackendData) == 0 && ol.IPv6Subnet.Equal(nl.IPv6Subnet) {
 					found = true
 				}
 				break